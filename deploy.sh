@@ -36,5 +36,9 @@ env GOOS=linux GOARCH=amd64 go build
 echo -n $'\003' | dd bs=1 count=1 seek=7 conv=notrunc of=./smtpd
 cd -
 
-scp smtpd/smtpd imapd/imapd ams1:~
+cd mymail
+env GOOS=linux GOARCH=amd64 go build
+cd -
+
+scp smtpd/smtpd imapd/imapd mymail/mymail ams1:~
 ssh ams1 '/etc/mymail/reload.sh'
\ No newline at end of file
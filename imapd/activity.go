@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/mpdroog/mymail/imapd/config"
+	"github.com/mpdroog/mymail/smtpd/activity"
+)
+
+// activityMailbox is the read-only virtual mailbox with the login history
+const activityMailbox = "Account Activity"
+
+// activityMessage builds the virtual mailbox holding one message with the
+// last 50 logins. The UID is the time of the last login so clients see a
+// new message whenever the history changes.
+func activityMessage(user string) (*Mailbox, error) {
+	entries, err := activity.Load(config.C.ActivityDir, user, 50)
+	if err != nil {
+		return nil, err
+	}
+
+	date := time.Now()
+	if len(entries) > 0 {
+		date = entries[len(entries)-1].Time
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: Account Activity <postmaster@%s>\r\n", config.C.Domain)
+	fmt.Fprintf(&b, "To: %s\r\n", user)
+	b.WriteString("Subject: Account activity\r\n")
+	fmt.Fprintf(&b, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString("Recent logins to your account, newest first. If you don't recognise\r\n")
+	b.WriteString("one of them change your password and contact your administrator.\r\n\r\n")
+
+	tw := tabwriter.NewWriter(&b, 0, 4, 2, ' ', 0)
+	fmt.Fprint(tw, "TIME\tPROTOCOL\tIP\tCLIENT\r\n")
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\r\n", e.Time.Format(time.RFC3339), e.Protocol, e.IP, e.Client)
+	}
+	tw.Flush()
+
+	raw := []byte(b.String())
+	uid := imap.UID(date.Unix())
+	return &Mailbox{
+		Name: activityMailbox,
+		Messages: []*Message{{
+			UID:     uid,
+			SeqNum:  1,
+			Flags:   []imap.Flag{},
+			Date:    date,
+			Size:    int64(len(raw)),
+			From:    "postmaster@" + config.C.Domain,
+			Subject: "Account activity",
+			raw:     raw,
+		}},
+		UIDNext:     uid + 1,
+		UIDValidity: 1,
+	}, nil
+}
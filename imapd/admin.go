@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mpdroog/mymail/imapd/config"
+	"github.com/mpdroog/mymail/smtpd/activity"
+	"github.com/mpdroog/mymail/smtpd/audit"
+	"github.com/mpdroog/mymail/smtpd/lockout"
+	"github.com/mpdroog/mymail/smtpd/logging"
+	"github.com/mpdroog/mymail/smtpd/users"
+)
+
+// defaultBan is used when POST /bans has no duration
+const defaultBan = time.Hour
+
+// startAdmin serves the operator HTTP API on config.C.AdminAddr
+func startAdmin(srv *Server) (*http.Server, error) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /sessions", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, srv.Sessions())
+	})
+	mux.HandleFunc("POST /sessions/{id}/kick", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+		if err != nil || !srv.Kick(id) {
+			http.NotFound(w, r)
+			return
+		}
+		log.Printf("Session %d kicked", id)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, srv.Metrics())
+	})
+	mux.HandleFunc("GET /bans", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, srv.Bans())
+	})
+	mux.HandleFunc("POST /bans", func(w http.ResponseWriter, r *http.Request) {
+		ip := net.ParseIP(r.FormValue("ip"))
+		if ip == nil {
+			http.Error(w, "Invalid ip", http.StatusBadRequest)
+			return
+		}
+		d := defaultBan
+		if v := r.FormValue("duration"); v != "" {
+			var err error
+			d, err = time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				http.Error(w, "Invalid duration", http.StatusBadRequest)
+				return
+			}
+		}
+		srv.Ban(ip.String(), d)
+		log.Printf("IP %s banned for %s", ip, d)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("DELETE /bans/{ip}", func(w http.ResponseWriter, r *http.Request) {
+		ip := net.ParseIP(r.PathValue("ip"))
+		if ip == nil || !srv.Unban(ip.String()) {
+			http.NotFound(w, r)
+			return
+		}
+		log.Printf("IP %s unbanned", ip)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("GET /activity/{user}", func(w http.ResponseWriter, r *http.Request) {
+		if config.C.ActivityDir == "" {
+			http.NotFound(w, r)
+			return
+		}
+		n := 50
+		if v, err := strconv.Atoi(r.FormValue("n")); err == nil && v > 0 {
+			n = v
+		}
+		entries, err := activity.Load(config.C.ActivityDir, r.PathValue("user"), n)
+		if err != nil {
+			log.Printf(logging.Err+"activity.Load e=%v", err)
+			http.Error(w, "Failed to read activity", http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, entries)
+	})
+
+	mux.HandleFunc("GET /audit", func(w http.ResponseWriter, r *http.Request) {
+		if config.C.AuditLog == "" {
+			http.NotFound(w, r)
+			return
+		}
+		n := 100
+		if v, err := strconv.Atoi(r.FormValue("n")); err == nil && v > 0 {
+			n = v
+		}
+		var since time.Time
+		if v := r.FormValue("since"); v != "" {
+			var err error
+			if since, err = time.Parse(time.RFC3339, v); err != nil {
+				http.Error(w, "Invalid since", http.StatusBadRequest)
+				return
+			}
+		}
+		entries, err := audit.Load(config.C.AuditLog, audit.Filter{User: r.FormValue("user"), Since: since, N: n})
+		if err != nil {
+			log.Printf(logging.Err+"audit.Load e=%v", err)
+			http.Error(w, "Failed to read audit log", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, entries)
+	})
+
+	listener, err := net.Listen("tcp", config.C.AdminAddr)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Admin service listening on %s", config.C.AdminAddr)
+
+	hs := &http.Server{Handler: authorizeAdmin(srv, mux)}
+	go func() {
+		if err := hs.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf(logging.Err+"Admin serve e=%v", err)
+		}
+	}()
+	return hs, nil
+}
+
+// authorizeAdmin requires HTTP basic auth of an admin account, without one
+// in the user file the API refuses everything. Failures count towards the
+// account lockout like a failed LOGIN. Requests other than GET end up in
+// the audit log.
+func authorizeAdmin(srv *Server, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+		if !ok || !srv.authenticateAdmin(user, pass, ip) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="mymail"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		sw := &audit.StatusWriter{ResponseWriter: w, Status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+		target := r.PathValue("ip")
+		if target == "" {
+			target = r.FormValue("ip")
+		}
+		recordAudit(audit.Entry{
+			Protocol: "imapd-admin",
+			User:     user,
+			IP:       ip,
+			Action:   r.Method + " " + r.URL.Path,
+			Target:   target,
+			Result:   strconv.Itoa(sw.Status),
+		})
+	})
+}
+
+// authenticateAdmin verifies credentials of an account with users.RoleAdmin
+// for the admin API, called from ip
+func (srv *Server) authenticateAdmin(username, password, ip string) bool {
+	if until := lockedUntil(username); !until.IsZero() {
+		log.Printf(logging.Warning+"Admin login for %s from %s refused, locked until %s", username, ip, until)
+		lockout.Delay(config.C.AuthFailDelay)
+		return false
+	}
+
+	acct, _ := srv.users.Account(username)
+	if srv.users.Validate(username, password) && acct.Has(users.RoleAdmin) {
+		return true
+	}
+	log.Printf(logging.Warning+"Admin login failed for %q from %s", username, ip)
+	if srv.users.Exists(username) {
+		srv.loginFailed(username, "imapd-admin", ip)
+	}
+	lockout.Delay(config.C.AuthFailDelay)
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Printf(logging.Err+"writeJSON e=%v", err)
+	}
+}
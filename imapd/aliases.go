@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+	"github.com/mpdroog/mymail/imapd/config"
+)
+
+// resolveAlias returns the mailbox an alias of mailbox_aliases stands for,
+// mailbox itself for any other name
+func resolveAlias(mailbox string) string {
+	if target, ok := config.C.MailboxAliases[mailbox]; ok {
+		return target
+	}
+	return mailbox
+}
+
+// checkNotAlias refuses DELETE and RENAME of an alias, they would hit the
+// mailbox behind it
+func checkNotAlias(mailboxes ...string) error {
+	for _, m := range mailboxes {
+		if target, ok := config.C.MailboxAliases[m]; ok {
+			return fmt.Errorf("%s is another name for %s", m, target)
+		}
+	}
+	return nil
+}
+
+// listAliases writes the aliases that a pattern without wildcards names,
+// with the attributes of their mailbox. LIST "" "*" leaves them out.
+func listAliases(w *imapserver.ListWriter, ref string, patterns []string) error {
+	aliases := make([]string, 0, len(config.C.MailboxAliases))
+	for alias := range config.C.MailboxAliases {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+
+	for _, alias := range aliases {
+		for _, pattern := range patterns {
+			if strings.ContainsAny(pattern, "*%") || !matchMailbox(alias, ref, pattern) {
+				continue
+			}
+			data := &imap.ListData{Mailbox: alias, Delim: '/'}
+			if attr := specialUse(config.C.MailboxAliases[alias]); attr != "" {
+				data.Attrs = append(data.Attrs, attr)
+			}
+			if err := w.WriteList(data); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"log"
+	"net"
+
+	"github.com/mpdroog/mymail/imapd/config"
+	"github.com/mpdroog/mymail/smtpd/audit"
+	"github.com/mpdroog/mymail/smtpd/logging"
+)
+
+// recordAudit appends e to the audit log, does nothing when disabled
+func recordAudit(e audit.Entry) {
+	if err := audit.Record(config.C.AuditLog, e); err != nil {
+		log.Printf(logging.Err+"audit.Record e=%v", err)
+	}
+}
+
+// audit records an IMAP operation of s
+func (s *Session) audit(action, mailbox, uids string, paths []string) {
+	ip, _, _ := net.SplitHostPort(s.remoteAddr)
+	recordAudit(audit.Entry{
+		Protocol: "imap",
+		User:     s.username,
+		IP:       ip,
+		Action:   action,
+		Target:   mailbox,
+		UIDs:     uids,
+		Paths:    paths,
+	})
+}
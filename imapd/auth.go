@@ -1,20 +1,22 @@
 package main
 
 import (
-	"encoding/json"
-	"os"
 	"sync"
+
+	"github.com/mpdroog/mymail/smtpd/users"
 )
 
+// UserStore is the user file shared with smtpd and the mymail CLI, see
+// users.Account for the format
 type UserStore struct {
 	mu    sync.RWMutex
-	users map[string]string // username -> password
+	users map[string]*users.Account
 	path  string
 }
 
 func NewUserStore(path string) (*UserStore, error) {
 	us := &UserStore{
-		users: make(map[string]string),
+		users: make(map[string]*users.Account),
 		path:  path,
 	}
 	if err := us.Load(); err != nil {
@@ -24,24 +26,13 @@ func NewUserStore(path string) (*UserStore, error) {
 }
 
 func (us *UserStore) Load() error {
-	us.mu.Lock()
-	defer us.mu.Unlock()
-
-	f, err := os.Open(us.path)
+	accounts, err := users.Load(us.path)
 	if err != nil {
-		if os.IsNotExist(err) {
-			us.users = make(map[string]string)
-			return nil
-		}
-		return err
-	}
-	defer f.Close()
-
-	users := make(map[string]string)
-	if err := json.NewDecoder(f).Decode(&users); err != nil {
 		return err
 	}
-	us.users = users
+	us.mu.Lock()
+	us.users = accounts
+	us.mu.Unlock()
 	return nil
 }
 
@@ -49,11 +40,28 @@ func (us *UserStore) Validate(username, password string) bool {
 	us.mu.RLock()
 	defer us.mu.RUnlock()
 
-	storedPass, exists := us.users[username]
-	if !exists {
-		return false
+	_, ok := users.Check(us.users, username, password)
+	return ok
+}
+
+// Account returns a copy of the account of username
+func (us *UserStore) Account(username string) (users.Account, bool) {
+	us.mu.RLock()
+	defer us.mu.RUnlock()
+	acct, ok := us.users[username]
+	if !ok {
+		return users.Account{}, false
 	}
-	return storedPass == password
+	return *acct, true
+}
+
+// Exists reports whether username is known, failures for unknown users
+// aren't tracked so guessing names can't fill the lockout dir
+func (us *UserStore) Exists(username string) bool {
+	us.mu.RLock()
+	defer us.mu.RUnlock()
+	_, ok := us.users[username]
+	return ok
 }
 
 func (us *UserStore) Reload() error {
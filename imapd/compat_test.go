@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap/v2/imapserver"
+	"github.com/mpdroog/mymail/imapd/config"
+)
+
+// startCompat serves the -demo mail of alice on a random local port and
+// returns the address
+func startCompat(t *testing.T) string {
+	config.C.InsecureAuth, config.C.MaxConnections, config.C.MaxAuthFailures = true, 10, 3
+	config.C.MaxAppendSize, config.C.MaxSearchTerms, config.C.MaxSetRanges = 1<<20, 100, 1000
+
+	path := filepath.Join(t.TempDir(), "users.json")
+	if err := writeDemoFile(path, map[string]string{"alice": "demo"}); err != nil {
+		t.Fatal(err)
+	}
+	users, err := NewUserStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := newMemStore()
+	if err := seedDemo(st); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := NewServer(users, st)
+	ln, err := srv.Listen("127.0.0.1:0", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	imap := imapserver.New(serverOptions(srv))
+	go imap.Serve(ln)
+	t.Cleanup(func() { imap.Close() })
+	return ln.Addr().String()
+}
+
+// replay sends the "C:" lines of transcript, literals included, and checks
+// every reply byte for byte against the "S:" lines, CRLF included
+func replay(t *testing.T, name, transcript string) {
+	conn, err := net.Dial("tcp", startCompat(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	for _, line := range strings.Split(strings.TrimSpace(transcript), "\n") {
+		if cmd, ok := strings.CutPrefix(line, "C:"); ok {
+			cmd = strings.TrimPrefix(cmd, " ")
+			if _, err := conn.Write([]byte(cmd + "\r\n")); err != nil {
+				t.Fatalf("%s: write %q e=%v", name, cmd, err)
+			}
+			continue
+		}
+		expect, _ := strings.CutPrefix(line, "S:")
+		expect = strings.TrimPrefix(expect, " ") + "\r\n"
+		got, err := r.ReadString('\n')
+		if got != expect {
+			t.Errorf("%s: got %q e=%v, expect %q", name, got, err, expect)
+			return
+		}
+	}
+}
+
+// TestCompat replays what Thunderbird, iOS Mail, K-9 and Outlook send on
+// their first sync. None of them sends CONDSTORE or ID unless advertised,
+// without CONDSTORE they resync flags with UID FETCH 1:* (FLAGS).
+func TestCompat(t *testing.T) {
+	patterns := map[string]string{
+		"thunderbird": `
+S: * OK [CAPABILITY IMAP4rev1 SASL-IR LITERAL- AUTH=PLAIN] IMAP server ready
+C: 1 CAPABILITY
+S: * CAPABILITY IMAP4rev1 SASL-IR LITERAL- AUTH=PLAIN
+S: 1 OK CAPABILITY completed
+C: 2 LOGIN "alice" "demo"
+S: 2 OK [CAPABILITY IMAP4rev1 SASL-IR LITERAL- UNSELECT ENABLE IDLE UTF8=ACCEPT UIDPLUS ESEARCH SEARCHRES MOVE BINARY SPECIAL-USE] Logged in
+C: 3 LIST (SPECIAL-USE) "" "*"
+S: * LIST (\Archive) "/" "Archive"
+S: * LIST (\Drafts) "/" "Drafts"
+S: * LIST (\Junk) "/" "Junk"
+S: * LIST (\Sent) "/" "Sent"
+S: * LIST (\Trash) "/" "Trash"
+S: 3 OK LIST completed
+C: 4 LIST "" "*"
+S: * LIST (\Archive) "/" "Archive"
+S: * LIST (\Drafts) "/" "Drafts"
+S: * LIST () "/" INBOX
+S: * LIST (\Junk) "/" "Junk"
+S: * LIST (\Sent) "/" "Sent"
+S: * LIST (\Trash) "/" "Trash"
+S: 4 OK LIST completed
+C: 5 LSUB "" "*"
+S: * LSUB (\Archive \Subscribed) "/" "Archive"
+S: * LSUB (\Drafts \Subscribed) "/" "Drafts"
+S: * LSUB (\Subscribed) "/" INBOX
+S: * LSUB (\Junk \Subscribed) "/" "Junk"
+S: * LSUB (\Sent \Subscribed) "/" "Sent"
+S: * LSUB (\Trash \Subscribed) "/" "Trash"
+S: 5 OK LSUB completed
+C: 6 SELECT "INBOX"
+S: * 4 EXISTS
+S: * 0 RECENT
+S: * OK [UIDVALIDITY 1] UIDs valid
+S: * OK [UIDNEXT 5] Predicted next UID
+S: * FLAGS (\Seen \Answered \Flagged \Deleted \Draft)
+S: * OK [PERMANENTFLAGS (\Seen \Answered \Flagged \Deleted \Draft \*)] Permanent flags
+S: 6 OK [READ-WRITE] SELECT completed
+C: 7 UID fetch 1:* (FLAGS)
+S: * 1 FETCH (UID 1 FLAGS ())
+S: * 2 FETCH (UID 2 FLAGS ())
+S: * 3 FETCH (UID 3 FLAGS ())
+S: * 4 FETCH (UID 4 FLAGS ())
+S: 7 OK UID FETCH completed
+C: 8 UID fetch 3:4 (UID RFC822.SIZE FLAGS BODY.PEEK[HEADER.FIELDS (From Subject Message-ID References In-Reply-To)])
+S: * 3 FETCH (UID 3 FLAGS () RFC822.SIZE 269 BODY[HEADER.FIELDS ("From" "Subject" "Message-ID" "References" "In-Reply-To")] {170}
+S: From: Dave <dave@example.org>
+S: Subject: Re: Lunch on Friday?
+S: Message-Id: <lunch-2@example.org>
+S: In-Reply-To: <lunch-1@example.org>
+S: References: <lunch-1@example.org>
+S:
+S: )
+S: * 4 FETCH (UID 4 FLAGS () RFC822.SIZE 224 BODY[HEADER.FIELDS ("From" "Subject" "Message-ID" "References" "In-Reply-To")] {105}
+S: From: Billing <billing@example.net>
+S: Subject: Invoice 2024-117
+S: Message-Id: <invoice-117@example.net>
+S:
+S: )
+S: 8 OK UID FETCH completed
+C: 9 UID fetch 3 (UID RFC822.SIZE BODY.PEEK[]<0.32>)
+S: * 3 FETCH (UID 3 RFC822.SIZE 269 BODY[]<0> {32}
+S: From: Dave <dave@example.org>
+S: T)
+S: 9 OK UID FETCH completed
+C: 10 logout
+S: * BYE Logging out
+S: 10 OK LOGOUT completed
+`,
+		"ios": `
+S: * OK [CAPABILITY IMAP4rev1 SASL-IR LITERAL- AUTH=PLAIN] IMAP server ready
+C: 1 CAPABILITY
+S: * CAPABILITY IMAP4rev1 SASL-IR LITERAL- AUTH=PLAIN
+S: 1 OK CAPABILITY completed
+C: 2 LOGIN alice demo
+S: 2 OK [CAPABILITY IMAP4rev1 SASL-IR LITERAL- UNSELECT ENABLE IDLE UTF8=ACCEPT UIDPLUS ESEARCH SEARCHRES MOVE BINARY SPECIAL-USE] Logged in
+C: 3 LIST "" ""
+S: * LIST (\Noselect) "/" ""
+S: 3 OK LIST completed
+C: 4 LIST "" "*" RETURN (SPECIAL-USE)
+S: * LIST (\Archive) "/" "Archive"
+S: * LIST (\Drafts) "/" "Drafts"
+S: * LIST () "/" INBOX
+S: * LIST (\Junk) "/" "Junk"
+S: * LIST (\Sent) "/" "Sent"
+S: * LIST (\Trash) "/" "Trash"
+S: 4 OK LIST completed
+C: 5 SELECT INBOX
+S: * 4 EXISTS
+S: * 0 RECENT
+S: * OK [UIDVALIDITY 1] UIDs valid
+S: * OK [UIDNEXT 5] Predicted next UID
+S: * FLAGS (\Seen \Answered \Flagged \Deleted \Draft)
+S: * OK [PERMANENTFLAGS (\Seen \Answered \Flagged \Deleted \Draft \*)] Permanent flags
+S: 5 OK [READ-WRITE] SELECT completed
+C: 6 UID FETCH 1:* (FLAGS)
+S: * 1 FETCH (UID 1 FLAGS ())
+S: * 2 FETCH (UID 2 FLAGS ())
+S: * 3 FETCH (UID 3 FLAGS ())
+S: * 4 FETCH (UID 4 FLAGS ())
+S: 6 OK UID FETCH completed
+C: 7 UID FETCH 4 (BODY.PEEK[1]<0.12>)
+S: * 4 FETCH (UID 4 BODY[1]<0> {12}
+S: Your invoice)
+S: 7 OK UID FETCH completed
+C: 8 UID STORE 4 +FLAGS.SILENT (\Seen)
+S: 8 OK UID STORE completed
+C: 9 UID FETCH 4 (FLAGS)
+S: * 4 FETCH (UID 4 FLAGS (\Seen))
+S: 9 OK UID FETCH completed
+C: 10 LOGOUT
+S: * BYE Logging out
+S: 10 OK LOGOUT completed
+`,
+		"k9": `
+S: * OK [CAPABILITY IMAP4rev1 SASL-IR LITERAL- AUTH=PLAIN] IMAP server ready
+C: 1 CAPABILITY
+S: * CAPABILITY IMAP4rev1 SASL-IR LITERAL- AUTH=PLAIN
+S: 1 OK CAPABILITY completed
+C: 2 LOGIN "alice" "demo"
+S: 2 OK [CAPABILITY IMAP4rev1 SASL-IR LITERAL- UNSELECT ENABLE IDLE UTF8=ACCEPT UIDPLUS ESEARCH SEARCHRES MOVE BINARY SPECIAL-USE] Logged in
+C: 3 LIST "" ""
+S: * LIST (\Noselect) "/" ""
+S: 3 OK LIST completed
+C: 4 LIST "" "*"
+S: * LIST (\Archive) "/" "Archive"
+S: * LIST (\Drafts) "/" "Drafts"
+S: * LIST () "/" INBOX
+S: * LIST (\Junk) "/" "Junk"
+S: * LIST (\Sent) "/" "Sent"
+S: * LIST (\Trash) "/" "Trash"
+S: 4 OK LIST completed
+C: 5 SELECT "INBOX"
+S: * 4 EXISTS
+S: * 0 RECENT
+S: * OK [UIDVALIDITY 1] UIDs valid
+S: * OK [UIDNEXT 5] Predicted next UID
+S: * FLAGS (\Seen \Answered \Flagged \Deleted \Draft)
+S: * OK [PERMANENTFLAGS (\Seen \Answered \Flagged \Deleted \Draft \*)] Permanent flags
+S: 5 OK [READ-WRITE] SELECT completed
+C: 6 UID SEARCH 1:* NOT DELETED
+S: * SEARCH 1 2 3 4
+S: 6 OK UID SEARCH completed
+C: 7 UID FETCH 1:2 (UID FLAGS RFC822.SIZE BODY.PEEK[HEADER.FIELDS (subject from message-id)])
+S: * 1 FETCH (UID 1 FLAGS () RFC822.SIZE 242 BODY[HEADER.FIELDS ("subject" "from" "message-id")] {114}
+S: From: Postmaster <postmaster@example.com>
+S: Subject: Welcome to mymail
+S: Message-Id: <welcome-alice@example.com>
+S:
+S: )
+S: * 2 FETCH (UID 2 FLAGS () RFC822.SIZE 206 BODY[HEADER.FIELDS ("subject" "from" "message-id")] {97}
+S: From: Carol <carol@example.org>
+S: Subject: Lunch on Friday?
+S: Message-Id: <lunch-1@example.org>
+S:
+S: )
+S: 7 OK UID FETCH completed
+C: 8 UID FETCH 2 (UID BODY.PEEK[]<0.40>)
+S: * 2 FETCH (UID 2 BODY[]<0> {40}
+S: From: Carol <carol@example.org>
+S: To: ali)
+S: 8 OK UID FETCH completed
+C: 9 LOGOUT
+S: * BYE Logging out
+S: 9 OK LOGOUT completed
+`,
+		"outlook": `
+S: * OK [CAPABILITY IMAP4rev1 SASL-IR LITERAL- AUTH=PLAIN] IMAP server ready
+C: 1 CAPABILITY
+S: * CAPABILITY IMAP4rev1 SASL-IR LITERAL- AUTH=PLAIN
+S: 1 OK CAPABILITY completed
+C: 2 LOGIN alice demo
+S: 2 OK [CAPABILITY IMAP4rev1 SASL-IR LITERAL- UNSELECT ENABLE IDLE UTF8=ACCEPT UIDPLUS ESEARCH SEARCHRES MOVE BINARY SPECIAL-USE] Logged in
+C: 3 LIST "" "%"
+S: * LIST (\Archive) "/" "Archive"
+S: * LIST (\Drafts) "/" "Drafts"
+S: * LIST () "/" INBOX
+S: * LIST (\Junk) "/" "Junk"
+S: * LIST (\Sent) "/" "Sent"
+S: * LIST (\Trash) "/" "Trash"
+S: 3 OK LIST completed
+C: 4 STATUS "Sent" (MESSAGES UNSEEN UIDNEXT UIDVALIDITY)
+S: * STATUS "Sent" (MESSAGES 0 UIDNEXT 1 UIDVALIDITY 1 UNSEEN 0)
+S: 4 OK STATUS completed
+C: 5 SELECT "INBOX"
+S: * 4 EXISTS
+S: * 0 RECENT
+S: * OK [UIDVALIDITY 1] UIDs valid
+S: * OK [UIDNEXT 5] Predicted next UID
+S: * FLAGS (\Seen \Answered \Flagged \Deleted \Draft)
+S: * OK [PERMANENTFLAGS (\Seen \Answered \Flagged \Deleted \Draft \*)] Permanent flags
+S: 5 OK [READ-WRITE] SELECT completed
+C: 6 UID FETCH 1:* (UID FLAGS)
+S: * 1 FETCH (UID 1 FLAGS ())
+S: * 2 FETCH (UID 2 FLAGS ())
+S: * 3 FETCH (UID 3 FLAGS ())
+S: * 4 FETCH (UID 4 FLAGS ())
+S: 6 OK UID FETCH completed
+C: 7 UID FETCH 2 (UID RFC822.SIZE BODY.PEEK[TEXT])
+S: * 2 FETCH (UID 2 RFC822.SIZE 206 BODY[TEXT] {47}
+S: Shall we try the new place around the corner?
+S: )
+S: 7 OK UID FETCH completed
+C: 8 FETCH 2 (BINARY.PEEK[1]<0.10>)
+S: * 2 FETCH (BINARY[1] ~{10}
+S: Shall we t)
+S: 8 OK FETCH completed
+C: 9 LOGOUT
+S: * BYE Logging out
+S: 9 OK LOGOUT completed
+`,
+	}
+	for name, transcript := range patterns {
+		replay(t, name, transcript)
+	}
+}
+
+// TestFetchSections checks BODY[section]<offset.count> against a MIME
+// message, the whole message and windows of it are streamed from the store
+func TestFetchSections(t *testing.T) {
+	replay(t, "sections", `
+S: * OK [CAPABILITY IMAP4rev1 SASL-IR LITERAL- AUTH=PLAIN] IMAP server ready
+C: 1 LOGIN alice demo
+S: 1 OK [CAPABILITY IMAP4rev1 SASL-IR LITERAL- UNSELECT ENABLE IDLE UTF8=ACCEPT UIDPLUS ESEARCH SEARCHRES MOVE BINARY SPECIAL-USE] Logged in
+C: 2 APPEND Drafts {170+}
+C: From: a@example.org
+C: Subject: parts
+C: Content-Type: multipart/mixed; boundary=x
+C:
+C: --x
+C: Content-Type: text/plain
+C:
+C: first
+C: --x
+C: Content-Type: text/plain
+C:
+C: second
+C: --x--
+C:
+S: 2 OK [APPENDUID 1 1] APPEND completed
+C: 3 SELECT Drafts
+S: * 1 EXISTS
+S: * 0 RECENT
+S: * OK [UIDVALIDITY 1] UIDs valid
+S: * OK [UIDNEXT 2] Predicted next UID
+S: * FLAGS (\Seen \Answered \Flagged \Deleted \Draft)
+S: * OK [PERMANENTFLAGS (\Seen \Answered \Flagged \Deleted \Draft \*)] Permanent flags
+S: 3 OK [READ-WRITE] SELECT completed
+C: 4 FETCH 1 (BODY.PEEK[])
+S: * 1 FETCH (BODY[] {170}
+S: From: a@example.org
+S: Subject: parts
+S: Content-Type: multipart/mixed; boundary=x
+S:
+S: --x
+S: Content-Type: text/plain
+S:
+S: first
+S: --x
+S: Content-Type: text/plain
+S:
+S: second
+S: --x--
+S: )
+S: 4 OK FETCH completed
+C: 5 FETCH 1 (BODY.PEEK[]<21.13>)
+S: * 1 FETCH (BODY[]<21> {13}
+S: Subject: part)
+S: 5 OK FETCH completed
+C: 6 FETCH 1 (BODY.PEEK[]<500.10>)
+S: * 1 FETCH (BODY[]<500> {0}
+S: )
+S: 6 OK FETCH completed
+C: 7 FETCH 1 (BODY.PEEK[HEADER])
+S: * 1 FETCH (BODY[HEADER] {82}
+S: From: a@example.org
+S: Subject: parts
+S: Content-Type: multipart/mixed; boundary=x
+S:
+S: )
+S: 7 OK FETCH completed
+C: 8 FETCH 1 (BODY.PEEK[HEADER.FIELDS.NOT (Content-Type From)])
+S: * 1 FETCH (BODY[HEADER.FIELDS.NOT ("Content-Type" "From")] {18}
+S: Subject: parts
+S:
+S: )
+S: 8 OK FETCH completed
+C: 9 FETCH 1 (BODY.PEEK[TEXT]<0.5>)
+S: * 1 FETCH (BODY[TEXT]<0> {5}
+S: --x
+S: )
+S: 9 OK FETCH completed
+C: 10 FETCH 1 (BODY.PEEK[2])
+S: * 1 FETCH (BODY[2] {6}
+S: second)
+S: 10 OK FETCH completed
+C: 11 FETCH 1 (BODY.PEEK[2.MIME])
+S: * 1 FETCH (BODY[2.MIME] {28}
+S: Content-Type: text/plain
+S:
+S: )
+S: 11 OK FETCH completed
+C: 12 FETCH 1 (BODY.PEEK[1]<2.100>)
+S: * 1 FETCH (BODY[1]<2> {3}
+S: rst)
+S: 12 OK FETCH completed
+C: 13 FETCH 1 (BODY.PEEK[3])
+S: * 1 FETCH (BODY[3] {0}
+S: )
+S: 13 OK FETCH completed
+C: 14 FETCH 1 (BODYSTRUCTURE)
+S: * 1 FETCH (BODYSTRUCTURE (("text" "plain" ("charset" "us-ascii") NIL NIL "7BIT" 5 0 NIL NIL NIL NIL) ("text" "plain" ("charset" "us-ascii") NIL NIL "7BIT" 6 0 NIL NIL NIL NIL) "mixed" ("boundary" "x") NIL NIL NIL))
+S: 14 OK FETCH completed
+C: 15 LOGOUT
+S: * BYE Logging out
+S: 15 OK LOGOUT completed
+`)
+}
+
+// TestKeywords checks keywords clients set like $Forwarded are kept, by
+// STORE and APPEND, and show up in FLAGS as soon as a message has them
+func TestKeywords(t *testing.T) {
+	replay(t, "keywords", `
+S: * OK [CAPABILITY IMAP4rev1 SASL-IR LITERAL- AUTH=PLAIN] IMAP server ready
+C: 1 LOGIN alice demo
+S: 1 OK [CAPABILITY IMAP4rev1 SASL-IR LITERAL- UNSELECT ENABLE IDLE UTF8=ACCEPT UIDPLUS ESEARCH SEARCHRES MOVE BINARY SPECIAL-USE] Logged in
+C: 2 SELECT INBOX
+S: * 4 EXISTS
+S: * 0 RECENT
+S: * OK [UIDVALIDITY 1] UIDs valid
+S: * OK [UIDNEXT 5] Predicted next UID
+S: * FLAGS (\Seen \Answered \Flagged \Deleted \Draft)
+S: * OK [PERMANENTFLAGS (\Seen \Answered \Flagged \Deleted \Draft \*)] Permanent flags
+S: 2 OK [READ-WRITE] SELECT completed
+C: 3 STORE 2 +FLAGS ($Forwarded \Recent)
+S: * 2 FETCH (FLAGS ($Forwarded))
+S: * FLAGS (\Seen \Answered \Flagged \Deleted \Draft $Forwarded)
+S: 3 OK STORE completed
+C: 4 STORE 2 +FLAGS ($forwarded)
+S: * 2 FETCH (FLAGS ($Forwarded))
+S: 4 OK STORE completed
+C: 5 APPEND INBOX ($MDNSent) {12+}
+C: Subject: x
+C:
+S: * FLAGS (\Seen \Answered \Flagged \Deleted \Draft $Forwarded $MDNSent)
+S: * 5 EXISTS
+S: * 1 RECENT
+S: 5 OK [APPENDUID 1 5] APPEND completed
+C: 6 SELECT INBOX
+S: * OK [CLOSED] Previous mailbox is now closed
+S: * 5 EXISTS
+S: * 0 RECENT
+S: * OK [UIDVALIDITY 1] UIDs valid
+S: * OK [UIDNEXT 6] Predicted next UID
+S: * FLAGS (\Seen \Answered \Flagged \Deleted \Draft $Forwarded $MDNSent)
+S: * OK [PERMANENTFLAGS (\Seen \Answered \Flagged \Deleted \Draft $Forwarded $MDNSent \*)] Permanent flags
+S: 6 OK [READ-WRITE] SELECT completed
+C: 7 LOGOUT
+S: * BYE Logging out
+S: 7 OK LOGOUT completed
+`)
+}
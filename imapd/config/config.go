@@ -4,6 +4,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"strings"
+	"time"
+
+	smtpdconfig "github.com/mpdroog/mymail/smtpd/config"
 )
 
 type Config struct {
@@ -11,16 +15,94 @@ type Config struct {
 	ListenAddr   string `json:"listen_addr"`
 	InsecureAuth bool   `json:"insecure_auth"` // Allow auth without TLS
 
-	// TLS settings
+	// Greeting
+	Greeting         string `json:"greeting"`          // Replaces "IMAP server ready" (e.g. a legal notice)
+	HideCapabilities bool   `json:"hide_capabilities"` // Leave CAPABILITY out of the greeting and trim it to what login needs until then
+
+	// TLS settings, STARTTLS is offered with a certificate
 	TLSCert string `json:"tls_cert"`
 	TLSKey  string `json:"tls_key"`
 
+	// Extra addresses with their own hostname and certificate, e.g. one IP per
+	// hosted domain. Every certificate is also offered by SNI name on the others.
+	Listeners []Listener `json:"listeners"`
+
+	// Per-domain certificates by SNI name, {cert_dir}/{domain}/fullchain.pem and
+	// privkey.pem as ACME clients (certbot, lego) write them, renewals are picked up
+	CertDir string `json:"cert_dir"` // e.g. "/etc/letsencrypt/live" (empty=disabled)
+
 	// Authentication
-	AuthFile string `json:"auth_file"` // Path to user credentials file (username:password per line)
+	AuthFile         string        `json:"auth_file"`         // Path to user credentials file (username:password per line)
+	AuthFailDelayStr string        `json:"auth_fail_delay"`   // Answer a failed LOGIN after this plus up to 50% jitter (default "2s")
+	AuthFailDelay    time.Duration `json:"-"`                 // Parsed delay
+	MaxAuthFailures  int           `json:"max_auth_failures"` // Failed logins per connection before BYE (default 3)
+	MaxConnections   int           `json:"max_connections"`   // Open connections before new ones get BYE (default 200)
+
+	// Account lockout after failed logins over all connections, shared with smtpd
+	LockoutDir         string        `json:"lockout_dir"`       // Empty=disabled
+	LockoutThreshold   int           `json:"lockout_threshold"` // Failed logins within the window (default 10)
+	LockoutWindowStr   string        `json:"lockout_window"`    // e.g. "15m" (default)
+	LockoutWindow      time.Duration `json:"-"`
+	LockoutDurationStr string        `json:"lockout_duration"` // e.g. "30m" (default)
+	LockoutDuration    time.Duration `json:"-"`
+	LockoutAdmin       string        `json:"lockout_admin"` // User whose INBOX gets an alert per lock (empty=none)
 
 	// Storage
 	MailDir string `json:"mail_dir"` // Directory with maildir structure
 	Domain string `json:"domain"`
+
+	// Other names clients use for a mailbox, e.g. {"Sent Items": "Sent",
+	// "Deleted Items": "Trash"} for Outlook. They are only listed when asked
+	// for by name, so other clients don't show the folder twice.
+	MailboxAliases map[string]string `json:"mailbox_aliases"`
+
+	// Expunged messages are moved to {user}/.trash, see mymail undelete
+	TrashRetentionStr string        `json:"trash_retention"` // Purge after e.g. "168h" (default), "0" deletes right away
+	TrashRetention    time.Duration `json:"-"`
+
+	// Limits against hostile clients, answered with NO or BAD
+	MaxAppendSizeStr string `json:"max_append_size"`  // e.g. "50MB" (default, at most 100MB)
+	MaxAppendSize    int64  `json:"-"`
+	MaxSearchTerms   int    `json:"max_search_terms"` // Criteria in one SEARCH, nested ones included (default 100)
+	MaxSetRanges     int    `json:"max_set_ranges"`   // Ranges in one sequence or UID set (default 1000)
+
+	// IDLE and NOOP report messages delivered, expunged or flagged elsewhere
+	IdleIntervalStr string        `json:"idle_interval"` // Look for changes this often while idling (default "5s")
+	IdleInterval    time.Duration `json:"-"`
+
+	// Logging
+	LogOutput  string `json:"log_output"`  // stderr (default), syslog or journald
+	SyslogAddr string `json:"syslog_addr"` // unix:///dev/log (default), udp://host:514 or tcp://host:514
+
+	// Address book per user, recipients of mail appended to Sent (shared with smtpd)
+	ContactsDir string `json:"contacts_dir"` // Empty=disabled
+
+	// Login history per user, shared with smtpd
+	ActivityDir string `json:"activity_dir"` // Empty=disabled, adds the "Account Activity" mailbox
+
+	// Read-only views for users coming from Gmail, rebuilt on every SELECT
+	AllMailbox  string `json:"all_mailbox"`  // e.g. "All Mail", every mailbox but Trash and Junk (empty=disabled)
+	LabelPrefix string `json:"label_prefix"` // e.g. "Labels", lists every keyword as Labels/{keyword} (empty=disabled)
+
+	// Saved searches of the user's .searches file as {search_prefix}/{name}, read-only
+	SearchPrefix string `json:"search_prefix"` // e.g. "Searches" (empty=disabled)
+
+	// Append-only log of destructive operations, shared with smtpd and mymail
+	AuditLog string `json:"audit_log"` // File path (empty=disabled)
+
+	// Admin HTTP API (sessions, bans), empty to disable
+	AdminAddr string `json:"admin_addr"` // e.g. 127.0.0.1:1144
+
+	// Privacy
+	PrivacyUsers []string `json:"privacy_users"` // Users that get remote content in HTML parts blocked
+}
+
+// Listener is an address next to listen_addr
+type Listener struct {
+	Addr     string `json:"addr"`     // e.g. "192.0.2.2:143"
+	Hostname string `json:"hostname"` // Named in the greeting
+	TLSCert  string `json:"tls_cert"` // Default tls_cert
+	TLSKey   string `json:"tls_key"`  // Default tls_key
 }
 
 var (
@@ -39,6 +121,77 @@ func Load(path string) error {
 		return err
 	}
 
+	C.AuthFailDelay = 2 * time.Second
+	if C.AuthFailDelayStr != "" {
+		d, err := time.ParseDuration(C.AuthFailDelayStr)
+		if err != nil {
+			return fmt.Errorf("invalid auth_fail_delay %q: %v", C.AuthFailDelayStr, err)
+		}
+		C.AuthFailDelay = d
+	}
+	if C.MaxAuthFailures <= 0 {
+		C.MaxAuthFailures = 3
+	}
+	if C.MaxConnections <= 0 {
+		C.MaxConnections = 200
+	}
+	if C.LockoutThreshold <= 0 {
+		C.LockoutThreshold = 10
+	}
+	for _, p := range []struct {
+		name string
+		str  string
+		dst  *time.Duration
+		def  time.Duration
+	}{
+		{"lockout_window", C.LockoutWindowStr, &C.LockoutWindow, 15 * time.Minute},
+		{"lockout_duration", C.LockoutDurationStr, &C.LockoutDuration, 30 * time.Minute},
+		{"idle_interval", C.IdleIntervalStr, &C.IdleInterval, 5 * time.Second},
+	} {
+		*p.dst = p.def
+		if p.str == "" {
+			continue
+		}
+		d, err := time.ParseDuration(p.str)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid %s %q", p.name, p.str)
+		}
+		*p.dst = d
+	}
+
+	C.TrashRetention = 7 * 24 * time.Hour
+	if C.TrashRetentionStr != "" {
+		d, err := time.ParseDuration(C.TrashRetentionStr)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid trash_retention %q", C.TrashRetentionStr)
+		}
+		C.TrashRetention = d
+	}
+
+	// go-imap refuses larger APPEND literals itself
+	const appendLimit = 100 * 1024 * 1024
+	if C.MaxAppendSizeStr == "" {
+		C.MaxAppendSizeStr = "50MB"
+	}
+	C.MaxAppendSize, err = smtpdconfig.ParseSize(C.MaxAppendSizeStr)
+	if err != nil || C.MaxAppendSize <= 0 || C.MaxAppendSize > appendLimit {
+		return fmt.Errorf("invalid max_append_size %q, at most 100MB", C.MaxAppendSizeStr)
+	}
+	if C.MaxSearchTerms <= 0 {
+		C.MaxSearchTerms = 100
+	}
+	if C.MaxSetRanges <= 0 {
+		C.MaxSetRanges = 1000
+	}
+	for alias, target := range C.MailboxAliases {
+		if target == "" || strings.EqualFold(alias, "INBOX") || C.MailboxAliases[target] != "" {
+			return fmt.Errorf("invalid mailbox_aliases %q: %q", alias, target)
+		}
+	}
+	if C.SearchPrefix != "" && C.SearchPrefix == C.LabelPrefix {
+		return fmt.Errorf("search_prefix equals label_prefix %q", C.SearchPrefix)
+	}
+
 	return CheckPaths()
 }
 
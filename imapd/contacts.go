@@ -0,0 +1,27 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/mpdroog/mymail/imapd/config"
+	"github.com/mpdroog/mymail/smtpd/contacts"
+)
+
+// isSentMailbox returns true for the mailboxes clients save sent mail in
+func isSentMailbox(mailbox string) bool {
+	return strings.HasPrefix(strings.ToLower(mailbox), "sent")
+}
+
+// contactsOwner returns the address the index of username is keyed on
+func contactsOwner(username string) string {
+	if !strings.Contains(username, "@") {
+		username += "@" + config.C.Domain
+	}
+	return strings.ToLower(username)
+}
+
+// recordContacts adds the recipients of a sent message to the index of username
+func recordContacts(username string, data []byte) error {
+	addrs := contacts.Addresses(data, "To", "Cc", "Bcc")
+	return contacts.Record(config.C.ContactsDir, contactsOwner(username), addrs)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// demoUsers log in to imapd -demo with password "demo"
+var demoUsers = []string{"alice", "bob"}
+
+// setupDemo writes the config and user file of -demo to a temporary
+// directory and returns the config path. Mail isn't written there, -demo
+// keeps it in a memStore.
+func setupDemo() (string, error) {
+	dir, err := os.MkdirTemp("", "imapd-demo-")
+	if err != nil {
+		return "", err
+	}
+	users := make(map[string]string)
+	for _, u := range demoUsers {
+		users[u] = "demo"
+	}
+	if err := writeDemoFile(filepath.Join(dir, "users.json"), users); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, "config.json")
+	return path, writeDemoFile(path, map[string]any{
+		"listen_addr":   "127.0.0.1:1143",
+		"insecure_auth": true,
+		"auth_file":     filepath.Join(dir, "users.json"),
+		"mail_dir":      dir,
+		"domain":        "example.com",
+	})
+}
+
+func writeDemoFile(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// demoMessages are delivered to every demo user, a conversation to try
+// THREAD on and a message to search for
+var demoMessages = []string{
+	"From: Postmaster <postmaster@example.com>\r\nTo: %[1]s@example.com\r\nSubject: Welcome to mymail\r\nDate: %[2]s\r\nMessage-Id: <welcome-%[1]s@example.com>\r\n\r\nThis is imapd -demo, mail is kept in memory and gone on restart.\r\n",
+	"From: Carol <carol@example.org>\r\nTo: %[1]s@example.com\r\nSubject: Lunch on Friday?\r\nDate: %[2]s\r\nMessage-Id: <lunch-1@example.org>\r\n\r\nShall we try the new place around the corner?\r\n",
+	"From: Dave <dave@example.org>\r\nTo: %[1]s@example.com\r\nCc: carol@example.org\r\nSubject: Re: Lunch on Friday?\r\nDate: %[2]s\r\nMessage-Id: <lunch-2@example.org>\r\nIn-Reply-To: <lunch-1@example.org>\r\nReferences: <lunch-1@example.org>\r\n\r\nCount me in.\r\n",
+	"From: Billing <billing@example.net>\r\nTo: %[1]s@example.com\r\nSubject: Invoice 2024-117\r\nDate: %[2]s\r\nMessage-Id: <invoice-117@example.net>\r\n\r\nYour invoice is attached. Just kidding, this is a demo.\r\n",
+}
+
+// seedDemo creates the mailboxes of the demo users and fills their INBOX
+func seedDemo(st MailStore) error {
+	start := time.Now().Add(-time.Duration(len(demoMessages)) * time.Hour)
+	for _, u := range demoUsers {
+		if err := ensureFolders(st, u); err != nil {
+			return err
+		}
+		for i, tmpl := range demoMessages {
+			date := start.Add(time.Duration(i) * time.Hour).Format(time.RFC1123Z)
+			if err := st.Deliver(u, "INBOX", []byte(fmt.Sprintf(tmpl, u, date))); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -2,11 +2,16 @@ module github.com/mpdroog/mymail/imapd
 
 go 1.25.5
 
-require github.com/emersion/go-imap/v2 v2.0.0-beta.7
+require (
+	github.com/emersion/go-imap/v2 v2.0.0-beta.7
+	github.com/mpdroog/mymail/smtpd v0.0.0-00010101000000-000000000000
+)
 
 require (
 	github.com/coreos/go-systemd/v22 v22.7.0 // indirect
 	github.com/emersion/go-message v0.18.1 // indirect
 	github.com/emersion/go-sasl v0.0.0-20231106173351-e73c9f7bad43 // indirect
-	golang.org/x/sys v0.5.0 // indirect
+	golang.org/x/sys v0.21.0 // indirect
 )
+
+replace github.com/mpdroog/mymail/smtpd => ../smtpd
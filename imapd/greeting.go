@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+
+	"github.com/mpdroog/mymail/imapd/config"
+)
+
+// greetingConn rewrites the first line go-imap writes ("* OK [CAPABILITY ..]
+// IMAP server ready") as the library has no option for the greeting text.
+// With hide_capabilities it also trims the CAPABILITY responses before
+// login, the library has no hook for those either.
+type greetingConn struct {
+	net.Conn
+	hostname string // Of the listener, see listeners.go
+	done     bool
+	trimmed  bool // Logged in or STARTTLS, nothing left to trim
+}
+
+func (c *greetingConn) Write(b []byte) (int, error) {
+	if !c.done {
+		c.done = true
+		end := bytes.Index(b, []byte("\r\n"))
+		if bytes.HasPrefix(b, []byte("* OK ")) && end != -1 {
+			if _, err := c.Conn.Write(rewriteGreeting(b[:end], c.hostname)); err != nil {
+				return 0, err
+			}
+			if _, err := c.Conn.Write(b[end:]); err != nil {
+				return 0, err
+			}
+			return len(b), nil
+		}
+	}
+	if c.trimmed || !config.C.HideCapabilities {
+		return c.Conn.Write(b)
+	}
+
+	var out []byte
+	for _, line := range bytes.SplitAfter(b, []byte("\r\n")) {
+		switch {
+		case bytes.HasPrefix(line, []byte("* CAPABILITY ")):
+			line = trimCapabilities(line)
+		case bytes.Contains(line, []byte(" OK [CAPABILITY ")), bytes.Contains(line, []byte(" OK Begin TLS negotiation")):
+			// Logged in (login.go, authenticate.go) or the next bytes are
+			// TLS (starttls.go), the client may see everything from now on
+			c.trimmed = true
+		}
+		out = append(out, line...)
+	}
+	if _, err := c.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// trimCapabilities keeps what a client needs to log in of an untagged
+// CAPABILITY line, like "* CAPABILITY IMAP4rev1 SASL-IR LITERAL- AUTH=PLAIN\r\n"
+func trimCapabilities(line []byte) []byte {
+	var keep []string
+	for _, c := range strings.Fields(string(line[len("* CAPABILITY "):])) {
+		switch {
+		case c == "IMAP4rev1", c == "IMAP4rev2", c == "STARTTLS", c == "LOGINDISABLED", strings.HasPrefix(c, "AUTH="):
+			keep = append(keep, c)
+		}
+	}
+	return []byte("* CAPABILITY " + strings.Join(keep, " ") + "\r\n")
+}
+
+// rewriteGreeting applies greeting, hide_capabilities and the hostname of
+// the listener to line (without CRLF)
+func rewriteGreeting(line []byte, hostname string) []byte {
+	rest := line[len("* OK "):]
+	var code []byte
+	if bytes.HasPrefix(rest, []byte("[")) {
+		if i := bytes.Index(rest, []byte("] ")); i != -1 {
+			code, rest = rest[:i+2], rest[i+2:]
+		}
+	}
+	if config.C.HideCapabilities {
+		code = nil
+	}
+	if config.C.Greeting != "" {
+		rest = []byte(config.C.Greeting)
+	}
+	if hostname != "" {
+		rest = append([]byte(hostname+" "), rest...)
+	}
+
+	out := append([]byte("* OK "), code...)
+	return append(out, rest...)
+}
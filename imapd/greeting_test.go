@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/mpdroog/mymail/imapd/config"
+)
+
+// bufConn collects what is written to it
+type bufConn struct {
+	net.Conn
+	out bytes.Buffer
+}
+
+func (c *bufConn) Write(b []byte) (int, error) {
+	return c.out.Write(b)
+}
+
+func TestHideCapabilities(t *testing.T) {
+	config.C.HideCapabilities = true
+	defer func() {
+		config.C.HideCapabilities = false
+	}()
+	raw := &bufConn{}
+	c := &greetingConn{Conn: raw}
+
+	writes := []string{
+		"* OK [CAPABILITY IMAP4rev1 SASL-IR LITERAL- AUTH=PLAIN] IMAP server ready\r\n",
+		"* CAPABILITY IMAP4rev1 SASL-IR LITERAL- STARTTLS LOGINDISABLED\r\nA1 OK CAPABILITY completed\r\n",
+		"A2 OK [CAPABILITY IMAP4rev1 IDLE MOVE] Logged in\r\n",
+		"* CAPABILITY IMAP4rev1 IDLE MOVE\r\n",
+	}
+	for _, w := range writes {
+		if n, err := c.Write([]byte(w)); err != nil || n != len(w) {
+			t.Fatalf("Write n=%d e=%v", n, err)
+		}
+	}
+
+	expect := "* OK IMAP server ready\r\n" +
+		"* CAPABILITY IMAP4rev1 STARTTLS LOGINDISABLED\r\nA1 OK CAPABILITY completed\r\n" +
+		"A2 OK [CAPABILITY IMAP4rev1 IDLE MOVE] Logged in\r\n" +
+		"* CAPABILITY IMAP4rev1 IDLE MOVE\r\n"
+	if out := raw.out.String(); out != expect {
+		t.Errorf("out=%q expect=%q", out, expect)
+	}
+}
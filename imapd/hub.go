@@ -0,0 +1,80 @@
+package main
+
+import (
+	"sync"
+)
+
+// hub wakes the sessions that have a mailbox selected when another session
+// of this process stored flags, expunged or added messages in it. The woken
+// sessions sync, so IDLE reports the change right away instead of at the
+// next idle_interval and each session computes its own sequence numbers.
+// Deliveries by smtpd and other processes are still found by polling.
+type hub struct {
+	mu   sync.Mutex
+	subs map[string]map[*Session]chan struct{} // By hubKey
+	keys map[*Session]string                   // What each session subscribed to
+}
+
+func newHub() *hub {
+	return &hub{
+		subs: make(map[string]map[*Session]chan struct{}),
+		keys: make(map[*Session]string),
+	}
+}
+
+func hubKey(username, mailbox string) string {
+	return username + "\x00" + mailbox
+}
+
+// subscribe replaces the subscription of s with one to mailbox and returns
+// the channel that gets a value when it changed
+func (h *hub) subscribe(s *Session, username, mailbox string) <-chan struct{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.remove(s)
+
+	key := hubKey(username, mailbox)
+	if h.subs[key] == nil {
+		h.subs[key] = make(map[*Session]chan struct{})
+	}
+	// Buffered so a change while s is busy isn't lost, more collapse into one
+	c := make(chan struct{}, 1)
+	h.subs[key][s] = c
+	h.keys[s] = key
+	return c
+}
+
+// unsubscribe drops the subscription of s, if any
+func (h *hub) unsubscribe(s *Session) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.remove(s)
+}
+
+// remove drops the subscription of s, h.mu must be held
+func (h *hub) remove(s *Session) {
+	key, ok := h.keys[s]
+	if !ok {
+		return
+	}
+	delete(h.keys, s)
+	delete(h.subs[key], s)
+	if len(h.subs[key]) == 0 {
+		delete(h.subs, key)
+	}
+}
+
+// notify wakes the sessions other than from that have mailbox selected
+func (h *hub) notify(from *Session, username, mailbox string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s, c := range h.subs[hubKey(username, mailbox)] {
+		if s == from {
+			continue
+		}
+		select {
+		case c <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestHub(t *testing.T) {
+	h := newHub()
+	a, b, c := &Session{}, &Session{}, &Session{}
+	wakeA := h.subscribe(a, "mark", "INBOX")
+	wakeB := h.subscribe(b, "mark", "INBOX")
+	wakeC := h.subscribe(c, "mark", "Sent")
+
+	h.notify(a, "mark", "INBOX")
+	h.notify(a, "mark", "INBOX")
+	patterns := map[string]struct {
+		wake   <-chan struct{}
+		expect int
+	}{
+		"changer":       {wakeA, 0},
+		"same mailbox":  {wakeB, 1},
+		"other mailbox": {wakeC, 0},
+	}
+	for name, p := range patterns {
+		if n := len(p.wake); n != p.expect {
+			t.Errorf("%s: %d wakeups, expect %d", name, n, p.expect)
+		}
+	}
+
+	// Selecting another mailbox moves the subscription
+	h.subscribe(b, "mark", "Sent")
+	h.unsubscribe(c)
+	if len(h.subs[hubKey("mark", "INBOX")]) != 1 || len(h.subs[hubKey("mark", "Sent")]) != 1 || len(h.keys) != 2 {
+		t.Errorf("subs=%v keys=%v", h.subs, h.keys)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+	"github.com/mpdroog/mymail/imapd/config"
+)
+
+// stamp is a cheap fingerprint of a mailbox directory, it changes when a
+// message is delivered, expunged or gets new flags
+type stamp struct {
+	n      int
+	latest time.Time
+}
+
+// scanMailbox returns the stamp of the mailbox in path and its messages
+func scanMailbox(path string) (stamp, map[string]bool, error) {
+	var st stamp
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return st, nil, err
+	}
+	files := make(map[string]bool)
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			// Removed since ReadDir, the next scan sees it gone
+			continue
+		}
+		st.n++
+		if info.ModTime().After(st.latest) {
+			st.latest = info.ModTime()
+		}
+		if strings.HasSuffix(e.Name(), ".eml") {
+			files[filepath.Join(path, e.Name())] = true
+		}
+	}
+	return st, files, nil
+}
+
+// sync tells the client about changes to the selected mailbox made by other
+// sessions and smtpd. Without allowExpunge sequence numbers can't shift, so
+// removed messages wait until a command that allows it (NOOP, IDLE).
+func (s *Session) sync(w *imapserver.UpdateWriter, allowExpunge bool) error {
+	mbox := s.mailbox
+	if mbox == nil || isVirtualMailbox(mbox.Name) {
+		return nil
+	}
+	st, files, err := s.server.storage.Watch(s.username, mbox.Name)
+	if err != nil || st == s.stamp {
+		return err
+	}
+
+	var kept, gone []*Message
+	for _, msg := range mbox.Messages {
+		if files[msg.Path] {
+			kept = append(kept, msg)
+			delete(files, msg.Path)
+		} else {
+			gone = append(gone, msg)
+		}
+	}
+	if len(gone) > 0 && !allowExpunge {
+		return nil
+	}
+	s.stamp = st
+
+	// Highest first so the numbers of the others stay valid
+	for i := len(gone) - 1; i >= 0; i-- {
+		if err := w.WriteExpunge(gone[i].SeqNum); err != nil {
+			return err
+		}
+	}
+	for i, msg := range kept {
+		msg.SeqNum = uint32(i + 1)
+		if flags := s.server.storage.loadFlags(msg.Path); !sameFlags(flags, msg.Flags) {
+			msg.Flags = flags
+			if err := w.WriteMessageFlags(msg.SeqNum, msg.UID, msg.Flags); err != nil {
+				return err
+			}
+		}
+	}
+
+	var added []*Message
+	for path := range files {
+		if msg, err := s.server.storage.loadMessage(path); err == nil {
+			added = append(added, msg)
+		}
+	}
+	sort.Slice(added, func(i, j int) bool {
+		return added[i].UID < added[j].UID
+	})
+	for _, msg := range added {
+		kept = append(kept, msg)
+		msg.SeqNum = uint32(len(kept))
+		if msg.UID >= mbox.UIDNext {
+			mbox.UIDNext = msg.UID + 1
+		}
+	}
+	mbox.Messages = kept
+	s.cached.Store(mbox.memory())
+	// A keyword new to the mailbox, set by this or another session
+	if flags := mailboxFlags(mbox); !slices.Equal(flags, s.flags) {
+		s.flags = flags
+		if err := w.WriteMailboxFlags(flags); err != nil {
+			return err
+		}
+	}
+	if len(added) > 0 {
+		if err := w.WriteNumMessages(uint32(len(kept))); err != nil {
+			return err
+		}
+		// The first session told about a message has it as recent, RFC 3501
+		// 2.3.2, imapd doesn't track which session that was so any that saw
+		// it arrive counts it
+		if s.recent == nil {
+			s.recent = make(map[imap.UID]bool)
+		}
+		n := 0
+		for _, msg := range kept {
+			if s.recent[msg.UID] || slices.Contains(added, msg) {
+				s.recent[msg.UID] = true
+				n++
+			}
+		}
+		return w.WriteNumRecent(uint32(n))
+	}
+	return nil
+}
+
+func (s *Session) Poll(w *imapserver.UpdateWriter, allowExpunge bool) error {
+	return s.sync(w, allowExpunge)
+}
+
+// Idle checks the selected mailbox every idle_interval, or right away when
+// another session changed it, until the client sends DONE
+func (s *Session) Idle(w *imapserver.UpdateWriter, stop <-chan struct{}) error {
+	t := time.NewTicker(config.C.IdleInterval)
+	defer t.Stop()
+	for {
+		if err := s.sync(w, true); err != nil {
+			return err
+		}
+		select {
+		case <-stop:
+			return nil
+		case <-t.C:
+		case <-s.wake:
+		}
+	}
+}
+
+// forget drops expunged messages from the selected mailbox and renumbers
+// the rest, as the client did on the EXPUNGE responses
+func (mbox *Mailbox) forget(gone map[imap.UID]bool) {
+	var kept []*Message
+	for _, msg := range mbox.Messages {
+		if !gone[msg.UID] {
+			msg.SeqNum = uint32(len(kept) + 1)
+			kept = append(kept, msg)
+		}
+	}
+	mbox.Messages = kept
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/mpdroog/mymail/smtpd/logging"
+	"github.com/mpdroog/mymail/smtpd/storage"
+)
+
+// indexDir keeps a mailboxIndex per mailbox, {user}/.index/{mailbox}.json.
+// It lives outside the mailbox so writing it doesn't touch the directory
+// mtime it's checked against.
+const indexDir = ".index"
+
+// mailboxIndex caches what GetMailbox parses from the message files. Those
+// never change once written (see smtpd/storage/immutable.go), their flags
+// do but are replaced by rename, so any change to a mailbox shows in the
+// mtime of its directory.
+type mailboxIndex struct {
+	Mtime    int64                  `json:"mtime"`    // Of the directory in ns, 0 when it changed during the scan
+	Messages map[string]*indexEntry `json:"messages"` // By file name
+}
+
+type indexEntry struct {
+	Size     int64       `json:"size"`
+	Mod      int64       `json:"mod"`       // File mtime in ns, a new file under the same name differs
+	FlagsMod int64       `json:"flags_mod"` // Of the .flags sidecar, 0 without one
+	Flags    []imap.Flag `json:"flags"`
+	Date     time.Time   `json:"date"`
+
+	From    string `json:"from"`
+	Subject string `json:"subject"`
+}
+
+func newIndexEntry(msg *Message, info os.FileInfo, flagsMod int64) *indexEntry {
+	return &indexEntry{
+		Size:     msg.Size,
+		Mod:      info.ModTime().UnixNano(),
+		FlagsMod: flagsMod,
+		Flags:    msg.Flags,
+		Date:     msg.Date,
+		From:     msg.From,
+		Subject:  msg.Subject,
+	}
+}
+
+func (e *indexEntry) message(path string) *Message {
+	return &Message{
+		UID:     parseUIDFromFilename(filepath.Base(path)),
+		Flags:   slices.Clone(e.Flags),
+		Date:    e.Date,
+		Size:    e.Size,
+		Path:    path,
+		From:    e.From,
+		Subject: e.Subject,
+	}
+}
+
+func (s *Storage) indexPath(username, mailbox string) string {
+	return filepath.Join(s.userDir(username), indexDir, mailbox+".json")
+}
+
+// index returns the index of the mailbox in path, dir is its FileInfo. The
+// index is used as is while the directory didn't change, otherwise only the
+// messages it doesn't have yet are read.
+func (s *Storage) index(username, mailbox, path string, dir os.FileInfo) (*mailboxIndex, error) {
+	indexPath := s.indexPath(username, mailbox)
+	idx := loadIndex(indexPath)
+	if idx.Mtime == 0 || idx.Mtime != dir.ModTime().UnixNano() {
+		var err error
+		idx, err = s.scanIndex(path, dir, idx)
+		if err != nil {
+			return nil, err
+		}
+		if err := saveIndex(indexPath, idx); err != nil {
+			log.Printf(logging.Err+"saveIndex(%s) e=%v", indexPath, err)
+		}
+	}
+	return idx, nil
+}
+
+// Keywords returns the keywords set on the messages of mailbox, from its
+// index without building the messages
+func (s *Storage) Keywords(username, mailbox string) ([]string, error) {
+	path, err := s.MailboxPath(username, mailbox)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	idx, err := s.index(username, mailbox, path, dir)
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, e := range idx.Messages {
+		out = append(out, keywords(e.Flags)...)
+	}
+	return out, nil
+}
+
+// keywords returns the flags that aren't system flags
+func keywords(flags []imap.Flag) []string {
+	var out []string
+	for _, f := range flags {
+		if !strings.HasPrefix(string(f), `\`) {
+			out = append(out, string(f))
+		}
+	}
+	return out
+}
+
+// loadIndex returns the index in path, an empty one when it's missing or
+// unreadable so the mailbox is scanned
+func loadIndex(path string) *mailboxIndex {
+	idx := &mailboxIndex{}
+	if data, err := os.ReadFile(path); err == nil {
+		if json.Unmarshal(data, idx) != nil {
+			idx = &mailboxIndex{}
+		}
+	}
+	if idx.Messages == nil {
+		idx.Messages = make(map[string]*indexEntry)
+	}
+	return idx
+}
+
+func saveIndex(path string, idx *mailboxIndex) error {
+	data, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return storage.ReplaceFile(path, data, 0600)
+}
+
+// scanIndex rebuilds the index of the mailbox in path. Entries of old whose
+// file is unchanged are kept, the other messages are read several at once
+// so disks can reorder the reads.
+func (s *Storage) scanIndex(path string, dir os.FileInfo, old *mailboxIndex) (*mailboxIndex, error) {
+	scanned := time.Now()
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	infos := make(map[string]os.FileInfo)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !(strings.HasSuffix(name, ".eml") || strings.HasSuffix(name, ".eml.flags")) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			// Removed since ReadDir
+			continue
+		}
+		infos[name] = info
+	}
+	flagsMod := func(name string) int64 {
+		if info, ok := infos[name+".flags"]; ok {
+			return info.ModTime().UnixNano()
+		}
+		return 0
+	}
+
+	idx := &mailboxIndex{Messages: make(map[string]*indexEntry)}
+	// A change within the same mtime tick as the scan would go unnoticed,
+	// the directory is only trusted once it was quiet for a while
+	if scanned.Sub(dir.ModTime()) > time.Second {
+		idx.Mtime = dir.ModTime().UnixNano()
+	}
+
+	var names []string
+	for name, info := range infos {
+		if !strings.HasSuffix(name, ".eml") {
+			continue
+		}
+		e := old.Messages[name]
+		if e == nil || e.Size != info.Size() || e.Mod != info.ModTime().UnixNano() {
+			names = append(names, name)
+			continue
+		}
+		if mod := flagsMod(name); e.FlagsMod != mod {
+			e.Flags = s.loadFlags(filepath.Join(path, name))
+			e.FlagsMod = mod
+		}
+		idx.Messages[name] = e
+	}
+
+	loaded := make([]*indexEntry, len(names))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(scanWorkers, len(names)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if msg, err := s.loadMessage(filepath.Join(path, names[i])); err == nil {
+					loaded[i] = newIndexEntry(msg, infos[names[i]], flagsMod(names[i]))
+				}
+			}
+		}()
+	}
+	for i := range names {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	for i, e := range loaded {
+		if e != nil {
+			idx.Messages[names[i]] = e
+		}
+	}
+	return idx, nil
+}
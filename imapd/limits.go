@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/mpdroog/mymail/imapd/config"
+)
+
+// checkNumSet refuses sequence and UID sets with more ranges than
+// max_set_ranges, every message is matched against all of them
+func checkNumSet(numSet imap.NumSet) error {
+	n := 0
+	switch ns := numSet.(type) {
+	case imap.SeqSet:
+		n = len(ns)
+	case imap.UIDSet:
+		n = len(ns)
+	}
+	if n > config.C.MaxSetRanges {
+		return &imap.Error{
+			Type: imap.StatusResponseTypeBad,
+			Text: fmt.Sprintf("Sets are limited to %d ranges", config.C.MaxSetRanges),
+		}
+	}
+	return nil
+}
+
+// checkSearch refuses criteria with more terms than max_search_terms,
+// counting nested NOT and OR and the ranges of sets
+func checkSearch(criteria *imap.SearchCriteria) error {
+	if n := searchTerms(criteria); n > config.C.MaxSearchTerms {
+		return &imap.Error{
+			Type: imap.StatusResponseTypeBad,
+			Text: fmt.Sprintf("SEARCH is limited to %d terms", config.C.MaxSearchTerms),
+		}
+	}
+	return nil
+}
+
+func searchTerms(c *imap.SearchCriteria) int {
+	if c == nil {
+		return 0
+	}
+	n := len(c.Header) + len(c.Body) + len(c.Text) + len(c.Flag) + len(c.NotFlag)
+	for _, s := range c.SeqNum {
+		n += len(s)
+	}
+	for _, s := range c.UID {
+		n += len(s)
+	}
+	for i := range c.Not {
+		n += 1 + searchTerms(&c.Not[i])
+	}
+	for i := range c.Or {
+		n += 1 + searchTerms(&c.Or[i][0]) + searchTerms(&c.Or[i][1])
+	}
+	return n
+}
+
+// checkAppend refuses messages over max_append_size before storing them,
+// the client still sends the literal but it isn't kept
+func checkAppend(size int64) error {
+	if size > config.C.MaxAppendSize {
+		return &imap.Error{
+			Type: imap.StatusResponseTypeNo,
+			Code: imap.ResponseCodeTooBig,
+			Text: fmt.Sprintf("Messages are limited to %s", config.C.MaxAppendSizeStr),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/mpdroog/mymail/imapd/config"
+	"github.com/mpdroog/mymail/smtpd/lockout"
+	"github.com/mpdroog/mymail/smtpd/logging"
+)
+
+// lockedUntil returns until when user is locked out, zero if not
+func lockedUntil(user string) time.Time {
+	return lockout.Locked(config.C.LockoutDir, user)
+}
+
+// loginFailed counts a failed login over protocol towards the account
+// lockout and tells the user and config.C.LockoutAdmin when it locks the
+// account
+func (srv *Server) loginFailed(user, protocol, ip string) {
+	policy := lockout.Policy{
+		Threshold: config.C.LockoutThreshold,
+		Window:    config.C.LockoutWindow,
+		Duration:  config.C.LockoutDuration,
+	}
+	f := lockout.Failure{Time: time.Now(), Protocol: protocol, IP: ip}
+	st, locked, err := lockout.Fail(config.C.LockoutDir, user, f, policy)
+	if err != nil {
+		log.Printf(logging.Err+"lockout.Fail e=%v", err)
+		return
+	}
+	if !locked {
+		return
+	}
+	log.Printf(logging.Warning+"Account %s locked until %s after %d failed logins", user, st.LockedUntil, len(st.Failures))
+
+	from := "MAILER-DAEMON@" + config.C.Domain
+	to := user + "@" + config.C.Domain
+	if err := srv.storage.Deliver(user, "INBOX", lockout.Notice(st, from, to, "")); err != nil {
+		log.Printf(logging.Err+"loginFailed::Deliver e=%v", err)
+	}
+	if admin := config.C.LockoutAdmin; admin != "" {
+		if err := srv.storage.Deliver(admin, "INBOX", lockout.Alert(st, from, admin+"@"+config.C.Domain)); err != nil {
+			log.Printf(logging.Err+"loginFailed::Deliver e=%v", err)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+// MailStore is what a Session needs from the place mail is kept. Storage,
+// the maildir shared with smtpd, is the backend; the interface keeps
+// sessions from depending on its layout so they can run against a fake in
+// tests and other backends (SQLite, S3, encrypted) can be added later.
+//
+// Mailboxes are named by user and mailbox, messages by Message.Path which
+// is a key only the backend interprets.
+type MailStore interface {
+	// Mailboxes
+	Migrate(username string) error
+	EnsureMailbox(username, mailbox string) error
+	DeleteMailbox(username, mailbox string) error
+	RenameMailbox(username, mailbox, newName string) error // os.ErrNotExist or os.ErrExist for the obvious
+	ListMailboxes(username string) ([]string, error)
+	GetMailbox(username, mailbox string) (*Mailbox, error)
+	Keywords(username, mailbox string) ([]string, error) // Set on any message, for the label mailboxes
+	UIDValidity(username, mailbox string) uint32
+	Subscriptions(username string) ([]string, error) // nil means all mailboxes
+	SetSubscribed(username, mailbox string, subscribed bool) error
+	SavedSearches(username string) (map[string]string, error) // By name the SEARCH criteria
+
+	// Messages
+	AppendMessage(username, mailbox string, r io.Reader, size int64, date time.Time, flags []imap.Flag) (imap.UID, error)
+	Deliver(username, mailbox string, data []byte) error
+	CopyMessage(username, mailbox string, msg *Message) (imap.UID, error)
+	MoveMessage(username, mailbox string, msg *Message) (imap.UID, error)
+	TrashMessage(username, mailbox, path string) error
+	GetRawMessage(path string) ([]byte, error)
+	OpenMessage(path string) (io.ReadSeekCloser, int64, error) // With its size, for streaming BODY[]
+	SaveFlags(path string, flags []imap.Flag) error
+	SaveFlagsBatch(paths []string, flags [][]imap.Flag) []error
+
+	// Watch returns a fingerprint of the mailbox that changes with its
+	// contents and the paths of its messages, see Session.sync
+	Watch(username, mailbox string) (stamp, map[string]bool, error)
+	loadMessage(path string) (*Message, error)
+	loadFlags(path string) []imap.Flag
+}
+
+var _ MailStore = (*Storage)(nil)
+
+// Watch scans the mailbox directory
+func (s *Storage) Watch(username, mailbox string) (stamp, map[string]bool, error) {
+	path, err := s.MailboxPath(username, mailbox)
+	if err != nil {
+		return stamp{}, nil, err
+	}
+	return scanMailbox(path)
+}
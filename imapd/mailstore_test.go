@@ -0,0 +1,155 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/mpdroog/mymail/imapd/config"
+	"github.com/mpdroog/mymail/smtpd/users"
+)
+
+// literal is an APPEND literal
+type literal struct {
+	*strings.Reader
+}
+
+func (l literal) Size() int64 { return l.Reader.Size() }
+
+// TestSessionMemStore runs APPEND, SELECT, COPY and EXPUNGE against memStore
+func TestSessionMemStore(t *testing.T) {
+	config.C.MaxAppendSize, config.C.MaxSetRanges = 1<<20, 1000
+	st := newMemStore()
+	s := &Session{server: NewServer(nil, st), username: "mark"}
+	for _, name := range []string{"INBOX", "Archive"} {
+		if err := s.Create(name, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, body := range []string{"Subject: a\r\n\r\na", "Subject: b\r\n\r\nb"} {
+		if _, err := s.Append("INBOX", literal{strings.NewReader(body)}, &imap.AppendOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sel, err := s.Select("INBOX", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sel.NumMessages != 2 || sel.UIDNext != 3 {
+		t.Errorf("select messages=%d uidnext=%d", sel.NumMessages, sel.UIDNext)
+	}
+
+	data, err := s.Copy(imap.SeqSetNum(2), "Archive")
+	if err != nil || data == nil || data.DestUIDs.String() != "1" {
+		t.Errorf("copy=%v e=%v", data, err)
+	}
+
+	s.mailbox.Messages[0].Flags = []imap.Flag{imap.FlagDeleted}
+	if err := s.Expunge(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if mbox, _ := st.GetMailbox("mark", "INBOX"); len(mbox.Messages) != 1 || mbox.Messages[0].UID != 2 {
+		t.Errorf("after expunge %v", mbox.Messages)
+	}
+}
+
+// TestMailboxAliases checks Outlook's names reach the special mailboxes
+func TestMailboxAliases(t *testing.T) {
+	config.C.MaxAppendSize = 1 << 20
+	config.C.MailboxAliases = map[string]string{"Sent Items": "Sent", "Deleted Items": "Trash"}
+	defer func() { config.C.MailboxAliases = nil }()
+	st := newMemStore()
+	s := &Session{server: NewServer(nil, st), username: "mark"}
+	if err := ensureFolders(st, "mark"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Create("Sent Items", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Append("Sent Items", literal{strings.NewReader("Subject: a\r\n\r\na")}, &imap.AppendOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	status, err := s.Status("Sent Items", &imap.StatusOptions{NumMessages: true})
+	if err != nil || status.Mailbox != "Sent Items" || *status.NumMessages != 1 {
+		t.Errorf("status=%+v e=%v", status, err)
+	}
+	if mailboxes, _ := st.ListMailboxes("mark"); len(mailboxes) != len(users.Folders) {
+		t.Errorf("mailboxes %v, expect no Sent Items", mailboxes)
+	}
+
+	patterns := map[string]bool{"Deleted Items": true, "Trash": false}
+	for mailbox, refused := range patterns {
+		if err := s.Delete(mailbox); (err != nil) != refused {
+			t.Errorf("Delete(%s) e=%v", mailbox, err)
+		}
+	}
+}
+
+// TestAllMail checks the views leave out Trash and keep their UIDs when
+// mail arrives
+func TestAllMail(t *testing.T) {
+	config.C.MaxAppendSize = 1 << 20
+	config.C.AllMailbox, config.C.LabelPrefix = "All Mail", "Labels"
+	defer func() { config.C.AllMailbox, config.C.LabelPrefix = "", "" }()
+	st := newMemStore()
+	s := &Session{server: NewServer(nil, st), username: "mark"}
+	for _, name := range []string{"INBOX", "Archive", "Trash"} {
+		if err := st.EnsureMailbox("mark", name); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Append(name, literal{strings.NewReader("Subject: " + name + "\r\n\r\nhi")}, &imap.AppendOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := st.SaveFlags("mark/Archive/1", []imap.Flag{imap.FlagSeen, "$Work"}); err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := s.Select("All Mail", nil)
+	if err != nil || all.NumMessages != 2 || all.UIDNext != 3 {
+		t.Fatalf("select=%+v e=%v", all, err)
+	}
+	if err := s.Expunge(nil, nil); err == nil {
+		t.Error("expunge in All Mail allowed")
+	}
+	work, err := s.getMailbox("Labels/$Work")
+	if err != nil || len(work.Messages) != 1 || work.Messages[0].Subject != "Archive" {
+		t.Fatalf("Labels/$Work=%+v e=%v", work, err)
+	}
+	archived := work.Messages[0].UID
+
+	if _, err := s.Append("Archive", literal{strings.NewReader("Subject: new\r\n\r\nhi")}, &imap.AppendOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	mbox, err := s.getMailbox("All Mail")
+	if err != nil || len(mbox.Messages) != 3 || mbox.UIDNext != 4 {
+		t.Fatalf("after append %+v e=%v", mbox, err)
+	}
+	for _, msg := range mbox.Messages {
+		if msg.Subject == "Archive" && msg.UID != archived {
+			t.Errorf("UID of Archive changed from %d to %d", archived, msg.UID)
+		}
+	}
+	if _, err := s.Append("All Mail", literal{strings.NewReader("Subject: x\r\n\r\nx")}, &imap.AppendOptions{}); err == nil {
+		t.Error("append to All Mail allowed")
+	}
+}
+
+// TestVirtualUIDsPrune checks gone messages are forgotten and their UIDs not
+// handed out again
+func TestVirtualUIDsPrune(t *testing.T) {
+	v := newVirtualUIDs()
+	a, b := &Message{Path: "a"}, &Message{Path: "b"}
+	v.assign("mark", []*Message{a, b}, map[string]bool{"a": true, "b": true})
+
+	c := &Message{Path: "c"}
+	next := v.assign("mark", []*Message{a, c}, map[string]bool{"a": true, "c": true})
+	if a.UID != 1 || c.UID != 3 || next != 4 {
+		t.Errorf("a=%d c=%d next=%d", a.UID, c.UID, next)
+	}
+	if n := len(v.users["mark"].uids); n != 2 {
+		t.Errorf("remembers %d messages, expect 2", n)
+	}
+}
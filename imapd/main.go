@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
@@ -12,47 +13,58 @@ import (
 	"github.com/emersion/go-imap/v2"
 	"github.com/emersion/go-imap/v2/imapserver"
 	"github.com/mpdroog/mymail/imapd/config"
+	"github.com/mpdroog/mymail/smtpd/certstore"
+	"github.com/mpdroog/mymail/smtpd/logging"
 )
 
 func main() {
 	configPath := flag.String("config", "config.json", "Path to configuration file")
+	demo := flag.Bool("demo", false, "Try imapd on 127.0.0.1:1143 as alice or bob (password demo), mail is kept in memory")
 	flag.BoolVar(&config.Verbose, "v", false, "Verbose-mode (log more)")
 	flag.Parse()
 
+	if *demo {
+		path, err := setupDemo()
+		if err != nil {
+			log.Fatalf(logging.Crit+"Failed to setup demo: %v", err)
+		}
+		*configPath = path
+	}
+
 	if err := config.Load(*configPath); err != nil {
-		log.Fatalf("Failed to load config: %v", err)
+		log.Fatalf(logging.Crit+"Failed to load config: %v", err)
 	}
 	if config.Verbose {
 		fmt.Printf("config.C=%+v\n", config.C)
 	}
+	if err := logging.Setup(config.C.LogOutput, config.C.SyslogAddr, "imapd"); err != nil {
+		log.Fatalf(logging.Crit+"Failed to setup logging: %v", err)
+	}
 
 	users, err := NewUserStore(config.C.AuthFile)
 	if err != nil {
-		log.Fatalf("Failed to load users: %v", err)
+		log.Fatalf(logging.Crit+"Failed to load users: %v", err)
 	}
 
-	storage, err := NewStorage(config.C.MailDir, config.C.Domain)
-	if err != nil {
-		log.Fatalf("Failed to initialize storage: %v", err)
+	var st MailStore
+	if *demo {
+		mem := newMemStore()
+		if err := seedDemo(mem); err != nil {
+			log.Fatalf(logging.Crit+"Failed to seed demo: %v", err)
+		}
+		st = mem
+	} else {
+		storage, err := NewStorage(config.C.MailDir, config.C.Domain)
+		if err != nil {
+			log.Fatalf(logging.Crit+"Failed to initialize storage: %v", err)
+		}
+		startTrashPurge(storage)
+		st = storage
 	}
 
-	srv := NewServer(users, storage)
-
-	caps := make(imap.CapSet)
-	caps[imap.CapIMAP4rev1] = struct{}{}
-
-	opts := &imapserver.Options{
-		NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
-			return srv.NewSession(), nil, nil
-		},
-		Caps:         caps,
-		InsecureAuth: config.C.InsecureAuth,
-	}
-	if config.Verbose {
-		opts.DebugWriter = os.Stdout
-	}
+	srv := NewServer(users, st)
 
-	imapSrv := imapserver.New(opts)
+	opts := serverOptions(srv)
 
 	// Handle SIGHUP for config reload
 	sigs := make(chan os.Signal, 1)
@@ -61,18 +73,87 @@ func main() {
 		for range sigs {
 			log.Println("Reloading configuration...")
 			if err := users.Reload(); err != nil {
-				log.Printf("Failed to reload users: %v", err)
+				log.Printf(logging.Err+"Failed to reload users: %v", err)
 			}
 			log.Println("Configuration reloaded")
 		}
 	}()
 
 	if config.C.InsecureAuth {
-		log.Println("WARNING: Insecure auth enabled (no TLS required)")
+		log.Println(logging.Warning + "WARNING: Insecure auth enabled (no TLS required)")
+	}
+
+	if config.C.AdminAddr != "" {
+		if _, err := startAdmin(srv); err != nil {
+			log.Fatalf(logging.Crit+"Failed to start admin service: %v", err)
+		}
+	}
+
+	listeners := append([]config.Listener{{
+		Addr:    config.C.ListenAddr,
+		TLSCert: config.C.TLSCert,
+		TLSKey:  config.C.TLSKey,
+	}}, config.C.Listeners...)
+	pairs := make([]certstore.Pair, len(listeners))
+	for i, l := range listeners {
+		pairs[i] = certstore.Pair{Cert: l.TLSCert, Key: l.TLSKey}
+	}
+	certs, err := certstore.Load(pairs, certstore.Pair{Cert: config.C.TLSCert, Key: config.C.TLSKey})
+	if err != nil {
+		log.Fatalf(logging.Crit+"Failed to load certificates: %v", err)
+	}
+
+	var store *certstore.Store
+	if config.C.CertDir != "" {
+		store = certstore.New(config.C.CertDir)
+	}
+
+	// One imapserver per listener, the STARTTLS certificate is an option
+	errs := make(chan error, len(listeners))
+	for i, l := range listeners {
+		lopts := *opts
+		if certs[i] != nil {
+			lopts.TLSConfig = &tls.Config{Certificates: certstore.SNI(certs, i)}
+			if store != nil {
+				lopts.TLSConfig.GetCertificate = store.GetCertificate
+			}
+		}
+		ln, err := srv.Listen(l.Addr, l.Hostname)
+		if err != nil {
+			log.Fatalf(logging.Crit+"Failed to listen: %v", err)
+		}
+		log.Printf("IMAP server listening on %s", l.Addr)
+		go func() {
+			errs <- imapserver.New(&lopts).Serve(ln)
+		}()
 	}
 
 	daemon.SdNotify(false, daemon.SdNotifyReady)
-	if err := imapSrv.ListenAndServe(config.C.ListenAddr); err != nil {
-		log.Fatalf("Server error: %v", err)
+	if err := <-errs; err != nil {
+		log.Fatalf(logging.Crit+"Server error: %v", err)
+	}
+}
+
+// serverOptions are the imapserver options of srv, the same on every listener
+func serverOptions(srv *Server) *imapserver.Options {
+	caps := make(imap.CapSet)
+	caps[imap.CapIMAP4rev1] = struct{}{}
+	caps[imap.CapESearch] = struct{}{}
+	caps[imap.CapSearchRes] = struct{}{}
+	caps[imap.CapSpecialUse] = struct{}{}
+	caps[imap.CapBinary] = struct{}{}
+	caps[imap.CapUIDPlus] = struct{}{}
+	caps[imap.CapMove] = struct{}{}
+
+	opts := &imapserver.Options{
+		NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			return srv.NewSession(conn), nil, nil
+		},
+		Caps:         caps,
+		InsecureAuth: config.C.InsecureAuth,
+	}
+	if config.Verbose {
+		opts.DebugWriter = os.Stdout
 	}
+	return opts
 }
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"maps"
+	"net/mail"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+// memStore is a volatile MailStore for tests and -demo, everything is gone
+// when imapd stops. Message.Path is "user/mailbox/uid".
+type memStore struct {
+	mu        sync.Mutex
+	mailboxes map[string]map[imap.UID]*Message // By "user/mailbox"
+	uidNext   map[string]imap.UID
+	subs      map[string][]string          // By user, see Storage.Subscriptions
+	searches  map[string]map[string]string // By user, see Storage.SavedSearches
+	changes   int
+}
+
+var _ MailStore = (*memStore)(nil)
+
+func newMemStore() *memStore {
+	return &memStore{mailboxes: make(map[string]map[imap.UID]*Message), uidNext: make(map[string]imap.UID), subs: make(map[string][]string), searches: make(map[string]map[string]string)}
+}
+
+func (m *memStore) Migrate(username string) error { return nil }
+
+func (m *memStore) EnsureMailbox(username, mailbox string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if key := username + "/" + mailbox; m.mailboxes[key] == nil {
+		m.mailboxes[key] = make(map[imap.UID]*Message)
+		m.uidNext[key] = 1
+	}
+	return nil
+}
+
+func (m *memStore) DeleteMailbox(username, mailbox string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.mailboxes, username+"/"+mailbox)
+	return nil
+}
+
+func (m *memStore) RenameMailbox(username, mailbox, newName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	src, dst := username+"/"+mailbox, username+"/"+newName
+	if m.mailboxes[src] == nil {
+		return os.ErrNotExist
+	}
+	if m.mailboxes[dst] != nil {
+		return os.ErrExist
+	}
+
+	// Inferiors move along, except those of INBOX
+	inbox := strings.EqualFold(mailbox, "INBOX")
+	var keys []string
+	for key := range m.mailboxes {
+		if key == src || !inbox && strings.HasPrefix(key, src+"/") {
+			keys = append(keys, key)
+		}
+	}
+	for _, key := range keys {
+		to := dst + key[len(src):]
+		for _, msg := range m.mailboxes[key] {
+			msg.Path = fmt.Sprintf("%s/%d", to, msg.UID)
+		}
+		m.mailboxes[to], m.uidNext[to] = m.mailboxes[key], m.uidNext[key]
+		delete(m.mailboxes, key)
+		if !inbox {
+			delete(m.uidNext, key)
+		}
+	}
+	if inbox {
+		// UIDs continue, memStore has one UIDVALIDITY for all
+		m.mailboxes[src] = make(map[imap.UID]*Message)
+	}
+	m.changes++
+	return nil
+}
+
+func (m *memStore) ListMailboxes(username string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var names []string
+	for key := range m.mailboxes {
+		if name, ok := strings.CutPrefix(key, username+"/"); ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (m *memStore) Subscriptions(username string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.subs[username]), nil
+}
+
+func (m *memStore) SetSubscribed(username, mailbox string, subscribed bool) error {
+	subs, _ := m.Subscriptions(username)
+	if subs == nil {
+		subs, _ = m.ListMailboxes(username)
+	}
+	subs = slices.DeleteFunc(subs, func(s string) bool { return s == mailbox })
+	if subscribed {
+		subs = append(subs, mailbox)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.subs[username] = append([]string{}, subs...)
+	return nil
+}
+
+func (m *memStore) SavedSearches(username string) (map[string]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return maps.Clone(m.searches[username]), nil
+}
+
+func (m *memStore) GetMailbox(username, mailbox string) (*Mailbox, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := username + "/" + mailbox
+	msgs, ok := m.mailboxes[key]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	mbox := &Mailbox{Name: mailbox, UIDNext: m.uidNext[key], UIDValidity: 1}
+	for _, msg := range msgs {
+		cp := *msg
+		cp.Flags = append([]imap.Flag(nil), msg.Flags...)
+		mbox.Messages = append(mbox.Messages, &cp)
+	}
+	sort.Slice(mbox.Messages, func(i, j int) bool { return mbox.Messages[i].UID < mbox.Messages[j].UID })
+	for i, msg := range mbox.Messages {
+		msg.SeqNum = uint32(i + 1)
+	}
+	return mbox, nil
+}
+
+func (m *memStore) Keywords(username, mailbox string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []string
+	for _, msg := range m.mailboxes[username+"/"+mailbox] {
+		out = append(out, keywords(msg.Flags)...)
+	}
+	return out, nil
+}
+
+func (m *memStore) UIDValidity(username, mailbox string) uint32 { return 1 }
+
+func (m *memStore) AppendMessage(username, mailbox string, r io.Reader, size int64, date time.Time, flags []imap.Flag) (imap.UID, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	msg := &Message{Flags: slices.Clone(flags), Date: date, Size: int64(len(data)), raw: data}
+	// The headers Storage.loadMessage keeps, for SEARCH
+	if parsed, err := mail.ReadMessage(bytes.NewReader(data)); err == nil {
+		h := parsed.Header
+		if t, err := mail.ParseDate(h.Get("Date")); err == nil {
+			msg.Date = t
+		}
+		msg.From, msg.Subject = h.Get("From"), h.Get("Subject")
+	}
+	return m.add(username+"/"+mailbox, msg)
+}
+
+func (m *memStore) Deliver(username, mailbox string, data []byte) error {
+	_, err := m.AppendMessage(username, mailbox, bytes.NewReader(data), int64(len(data)), time.Now(), nil)
+	return err
+}
+
+func (m *memStore) add(key string, msg *Message) (imap.UID, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.mailboxes[key] == nil {
+		return 0, os.ErrNotExist
+	}
+	msg.UID = m.uidNext[key]
+	msg.Path = fmt.Sprintf("%s/%d", key, msg.UID)
+	m.uidNext[key]++
+	m.mailboxes[key][msg.UID] = msg
+	m.changes++
+	return msg.UID, nil
+}
+
+func (m *memStore) find(path string) *Message {
+	key := path[:strings.LastIndex(path, "/")]
+	for _, msg := range m.mailboxes[key] {
+		if msg.Path == path {
+			return msg
+		}
+	}
+	return nil
+}
+
+func (m *memStore) CopyMessage(username, mailbox string, msg *Message) (imap.UID, error) {
+	m.mu.Lock()
+	src := m.find(msg.Path)
+	m.mu.Unlock()
+	if src == nil {
+		return 0, os.ErrNotExist
+	}
+	cp := *src
+	cp.Flags = append([]imap.Flag(nil), msg.Flags...)
+	return m.add(username+"/"+mailbox, &cp)
+}
+
+func (m *memStore) MoveMessage(username, mailbox string, msg *Message) (imap.UID, error) {
+	uid, err := m.CopyMessage(username, mailbox, msg)
+	if err != nil {
+		return 0, err
+	}
+	return uid, m.TrashMessage(username, mailbox, msg.Path)
+}
+
+func (m *memStore) TrashMessage(username, mailbox, path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	msg := m.find(path)
+	if msg == nil {
+		return os.ErrNotExist
+	}
+	delete(m.mailboxes[path[:strings.LastIndex(path, "/")]], msg.UID)
+	m.changes++
+	return nil
+}
+
+func (m *memStore) GetRawMessage(path string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if msg := m.find(path); msg != nil {
+		return msg.raw, nil
+	}
+	return nil, os.ErrNotExist
+}
+
+func (m *memStore) OpenMessage(path string) (io.ReadSeekCloser, int64, error) {
+	raw, err := m.GetRawMessage(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	return nopCloser{bytes.NewReader(raw)}, int64(len(raw)), nil
+}
+
+type nopCloser struct {
+	*bytes.Reader
+}
+
+func (nopCloser) Close() error { return nil }
+
+func (m *memStore) SaveFlags(path string, flags []imap.Flag) error {
+	if path == "" {
+		// Nothing to write, like Storage.SaveFlags
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	msg := m.find(path)
+	if msg == nil {
+		return os.ErrNotExist
+	}
+	msg.Flags = append([]imap.Flag(nil), flags...)
+	m.changes++
+	return nil
+}
+
+func (m *memStore) SaveFlagsBatch(paths []string, flags [][]imap.Flag) []error {
+	var errs []error
+	for i, path := range paths {
+		if err := m.SaveFlags(path, flags[i]); err != nil {
+			if errs == nil {
+				errs = make([]error, len(paths))
+			}
+			errs[i] = err
+		}
+	}
+	return errs
+}
+
+func (m *memStore) Watch(username, mailbox string) (stamp, map[string]bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	paths := make(map[string]bool)
+	for _, msg := range m.mailboxes[username+"/"+mailbox] {
+		paths[msg.Path] = true
+	}
+	return stamp{n: m.changes}, paths, nil
+}
+
+func (m *memStore) loadMessage(path string) (*Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if msg := m.find(path); msg != nil {
+		cp := *msg
+		return &cp, nil
+	}
+	return nil, os.ErrNotExist
+}
+
+func (m *memStore) loadFlags(path string) []imap.Flag {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if msg := m.find(path); msg != nil {
+		return append([]imap.Flag(nil), msg.Flags...)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"runtime"
+	"unsafe"
+
+	"github.com/mpdroog/mymail/imapd/config"
+	"github.com/mpdroog/mymail/smtpd/tracker"
+)
+
+// Metrics are the gauges of GET /metrics, enough to see a small VPS run out
+// of memory before it does
+type Metrics struct {
+	Connections    int64  `json:"connections"`
+	MaxConnections int    `json:"max_connections"`
+	Goroutines     int    `json:"goroutines"`
+	Buffered       int64  `json:"buffered"` // APPENDs held in memory, bytes
+	Cached         int64  `json:"cached"`   // Selected mailboxes, estimated bytes
+	HeapAlloc      uint64 `json:"heap_alloc"`
+	Sys            uint64 `json:"sys"` // Memory obtained from the OS
+}
+
+// Metrics returns the current gauges
+func (srv *Server) Metrics() Metrics {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	m := Metrics{
+		Connections:    srv.conns.Load(),
+		MaxConnections: config.C.MaxConnections,
+		Goroutines:     runtime.NumGoroutine(),
+		HeapAlloc:      ms.HeapAlloc,
+		Sys:            ms.Sys,
+	}
+	srv.Each(func(t tracker.Session) {
+		sess := t.(*Session)
+		m.Buffered += sess.buffered.Load()
+		m.Cached += sess.cached.Load()
+	})
+	return m
+}
+
+// memory estimates what mbox takes in memory, the Message structs and the
+// strings and slices they point to
+func (mbox *Mailbox) memory() int64 {
+	n := int64(unsafe.Sizeof(*mbox))
+	for _, msg := range mbox.Messages {
+		n += int64(unsafe.Sizeof(*msg)) + int64(unsafe.Sizeof(msg))
+		n += int64(len(msg.Path) + len(msg.From) + len(msg.Subject) + len(msg.raw))
+		for _, f := range msg.Flags {
+			n += int64(unsafe.Sizeof(f)) + int64(len(f))
+		}
+	}
+	return n
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// migration upgrades the storage of one user to version
+type migration struct {
+	version int
+	name    string
+	run     func(s *Storage, username string) error
+}
+
+// migrations run in order on the first login after an upgrade, append new
+// ones with the next version. They may be interrupted and rerun so must
+// be idempotent.
+var migrations = []migration{
+	{1, "standard folders", migrateFolders},
+	{2, "orphaned flags", migrateOrphanFlags},
+}
+
+// migrateMu keeps concurrent logins of a user in this process apart, the
+// flock in Migrate covers other processes
+var migrateMu sync.Mutex
+
+// Migrate brings the storage of username up to the latest version, recorded
+// in the .version file of the user directory
+func (s *Storage) Migrate(username string) error {
+	dir := s.userDir(username)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	migrateMu.Lock()
+	defer migrateMu.Unlock()
+
+	lock, err := os.OpenFile(filepath.Join(dir, ".migrate.lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+
+	current := 0
+	if data, err := os.ReadFile(filepath.Join(dir, ".version")); err == nil {
+		if current, err = strconv.Atoi(strings.TrimSpace(string(data))); err != nil {
+			return fmt.Errorf("%s/.version: %v", dir, err)
+		}
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		log.Printf("Migrating %s to version %d (%s)", username, m.version, m.name)
+		if err := m.run(s, username); err != nil {
+			return fmt.Errorf("migration %d (%s): %v", m.version, m.name, err)
+		}
+		// Record each step so a failure later on resumes from here
+		tmp := filepath.Join(dir, ".version.tmp")
+		if err := os.WriteFile(tmp, []byte(strconv.Itoa(m.version)), 0600); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, filepath.Join(dir, ".version")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateFolders creates the folders `mymail user add` sets up for accounts
+// that predate it
+func migrateFolders(s *Storage, username string) error {
+	return ensureFolders(s, username)
+}
+
+// migrateOrphanFlags removes .flags files whose message is gone, left by
+// DeleteMessage when removing the .eml failed halfway
+func migrateOrphanFlags(s *Storage, username string) error {
+	matches, err := filepath.Glob(filepath.Join(s.userDir(username), "*", "*.eml.flags"))
+	if err != nil {
+		return err
+	}
+	for _, flags := range matches {
+		if _, err := os.Stat(strings.TrimSuffix(flags, ".flags")); os.IsNotExist(err) {
+			if err := os.Remove(flags); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	base := t.TempDir()
+	s, _ := NewStorage(base, "example.com")
+	inbox := mailboxPath(s, "mark", "INBOX")
+	os.MkdirAll(inbox, 0700)
+	os.WriteFile(filepath.Join(inbox, "1_1.eml"), []byte("Subject: kept\r\n\r\n"), 0600)
+	os.WriteFile(filepath.Join(inbox, "1_1.eml.flags"), []byte(`\Seen`), 0600)
+	os.WriteFile(filepath.Join(inbox, "1_2.eml.flags"), []byte(`\Seen`), 0600)
+
+	// Twice, the second run has nothing to do
+	for i := 0; i < 2; i++ {
+		if err := s.Migrate("mark"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	version, _ := os.ReadFile(filepath.Join(base, "example.com", "mark", ".version"))
+	if string(version) != "2" {
+		t.Errorf("version=%q", version)
+	}
+	if _, err := os.Stat(mailboxPath(s, "mark", "Sent")); err != nil {
+		t.Errorf("Sent not created e=%v", err)
+	}
+	if _, err := os.Stat(filepath.Join(inbox, "1_1.eml.flags")); err != nil {
+		t.Errorf("flags of existing message removed")
+	}
+	if _, err := os.Stat(filepath.Join(inbox, "1_2.eml.flags")); !os.IsNotExist(err) {
+		t.Errorf("orphaned flags kept")
+	}
+}
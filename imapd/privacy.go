@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"regexp"
+	"strings"
+
+	"github.com/mpdroog/mymail/imapd/config"
+)
+
+// blockedImage replaces remote image URLs (1x1 transparent GIF)
+const blockedImage = "data:image/gif;base64,R0lGODlhAQABAIAAAAAAAP///yH5BAEAAAAALAAAAAABAAEAAAIBRAA7"
+
+var (
+	imgTagRe     = regexp.MustCompile(`(?is)<img\b[^>]*>`)
+	pixelRe      = regexp.MustCompile(`(?is)\b(?:width|height)\s*=\s*["']?\s*[01](?:px)?\b|display\s*:\s*none`)
+	remoteAttrRe = regexp.MustCompile(`(?i)(\b(?:src|background)\s*=\s*)(["']?)(?:https?:)?//[^"'\s>]*(["']?)`)
+	remoteCSSRe  = regexp.MustCompile(`(?i)url\(\s*(["']?)(?:https?:)?//[^)"']*(["']?)\s*\)`)
+)
+
+// isPrivacyUser returns true if remote content should be blocked for username
+func isPrivacyUser(username string) bool {
+	for _, u := range config.C.PrivacyUsers {
+		if strings.EqualFold(u, username) {
+			return true
+		}
+	}
+	return false
+}
+
+// sanitizeHTML drops tracking pixels and points remote images to a local placeholder
+func sanitizeHTML(html []byte) []byte {
+	html = imgTagRe.ReplaceAllFunc(html, func(tag []byte) []byte {
+		if pixelRe.Match(tag) {
+			return nil
+		}
+		return tag
+	})
+	html = remoteAttrRe.ReplaceAll(html, []byte("${1}${2}"+blockedImage+"${3}"))
+	html = remoteCSSRe.ReplaceAll(html, []byte("url(${1}"+blockedImage+"${2})"))
+	return html
+}
+
+// sanitizeMessage rewrites all text/html parts of a raw message with sanitizeHTML.
+// The top-level header is kept as-is, on parse errors the original is returned.
+func sanitizeMessage(data []byte) []byte {
+	sep := []byte("\r\n\r\n")
+	idx := bytes.Index(data, sep)
+	if idx == -1 {
+		sep = []byte("\n\n")
+		idx = bytes.Index(data, sep)
+	}
+	if idx == -1 {
+		return data
+	}
+
+	header, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(data[:idx+len(sep)]))).ReadMIMEHeader()
+	if err != nil {
+		return data
+	}
+
+	body, err := sanitizeEntity(header, data[idx+len(sep):])
+	if err != nil {
+		return data
+	}
+
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:idx+len(sep)]...)
+	return append(out, body...)
+}
+
+func sanitizeEntity(header textproto.MIMEHeader, body []byte) ([]byte, error) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		// No (valid) Content-Type means text/plain
+		return body, nil
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		return sanitizeMultipart(body, params["boundary"])
+	}
+	if mediaType != "text/html" {
+		return body, nil
+	}
+
+	cte := strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding")))
+	decoded, err := decodeTransfer(cte, body)
+	if err != nil {
+		return nil, err
+	}
+	return encodeTransfer(cte, sanitizeHTML(decoded))
+}
+
+func sanitizeMultipart(body []byte, boundary string) ([]byte, error) {
+	if boundary == "" {
+		return body, nil
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	if err := mw.SetBoundary(boundary); err != nil {
+		return nil, err
+	}
+
+	mr := multipart.NewReader(bytes.NewReader(body), boundary)
+	for {
+		part, err := mr.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		raw, err := io.ReadAll(part)
+		if err != nil {
+			return nil, err
+		}
+		partBody, err := sanitizeEntity(part.Header, raw)
+		if err != nil {
+			return nil, err
+		}
+		pw, err := mw.CreatePart(part.Header)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := pw.Write(partBody); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeTransfer(cte string, body []byte) ([]byte, error) {
+	switch cte {
+	case "base64":
+		return io.ReadAll(base64.NewDecoder(base64.StdEncoding, newlineStripper(body)))
+	case "quoted-printable":
+		return io.ReadAll(quotedprintable.NewReader(bytes.NewReader(body)))
+	}
+	return body, nil
+}
+
+func encodeTransfer(cte string, body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	switch cte {
+	case "base64":
+		enc := base64.StdEncoding.EncodeToString(body)
+		for len(enc) > 76 {
+			buf.WriteString(enc[:76] + "\r\n")
+			enc = enc[76:]
+		}
+		buf.WriteString(enc + "\r\n")
+	case "quoted-printable":
+		w := quotedprintable.NewWriter(&buf)
+		if _, err := w.Write(body); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	default:
+		buf.Write(body)
+	}
+	return buf.Bytes(), nil
+}
+
+func newlineStripper(body []byte) io.Reader {
+	return strings.NewReader(strings.NewReplacer("\r", "", "\n", "").Replace(string(body)))
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitizeHTML(t *testing.T) {
+	patterns := map[string]string{
+		`<p>Hi</p><img src="https://t.example/p.gif" width="1" height="1">`: `<p>Hi</p>`,
+		`<img src="https://cdn.example/logo.png" alt="logo">`:               `<img src="` + blockedImage + `" alt="logo">`,
+		`<td background='http://cdn.example/bg.png'>`:                       `<td background='` + blockedImage + `'>`,
+		`<div style="background:url(https://cdn.example/bg.png)">`:          `<div style="background:url(` + blockedImage + `)">`,
+		`<img src="cid:part1@example">`:                                     `<img src="cid:part1@example">`,
+	}
+	for in, expect := range patterns {
+		if out := string(sanitizeHTML([]byte(in))); out != expect {
+			t.Errorf("sanitizeHTML(%s)=%s expect=%s", in, out, expect)
+		}
+	}
+}
+
+func TestSanitizeMessage(t *testing.T) {
+	msg := "From: a@example.com\r\n" +
+		"Content-Type: multipart/alternative; boundary=b1\r\n" +
+		"\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"https://cdn.example/logo.png\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/html\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"<img src=3D\"https://cdn.example/logo.png\">\r\n" +
+		"--b1--\r\n"
+
+	out := string(sanitizeMessage([]byte(msg)))
+	if !strings.HasPrefix(out, "From: a@example.com\r\n") {
+		t.Errorf("header not preserved: %s", out)
+	}
+	if !strings.Contains(out, "\r\nhttps://cdn.example/logo.png\r\n") {
+		t.Errorf("text/plain part modified: %s", out)
+	}
+	if strings.Contains(out, "src=3D\"https://") {
+		t.Errorf("remote image not blocked: %s", out)
+	}
+}
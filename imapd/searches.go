@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/mpdroog/mymail/imapd/config"
+)
+
+// searchesFile holds the saved searches of a user as a JSON object of name
+// and SEARCH criteria, e.g. {"Unread": "UNSEEN", "Last 7 days": "YOUNGER 604800"}
+const searchesFile = ".searches"
+
+// SavedSearches returns the saved searches of username, none without a file
+func (s *Storage) SavedSearches(username string) (map[string]string, error) {
+	data, err := os.ReadFile(filepath.Join(s.userDir(username), searchesFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var searches map[string]string
+	if err := json.Unmarshal(data, &searches); err != nil {
+		return nil, fmt.Errorf("%s of %s: %v", searchesFile, username, err)
+	}
+	return searches, nil
+}
+
+// searchOf returns the name of a saved search mailbox, {search_prefix}/{name}
+func searchOf(mailbox string) (string, bool) {
+	if config.C.SearchPrefix == "" {
+		return "", false
+	}
+	name, ok := strings.CutPrefix(mailbox, config.C.SearchPrefix+"/")
+	return name, ok && name != ""
+}
+
+// searchMailbox builds the saved search name like all_mailbox, with only
+// the messages matching its criteria
+func (s *Session) searchMailbox(mailbox, name string) (*Mailbox, error) {
+	searches, err := s.server.storage.SavedSearches(s.username)
+	if err != nil {
+		return nil, err
+	}
+	query, ok := searches[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	criteria, err := parseSearch(query, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("saved search %s: %v", name, err)
+	}
+	return s.virtualMailbox(mailbox, func(msg *Message) bool {
+		return s.matchesCriteria(msg, criteria)
+	})
+}
+
+// searchFlags are the SEARCH keys that test a system flag, by key the flag
+// and whether it must be set
+var searchFlags = map[string]struct {
+	flag imap.Flag
+	set  bool
+}{
+	"ANSWERED":   {imap.FlagAnswered, true},
+	"UNANSWERED": {imap.FlagAnswered, false},
+	"DELETED":    {imap.FlagDeleted, true},
+	"UNDELETED":  {imap.FlagDeleted, false},
+	"DRAFT":      {imap.FlagDraft, true},
+	"UNDRAFT":    {imap.FlagDraft, false},
+	"FLAGGED":    {imap.FlagFlagged, true},
+	"UNFLAGGED":  {imap.FlagFlagged, false},
+	"SEEN":       {imap.FlagSeen, true},
+	"UNSEEN":     {imap.FlagSeen, false},
+}
+
+// parseSearch parses the SEARCH keys matchesCriteria can evaluate: the
+// flags, KEYWORD, UNKEYWORD, SINCE and BEFORE with a date like 1-Feb-2024,
+// and YOUNGER and OLDER (RFC 5032) in seconds before now
+func parseSearch(query string, now time.Time) (*imap.SearchCriteria, error) {
+	criteria := &imap.SearchCriteria{}
+	keys := strings.Fields(query)
+	for i := 0; i < len(keys); i++ {
+		key := strings.ToUpper(keys[i])
+		if f, ok := searchFlags[key]; ok {
+			if f.set {
+				criteria.Flag = append(criteria.Flag, f.flag)
+			} else {
+				criteria.NotFlag = append(criteria.NotFlag, f.flag)
+			}
+			continue
+		}
+		if key == "ALL" {
+			continue
+		}
+
+		if i+1 == len(keys) {
+			return nil, fmt.Errorf("unknown or incomplete key %s", keys[i])
+		}
+		i++
+		arg := keys[i]
+		switch key {
+		case "KEYWORD":
+			criteria.Flag = append(criteria.Flag, imap.Flag(arg))
+		case "UNKEYWORD":
+			criteria.NotFlag = append(criteria.NotFlag, imap.Flag(arg))
+		case "SINCE", "BEFORE":
+			t, err := time.ParseInLocation("2-Jan-2006", arg, now.Location())
+			if err != nil {
+				return nil, fmt.Errorf("invalid date %s", arg)
+			}
+			if key == "SINCE" {
+				criteria.Since = t
+			} else {
+				criteria.Before = t
+			}
+		case "YOUNGER", "OLDER":
+			n, err := strconv.ParseInt(arg, 10, 64)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid interval %s", arg)
+			}
+			t := now.Add(-time.Duration(n) * time.Second)
+			if key == "YOUNGER" {
+				criteria.Since = t
+			} else {
+				criteria.Before = t
+			}
+		default:
+			return nil, fmt.Errorf("unknown key %s", keys[i-1])
+		}
+	}
+	return criteria, nil
+}
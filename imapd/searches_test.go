@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/mpdroog/mymail/imapd/config"
+)
+
+func TestParseSearch(t *testing.T) {
+	now := time.Date(2024, 2, 10, 12, 0, 0, 0, time.UTC)
+	patterns := map[string]string{
+		"ALL":                          "[] [] - -",
+		"unseen":                       "[] [\\Seen] - -",
+		"FLAGGED UNDELETED":            "[\\Flagged] [\\Deleted] - -",
+		"KEYWORD $Work UNKEYWORD x":    "[$Work] [x] - -",
+		"SINCE 1-Feb-2024":             "[] [] 2024-02-01 00:00 -",
+		"YOUNGER 604800":               "[] [] 2024-02-03 12:00 -",
+		"OLDER 3600 BEFORE 9-Feb-2024": "[] [] - 2024-02-09 00:00",
+		"FROM mark":                    "error",
+		"KEYWORD":                      "error",
+		"SINCE yesterday":              "error",
+		"YOUNGER -1":                   "error",
+	}
+	format := func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return t.Format("2006-01-02 15:04")
+	}
+	for in, expect := range patterns {
+		out := "error"
+		if c, err := parseSearch(in, now); err == nil {
+			out = fmt.Sprintf("%v %v %s %s", c.Flag, c.NotFlag, format(c.Since), format(c.Before))
+		}
+		if out != expect {
+			t.Errorf("parseSearch(%s)=%s expect=%s", in, out, expect)
+		}
+	}
+}
+
+// TestSavedSearches checks a saved search lists under search_prefix and
+// holds the matching messages of the views
+func TestSavedSearches(t *testing.T) {
+	config.C.MaxAppendSize = 1 << 20
+	config.C.SearchPrefix = "Searches"
+	defer func() { config.C.SearchPrefix = "" }()
+	st := newMemStore()
+	st.searches["mark"] = map[string]string{"Unread": "UNSEEN", "Broken": "FROM mark"}
+	s := &Session{server: NewServer(nil, st), username: "mark"}
+	for _, name := range []string{"INBOX", "Archive", "Trash"} {
+		if err := st.EnsureMailbox("mark", name); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Append(name, literal{strings.NewReader("Subject: " + name + "\r\n\r\nhi")}, &imap.AppendOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := st.SaveFlags("mark/INBOX/1", []imap.Flag{imap.FlagSeen}); err != nil {
+		t.Fatal(err)
+	}
+
+	unread, err := s.Select("Searches/Unread", nil)
+	if err != nil || unread.NumMessages != 1 {
+		t.Fatalf("select=%+v e=%v", unread, err)
+	}
+	mbox, err := s.getMailbox("Searches/Unread")
+	if err != nil || mbox.Messages[0].Subject != "Archive" {
+		t.Fatalf("Searches/Unread=%+v e=%v", mbox, err)
+	}
+	if _, err := s.Select("Searches/Broken", nil); err == nil {
+		t.Error("select of an invalid search allowed")
+	}
+	if _, err := s.Select("Searches/Missing", nil); err == nil {
+		t.Error("select of a missing search allowed")
+	}
+	if _, err := s.Append("Searches/Unread", literal{strings.NewReader("Subject: x\r\n\r\nx")}, &imap.AppendOptions{}); err == nil {
+		t.Error("append to Searches/Unread allowed")
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"github.com/emersion/go-imap/v2"
+)
+
+// staticNumSet resolves what numSet means for the selected mailbox: "$"
+// becomes the result saved by SEARCH RETURN (SAVE) (RFC 5182) and "*" the
+// last message
+func (s *Session) staticNumSet(numSet imap.NumSet) imap.NumSet {
+	if uids, ok := numSet.(imap.UIDSet); ok && imap.IsSearchRes(uids) {
+		return s.searchRes
+	}
+	var lastSeq uint32
+	var lastUID imap.UID
+	if n := len(s.mailbox.Messages); n > 0 {
+		lastSeq, lastUID = uint32(n), s.mailbox.Messages[n-1].UID
+	}
+
+	switch ns := numSet.(type) {
+	case imap.SeqSet:
+		out := make(imap.SeqSet, len(ns))
+		for i, r := range ns {
+			out[i] = imap.SeqRange{Start: orLast(r.Start, lastSeq), Stop: orLast(r.Stop, lastSeq)}
+			if out[i].Start > out[i].Stop {
+				// "5:*" with 3 messages is "3:5"
+				out[i].Start, out[i].Stop = out[i].Stop, out[i].Start
+			}
+		}
+		return out
+	case imap.UIDSet:
+		out := make(imap.UIDSet, len(ns))
+		for i, r := range ns {
+			out[i] = imap.UIDRange{Start: orLast(r.Start, lastUID), Stop: orLast(r.Stop, lastUID)}
+			if out[i].Start > out[i].Stop {
+				out[i].Start, out[i].Stop = out[i].Stop, out[i].Start
+			}
+		}
+		return out
+	}
+	return numSet
+}
+
+// orLast replaces "*" (0) with last
+func orLast[T uint32 | imap.UID](n, last T) T {
+	if n == 0 {
+		return last
+	}
+	return n
+}
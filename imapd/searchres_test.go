@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+func TestStaticNumSet(t *testing.T) {
+	s := &Session{mailbox: &Mailbox{Messages: []*Message{
+		{SeqNum: 1, UID: 10}, {SeqNum: 2, UID: 20}, {SeqNum: 3, UID: 30},
+	}}}
+	s.searchRes = imap.UIDSetNum(20)
+
+	patterns := map[string]imap.NumSet{
+		"3":     imap.SeqSet{{Start: 0, Stop: 0}},
+		"2:3":   imap.SeqSet{{Start: 2, Stop: 0}},
+		"30":    imap.UIDSet{{Start: 0, Stop: 0}},
+		"25:30": imap.UIDSet{{Start: 25, Stop: 0}},
+		"30:40": imap.UIDSet{{Start: 40, Stop: 0}},
+		"20":    imap.SearchRes(),
+	}
+	for expect, in := range patterns {
+		if out := s.staticNumSet(in).String(); out != expect {
+			t.Errorf("staticNumSet(%s)=%s expect=%s", in, out, expect)
+		}
+	}
+}
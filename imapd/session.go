@@ -1,122 +1,449 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net"
 	"net/mail"
+	"os"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/emersion/go-imap/v2"
 	"github.com/emersion/go-imap/v2/imapserver"
+	"github.com/mpdroog/mymail/imapd/config"
+	"github.com/mpdroog/mymail/smtpd/activity"
+	"github.com/mpdroog/mymail/smtpd/lockout"
+	"github.com/mpdroog/mymail/smtpd/logging"
+	"github.com/mpdroog/mymail/smtpd/tracker"
+	"github.com/mpdroog/mymail/smtpd/users"
 )
 
 type Session struct {
-	server   *Server
-	username string
-	mailbox  *Mailbox
+	server    *Server
+	username  string
+	mailbox   *Mailbox
+	stamp     stamp             // Of mailbox when last synced, see idle.go
+	searchRes imap.UIDSet       // Saved by SEARCH RETURN (SAVE), see searchres.go
+	flags     []imap.Flag       // Of the last FLAGS response, see mailboxFlags
+	recent    map[imap.UID]bool // Arrived while selected, see sync
+	wake      <-chan struct{}   // Another session changed the mailbox, see hub.go
+	privacy   bool              // Block remote content in HTML parts
+
+	authFailures int // Failed logins on this connection
+
+	// Memory held for the session, see metrics.go
+	buffered atomic.Int64 // APPEND to Sent being indexed
+	cached   atomic.Int64 // Estimate of the selected mailbox
+
+	// Admin view, see tracker.go
+	id         uint64
+	conn       *imapserver.Conn
+	remoteAddr string
+	started    time.Time
+	mu         sync.Mutex
+	user       string
+	state      string
 }
 
 func (s *Session) Close() error {
+	s.server.hub.unsubscribe(s)
+	s.server.Remove(s.id)
 	return nil
 }
 
 func (s *Session) Login(username, password string) error {
-	if !s.server.users.Validate(username, password) {
+	// "user*admin" logs an admin in as user with the admin's own password
+	login := username
+	if target, master, ok := strings.Cut(username, "*"); ok {
+		username, login = target, master
+	}
+
+	// A locked account is refused before its password is hashed
+	locked := lockedUntil(login)
+	valid := locked.IsZero() && s.server.users.Validate(login, password)
+	acct, _ := s.server.users.Account(login)
+	switch {
+	case !locked.IsZero():
+		log.Printf(logging.Warning+"LOGIN for %s from %s refused, locked until %s", login, s.remoteAddr, locked)
+	case !valid:
+		if s.server.users.Exists(login) {
+			ip, _, _ := net.SplitHostPort(s.remoteAddr)
+			s.server.loginFailed(login, "imap", ip)
+		}
+	case login != username && (!acct.Has(users.RoleAdmin) || !s.server.users.Exists(username)):
+		log.Printf(logging.Warning+"LOGIN by %s as %s from %s refused, not an admin or no such user", login, username, s.remoteAddr)
+		valid = false
+	case login == username && !acct.CanIMAP():
+		log.Printf(logging.Warning+"LOGIN for send-only %s from %s refused", login, s.remoteAddr)
+		valid = false
+	}
+	if !valid {
+		log.Printf(logging.Warning+"LOGIN failed for %s from %s", username, s.remoteAddr)
+		s.authFailures++
+		lockout.Delay(config.C.AuthFailDelay)
+		if s.authFailures >= config.C.MaxAuthFailures {
+			s.conn.Bye("Too many failed logins")
+		}
 		return imapserver.ErrAuthFailed
 	}
+	if login != username {
+		log.Printf("Master login by %s as %s from %s", login, username, s.remoteAddr)
+	}
 	s.username = username
-	if err := s.server.storage.EnsureMailbox(username, "INBOX"); err != nil {
+	s.privacy = isPrivacyUser(username)
+	s.mu.Lock()
+	s.user = username
+	s.state = "authenticated"
+	s.mu.Unlock()
+
+	// go-imap has no ID command yet, so there is no client string. A master
+	// login shows up in the history of the user.
+	ip, _, _ := net.SplitHostPort(s.remoteAddr)
+	e := activity.Entry{Time: time.Now(), Protocol: "imap", IP: ip}
+	if login != username {
+		e.Client = "master login by " + login
+	}
+	if err := activity.Record(config.C.ActivityDir, username, e); err != nil {
+		log.Printf(logging.Err+"activity.Record e=%v", err)
+	}
+	if err := s.server.storage.Migrate(username); err != nil {
+		log.Printf(logging.Err+"Migrate(%s) e=%v", username, err)
 		return err
 	}
-	return nil
+	return ensureFolders(s.server.storage, username)
+}
+
+// getMailbox loads a mailbox from storage or builds a virtual one
+func (s *Session) getMailbox(mailbox string) (*Mailbox, error) {
+	if isActivityMailbox(mailbox) {
+		return activityMessage(s.username)
+	}
+	if isAllMailbox(mailbox) {
+		return s.virtualMailbox(mailbox, nil)
+	}
+	if keyword, ok := labelOf(mailbox); ok {
+		return s.virtualMailbox(mailbox, func(msg *Message) bool {
+			return hasFlag(msg.Flags, imap.Flag(keyword))
+		})
+	}
+	if name, ok := searchOf(mailbox); ok {
+		return s.searchMailbox(mailbox, name)
+	}
+	return s.server.storage.GetMailbox(s.username, mailbox)
+}
+
+func isActivityMailbox(mailbox string) bool {
+	return config.C.ActivityDir != "" && mailbox == activityMailbox
 }
 
 func (s *Session) Select(mailbox string, options *imap.SelectOptions) (*imap.SelectData, error) {
-	mbox, err := s.server.storage.GetMailbox(s.username, mailbox)
+	mailbox = resolveAlias(mailbox)
+	// Before loading, changes in between show up at the first sync
+	s.stamp = stamp{}
+	if !isVirtualMailbox(mailbox) {
+		s.stamp, _, _ = s.server.storage.Watch(s.username, mailbox)
+	}
+	mbox, err := s.getMailbox(mailbox)
 	if err != nil {
 		return nil, err
 	}
 	s.mailbox = mbox
-
-	flags := []imap.Flag{imap.FlagSeen, imap.FlagAnswered, imap.FlagFlagged, imap.FlagDeleted, imap.FlagDraft}
-	permanentFlags := []imap.Flag{imap.FlagSeen, imap.FlagAnswered, imap.FlagFlagged, imap.FlagDeleted, imap.FlagDraft}
+	s.searchRes = nil
+	s.recent = nil
+	s.wake = nil
+	s.server.hub.unsubscribe(s)
+	if !isVirtualMailbox(mailbox) {
+		s.wake = s.server.hub.subscribe(s, s.username, mailbox)
+	}
+	s.cached.Store(mbox.memory())
+	s.setState("selected " + mailbox)
+
+	flags := mailboxFlags(mbox)
+	s.flags = flags
+	// \* as any keyword can be stored, $Forwarded, $MDNSent and labels
+	permanentFlags := append(slices.Clone(flags), imap.FlagWildcard)
+	if isVirtualMailbox(mailbox) {
+		// go-imap always says READ-WRITE, no permanent flags tell the client
+		permanentFlags = nil
+	}
 
 	return &imap.SelectData{
 		Flags:          flags,
 		PermanentFlags: permanentFlags,
 		NumMessages:    uint32(len(mbox.Messages)),
 		UIDNext:        mbox.UIDNext,
-		UIDValidity:    1,
+		UIDValidity:    mbox.UIDValidity,
 	}, nil
 }
 
 func (s *Session) Unselect() error {
 	s.mailbox = nil
+	s.flags = nil
+	s.searchRes = nil
+	s.recent = nil
+	s.wake = nil
+	s.server.hub.unsubscribe(s)
+	s.cached.Store(0)
+	s.setState("authenticated")
 	return nil
 }
 
 func (s *Session) Create(mailbox string, options *imap.CreateOptions) error {
+	mailbox = resolveAlias(mailbox)
 	// Block creation of trash/deleted folders - we don't want them
-	if mailbox == "Deleted Messages" || mailbox == "Trash" {
+	if mailbox == "Deleted Messages" || mailbox == "Trash" || isVirtualMailbox(mailbox) {
 		return nil // Silently ignore
 	}
 	return s.server.storage.EnsureMailbox(s.username, mailbox)
 }
 
 func (s *Session) Delete(mailbox string) error {
-	return s.server.storage.DeleteMailbox(s.username, mailbox)
+	if isVirtualMailbox(mailbox) {
+		return fmt.Errorf("%s is read-only", mailbox)
+	}
+	if err := checkNotAlias(mailbox); err != nil {
+		return err
+	}
+	if err := s.server.storage.DeleteMailbox(s.username, mailbox); err != nil {
+		return err
+	}
+	s.audit("delete-mailbox", mailbox, "", nil)
+	return nil
 }
 
 func (s *Session) Rename(mailbox, newName string, options *imap.RenameOptions) error {
-	return fmt.Errorf("RENAME not supported")
+	if isVirtualMailbox(mailbox) {
+		return fmt.Errorf("%s is read-only", mailbox)
+	}
+	if isVirtualMailbox(newName) {
+		return fmt.Errorf("%s is read-only", newName)
+	}
+	if err := checkNotAlias(mailbox, newName); err != nil {
+		return err
+	}
+	if strings.EqualFold(newName, "INBOX") {
+		return &imap.Error{Type: imap.StatusResponseTypeNo, Code: imap.ResponseCodeAlreadyExists, Text: "INBOX always exists"}
+	}
+
+	err := s.server.storage.RenameMailbox(s.username, mailbox, newName)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return &imap.Error{Type: imap.StatusResponseTypeNo, Code: imap.ResponseCodeNonExistent, Text: "No such mailbox"}
+	case errors.Is(err, os.ErrExist):
+		return &imap.Error{Type: imap.StatusResponseTypeNo, Code: imap.ResponseCodeAlreadyExists, Text: "Mailbox already exists"}
+	case err != nil:
+		return err
+	}
+	s.audit("rename-mailbox", mailbox+" -> "+newName, "", nil)
+
+	// The UIDs stay, only the messages' paths changed
+	if s.mailbox != nil && s.mailbox.Name == mailbox && !strings.EqualFold(mailbox, "INBOX") {
+		if mbox, err := s.getMailbox(newName); err == nil {
+			s.mailbox = mbox
+			s.stamp, _, _ = s.server.storage.Watch(s.username, newName)
+			s.wake = s.server.hub.subscribe(s, s.username, newName)
+		}
+	}
+	return nil
 }
 
 func (s *Session) Subscribe(mailbox string) error {
-	return nil
+	return s.server.storage.SetSubscribed(s.username, resolveAlias(mailbox), true)
 }
 
 func (s *Session) Unsubscribe(mailbox string) error {
-	return nil
+	return s.server.storage.SetSubscribed(s.username, resolveAlias(mailbox), false)
 }
 
 func (s *Session) List(w *imapserver.ListWriter, ref string, patterns []string, options *imap.ListOptions) error {
+	// An empty pattern asks for the hierarchy delimiter (RFC 3501 6.3.8),
+	// iOS Mail and K-9 probe with LIST "" "" before anything else. go-imap
+	// drops it and leaves no patterns.
+	if len(patterns) == 0 && !options.SelectSubscribed {
+		return w.WriteList(&imap.ListData{Attrs: []imap.MailboxAttr{imap.MailboxAttrNoSelect}, Delim: '/'})
+	}
+
 	mailboxes, err := s.server.storage.ListMailboxes(s.username)
 	if err != nil {
 		return err
 	}
+	if config.C.ActivityDir != "" {
+		mailboxes = append(mailboxes, activityMailbox)
+	}
+	if config.C.AllMailbox != "" {
+		mailboxes = append(mailboxes, config.C.AllMailbox)
+	}
+	if config.C.LabelPrefix != "" {
+		labels, err := s.labels()
+		if err != nil {
+			return err
+		}
+		mailboxes = append(mailboxes, config.C.LabelPrefix)
+		for _, l := range labels {
+			mailboxes = append(mailboxes, config.C.LabelPrefix+"/"+l)
+		}
+	}
+	if config.C.SearchPrefix != "" {
+		searches, err := s.server.storage.SavedSearches(s.username)
+		if err != nil {
+			return err
+		}
+		mailboxes = append(mailboxes, config.C.SearchPrefix)
+		for _, name := range slices.Sorted(maps.Keys(searches)) {
+			mailboxes = append(mailboxes, config.C.SearchPrefix+"/"+name)
+		}
+	}
+
+	// LSUB and LIST (SUBSCRIBED) also name subscriptions whose mailbox is
+	// gone, LIST RETURN (SUBSCRIBED) marks them
+	var subscribed map[string]bool
+	if options.SelectSubscribed || options.ReturnSubscribed {
+		subs, err := s.server.storage.Subscriptions(s.username)
+		if err != nil {
+			return err
+		}
+		if subs == nil {
+			subs = mailboxes
+		}
+		subscribed = make(map[string]bool)
+		for _, m := range subs {
+			subscribed[m] = true
+		}
+	}
+	exists := make(map[string]bool)
+	for _, m := range mailboxes {
+		exists[m] = true
+	}
+	if options.SelectSubscribed {
+		mailboxes = mailboxes[:0]
+		for m := range subscribed {
+			mailboxes = append(mailboxes, m)
+		}
+		sort.Strings(mailboxes)
+	}
 
 	for _, mbox := range mailboxes {
+		attr := specialUse(mbox)
+		if options.SelectSpecialUse && attr == "" {
+			continue
+		}
 		for _, pattern := range patterns {
 			if matchMailbox(mbox, ref, pattern) {
-				w.WriteList(&imap.ListData{
+				data := &imap.ListData{
 					Mailbox: mbox,
 					Delim:   '/',
-				})
+				}
+				if attr != "" {
+					data.Attrs = append(data.Attrs, attr)
+				}
+				if mbox == config.C.LabelPrefix || mbox == config.C.SearchPrefix {
+					data.Attrs = append(data.Attrs, imap.MailboxAttrNoSelect)
+				}
+				if !exists[mbox] {
+					data.Attrs = append(data.Attrs, imap.MailboxAttrNonExistent, imap.MailboxAttrNoSelect)
+				}
+				if subscribed[mbox] {
+					data.Attrs = append(data.Attrs, imap.MailboxAttrSubscribed)
+				}
+				w.WriteList(data)
 				break
 			}
 		}
 	}
-	return nil
+	if options.SelectSubscribed {
+		return nil
+	}
+	return listAliases(w, ref, patterns)
 }
 
+// matchMailbox reports whether mailbox is listed for ref and pattern, the
+// wildcards of RFC 3501 section 6.3.8: "*" matches anything and "%"
+// anything but the hierarchy delimiter. A pattern starting with the
+// delimiter ignores ref. INBOX is case-insensitive.
 func matchMailbox(mailbox, ref, pattern string) bool {
-	if pattern == "*" || pattern == "%" {
-		return true
+	if strings.HasPrefix(pattern, "/") {
+		ref, pattern = "", pattern[1:]
 	}
-	if ref != "" {
-		pattern = ref + pattern
+	return matchWildcard(canonicalInbox(mailbox), canonicalInbox(ref+pattern))
+}
+
+// matchWildcard tracks which positions of pattern the name read so far
+// reaches, O(len(name)*len(pattern)) where backtracking over patterns like
+// "*a*a*a*b" is exponential
+func matchWildcard(name, pattern string) bool {
+	pattern = collapseWildcards(pattern)
+	reach := make([]bool, len(pattern)+1) // reach[i]: pattern[:i] matches
+	next := make([]bool, len(pattern)+1)
+	reach[0] = true
+	skipWildcards(reach, pattern)
+	for k := 0; k < len(name); k++ {
+		c := name[k]
+		clear(next)
+		for i := 0; i < len(pattern); i++ {
+			if !reach[i] {
+				continue
+			}
+			switch p := pattern[i]; {
+			case p == '*' || p == '%' && c != '/':
+				next[i] = true
+			case p == c:
+				next[i+1] = true
+			}
+		}
+		skipWildcards(next, pattern)
+		reach, next = next, reach
 	}
-	pattern = strings.ReplaceAll(pattern, "*", "")
-	pattern = strings.ReplaceAll(pattern, "%", "")
-	if pattern == "" {
-		return true
+	return reach[len(pattern)]
+}
+
+// skipWildcards marks the positions after reached wildcards, which match
+// the empty string too
+func skipWildcards(reach []bool, pattern string) {
+	for i := 0; i < len(pattern); i++ {
+		if reach[i] && (pattern[i] == '*' || pattern[i] == '%') {
+			reach[i+1] = true
+		}
 	}
-	return strings.Contains(strings.ToUpper(mailbox), strings.ToUpper(pattern))
+}
+
+// collapseWildcards replaces runs of wildcards by one, "*" when the run has
+// one as it matches everything "%" does
+func collapseWildcards(pattern string) string {
+	out := make([]byte, 0, len(pattern))
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		if n := len(out); n > 0 && (c == '*' || c == '%') && (out[n-1] == '*' || out[n-1] == '%') {
+			if c == '*' {
+				out[n-1] = '*'
+			}
+			continue
+		}
+		out = append(out, c)
+	}
+	return string(out)
+}
+
+// canonicalInbox uppercases a leading INBOX so "inbox/%" matches INBOX's
+// children
+func canonicalInbox(name string) string {
+	if len(name) >= 5 && strings.EqualFold(name[:5], "INBOX") && (len(name) == 5 || name[5] == '/') {
+		return "INBOX" + name[5:]
+	}
+	return name
 }
 
 func (s *Session) Status(mailbox string, options *imap.StatusOptions) (*imap.StatusData, error) {
-	mbox, err := s.server.storage.GetMailbox(s.username, mailbox)
+	mbox, err := s.getMailbox(resolveAlias(mailbox))
 	if err != nil {
 		return nil, err
 	}
@@ -130,8 +457,11 @@ func (s *Session) Status(mailbox string, options *imap.StatusOptions) (*imap.Sta
 		data.UIDNext = mbox.UIDNext
 	}
 	if options.UIDValidity {
-		v := uint32(1)
-		data.UIDValidity = v
+		data.UIDValidity = mbox.UIDValidity
+	}
+	if options.AppendLimit {
+		limit := uint32(config.C.MaxAppendSize)
+		data.AppendLimit = &limit
 	}
 	if options.NumUnseen {
 		var unseen uint32
@@ -145,29 +475,89 @@ func (s *Session) Status(mailbox string, options *imap.StatusOptions) (*imap.Sta
 	return data, nil
 }
 
+// hasFlag ignores case, keywords are case-insensitive like system flags
 func hasFlag(flags []imap.Flag, flag imap.Flag) bool {
 	for _, f := range flags {
-		if f == flag {
+		if strings.EqualFold(string(f), string(flag)) {
 			return true
 		}
 	}
 	return false
 }
 
+// systemFlags are the flags of RFC 9051 2.3.2 a client can set, \Recent is
+// up to the server
+var systemFlags = []imap.Flag{imap.FlagSeen, imap.FlagAnswered, imap.FlagFlagged, imap.FlagDeleted, imap.FlagDraft}
+
+// storableFlags drops what a client can't store from flags, \Recent, \*
+// and unknown system flags, and duplicates. Keywords are kept as given.
+func storableFlags(flags []imap.Flag) []imap.Flag {
+	var out []imap.Flag
+	for _, f := range flags {
+		if strings.HasPrefix(string(f), "\\") && !hasFlag(systemFlags, f) {
+			continue
+		}
+		if !hasFlag(out, f) {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// mailboxFlags returns the system flags and, sorted, the keywords set on
+// any message of mbox, the FLAGS response lists both
+func mailboxFlags(mbox *Mailbox) []imap.Flag {
+	var keywords []imap.Flag
+	for _, msg := range mbox.Messages {
+		for _, f := range msg.Flags {
+			if !strings.HasPrefix(string(f), "\\") && !hasFlag(keywords, f) {
+				keywords = append(keywords, f)
+			}
+		}
+	}
+	slices.Sort(keywords)
+	return append(slices.Clone(systemFlags), keywords...)
+}
+
 func (s *Session) Append(mailbox string, r imap.LiteralReader, options *imap.AppendOptions) (*imap.AppendData, error) {
+	mailbox = resolveAlias(mailbox)
+	if isVirtualMailbox(mailbox) {
+		return nil, fmt.Errorf("%s is read-only", mailbox)
+	}
+
+	if err := checkAppend(r.Size()); err != nil {
+		return nil, err
+	}
+
 	date := time.Now()
 	if options.Time != (time.Time{}) {
 		date = options.Time
 	}
 
-	uid, err := s.server.storage.AppendMessage(s.username, mailbox, r, r.Size(), date)
+	var body io.Reader = r
+	if isSentMailbox(mailbox) && config.C.ContactsDir != "" {
+		// Buffer to index the recipients for autocomplete
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		s.buffered.Store(int64(len(data)))
+		defer s.buffered.Store(0)
+		if err := recordContacts(s.username, data); err != nil {
+			log.Printf(logging.Err+"recordContacts e=%v", err)
+		}
+		body = bytes.NewReader(data)
+	}
+
+	uid, err := s.server.storage.AppendMessage(s.username, mailbox, body, r.Size(), date, storableFlags(options.Flags))
 	if err != nil {
 		return nil, err
 	}
+	s.server.hub.notify(s, s.username, mailbox)
 
 	return &imap.AppendData{
 		UID:         uid,
-		UIDValidity: 1,
+		UIDValidity: s.server.storage.UIDValidity(s.username, mailbox),
 	}, nil
 }
 
@@ -175,6 +565,10 @@ func (s *Session) Fetch(w *imapserver.FetchWriter, numSet imap.NumSet, options *
 	if s.mailbox == nil {
 		return fmt.Errorf("no mailbox selected")
 	}
+	if err := checkNumSet(numSet); err != nil {
+		return err
+	}
+	numSet = s.staticNumSet(numSet)
 
 	for _, msg := range s.mailbox.Messages {
 		if !numSetContains(numSet, msg.SeqNum, msg.UID) {
@@ -205,17 +599,68 @@ func (s *Session) Fetch(w *imapserver.FetchWriter, numSet imap.NumSet, options *
 			}
 		}
 		if options.BodyStructure != nil {
-			bs := s.getBodyStructure(msg, options.BodyStructure.Extended)
-			fw.WriteBodyStructure(bs)
+			fw.WriteBodyStructure(s.getBodyStructure(msg))
+		}
+
+		// Sections that need the parsed message share one copy of it, it's
+		// only read when such a section is asked for
+		var raw []byte
+		load := func() ([]byte, error) {
+			if raw != nil {
+				return raw, nil
+			}
+			data, err := s.rawMessage(msg)
+			if err != nil {
+				return nil, err
+			}
+			if s.privacy {
+				data = sanitizeMessage(data)
+			}
+			raw = data
+			return raw, nil
 		}
 
 		for _, bs := range options.BodySection {
-			data, err := s.server.storage.GetRawMessage(msg.Path)
+			if s.streamable(msg, bs) {
+				if err := s.streamMessage(fw, msg, bs); err != nil {
+					return err
+				}
+			} else {
+				var data []byte
+				var err error
+				if isHeaderSection(bs) {
+					// HEADER.FIELDS of a large message only reads its header
+					data, err = s.rawHeader(msg)
+				} else {
+					data, err = load()
+				}
+				if err != nil {
+					continue
+				}
+				// Honours section parts and <offset.count> windows so clients
+				// can page through large messages
+				data = imapserver.ExtractBodySection(bytes.NewReader(data), bs)
+
+				wc := fw.WriteBodySection(bs, int64(len(data)))
+				wc.Write(data)
+				wc.Close()
+			}
+
+			if !bs.Peek && !hasFlag(msg.Flags, imap.FlagSeen) {
+				msg.Flags = append(msg.Flags, imap.FlagSeen)
+				s.server.storage.SaveFlags(msg.Path, msg.Flags)
+			}
+		}
+
+		// BINARY returns parts with the transfer encoding removed
+		for _, bs := range options.BinarySection {
+			data, err := load()
 			if err != nil {
 				continue
 			}
+			data = imapserver.ExtractBinarySection(bytes.NewReader(data), bs)
 
-			wc := fw.WriteBodySection(bs, int64(len(data)))
+			wc := fw.WriteBinarySection(bs, int64(len(data)))
 			wc.Write(data)
 			wc.Close()
 
@@ -224,6 +669,13 @@ func (s *Session) Fetch(w *imapserver.FetchWriter, numSet imap.NumSet, options *
 				s.server.storage.SaveFlags(msg.Path, msg.Flags)
 			}
 		}
+		for _, bss := range options.BinarySectionSize {
+			data, err := load()
+			if err != nil {
+				continue
+			}
+			fw.WriteBinarySectionSize(bss, imapserver.ExtractBinarySectionSize(bytes.NewReader(data), bss))
+		}
 
 		fw.Close()
 	}
@@ -240,8 +692,102 @@ func numSetContains(numSet imap.NumSet, seqNum uint32, uid imap.UID) bool {
 	return false
 }
 
+// streamable reports whether bs is the message as stored or its TEXT, or a
+// window <offset.count> of those, so it can be copied from the store
+// without holding it in memory
+func (s *Session) streamable(msg *Message, bs *imap.FetchItemBodySection) bool {
+	if msg.Path == "" || s.privacy || len(bs.Part) > 0 {
+		return false
+	}
+	return bs.Specifier == imap.PartSpecifierNone || bs.Specifier == imap.PartSpecifierText
+}
+
+// isHeaderSection reports whether bs only needs the top-level header,
+// HEADER and HEADER.FIELDS (NOT)
+func isHeaderSection(bs *imap.FetchItemBodySection) bool {
+	return bs.Specifier == imap.PartSpecifierHeader && len(bs.Part) == 0
+}
+
+// streamMessage writes BODY[] or BODY[TEXT] from the store through a small
+// buffer, large messages don't end up in a byte slice per connection. A
+// partial fetch seeks to the offset and only copies count bytes.
+func (s *Session) streamMessage(fw *imapserver.FetchResponseWriter, msg *Message, bs *imap.FetchItemBodySection) error {
+	r, size, err := s.server.storage.OpenMessage(msg.Path)
+	if err != nil {
+		// Expunged by another session, skip like the in-memory path does
+		return nil
+	}
+	defer r.Close()
+
+	start := int64(0)
+	if bs.Specifier == imap.PartSpecifierText {
+		header, err := readHeader(r)
+		if err != nil {
+			return nil
+		}
+		start = int64(len(header))
+	}
+
+	offset, n := int64(0), size-start
+	if p := bs.Partial; p != nil {
+		offset = min(p.Offset, n)
+		n = min(p.Size, n-offset)
+	}
+	if _, err := r.Seek(start+offset, io.SeekStart); err != nil {
+		return nil
+	}
+
+	// The literal length is sent first, so a short copy can't be recovered
+	wc := fw.WriteBodySection(bs, n)
+	if _, err := io.CopyN(wc, r, n); err != nil {
+		wc.Close()
+		return err
+	}
+	return wc.Close()
+}
+
+// rawMessage returns the message as stored, virtual messages have no Path
+func (s *Session) rawMessage(msg *Message) ([]byte, error) {
+	if msg.Path == "" {
+		return msg.raw, nil
+	}
+	return s.server.storage.GetRawMessage(msg.Path)
+}
+
+// rawHeader returns the header of msg as stored, without reading its body
+func (s *Session) rawHeader(msg *Message) ([]byte, error) {
+	if msg.Path == "" {
+		return readHeader(bytes.NewReader(msg.raw))
+	}
+	r, _, err := s.server.storage.OpenMessage(msg.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readHeader(r)
+}
+
+// readHeader reads a message up to and including the empty line that ends
+// its header, all of it when there is no body
+func readHeader(r io.Reader) ([]byte, error) {
+	br := bufio.NewReader(r)
+	var header []byte
+	for {
+		line, err := br.ReadBytes('\n')
+		header = append(header, line...)
+		if err == io.EOF {
+			return header, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return header, nil
+		}
+	}
+}
+
 func (s *Session) getEnvelope(msg *Message) (*imap.Envelope, error) {
-	data, err := s.server.storage.GetRawMessage(msg.Path)
+	data, err := s.rawHeader(msg)
 	if err != nil {
 		return nil, err
 	}
@@ -299,52 +845,99 @@ func parseAddresses(s string) []imap.Address {
 	return result
 }
 
-func (s *Session) getBodyStructure(msg *Message, extended bool) imap.BodyStructure {
-	bs := &imap.BodyStructureSinglePart{
-		Type:    "text",
-		Subtype: "plain",
-		Params:  map[string]string{"charset": "utf-8"},
-		Size:    uint32(msg.Size),
+// getBodyStructure parses the MIME structure of msg as sent by BODY[n], a
+// message that can't be read is described as a plain text part
+func (s *Session) getBodyStructure(msg *Message) imap.BodyStructure {
+	data, err := s.rawMessage(msg)
+	if err != nil {
+		log.Printf(logging.Err+"getBodyStructure(%s) e=%v", msg.Path, err)
+		return &imap.BodyStructureSinglePart{
+			Type:     "text",
+			Subtype:  "plain",
+			Params:   map[string]string{"charset": "us-ascii"},
+			Size:     uint32(msg.Size),
+			Text:     &imap.BodyStructureText{},
+			Extended: &imap.BodyStructureSinglePartExt{},
+		}
 	}
-	if extended {
-		bs.Extended = &imap.BodyStructureSinglePartExt{}
+	if s.privacy {
+		data = sanitizeMessage(data)
 	}
+	bs := imapserver.ExtractBodyStructure(bytes.NewReader(data))
+	defaultCharset(bs)
 	return bs
 }
 
+// defaultCharset fills in the us-ascii of text parts without Content-Type
+// (RFC 2045 5.2), some clients show NIL parameters as an unknown charset
+func defaultCharset(bs imap.BodyStructure) {
+	switch bs := bs.(type) {
+	case *imap.BodyStructureSinglePart:
+		if bs.Type == "text" && len(bs.Params) == 0 {
+			bs.Params = map[string]string{"charset": "us-ascii"}
+		}
+		if bs.MessageRFC822 != nil {
+			defaultCharset(bs.MessageRFC822.BodyStructure)
+		}
+	case *imap.BodyStructureMultiPart:
+		for _, child := range bs.Children {
+			defaultCharset(child)
+		}
+	}
+}
+
 func (s *Session) Search(kind imapserver.NumKind, criteria *imap.SearchCriteria, options *imap.SearchOptions) (*imap.SearchData, error) {
 	if s.mailbox == nil {
 		return nil, fmt.Errorf("no mailbox selected")
 	}
+	if err := checkSearch(criteria); err != nil {
+		if options.ReturnSave {
+			// A failed SAVE empties $
+			s.searchRes = nil
+		}
+		return nil, err
+	}
 
-	var uids []imap.UID
-
+	// Messages are ordered by UID so nums is ascending for both kinds
+	var nums []uint32
+	var saved imap.UIDSet
 	for _, msg := range s.mailbox.Messages {
-		if s.matchesCriteria(msg, criteria) {
-			uids = append(uids, msg.UID)
+		if !s.matchesCriteria(msg, criteria) {
+			continue
+		}
+		saved.AddNum(msg.UID)
+		if kind == imapserver.NumKindUID {
+			nums = append(nums, uint32(msg.UID))
+		} else {
+			nums = append(nums, msg.SeqNum)
 		}
 	}
 
 	data := &imap.SearchData{}
-	if kind == imapserver.NumKindUID {
-		var uidSet imap.UIDSet
-		for _, uid := range uids {
-			uidSet.AddNum(uid)
-		}
-		data.All = uidSet
-	} else {
-		var seqSet imap.SeqSet
-		for _, msg := range s.mailbox.Messages {
-			for _, uid := range uids {
-				if msg.UID == uid {
-					seqSet.AddNum(msg.SeqNum)
-					break
-				}
+	if options.ReturnAll {
+		if kind == imapserver.NumKindUID {
+			var uidSet imap.UIDSet
+			for _, n := range nums {
+				uidSet.AddNum(imap.UID(n))
 			}
+			data.All = uidSet
+		} else {
+			var seqSet imap.SeqSet
+			seqSet.AddNum(nums...)
+			data.All = seqSet
 		}
-		data.All = seqSet
 	}
 
+	// ESEARCH MIN/MAX/COUNT let clients size a huge result without fetching it
+	if len(nums) > 0 {
+		data.Min = nums[0]
+		data.Max = nums[len(nums)-1]
+	}
+	data.Count = uint32(len(nums))
+
+	if options.ReturnSave {
+		s.searchRes = saved
+	}
 	return data, nil
 }
 
@@ -365,6 +958,18 @@ func (s *Session) matchesCriteria(msg *Message, criteria *imap.SearchCriteria) b
 		}
 	}
 
+	for _, seqSet := range criteria.SeqNum {
+		if !numSetContains(s.staticNumSet(seqSet), msg.SeqNum, msg.UID) {
+			return false
+		}
+	}
+
+	for _, uidSet := range criteria.UID {
+		if !numSetContains(s.staticNumSet(uidSet), msg.SeqNum, msg.UID) {
+			return false
+		}
+	}
+
 	if !criteria.Since.IsZero() && msg.Date.Before(criteria.Since) {
 		return false
 	}
@@ -380,39 +985,48 @@ func (s *Session) Store(w *imapserver.FetchWriter, numSet imap.NumSet, flags *im
 	if s.mailbox == nil {
 		return fmt.Errorf("no mailbox selected")
 	}
+	if err := checkNumSet(numSet); err != nil {
+		return err
+	}
+	numSet = s.staticNumSet(numSet)
+	if isVirtualMailbox(s.mailbox.Name) {
+		return fmt.Errorf("%s is read-only", s.mailbox.Name)
+	}
 
+	// Work out the new flags first, only the changed ones are written in
+	// one parallel batch and clients hear about them once they're on disk
+	var msgs []*Message
+	var paths []string
+	var newFlags [][]imap.Flag
 	for _, msg := range s.mailbox.Messages {
 		if !numSetContains(numSet, msg.SeqNum, msg.UID) {
 			continue
 		}
+		updated := applyStore(msg.Flags, flags)
+		path := msg.Path
+		if sameFlags(msg.Flags, updated) {
+			// Nothing to write, SaveFlags skips ""
+			path = ""
+		}
+		msgs = append(msgs, msg)
+		paths = append(paths, path)
+		newFlags = append(newFlags, updated)
+	}
 
-		switch flags.Op {
-		case imap.StoreFlagsSet:
-			msg.Flags = flags.Flags
-		case imap.StoreFlagsAdd:
-			for _, f := range flags.Flags {
-				if !hasFlag(msg.Flags, f) {
-					msg.Flags = append(msg.Flags, f)
-				}
-			}
-		case imap.StoreFlagsDel:
-			var newFlags []imap.Flag
-			for _, f := range msg.Flags {
-				remove := false
-				for _, rf := range flags.Flags {
-					if f == rf {
-						remove = true
-						break
-					}
-				}
-				if !remove {
-					newFlags = append(newFlags, f)
-				}
+	errs := s.server.storage.SaveFlagsBatch(paths, newFlags)
+	if slices.ContainsFunc(paths, func(p string) bool { return p != "" }) {
+		s.server.hub.notify(s, s.username, s.mailbox.Name)
+	}
+	var firstErr error
+	for i, msg := range msgs {
+		if errs != nil && errs[i] != nil {
+			log.Printf(logging.Err+"Store(%s) e=%v", msg.Path, errs[i])
+			if firstErr == nil {
+				firstErr = errs[i]
 			}
-			msg.Flags = newFlags
+			continue
 		}
-
-		s.server.storage.SaveFlags(msg.Path, msg.Flags)
+		msg.Flags = newFlags[i]
 
 		if !flags.Silent {
 			fw := w.CreateMessage(msg.SeqNum)
@@ -422,13 +1036,60 @@ func (s *Session) Store(w *imapserver.FetchWriter, numSet imap.NumSet, flags *im
 			}
 		}
 	}
-	return nil
+	return firstErr
+}
+
+// applyStore returns current with the STORE operation applied, current
+// itself is left alone
+func applyStore(current []imap.Flag, flags *imap.StoreFlags) []imap.Flag {
+	switch flags.Op {
+	case imap.StoreFlagsSet:
+		return storableFlags(flags.Flags)
+	case imap.StoreFlagsAdd:
+		out := append([]imap.Flag(nil), current...)
+		for _, f := range storableFlags(flags.Flags) {
+			if !hasFlag(out, f) {
+				out = append(out, f)
+			}
+		}
+		return out
+	case imap.StoreFlagsDel:
+		var out []imap.Flag
+		for _, f := range current {
+			if !hasFlag(flags.Flags, f) {
+				out = append(out, f)
+			}
+		}
+		return out
+	}
+	return current
+}
+
+// sameFlags reports whether a and b hold the same flags in any order
+func sameFlags(a, b []imap.Flag) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, f := range a {
+		if !hasFlag(b, f) {
+			return false
+		}
+	}
+	return true
 }
 
 func (s *Session) Copy(numSet imap.NumSet, dest string) (*imap.CopyData, error) {
 	if s.mailbox == nil {
 		return nil, fmt.Errorf("no mailbox selected")
 	}
+	if err := checkNumSet(numSet); err != nil {
+		return nil, err
+	}
+	numSet = s.staticNumSet(numSet)
+	dest = resolveAlias(dest)
+	if isVirtualMailbox(dest) {
+		return nil, fmt.Errorf("%s is read-only", dest)
+	}
 
 	var srcUIDs imap.UIDSet
 	var destUIDs imap.UIDSet
@@ -438,13 +1099,9 @@ func (s *Session) Copy(numSet imap.NumSet, dest string) (*imap.CopyData, error)
 			continue
 		}
 
-		data, err := s.server.storage.GetRawMessage(msg.Path)
-		if err != nil {
-			continue
-		}
-
-		uid, err := s.server.storage.AppendMessage(s.username, dest, bytes.NewReader(data), int64(len(data)), msg.Date)
+		uid, err := s.server.storage.CopyMessage(s.username, dest, msg)
 		if err != nil {
+			log.Printf(logging.Err+"Copy(%s) e=%v", msg.Path, err)
 			continue
 		}
 
@@ -452,48 +1109,117 @@ func (s *Session) Copy(numSet imap.NumSet, dest string) (*imap.CopyData, error)
 		destUIDs.AddNum(uid)
 	}
 
+	if len(srcUIDs) == 0 {
+		// COPYUID needs at least one UID
+		return nil, nil
+	}
+	s.server.hub.notify(s, s.username, dest)
 	return &imap.CopyData{
-		UIDValidity: 1,
+		UIDValidity: s.server.storage.UIDValidity(s.username, dest),
 		SourceUIDs:  srcUIDs,
 		DestUIDs:    destUIDs,
 	}, nil
 }
 
+// Move is COPY, then expunging the originals, without the \Deleted state
+// in between
+func (s *Session) Move(w *imapserver.MoveWriter, numSet imap.NumSet, dest string) error {
+	if s.mailbox == nil {
+		return fmt.Errorf("no mailbox selected")
+	}
+	if err := checkNumSet(numSet); err != nil {
+		return err
+	}
+	numSet = s.staticNumSet(numSet)
+	dest = resolveAlias(dest)
+	if isVirtualMailbox(dest) {
+		return fmt.Errorf("%s is read-only", dest)
+	}
+	if isVirtualMailbox(s.mailbox.Name) {
+		return fmt.Errorf("%s is read-only", s.mailbox.Name)
+	}
+
+	var srcUIDs, destUIDs imap.UIDSet
+	var moved []*Message
+	for _, msg := range s.mailbox.Messages {
+		if !numSetContains(numSet, msg.SeqNum, msg.UID) {
+			continue
+		}
+		uid, err := s.server.storage.MoveMessage(s.username, dest, msg)
+		if err != nil {
+			log.Printf(logging.Err+"Move(%s) e=%v", msg.Path, err)
+			continue
+		}
+		srcUIDs.AddNum(msg.UID)
+		destUIDs.AddNum(uid)
+		moved = append(moved, msg)
+	}
+
+	var data *imap.CopyData
+	if len(moved) > 0 {
+		s.server.hub.notify(s, s.username, dest)
+		s.server.hub.notify(s, s.username, s.mailbox.Name)
+		data = &imap.CopyData{
+			UIDValidity: s.server.storage.UIDValidity(s.username, dest),
+			SourceUIDs:  srcUIDs,
+			DestUIDs:    destUIDs,
+		}
+	}
+	if err := w.WriteCopyData(data); err != nil {
+		return err
+	}
+	gone := make(map[imap.UID]bool)
+	for i := len(moved) - 1; i >= 0; i-- {
+		if err := w.WriteExpunge(moved[i].SeqNum); err != nil {
+			return err
+		}
+		gone[moved[i].UID] = true
+	}
+	s.mailbox.forget(gone)
+	return nil
+}
+
 func (s *Session) Expunge(w *imapserver.ExpungeWriter, uids *imap.UIDSet) error {
 	if s.mailbox == nil {
 		return fmt.Errorf("no mailbox selected")
 	}
+	if isVirtualMailbox(s.mailbox.Name) {
+		return fmt.Errorf("%s is read-only", s.mailbox.Name)
+	}
 
 	var toDelete []*Message
 	for _, msg := range s.mailbox.Messages {
 		if !hasFlag(msg.Flags, imap.FlagDeleted) {
 			continue
 		}
-		if uids != nil && !uids.Contains(msg.UID) {
+		if uids != nil && !s.staticNumSet(*uids).(imap.UIDSet).Contains(msg.UID) {
 			continue
 		}
 		toDelete = append(toDelete, msg)
 	}
 
+	var expunged imap.UIDSet
+	var paths []string
+	gone := make(map[imap.UID]bool)
 	for i := len(toDelete) - 1; i >= 0; i-- {
 		msg := toDelete[i]
-		if err := s.server.storage.DeleteMessage(msg.Path); err != nil {
+		if err := s.server.storage.TrashMessage(s.username, s.mailbox.Name, msg.Path); err != nil {
+			log.Printf(logging.Err+"Expunge(%s) e=%v", msg.Path, err)
 			continue
 		}
+		expunged.AddNum(msg.UID)
+		gone[msg.UID] = true
+		paths = append(paths, msg.Path)
 		if w != nil {
 			w.WriteExpunge(msg.SeqNum)
 		}
 	}
 
-	return nil
-}
-
-func (s *Session) Poll(w *imapserver.UpdateWriter, allowExpunge bool) error {
-	return nil
-}
-
-func (s *Session) Idle(w *imapserver.UpdateWriter, stop <-chan struct{}) error {
-	<-stop
+	if len(paths) > 0 {
+		s.mailbox.forget(gone)
+		s.server.hub.notify(s, s.username, s.mailbox.Name)
+		s.audit("expunge", s.mailbox.Name, expunged.String(), paths)
+	}
 	return nil
 }
 
@@ -505,16 +1231,25 @@ func (s *Session) Namespace() (*imap.NamespaceData, error) {
 
 type Server struct {
 	users   *UserStore
-	storage *Storage
+	storage MailStore
+	virtual *virtualUIDs // All Mail and labels, see virtual.go
+	hub     *hub         // Sessions by selected mailbox, see hub.go
+
+	// Live sessions and temporary IP bans, see tracker.go
+	*tracker.Tracker
+	conns atomic.Int64 // Open connections, see metrics.go
 }
 
-func NewServer(users *UserStore, storage *Storage) *Server {
+func NewServer(users *UserStore, storage MailStore) *Server {
 	return &Server{
 		users:   users,
 		storage: storage,
+		virtual: newVirtualUIDs(),
+		hub:     newHub(),
+		Tracker: tracker.New(),
 	}
 }
 
-func (srv *Server) NewSession() *Session {
-	return &Session{server: srv}
+func (srv *Server) NewSession(conn *imapserver.Conn) *Session {
+	return newTrackedSession(srv, conn)
 }
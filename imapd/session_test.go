@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+func TestMatchMailbox(t *testing.T) {
+	patterns := map[string]bool{
+		"INBOX|*":             true,
+		"Work/Projects|*":     true,
+		"Work/Projects|%":     false,
+		"Work|%":              true,
+		"INBOX/Sub|INBOX/%":   true,
+		"INBOX/Sub/X|INBOX/%": false,
+		"INBOX/Sub/X|inbox/*": true,
+		"INBOX|inbox":         true,
+		"Inboxes|inbox%":      false,
+		"Sent|S%":             true,
+		"Sent|%t":             true,
+		"Sent|Se":             false,
+		"Work/Sent|%/S%":      true,
+		"Work/Sent|Work/|%":   true,
+		"Work/Sent|Work/|/%":  false,
+		"Work|Work/|/%":       true,
+		"Work/Sent|%%":        false,
+		"Work/Sent|%*%":       true,
+		"Work/Sent|*%t":       true,
+		"a/b/c|%/%/%":         true,
+		"a/b/c|%/%":           false,
+	}
+	for in, expect := range patterns {
+		parts := strings.Split(in, "|")
+		mailbox, ref, pattern := parts[0], "", parts[len(parts)-1]
+		if len(parts) == 3 {
+			ref = parts[1]
+		}
+		if out := matchMailbox(mailbox, ref, pattern); out != expect {
+			t.Errorf("matchMailbox(%s, %q, %s)=%v expect=%v", mailbox, ref, pattern, out, expect)
+		}
+	}
+}
+
+// TestMatchWildcardHostile checks a pattern built to make a backtracking
+// matcher explode returns right away
+func TestMatchWildcardHostile(t *testing.T) {
+	name := strings.Repeat("a", 200)
+	pattern := strings.Repeat("*a%", 40) + "b"
+	done := make(chan bool)
+	go func() {
+		done <- matchWildcard(name, pattern)
+	}()
+	select {
+	case out := <-done:
+		if out {
+			t.Errorf("matched")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("matchWildcard still running after a second")
+	}
+}
+
+// describe renders bs as type/subtype[encoding size disposition], children
+// of a multipart in parentheses
+func describe(bs imap.BodyStructure) string {
+	switch bs := bs.(type) {
+	case *imap.BodyStructureMultiPart:
+		var children []string
+		for _, c := range bs.Children {
+			children = append(children, describe(c))
+		}
+		return "multipart/" + bs.Subtype + "(" + strings.Join(children, ",") + ")"
+	case *imap.BodyStructureSinglePart:
+		out := fmt.Sprintf("%s/%s[%s %d", bs.Type, bs.Subtype, bs.Params["charset"]+bs.Params["name"], bs.Size)
+		if bs.Encoding != "" {
+			out += " " + bs.Encoding
+		}
+		if d := bs.Extended.Disposition; d != nil {
+			out += " " + d.Value
+		}
+		if bs.MessageRFC822 != nil {
+			out += " " + describe(bs.MessageRFC822.BodyStructure)
+		}
+		return out + "]"
+	}
+	return "?"
+}
+
+func TestBodyStructure(t *testing.T) {
+	mixed := "Content-Type: multipart/mixed; boundary=b1\r\n\r\n" +
+		"--b1\r\nContent-Type: multipart/alternative; boundary=b2\r\n\r\n" +
+		"--b2\r\nContent-Type: text/plain; charset=utf-8\r\n\r\nhi\r\n" +
+		"--b2\r\nContent-Type: text/html; charset=utf-8\r\n\r\n<p>hi</p>\r\n--b2--\r\n" +
+		"--b1\r\nContent-Type: application/pdf; name=a.pdf\r\nContent-Transfer-Encoding: base64\r\n" +
+		"Content-Disposition: attachment; filename=a.pdf\r\n\r\nJVBERi0=\r\n--b1--\r\n"
+	forwarded := "Content-Type: message/rfc822\r\n\r\nSubject: fw\r\n\r\nhello\r\n"
+	patterns := map[string]string{
+		"Subject: hi\r\n\r\nhi\r\n":                                  "text/plain[us-ascii 4]",
+		"Content-Type: text/html; charset=iso-8859-1\r\n\r\n<p>\r\n": "text/html[iso-8859-1 5]",
+		mixed: "multipart/mixed(multipart/alternative(text/plain[utf-8 2],text/html[utf-8 9])," +
+			"application/pdf[a.pdf 8 base64 attachment])",
+		forwarded: "message/rfc822[ 22 text/plain[us-ascii 7]]",
+	}
+	s := &Session{}
+	for input, expect := range patterns {
+		if got := describe(s.getBodyStructure(&Message{raw: []byte(input)})); got != expect {
+			t.Errorf("getBodyStructure(%q)=%s expect=%s", input, got, expect)
+		}
+	}
+}
+
+func TestReadHeader(t *testing.T) {
+	patterns := map[string]string{
+		"Subject: a\r\n\r\nbody\r\n":    "Subject: a\r\n\r\n",
+		"Subject: a\n\nbody\n":          "Subject: a\n\n",
+		"Subject: a\r\n b\r\n\r\n\r\nx": "Subject: a\r\n b\r\n\r\n",
+		"Subject: no body\r\n":          "Subject: no body\r\n",
+		"\r\nonly body":                 "\r\n",
+	}
+	for in, expect := range patterns {
+		out, err := readHeader(strings.NewReader(in))
+		if err != nil || string(out) != expect {
+			t.Errorf("readHeader(%q)=%q e=%v expect=%q", in, out, err, expect)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/mpdroog/mymail/smtpd/users"
+)
+
+// specialUse returns the attribute of mailbox, empty for ordinary ones.
+// The standard folders are marked in LIST (RFC 6154) so clients use them
+// instead of making up their own.
+func specialUse(mailbox string) imap.MailboxAttr {
+	if isAllMailbox(mailbox) {
+		return imap.MailboxAttrAll
+	}
+	for _, f := range users.Folders {
+		if strings.EqualFold(f.Name, mailbox) {
+			return imap.MailboxAttr(f.Use)
+		}
+	}
+	return ""
+}
+
+// ensureFolders creates the standard folders of username, see users.Folders
+func ensureFolders(st MailStore, username string) error {
+	for _, f := range users.Folders {
+		if err := st.EnsureMailbox(username, f.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -4,9 +4,11 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"maps"
 	"net/mail"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -14,8 +16,12 @@ import (
 	"time"
 
 	"github.com/emersion/go-imap/v2"
+	"github.com/mpdroog/mymail/smtpd/storage"
 )
 
+// scanWorkers is how many files GetMailbox and SaveFlagsBatch handle at once
+const scanWorkers = 16
+
 type Message struct {
 	UID      imap.UID
 	SeqNum   uint32
@@ -25,13 +31,14 @@ type Message struct {
 	Path     string
 	From     string
 	Subject  string
-	raw      []byte
+	raw      []byte // Content of virtual messages (Path ""), files are read on demand
 }
 
 type Mailbox struct {
-	Name     string
-	Messages []*Message
-	UIDNext  imap.UID
+	Name        string
+	Messages    []*Message
+	UIDNext     imap.UID
+	UIDValidity uint32
 }
 
 type Storage struct {
@@ -48,42 +55,72 @@ func NewStorage(basePath string, domain string) (*Storage, error) {
 	return s, nil
 }
 
-func (s *Storage) MailboxPath(username, mailbox string) string {
-	return filepath.Join(s.basePath, s.domain, username, mailbox)
+// MailboxPath returns the directory of mailbox, an error when the name
+// would leave the directory of username or reach its sidecars. Names come
+// from clients, so this runs before anything touches the disk.
+func (s *Storage) MailboxPath(username, mailbox string) (string, error) {
+	if err := validMailbox(mailbox); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.userDir(username), mailbox), nil
+}
+
+// userDir is the directory of username, see storage.UserDir
+func (s *Storage) userDir(username string) string {
+	return storage.UserDir(s.basePath, s.domain, username)
+}
+
+// validMailbox rejects absolute names and names with an empty, . or ..
+// component or one starting with a dot, like .index and .trash
+func validMailbox(mailbox string) error {
+	if !filepath.IsLocal(mailbox) {
+		return fmt.Errorf("invalid mailbox name %q", mailbox)
+	}
+	for _, part := range strings.Split(mailbox, "/") {
+		if part == "" || strings.HasPrefix(part, ".") {
+			return fmt.Errorf("invalid mailbox name %q", mailbox)
+		}
+	}
+	return nil
 }
 
 func (s *Storage) EnsureMailbox(username, mailbox string) error {
-	return os.MkdirAll(s.MailboxPath(username, mailbox), 0700) // TODO: Better security
+	path, err := s.MailboxPath(username, mailbox)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(path, 0700) // TODO: Better security
 }
 
 func (s *Storage) GetMailbox(username, mailbox string) (*Mailbox, error) {
-	path := s.MailboxPath(username, mailbox)
+	path, err := s.MailboxPath(username, mailbox)
+	if err != nil {
+		return nil, err
+	}
 	if err := os.MkdirAll(path, 0700); err != nil {
 		return nil, err
 	}
 
 	fmt.Printf("GetMailbox=%s\n", path)
-	entries, err := os.ReadDir(path)
+	mbox := &Mailbox{
+		Name:        mailbox,
+		Messages:    make([]*Message, 0),
+		UIDNext:     1, // todo: uidnext counter somewhere?
+		UIDValidity: s.uidValidity(path),
+	}
+	// After uidValidity, which may create .uidvalidity
+	dir, err := os.Stat(path)
 	if err != nil {
 		return nil, err
 	}
 
-	mbox := &Mailbox{
-		Name:     mailbox,
-		Messages: make([]*Message, 0),
-		UIDNext:  1, // todo: uidnext counter somewhere?
+	idx, err := s.index(username, mailbox, path, dir)
+	if err != nil {
+		return nil, err
 	}
 
-	for _, entry := range entries {
-		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".eml") {
-			continue
-		}
-
-		msg, err := s.loadMessage(filepath.Join(path, entry.Name()))
-		if err != nil {
-			continue
-		}
-
+	for name, e := range idx.Messages {
+		msg := e.message(filepath.Join(path, name))
 		mbox.Messages = append(mbox.Messages, msg)
 		if msg.UID >= mbox.UIDNext {
 			mbox.UIDNext = msg.UID + 1
@@ -101,29 +138,37 @@ func (s *Storage) GetMailbox(username, mailbox string) (*Mailbox, error) {
 	return mbox, nil
 }
 
+// loadMessage parses the message file in path, only its header is read
 func (s *Storage) loadMessage(path string) (*Message, error) {
-	data, err := os.ReadFile(path)
+	f, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
-
-	info, err := os.Stat(path)
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	header, err := readHeader(f)
 	if err != nil {
 		return nil, err
 	}
 
-	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	msg, err := mail.ReadMessage(bytes.NewReader(header))
 	if err != nil {
 		return nil, err
 	}
 
 	uid := parseUIDFromFilename(filepath.Base(path))
 
-	date := info.ModTime()
-	if dateStr := msg.Header.Get("Date"); dateStr != "" {
-		if t, err := mail.ParseDate(dateStr); err == nil {
-			date = t
-		}
+	// The file time only when neither the Date header nor the filename has a date
+	var date time.Time
+	if t, err := mail.ParseDate(msg.Header.Get("Date")); err == nil {
+		date = t
+	} else if t, ok := parseTimeFromFilename(filepath.Base(path)); ok {
+		date = t
+	} else {
+		date = info.ModTime()
 	}
 
 	flags := s.loadFlags(path)
@@ -136,7 +181,6 @@ func (s *Storage) loadMessage(path string) (*Message, error) {
 		Path:    path,
 		From:    msg.Header.Get("From"),
 		Subject: msg.Header.Get("Subject"),
-		raw:     data,
 	}, nil
 }
 
@@ -151,6 +195,19 @@ func parseUIDFromFilename(name string) imap.UID {
 	return 1
 }
 
+// parseTimeFromFilename returns the delivery time from {unix}_{uid}.eml
+func parseTimeFromFilename(name string) (time.Time, bool) {
+	prefix, _, ok := strings.Cut(name, "_")
+	if !ok {
+		return time.Time{}, false
+	}
+	sec, err := strconv.ParseInt(prefix, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(sec, 0), true
+}
+
 func (s *Storage) loadFlags(emlPath string) []imap.Flag {
 	flagPath := emlPath + ".flags"
 	data, err := os.ReadFile(flagPath)
@@ -168,57 +225,350 @@ func (s *Storage) loadFlags(emlPath string) []imap.Flag {
 }
 
 func (s *Storage) SaveFlags(emlPath string, flags []imap.Flag) error {
-	flagPath := emlPath + ".flags"
+	if emlPath == "" {
+		// Virtual message, flags live in memory only
+		return nil
+	}
+	lock, err := storage.LockMailbox(filepath.Dir(emlPath))
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	return saveFlags(emlPath, flags)
+}
+
+// saveFlags writes the .flags sidecar of emlPath, the caller holds the lock
+// of its mailbox
+func saveFlags(emlPath string, flags []imap.Flag) error {
 	var lines []string
 	for _, f := range flags {
 		lines = append(lines, string(f))
 	}
-	return os.WriteFile(flagPath, []byte(strings.Join(lines, "\n")), 0600)
+	return storage.ReplaceFile(emlPath+".flags", []byte(strings.Join(lines, "\n")), 0640)
+}
+
+// SaveFlagsBatch writes flags[i] for paths[i] in parallel and returns the
+// error per message, nil when all were written
+func (s *Storage) SaveFlagsBatch(paths []string, flags [][]imap.Flag) []error {
+	// Each mailbox is locked once, in sorted order so batches can't deadlock
+	locked := make(map[string]error)
+	for _, p := range paths {
+		if p != "" {
+			locked[filepath.Dir(p)] = nil
+		}
+	}
+	for _, dir := range slices.Sorted(maps.Keys(locked)) {
+		lock, err := storage.LockMailbox(dir)
+		if err != nil {
+			locked[dir] = err
+			continue
+		}
+		defer lock.Unlock()
+	}
+
+	var errs []error
+	var mu sync.Mutex
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(scanWorkers, len(paths)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if paths[i] == "" {
+					continue
+				}
+				err := locked[filepath.Dir(paths[i])]
+				if err == nil {
+					err = saveFlags(paths[i], flags[i])
+				}
+				if err != nil {
+					mu.Lock()
+					if errs == nil {
+						errs = make([]error, len(paths))
+					}
+					errs[i] = err
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for i := range paths {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return errs
 }
 
-func (s *Storage) AppendMessage(username, mailbox string, r io.Reader, size int64, date time.Time) (imap.UID, error) {
-	path := filepath.Join(s.basePath, username, mailbox)
+func (s *Storage) AppendMessage(username, mailbox string, r io.Reader, size int64, date time.Time, flags []imap.Flag) (imap.UID, error) {
+	path, err := s.MailboxPath(username, mailbox)
+	if err != nil {
+		return 0, err
+	}
 	if err := os.MkdirAll(path, 0700); err != nil {
 		return 0, err
 	}
 
-	uid := s.nextUID(path)
+	lock, err := storage.LockMailbox(path)
+	if err != nil {
+		return 0, err
+	}
+	defer lock.Unlock()
+	n, err := lock.NextUID()
+	if err != nil {
+		return 0, err
+	}
+	uid := imap.UID(n)
 	filename := fmt.Sprintf("%d_%d.eml", date.Unix(), uid)
 	fullPath := filepath.Join(path, filename)
 
-	data, err := io.ReadAll(r)
+	// Flags first, the message never shows up without them
+	if len(flags) > 0 {
+		if err := saveFlags(fullPath, flags); err != nil {
+			return 0, err
+		}
+	}
+	if err := storage.WriteMessage(fullPath, r, 0640); err != nil {
+		os.Remove(fullPath + ".flags")
+		return 0, err
+	}
+
+	return uid, nil
+}
+
+// Deliver stores a message generated by imapd itself, e.g. a notice
+func (s *Storage) Deliver(username, mailbox string, data []byte) error {
+	path, err := s.MailboxPath(username, mailbox)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return err
+	}
+	lock, err := storage.LockMailbox(path)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	uid, err := lock.NextUID()
+	if err != nil {
+		return err
+	}
+	filename := fmt.Sprintf("%d_%d.eml", time.Now().Unix(), uid)
+	return storage.WriteMessage(filepath.Join(path, filename), bytes.NewReader(data), 0640)
+}
+
+// CopyMessage adds msg with its flags to mailbox. The message file is hard
+// linked, message files never change so both mailboxes can share it. Across
+// filesystems it falls back to copying the file.
+func (s *Storage) CopyMessage(username, mailbox string, msg *Message) (imap.UID, error) {
+	if msg.Path == "" {
+		return s.AppendMessage(username, mailbox, bytes.NewReader(msg.raw), int64(len(msg.raw)), msg.Date, msg.Flags)
+	}
+
+	path, err := s.MailboxPath(username, mailbox)
 	if err != nil {
 		return 0, err
 	}
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return 0, err
+	}
+	return linkMessage(path, msg, false)
+}
 
-	if err := os.WriteFile(fullPath, data, 0600); err != nil {
+// MoveMessage relocates msg with its flags to mailbox. The file is linked
+// before the original goes, so a crash leaves a copy instead of nothing.
+func (s *Storage) MoveMessage(username, mailbox string, msg *Message) (imap.UID, error) {
+	if msg.Path == "" {
+		return 0, fmt.Errorf("virtual message can't be moved")
+	}
+	path, err := s.MailboxPath(username, mailbox)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(path, 0700); err != nil {
 		return 0, err
 	}
 
+	uid, err := linkMessage(path, msg, true)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.DeleteMessage(msg.Path); err != nil {
+		return 0, err
+	}
 	return uid, nil
 }
 
-func (s *Storage) nextUID(mailboxPath string) imap.UID {
-	uidFile := filepath.Join(mailboxPath, ".uidnext")
-	data, err := os.ReadFile(uidFile)
-	uid := imap.UID(1)
+// linkMessage links msg into the mailbox in path under a new UID, with the
+// flags it has in memory or, for move, its .flags sidecar. The lock is gone
+// when it returns, DeleteMessage takes the lock of the source mailbox which
+// may be the same one.
+func linkMessage(path string, msg *Message, move bool) (imap.UID, error) {
+	lock, err := storage.LockMailbox(path)
+	if err != nil {
+		return 0, err
+	}
+	defer lock.Unlock()
+	n, err := lock.NextUID()
+	if err != nil {
+		return 0, err
+	}
+	uid := imap.UID(n)
+
+	fullPath := filepath.Join(path, fmt.Sprintf("%d_%d.eml", msg.Date.Unix(), uid))
+	if err := os.Link(msg.Path, fullPath); err != nil {
+		if err := copyFile(msg.Path, fullPath); err != nil {
+			return 0, err
+		}
+	}
+
+	if move {
+		if err := os.Rename(msg.Path+".flags", fullPath+".flags"); err == nil || os.IsNotExist(err) {
+			return uid, nil
+		}
+	}
+	if len(msg.Flags) > 0 {
+		if err := saveFlags(fullPath, msg.Flags); err != nil {
+			return 0, err
+		}
+	}
+	return uid, nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return storage.WriteMessage(dst, in, 0640)
+}
+
+// UIDValidity returns the UIDVALIDITY of mailbox, 0 for an invalid name
+func (s *Storage) UIDValidity(username, mailbox string) uint32 {
+	path, err := s.MailboxPath(username, mailbox)
+	if err != nil {
+		return 0
+	}
+	return s.uidValidity(path)
+}
+
+// uidValidity returns the UIDVALIDITY of the mailbox in mailboxPath, kept
+// in a .uidvalidity sidecar. New mailboxes get the time of creation so a
+// recreated one differs, existing ones keep the 1 clients have cached.
+func (s *Storage) uidValidity(mailboxPath string) uint32 {
+	file := filepath.Join(mailboxPath, ".uidvalidity")
+	data, err := os.ReadFile(file)
 	if err == nil {
-		if n, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 32); err == nil {
-			uid = imap.UID(n)
+		if n, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 32); err == nil && n > 0 {
+			return uint32(n)
+		}
+	}
+
+	v := uint32(time.Now().Unix())
+	if _, err := os.Stat(filepath.Join(mailboxPath, ".uidnext")); err == nil {
+		v = 1
+	}
+	// Linked like messages so two sessions on a new mailbox agree on one value
+	if err := storage.WriteMessage(file, strings.NewReader(strconv.FormatUint(uint64(v), 10)), 0400); os.IsExist(err) {
+		if data, err := os.ReadFile(file); err == nil {
+			if n, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 32); err == nil {
+				return uint32(n)
+			}
 		}
 	}
-	os.WriteFile(uidFile, []byte(fmt.Sprintf("%d", uid+1)), 0600)
-	return uid
+	return v
 }
 
 func (s *Storage) DeleteMessage(path string) error {
+	lock, err := storage.LockMailbox(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
 	flagPath := path + ".flags"
 	os.Remove(flagPath)
 	return os.Remove(path)
 }
 
+// RenameMailbox renames mailbox to newName. The directory moves as a
+// whole so UIDs, flags and UIDVALIDITY stay and clients keep their cache.
+// Renaming INBOX moves its messages and leaves an empty INBOX behind, with
+// its inferiors still in it (RFC 3501 section 6.3.5).
+func (s *Storage) RenameMailbox(username, mailbox, newName string) error {
+	src, err := s.MailboxPath(username, mailbox)
+	if err != nil {
+		return err
+	}
+	dst, err := s.MailboxPath(username, newName)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(src); err != nil {
+		return err
+	}
+	if _, err := os.Stat(dst); err == nil {
+		return os.ErrExist
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return err
+	}
+
+	// No writer is halfway once we hold the lock
+	lock, err := storage.LockMailbox(src)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	if err := os.Rename(src, dst); err != nil {
+		return err
+	}
+	// A mailbox created under the old name starts without index
+	os.Remove(s.indexPath(username, mailbox))
+	if !strings.EqualFold(mailbox, "INBOX") {
+		return nil
+	}
+
+	// A new INBOX, smtpd may deliver any moment. Its UIDs start over, so it
+	// gets a UIDVALIDITY above the one that moved away before anyone can
+	// take a UID.
+	if err := os.MkdirAll(src, 0700); err != nil {
+		return err
+	}
+	inbox, err := storage.LockMailbox(src)
+	if err != nil {
+		return err
+	}
+	defer inbox.Unlock()
+	if err := storage.ReplaceFile(filepath.Join(src, ".uidvalidity"), []byte(strconv.FormatUint(uint64(s.uidValidity(dst)), 10)), 0400); err != nil {
+		return err
+	}
+	if err := inbox.BumpUIDValidity(); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(dst)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			if err := os.Rename(filepath.Join(dst, e.Name()), filepath.Join(src, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func (s *Storage) DeleteMailbox(username, mailbox string) error {
-	path := s.MailboxPath(username, mailbox)
+	path, err := s.MailboxPath(username, mailbox)
+	if err != nil {
+		return err
+	}
+	os.Remove(s.indexPath(username, mailbox))
 	return os.RemoveAll(path)
 }
 
@@ -226,8 +576,21 @@ func (s *Storage) GetRawMessage(path string) ([]byte, error) {
 	return os.ReadFile(path)
 }
 
+func (s *Storage) OpenMessage(path string) (io.ReadSeekCloser, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
+}
+
 func (s *Storage) ListMailboxes(username string) ([]string, error) {
-	path := filepath.Join(s.basePath, username)
+	path := s.userDir(username)
 	if err := os.MkdirAll(path, 0700); err != nil {
 		return nil, err
 	}
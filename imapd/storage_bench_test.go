@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+)
+
+// Storage benchmarks, run with
+//
+//	go test -run '^$' -bench . -benchmem
+//
+// -short skips the 100k mailbox. Generated mailboxes are cached in
+// $MYMAIL_BENCH_DIR when set, otherwise rebuilt in a temp dir per run.
+//
+// Budget on a laptop SSD with a warm page cache, redesigns of the storage
+// layer shouldn't exceed it:
+//
+//	SELECT   50µs per message (1k mailbox < 50ms)
+//	FETCH    ENVELOPE BODY.PEEK[] 30µs per message
+//	APPEND   1ms per message
+//	STORE    +FLAGS \Seen 100µs per changed message
+
+var benchSizes = []int{1000, 10000, 100000}
+
+// BenchmarkSelect is a mailbox that didn't change since its index was
+// written, BenchmarkSelectScan one without index
+func BenchmarkSelect(b *testing.B) {
+	benchSelect(b, false)
+}
+
+func BenchmarkSelectScan(b *testing.B) {
+	benchSelect(b, true)
+}
+
+func benchSelect(b *testing.B, scan bool) {
+	for _, n := range benchSizes {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			st := benchStorage(b, n)
+			if _, err := st.GetMailbox("bench", "INBOX"); err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if scan {
+					os.Remove(st.indexPath("bench", "INBOX"))
+				}
+				mbox, err := st.GetMailbox("bench", "INBOX")
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(mbox.Messages) != n {
+					b.Fatalf("%d messages, expect %d", len(mbox.Messages), n)
+				}
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*n), "ns/msg")
+		})
+	}
+}
+
+// BenchmarkFetch is what a client syncing a mailbox asks for, ENVELOPE and
+// BODY.PEEK[] of every message
+func BenchmarkFetch(b *testing.B) {
+	st := benchStorage(b, 1000)
+	mbox, err := st.GetMailbox("bench", "INBOX")
+	if err != nil {
+		b.Fatal(err)
+	}
+	s := &Session{server: NewServer(nil, st), mailbox: mbox}
+	section := &imap.FetchItemBodySection{Peek: true}
+
+	b.ResetTimer()
+	var total int64
+	for i := 0; i < b.N; i++ {
+		for _, msg := range mbox.Messages {
+			if _, err := s.getEnvelope(msg); err != nil {
+				b.Fatal(err)
+			}
+			data, err := s.rawMessage(msg)
+			if err != nil {
+				b.Fatal(err)
+			}
+			total += int64(len(imapserver.ExtractBodySection(bytes.NewReader(data), section)))
+		}
+	}
+	b.SetBytes(total / int64(b.N))
+	b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*len(mbox.Messages)), "ns/msg")
+}
+
+func BenchmarkAppend(b *testing.B) {
+	st, _ := NewStorage(b.TempDir(), "example.com")
+	msg := benchMessage(1)
+	now := time.Now()
+
+	b.SetBytes(int64(len(msg)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := st.AppendMessage("bench", "INBOX", bytes.NewReader(msg), int64(len(msg)), now, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkStore marks a 1k mailbox read and unread again, every message
+// changes so every .flags file is written
+func BenchmarkStore(b *testing.B) {
+	st, _ := NewStorage(b.TempDir(), "example.com")
+	if err := generateMailbox(mailboxPath(st, "bench", "INBOX"), 1000); err != nil {
+		b.Fatal(err)
+	}
+	mbox, err := st.GetMailbox("bench", "INBOX")
+	if err != nil {
+		b.Fatal(err)
+	}
+	s := &Session{server: NewServer(nil, st), mailbox: mbox}
+	all := imap.SeqSetNum()
+	all.AddRange(1, 0)
+	ops := []imap.StoreFlagsOp{imap.StoreFlagsSet, imap.StoreFlagsDel}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		store := &imap.StoreFlags{Op: ops[i%2], Silent: true, Flags: []imap.Flag{imap.FlagSeen}}
+		if err := s.Store(nil, all, store, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*len(mbox.Messages)), "ns/msg")
+}
+
+// benchStorage returns storage with an INBOX of n generated messages for
+// user "bench"
+func benchStorage(b *testing.B, n int) *Storage {
+	b.Helper()
+	if n > 10000 && testing.Short() {
+		b.Skip("large mailbox in -short mode")
+	}
+
+	base := os.Getenv("MYMAIL_BENCH_DIR")
+	if base == "" {
+		base = b.TempDir()
+	}
+	base = filepath.Join(base, strconv.Itoa(n))
+	st, _ := NewStorage(base, "example.com")
+	if err := generateMailbox(mailboxPath(st, "bench", "INBOX"), n); err != nil {
+		b.Fatal(err)
+	}
+	return st
+}
+
+// generateMailbox fills dir with n synthetic messages like smtpd stores
+// them, unless it already holds them
+func generateMailbox(dir string, n int) error {
+	if data, err := os.ReadFile(filepath.Join(dir, ".uidnext")); err == nil && string(data) == strconv.Itoa(n+1) {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	start := time.Now().Add(-time.Duration(n) * time.Minute).Unix()
+	for uid := 1; uid <= n; uid++ {
+		name := filepath.Join(dir, fmt.Sprintf("%d_%d.eml", start+int64(uid)*60, uid))
+		if err := os.WriteFile(name, benchMessage(uid), 0600); err != nil {
+			return err
+		}
+		if uid%3 == 0 {
+			if err := os.WriteFile(name+".flags", []byte(`\Seen`), 0600); err != nil {
+				return err
+			}
+		}
+	}
+	for name, v := range map[string]string{".uidvalidity": "1", ".uidnext": strconv.Itoa(n + 1)} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(v), 0600); err != nil {
+			return err
+		}
+	}
+	// No delivery for a while, so the index is trusted
+	quiet := time.Now().Add(-time.Hour)
+	return os.Chtimes(dir, quiet, quiet)
+}
+
+// benchMessage is a plain text message of a few KB, sized by uid so not
+// every message is the same
+func benchMessage(uid int) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Received: from mx.example.org (mx.example.org [192.0.2.1])\r\n")
+	fmt.Fprintf(&buf, "From: Sender %d <sender%d@example.org>\r\n", uid%50, uid%50)
+	fmt.Fprintf(&buf, "To: bench@example.com\r\n")
+	fmt.Fprintf(&buf, "Subject: Benchmark message %d\r\n", uid)
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Unix(int64(uid)*60, 0).UTC().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%d@example.org>\r\n", uid)
+	fmt.Fprintf(&buf, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	for i := 0; i < 20+uid%40; i++ {
+		fmt.Fprintf(&buf, "Line %d of message %d, padding text to get a realistic body size.\r\n", i, uid)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/mpdroog/mymail/imapd/config"
+	smtpdconfig "github.com/mpdroog/mymail/smtpd/config"
+	"github.com/mpdroog/mymail/smtpd/storage"
+)
+
+// TestCopyMessage checks COPY links the message file and copies its flags
+func TestCopyMessage(t *testing.T) {
+	s, _ := NewStorage(t.TempDir(), "example.com")
+	src := filepath.Join(mailboxPath(s, "mark", "INBOX"), "1_1.eml")
+	os.MkdirAll(filepath.Dir(src), 0700)
+	os.WriteFile(src, []byte("Subject: hi\r\n\r\nbody\r\n"), 0600)
+	msg := &Message{Path: src, Flags: []imap.Flag{imap.FlagSeen}, Date: time.Unix(1, 0)}
+
+	uid, err := s.CopyMessage("mark", "Archive", msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(mailboxPath(s, "mark", "Archive"), "1_1.eml")
+	if uid != 1 {
+		t.Errorf("uid=%d", uid)
+	}
+
+	a, _ := os.Stat(src)
+	b, err := os.Stat(dst)
+	if err != nil || !os.SameFile(a, b) {
+		t.Errorf("copy is not a hard link e=%v", err)
+	}
+	if flags := s.loadFlags(dst); len(flags) != 1 || flags[0] != imap.FlagSeen {
+		t.Errorf("flags=%v", flags)
+	}
+}
+
+// TestTrashMessage checks EXPUNGE keeps the message with its flags in the
+// trash until it's purged
+func TestTrashMessage(t *testing.T) {
+	config.C.TrashRetention = time.Hour
+	s, _ := NewStorage(t.TempDir(), "example.com")
+	inbox := mailboxPath(s, "mark", "INBOX")
+	os.MkdirAll(inbox, 0700)
+	src := filepath.Join(inbox, "1_1.eml")
+	os.WriteFile(src, []byte("Subject: hi\r\n\r\n"), 0600)
+	os.WriteFile(src+".flags", []byte(`\Deleted`), 0600)
+
+	if err := s.TrashMessage("mark", "INBOX", src); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Errorf("message still in INBOX")
+	}
+	trashed, _ := filepath.Glob(filepath.Join(s.basePath, s.domain, "mark", trashDir, "INBOX", "*-1_1.eml*"))
+	if len(trashed) != 2 {
+		t.Fatalf("trash=%v, expect message and flags", trashed)
+	}
+
+	if err := s.PurgeTrash(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(trashed[0]); err != nil {
+		t.Errorf("purged before retention e=%v", err)
+	}
+	if err := s.PurgeTrash(-time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(trashed[0]); !os.IsNotExist(err) {
+		t.Errorf("not purged after retention")
+	}
+}
+
+// TestMoveMessage checks MOVE takes the flags along and leaves no original
+func TestMoveMessage(t *testing.T) {
+	s, _ := NewStorage(t.TempDir(), "example.com")
+	src := filepath.Join(mailboxPath(s, "mark", "INBOX"), "1_1.eml")
+	os.MkdirAll(filepath.Dir(src), 0700)
+	os.WriteFile(src, []byte("Subject: hi\r\n\r\nbody\r\n"), 0600)
+	s.SaveFlags(src, []imap.Flag{imap.FlagFlagged})
+	msg := &Message{Path: src, Flags: []imap.Flag{imap.FlagFlagged}, Date: time.Unix(1, 0)}
+
+	uid, err := s.MoveMessage("mark", "Archive", msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(mailboxPath(s, "mark", "Archive"), "1_1.eml")
+	if uid != 1 {
+		t.Errorf("uid=%d", uid)
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Errorf("original still there e=%v", err)
+	}
+	if _, err := os.Stat(src + ".flags"); !os.IsNotExist(err) {
+		t.Errorf("original flags still there e=%v", err)
+	}
+	if flags := s.loadFlags(dst); len(flags) != 1 || flags[0] != imap.FlagFlagged {
+		t.Errorf("flags=%v", flags)
+	}
+}
+
+// TestUIDValidity checks the value is kept, stays 1 for mailboxes from
+// before it was stored and changes when the UID counter is lost
+func TestUIDValidity(t *testing.T) {
+	s, _ := NewStorage(t.TempDir(), "example.com")
+	old := mailboxPath(s, "mark", "INBOX")
+	os.MkdirAll(old, 0700)
+	os.WriteFile(filepath.Join(old, ".uidnext"), []byte("5"), 0600)
+	if v := s.UIDValidity("mark", "INBOX"); v != 1 {
+		t.Errorf("existing mailbox uidvalidity=%d", v)
+	}
+
+	s.EnsureMailbox("mark", "Archive")
+	v := s.UIDValidity("mark", "Archive")
+	if v <= 1 || s.UIDValidity("mark", "Archive") != v {
+		t.Errorf("new mailbox uidvalidity=%d not kept", v)
+	}
+
+	// Without .uidnext UIDs of expunged messages could come back
+	os.WriteFile(filepath.Join(old, "1_4.eml"), []byte("Subject: hi\r\n\r\n"), 0400)
+	os.Remove(filepath.Join(old, ".uidnext"))
+	uid, err := s.AppendMessage("mark", "INBOX", strings.NewReader("Subject: new\r\n\r\n"), 16, time.Now(), nil)
+	if err != nil || uid != 5 {
+		t.Errorf("uid=%d e=%v, expect 5", uid, err)
+	}
+	if v := s.UIDValidity("mark", "INBOX"); v <= 1 {
+		t.Errorf("uidvalidity=%d after losing .uidnext", v)
+	}
+}
+
+// TestRenameMailbox checks UIDs and UIDVALIDITY move along, and that
+// renaming INBOX leaves an empty one with its inferiors and a new
+// UIDVALIDITY
+func TestRenameMailbox(t *testing.T) {
+	s, _ := NewStorage(t.TempDir(), "example.com")
+	inbox := mailboxPath(s, "mark", "INBOX")
+	os.MkdirAll(filepath.Join(inbox, "Sub"), 0700)
+	os.WriteFile(filepath.Join(inbox, "1_7.eml"), []byte("Subject: hi\r\n\r\nbody\r\n"), 0600)
+	v := s.UIDValidity("mark", "INBOX")
+
+	if err := s.RenameMailbox("mark", "INBOX", "Old"); err != nil {
+		t.Fatal(err)
+	}
+	if mbox, _ := s.GetMailbox("mark", "Old"); len(mbox.Messages) != 1 || mbox.Messages[0].UID != 7 || mbox.UIDValidity != v {
+		t.Errorf("renamed INBOX messages=%v uidvalidity=%d", mbox.Messages, mbox.UIDValidity)
+	}
+	if mbox, _ := s.GetMailbox("mark", "INBOX"); len(mbox.Messages) != 0 || mbox.UIDValidity <= v {
+		t.Errorf("INBOX messages=%d uidvalidity=%d, expect empty above %d", len(mbox.Messages), mbox.UIDValidity, v)
+	}
+	// UIDs start over in the new INBOX, under its own UIDVALIDITY
+	if uid, err := s.AppendMessage("mark", "INBOX", strings.NewReader("Subject: new\r\n\r\n"), 16, time.Now(), nil); err != nil || uid != 1 {
+		t.Errorf("uid=%d e=%v, expect 1", uid, err)
+	}
+	if nv := s.UIDValidity("mark", "INBOX"); nv <= v {
+		t.Errorf("uidvalidity=%d after append, expect above %d", nv, v)
+	}
+	if _, err := os.Stat(filepath.Join(inbox, "Sub")); err != nil {
+		t.Errorf("INBOX/Sub moved e=%v", err)
+	}
+
+	if err := s.RenameMailbox("mark", "Old", "INBOX"); !os.IsExist(err) {
+		t.Errorf("rename onto existing e=%v", err)
+	}
+	if err := s.RenameMailbox("mark", "Gone", "New"); !os.IsNotExist(err) {
+		t.Errorf("rename of missing e=%v", err)
+	}
+}
+
+// TestSubscriptions checks all mailboxes are subscribed until the first
+// (UN)SUBSCRIBE, which starts from them
+func TestSubscriptions(t *testing.T) {
+	s, _ := NewStorage(t.TempDir(), "example.com")
+	s.EnsureMailbox("mark", "INBOX")
+	s.EnsureMailbox("mark", "Archive")
+	if subs, err := s.Subscriptions("mark"); subs != nil || err != nil {
+		t.Errorf("initial subs=%v e=%v", subs, err)
+	}
+
+	s.SetSubscribed("mark", "Archive", false)
+	s.SetSubscribed("mark", "Gone", true)
+	if subs, _ := s.Subscriptions("mark"); strings.Join(subs, ",") != "Gone,INBOX" {
+		t.Errorf("subs=%v", subs)
+	}
+	s.SetSubscribed("mark", "INBOX", false)
+	s.SetSubscribed("mark", "Gone", false)
+	if subs, _ := s.Subscriptions("mark"); subs == nil || len(subs) != 0 {
+		t.Errorf("subs=%v, expect none", subs)
+	}
+}
+
+// TestMailboxIndex checks an unchanged mailbox comes from its index and a
+// new message or flag change is picked up
+func TestMailboxIndex(t *testing.T) {
+	s, _ := NewStorage(t.TempDir(), "example.com")
+	inbox := mailboxPath(s, "mark", "INBOX")
+	os.MkdirAll(inbox, 0700)
+	os.WriteFile(filepath.Join(inbox, "1_1.eml"), []byte("Subject: one\r\n\r\n"), 0400)
+	os.WriteFile(filepath.Join(inbox, ".uidvalidity"), []byte("1"), 0400)
+	old := time.Now().Add(-time.Minute)
+	os.Chtimes(inbox, old, old)
+
+	if mbox, err := s.GetMailbox("mark", "INBOX"); err != nil || len(mbox.Messages) != 1 {
+		t.Fatalf("mbox=%+v e=%v", mbox, err)
+	}
+	// Served from the index while the directory doesn't change
+	idx := loadIndex(s.indexPath("mark", "INBOX"))
+	if idx.Mtime != old.UnixNano() || idx.Messages["1_1.eml"] == nil {
+		t.Fatalf("index=%+v", idx)
+	}
+	idx.Messages["1_1.eml"].Subject = "indexed"
+	saveIndex(s.indexPath("mark", "INBOX"), idx)
+	if mbox, _ := s.GetMailbox("mark", "INBOX"); mbox.Messages[0].Subject != "indexed" {
+		t.Errorf("subject=%s, mailbox scanned", mbox.Messages[0].Subject)
+	}
+
+	os.WriteFile(filepath.Join(inbox, "2_2.eml"), []byte("Subject: two\r\n\r\n"), 0400)
+	if err := s.SaveFlags(filepath.Join(inbox, "1_1.eml"), []imap.Flag{imap.FlagSeen}); err != nil {
+		t.Fatal(err)
+	}
+	mbox, err := s.GetMailbox("mark", "INBOX")
+	if err != nil || len(mbox.Messages) != 2 || mbox.UIDNext != 3 {
+		t.Fatalf("after delivery mbox=%+v e=%v", mbox, err)
+	}
+	if m := mbox.Messages[0]; m.Subject != "indexed" || len(m.Flags) != 1 || m.Flags[0] != imap.FlagSeen {
+		t.Errorf("message 1=%+v, expect the indexed entry with new flags", m)
+	}
+	if m := mbox.Messages[1]; m.Subject != "two" {
+		t.Errorf("message 2=%+v", m)
+	}
+}
+
+// TestMailboxPath checks names that leave the user's directory or reach its
+// sidecars are refused before anything touches the disk
+func TestMailboxPath(t *testing.T) {
+	base := t.TempDir()
+	s, _ := NewStorage(base, "example.com")
+	patterns := map[string]bool{
+		"INBOX":          true,
+		"Archive/2024":   true,
+		"":               false,
+		".":              false,
+		"..":             false,
+		"../bob/INBOX":   false,
+		"Archive/../..":  false,
+		"/etc":           false,
+		".index":         false,
+		"Archive/.trash": false,
+		"Archive//2024":  false,
+	}
+	for name, ok := range patterns {
+		if _, err := s.MailboxPath("mark", name); (err == nil) != ok {
+			t.Errorf("MailboxPath(%q) e=%v", name, err)
+		}
+	}
+
+	bob := filepath.Join(base, "example.com", "bob", "INBOX")
+	os.MkdirAll(bob, 0700)
+	if err := s.RenameMailbox("mark", "../bob/INBOX", "loot"); err == nil {
+		t.Errorf("renamed a mailbox of another user")
+	}
+	if err := s.RenameMailbox("mark", "INBOX", "../../loot"); err == nil {
+		t.Errorf("renamed a mailbox out of the user's directory")
+	}
+	if _, err := os.Stat(bob); err != nil {
+		t.Errorf("mailbox of bob gone e=%v", err)
+	}
+}
+
+// TestSharedLayout delivers through smtpd's storage and reads the INBOX
+// back as the account, stored by username or by full address
+func TestSharedLayout(t *testing.T) {
+	smtpdconfig.C.MailDir = t.TempDir()
+	defer func() {
+		smtpdconfig.C.MailDir = ""
+	}()
+	st := storage.New()
+	s, _ := NewStorage(smtpdconfig.C.MailDir, "example.com")
+
+	// Account name: recipient smtpd delivers to
+	patterns := map[string]string{
+		"mark":              "mark@example.com",
+		"Alice@example.com": "alice@example.com",
+		"bob@other.tld":     "Bob@Other.tld",
+	}
+	for name, rcpt := range patterns {
+		if err := st.StoreLocal(rcpt, "a@example.org", []byte("Subject: hi\r\n\r\nbody\r\n")); err != nil {
+			t.Fatal(err)
+		}
+		mbox, err := s.GetMailbox(name, "INBOX")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(mbox.Messages) != 1 || mbox.Messages[0].Subject != "hi" {
+			t.Errorf("%s: messages=%d, expect the one delivered to %s", name, len(mbox.Messages), rcpt)
+		}
+	}
+}
+
+// mailboxPath is MailboxPath for names tests know are valid
+func mailboxPath(s *Storage, username, mailbox string) string {
+	path, err := s.MailboxPath(username, mailbox)
+	if err != nil {
+		panic(err)
+	}
+	return path
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/mpdroog/mymail/smtpd/storage"
+)
+
+// subscriptionsFile lists the subscribed mailboxes of a user, one per line.
+// A user without one never used SUBSCRIBE, which did nothing before, so
+// all mailboxes count as subscribed.
+const subscriptionsFile = ".subscriptions"
+
+// Subscriptions returns the subscribed mailboxes of username, nil when the
+// user never (un)subscribed and all mailboxes are
+func (s *Storage) Subscriptions(username string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.loadSubscriptions(username)
+}
+
+func (s *Storage) loadSubscriptions(username string) ([]string, error) {
+	data, err := os.ReadFile(filepath.Join(s.userDir(username), subscriptionsFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	subs := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			subs = append(subs, line)
+		}
+	}
+	return subs, nil
+}
+
+// SetSubscribed adds mailbox to or removes it from the subscriptions of
+// username, the mailbox doesn't have to exist
+func (s *Storage) SetSubscribed(username, mailbox string, subscribed bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	subs, err := s.loadSubscriptions(username)
+	if err != nil {
+		return err
+	}
+	if subs == nil {
+		if subs, err = s.ListMailboxes(username); err != nil {
+			return err
+		}
+	}
+
+	subs = slices.DeleteFunc(subs, func(m string) bool { return m == mailbox })
+	if subscribed {
+		subs = append(subs, mailbox)
+	}
+	slices.Sort(subs)
+	var b strings.Builder
+	for _, m := range subs {
+		b.WriteString(m + "\n")
+	}
+	return storage.ReplaceFile(filepath.Join(s.userDir(username), subscriptionsFile), []byte(b.String()), 0600)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap/v2/imapserver"
+	"github.com/mpdroog/mymail/imapd/config"
+	"github.com/mpdroog/mymail/smtpd/tracker"
+)
+
+// slotConn holds one of max_connections until it is closed, by the session
+// or by a kick
+type slotConn struct {
+	net.Conn
+	srv   *Server
+	close sync.Once
+}
+
+func (c *slotConn) Close() error {
+	c.close.Do(func() {
+		c.srv.conns.Add(-1)
+	})
+	return c.Conn.Close()
+}
+
+// trackingListener refuses banned IPs and wraps accepted connections
+// in a tracker.Conn
+type trackingListener struct {
+	net.Listener
+	srv      *Server
+	hostname string
+}
+
+func (l *trackingListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.srv.Banned(conn.RemoteAddr()) {
+			conn.Write([]byte("* BYE Access temporarily denied by the administrator\r\n"))
+			conn.Close()
+			continue
+		}
+		// Checked before the greeting, a flood can't make imapd buffer more
+		if l.srv.conns.Load() >= int64(config.C.MaxConnections) {
+			log.Printf("Refused %s, max_connections reached", conn.RemoteAddr())
+			conn.Write([]byte("* BYE Too many connections, try again later\r\n"))
+			conn.Close()
+			continue
+		}
+		l.srv.conns.Add(1)
+		if config.C.Greeting != "" || config.C.HideCapabilities || l.hostname != "" {
+			conn = &greetingConn{Conn: conn, hostname: l.hostname}
+		}
+		return &tracker.Conn{Conn: &slotConn{Conn: conn, srv: l.srv}}, nil
+	}
+}
+
+func (srv *Server) Listen(addr, hostname string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &trackingListener{Listener: ln, srv: srv, hostname: hostname}, nil
+}
+
+func (s *Session) setState(state string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = state
+}
+
+// Info returns a snapshot for the admin API
+func (s *Session) Info() tracker.Info {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return tracker.Info{
+		Protocol:   "imap",
+		RemoteAddr: s.remoteAddr,
+		User:       s.user,
+		State:      s.state,
+		Started:    s.started,
+		Memory:     s.buffered.Load() + s.cached.Load(),
+	}
+}
+
+func newTrackedSession(srv *Server, conn *imapserver.Conn) *Session {
+	netConn := conn.NetConn()
+	sess := &Session{
+		server:     srv,
+		conn:       conn,
+		remoteAddr: netConn.RemoteAddr().String(),
+		started:    time.Now(),
+		state:      "not authenticated",
+	}
+	// Connections of tests and the demo aren't counted, nor listed
+	if counter, ok := netConn.(*tracker.Conn); ok {
+		sess.id = srv.Add(sess, counter)
+	}
+	return sess
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mpdroog/mymail/imapd/config"
+	"github.com/mpdroog/mymail/smtpd/logging"
+	"github.com/mpdroog/mymail/smtpd/storage"
+)
+
+// trashDir holds expunged messages per user as .trash/{mailbox}/{unix}-{file},
+// {unix} is the time of the EXPUNGE. The dot keeps it out of LIST.
+const trashDir = ".trash"
+
+// trashPurgeInterval is how often expired trash is removed
+const trashPurgeInterval = time.Hour
+
+// TrashMessage moves an expunged message with its flags into the trash of
+// username, or deletes it when trash_retention is 0
+func (s *Storage) TrashMessage(username, mailbox, path string) error {
+	if config.C.TrashRetention == 0 {
+		return s.DeleteMessage(path)
+	}
+
+	if err := validMailbox(mailbox); err != nil {
+		return err
+	}
+	dir := filepath.Join(s.userDir(username), trashDir, mailbox)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	dst := filepath.Join(dir, fmt.Sprintf("%d-%s", time.Now().Unix(), filepath.Base(path)))
+
+	lock, err := storage.LockMailbox(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	if err := os.Rename(path, dst); err != nil {
+		return err
+	}
+	// The message is gone from the mailbox, flags are best effort
+	if err := os.Rename(path+".flags", dst+".flags"); err != nil && !os.IsNotExist(err) {
+		log.Printf(logging.Err+"TrashMessage(%s) flags e=%v", path, err)
+	}
+	return nil
+}
+
+// PurgeTrash removes trashed messages of all users, in every domain, older
+// than retention
+func (s *Storage) PurgeTrash(retention time.Duration) error {
+	dirs, err := filepath.Glob(filepath.Join(s.basePath, "*", "*", trashDir))
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-retention).Unix()
+	for _, dir := range dirs {
+		err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			name := d.Name()
+			i := strings.IndexByte(name, '-')
+			if i == -1 {
+				return nil
+			}
+			deleted, err := strconv.ParseInt(name[:i], 10, 64)
+			if err != nil || deleted > cutoff {
+				return nil
+			}
+			return os.Remove(path)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startTrashPurge runs PurgeTrash in the background
+func startTrashPurge(s *Storage) {
+	if config.C.TrashRetention == 0 {
+		return
+	}
+	go func() {
+		for {
+			if err := s.PurgeTrash(config.C.TrashRetention); err != nil {
+				log.Printf(logging.Err+"PurgeTrash e=%v", err)
+			}
+			time.Sleep(trashPurgeInterval)
+		}
+	}()
+}
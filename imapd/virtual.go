@@ -0,0 +1,166 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/mpdroog/mymail/imapd/config"
+)
+
+// virtualUIDs numbers the messages of all_mailbox and the label mailboxes.
+// A message keeps its UID in every view while imapd runs, UIDVALIDITY
+// changes on restart so clients resync.
+type virtualUIDs struct {
+	mu       sync.Mutex
+	validity uint32
+	users    map[string]*userUIDs
+}
+
+type userUIDs struct {
+	next imap.UID
+	uids map[string]imap.UID // By message path
+}
+
+func newVirtualUIDs() *virtualUIDs {
+	return &virtualUIDs{
+		validity: uint32(time.Now().Unix()),
+		users:    make(map[string]*userUIDs),
+	}
+}
+
+// assign sets the UID of msgs, messages seen before keep theirs and new
+// ones are numbered in the order given. Messages not in live, the paths of
+// all messages in the views, are gone and forgotten. Returns the next UID.
+func (v *virtualUIDs) assign(username string, msgs []*Message, live map[string]bool) imap.UID {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	u := v.users[username]
+	if u == nil {
+		u = &userUIDs{next: 1, uids: make(map[string]imap.UID)}
+		v.users[username] = u
+	}
+	for path := range u.uids {
+		if !live[path] {
+			delete(u.uids, path)
+		}
+	}
+	for _, msg := range msgs {
+		uid, ok := u.uids[msg.Path]
+		if !ok {
+			uid = u.next
+			u.uids[msg.Path] = uid
+			u.next++
+		}
+		msg.UID = uid
+	}
+	return u.next
+}
+
+// isVirtualMailbox reports whether mailbox is built by imapd instead of
+// stored, those are read-only
+func isVirtualMailbox(mailbox string) bool {
+	_, label := labelOf(mailbox)
+	_, search := searchOf(mailbox)
+	return isActivityMailbox(mailbox) || isAllMailbox(mailbox) || label || search
+}
+
+func isAllMailbox(mailbox string) bool {
+	return config.C.AllMailbox != "" && mailbox == config.C.AllMailbox
+}
+
+// labelOf returns the keyword of a label mailbox, {label_prefix}/{keyword}
+func labelOf(mailbox string) (string, bool) {
+	if config.C.LabelPrefix == "" {
+		return "", false
+	}
+	keyword, ok := strings.CutPrefix(mailbox, config.C.LabelPrefix+"/")
+	return keyword, ok && keyword != ""
+}
+
+// inAllMail reports whether the messages of mailbox show up in the views,
+// like Gmail they leave out Trash and Junk
+func inAllMail(mailbox string) bool {
+	attr := specialUse(mailbox)
+	return attr != imap.MailboxAttrTrash && attr != imap.MailboxAttrJunk && !isVirtualMailbox(mailbox)
+}
+
+// virtualMailbox builds all_mailbox from the stored mailboxes, or a label or
+// saved search mailbox with the messages match accepts when it isn't nil
+func (s *Session) virtualMailbox(name string, match func(*Message) bool) (*Mailbox, error) {
+	mailboxes, err := s.server.storage.ListMailboxes(s.username)
+	if err != nil {
+		return nil, err
+	}
+
+	var msgs []*Message
+	live := make(map[string]bool)
+	for _, m := range mailboxes {
+		if !inAllMail(m) {
+			continue
+		}
+		mbox, err := s.server.storage.GetMailbox(s.username, m)
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range mbox.Messages {
+			live[msg.Path] = true
+			if match != nil && !match(msg) {
+				continue
+			}
+			// A copy, the UID and sequence number are the view's own
+			v := *msg
+			v.Flags = append([]imap.Flag(nil), msg.Flags...)
+			msgs = append(msgs, &v)
+		}
+	}
+
+	// New messages get their UID in date order, the view is in UID order
+	sort.SliceStable(msgs, func(i, j int) bool {
+		return msgs[i].Date.Before(msgs[j].Date)
+	})
+	next := s.server.virtual.assign(s.username, msgs, live)
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].UID < msgs[j].UID
+	})
+	for i, msg := range msgs {
+		msg.SeqNum = uint32(i + 1)
+	}
+
+	return &Mailbox{
+		Name:        name,
+		Messages:    msgs,
+		UIDNext:     next,
+		UIDValidity: s.server.virtual.validity,
+	}, nil
+}
+
+// labels returns the keywords set on any message in the views, sorted
+func (s *Session) labels() ([]string, error) {
+	mailboxes, err := s.server.storage.ListMailboxes(s.username)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for _, m := range mailboxes {
+		if !inAllMail(m) {
+			continue
+		}
+		keywords, err := s.server.storage.Keywords(s.username, m)
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range keywords {
+			seen[k] = true
+		}
+	}
+	labels := make([]string, 0, len(seen))
+	for l := range seen {
+		labels = append(labels, l)
+	}
+	sort.Strings(labels)
+	return labels, nil
+}
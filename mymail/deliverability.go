@@ -0,0 +1,126 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mpdroog/mymail/smtpd/config"
+	"github.com/mpdroog/mymail/smtpd/stats"
+)
+
+// A destination is flagged when less than half of today's attempts to it
+// got through, with at least this many attempts
+const flagAttempts = 5
+
+// cmdDeliverability reports the delivery attempts per destination domain,
+// so an operator notices when a provider starts deferring everything
+func cmdDeliverability(args []string) error {
+	fs := flag.NewFlagSet("deliverability", flag.ExitOnError)
+	configPath := fs.String("config", "config.json", "Path to smtpd configuration file")
+	days := fs.Int("days", 7, "Number of days to report (including today)")
+	minAttempts := fs.Int("min", 1, "Leave out domains with fewer attempts")
+	fs.Parse(args)
+	if *days < 1 {
+		return fmt.Errorf("-days must be 1 or more")
+	}
+
+	if err := config.Load(*configPath); err != nil {
+		return err
+	}
+	if config.C.StatsDir == "" {
+		return fmt.Errorf("stats_dir not configured")
+	}
+
+	to := time.Now()
+	from := to.AddDate(0, 0, -(*days - 1))
+	report, err := stats.LoadRange(config.C.StatsDir, from, to)
+	if err != nil {
+		return err
+	}
+	period := make(map[string]*stats.Outbound)
+	for _, d := range report {
+		for domain, o := range d.Outbound {
+			if period[domain] == nil {
+				period[domain] = &stats.Outbound{}
+			}
+			period[domain].Add(o)
+		}
+	}
+	today := report[len(report)-1].Outbound
+
+	domains := make([]string, 0, len(period))
+	for domain, o := range period {
+		if o.Attempts >= *minAttempts {
+			domains = append(domains, domain)
+		}
+	}
+	// Busiest first, the ones that matter most
+	sort.Slice(domains, func(i, j int) bool {
+		a, b := period[domains[i]], period[domains[j]]
+		if a.Attempts != b.Attempts {
+			return a.Attempts > b.Attempts
+		}
+		return domains[i] < domains[j]
+	})
+
+	fmt.Printf("Period %s - %s\n\n", report[0].Date, report[len(report)-1].Date)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "DOMAIN\tATTEMPTS\tDELIVERED\tDEFERRED\tFAILED\tSUCCESS\tTLS\tLATENCY\tTODAY\tREJECTIONS")
+	var flagged []string
+	for _, domain := range domains {
+		o := period[domain]
+		todayRate := "-"
+		if t := today[domain]; t != nil && t.Attempts > 0 {
+			todayRate = percent(t.Delivered, t.Attempts)
+			if t.Attempts >= flagAttempts && t.Delivered*2 < t.Attempts {
+				flagged = append(flagged, fmt.Sprintf("%s: %s of %d attempts today got through, %d deferred, %d failed", domain, todayRate, t.Attempts, t.Deferred, t.Failed))
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%s\t%s\t%s\t%s\t%s\n", domain, o.Attempts, o.Delivered, o.Deferred, o.Failed,
+			percent(o.Delivered, o.Attempts), percent(o.TLS, o.Attempts), o.Latency().Round(time.Millisecond), todayRate, rejections(o.Rejections))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if len(flagged) > 0 {
+		fmt.Println()
+		for _, line := range flagged {
+			fmt.Println("WARNING " + line)
+		}
+	}
+	return nil
+}
+
+func percent(n, of int) string {
+	if of == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%d%%", n*100/of)
+}
+
+// rejections lists the reputation categories, most frequent first
+func rejections(m map[string]int) string {
+	if len(m) == 0 {
+		return "-"
+	}
+	categories := make([]string, 0, len(m))
+	for category := range m {
+		categories = append(categories, category)
+	}
+	sort.Slice(categories, func(i, j int) bool {
+		if m[categories[i]] != m[categories[j]] {
+			return m[categories[i]] > m[categories[j]]
+		}
+		return categories[i] < categories[j]
+	})
+	for i, category := range categories {
+		categories[i] = fmt.Sprintf("%s=%d", category, m[category])
+	}
+	return strings.Join(categories, ",")
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mpdroog/mymail/smtpd/config"
+	"github.com/mpdroog/mymail/smtpd/dkim"
+)
+
+// cmdDkim manages the DKIM keys smtpd signs outbound mail with. A rotation
+// publishes a new selector, signs with both once it spread and retires the
+// old one after mail it signed was verified.
+func cmdDkim(args []string) error {
+	if len(args) == 0 {
+		return errors.New("expected keygen, rotate or dns")
+	}
+
+	fs := flag.NewFlagSet("dkim "+args[0], flag.ExitOnError)
+	configPath := fs.String("config", "config.json", "Path to smtpd configuration file")
+	algo := fs.String("algo", "rsa", "Key algorithm: rsa or ed25519")
+	bits := fs.Int("bits", 2048, "Size of rsa keys")
+	publish := fs.Duration("publish", 48*time.Hour, "Time for the DNS record to spread before the key signs")
+	overlap := fs.Duration("overlap", 48*time.Hour, "How long the old key keeps signing next to the new one")
+	grace := fs.Duration("grace", 7*24*time.Hour, "How long the old record stays after its last signature")
+	fs.Parse(args[1:])
+
+	if err := config.Load(*configPath); err != nil {
+		return err
+	}
+	if config.C.DKIMDir == "" {
+		return fmt.Errorf("dkim_dir not configured")
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: mymail dkim %s [flags] <domain>", args[0])
+	}
+	domain := strings.ToLower(fs.Arg(0))
+	if strings.ContainsAny(domain, `/\`) || strings.HasPrefix(domain, ".") {
+		return fmt.Errorf("invalid domain %q", domain)
+	}
+	keys, err := dkim.Keys(config.C.DKIMDir, domain)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+
+	switch args[0] {
+	case "keygen":
+		if len(keys) > 0 {
+			return fmt.Errorf("%s has keys, mymail dkim rotate replaces them", domain)
+		}
+		k, err := dkim.Generate(config.C.DKIMDir, domain, *algo, *bits, now.Add(*publish))
+		if err != nil {
+			return err
+		}
+		if err := dkim.SaveKeys(config.C.DKIMDir, domain, []dkim.Key{k}); err != nil {
+			return err
+		}
+		auditCLI("dkim keygen", domain, k.Selector)
+		fmt.Printf("Selector %s signs from %s, publish its record before then:\n", k.Selector, k.SignFrom.Format(time.RFC3339))
+		return printRecord(domain, k)
+
+	case "rotate":
+		k, err := dkim.Generate(config.C.DKIMDir, domain, *algo, *bits, now.Add(*publish))
+		if err != nil {
+			return err
+		}
+		var kept []dkim.Key
+		for _, old := range keys {
+			if old.State(now) == dkim.StateRetired {
+				if err := dkim.Remove(config.C.DKIMDir, domain, old.Selector); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+				fmt.Printf("Removed retired selector %s, delete %s._domainkey.%s from DNS\n", old.Selector, old.Selector, domain)
+				continue
+			}
+			// Both sign until the new key took over
+			if old.SignUntil.IsZero() {
+				old.SignUntil = k.SignFrom.Add(*overlap)
+				old.RetireAt = old.SignUntil.Add(*grace)
+				fmt.Printf("Selector %s signs until %s, its record can go at %s\n", old.Selector, old.SignUntil.Format(time.RFC3339), old.RetireAt.Format(time.RFC3339))
+			}
+			kept = append(kept, old)
+		}
+		if err := dkim.SaveKeys(config.C.DKIMDir, domain, append(kept, k)); err != nil {
+			return err
+		}
+		auditCLI("dkim rotate", domain, k.Selector)
+		fmt.Printf("Selector %s signs from %s, publish its record before then:\n", k.Selector, k.SignFrom.Format(time.RFC3339))
+		return printRecord(domain, k)
+
+	case "dns":
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "SELECTOR\tALGORITHM\tSTATE\tSIGN FROM\tSIGN UNTIL\tRETIRE AT")
+		for _, k := range keys {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", k.Selector, k.Algorithm, k.State(now), formatTime(k.SignFrom), formatTime(k.SignUntil), formatTime(k.RetireAt))
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+		fmt.Println()
+		for _, k := range keys {
+			if k.State(now) == dkim.StateRetired {
+				fmt.Printf("; delete %s._domainkey.%s, mymail dkim rotate removes its key\n", k.Selector, domain)
+				continue
+			}
+			if err := printRecord(domain, k); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown subcommand %q, expected keygen, rotate or dns", args[0])
+}
+
+func printRecord(domain string, k dkim.Key) error {
+	record, err := dkim.Record(config.C.DKIMDir, domain, k)
+	if err != nil {
+		return err
+	}
+	fmt.Println(record)
+	return nil
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04")
+}
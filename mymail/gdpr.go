@@ -0,0 +1,499 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/rand"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mpdroog/mymail/smtpd/audit"
+	"github.com/mpdroog/mymail/smtpd/config"
+	"github.com/mpdroog/mymail/smtpd/journal"
+	"github.com/mpdroog/mymail/smtpd/stats"
+	"github.com/mpdroog/mymail/smtpd/storage"
+	"github.com/mpdroog/mymail/smtpd/users"
+)
+
+// subject is everything stored about one user, for export and erase
+type subject struct {
+	name    string
+	addr    string
+	maildir string
+	files   map[string]string // Name in the export => per-user file of another store
+}
+
+func newSubject(name, domain string) (*subject, error) {
+	if !users.ValidName(name) {
+		return nil, fmt.Errorf("invalid username %q", name)
+	}
+	if domain == "" {
+		if len(config.C.LocalDomains) == 0 {
+			return nil, fmt.Errorf("no -domain and no local_domains configured")
+		}
+		domain = config.C.LocalDomains[0]
+	}
+	if !localDomain(domain) {
+		return nil, fmt.Errorf("domain %q is not in local_domains", domain)
+	}
+	domain = strings.ToLower(domain)
+
+	addr := name
+	if !strings.Contains(addr, "@") {
+		addr += "@" + domain
+	}
+	s := &subject{
+		name:    name,
+		addr:    strings.ToLower(addr),
+		maildir: storage.UserDir(config.C.MailDir, domain, name),
+		files:   make(map[string]string),
+	}
+	// Layouts of smtpd/activity, contacts, lockout and whitelist, contacts
+	// are kept by address (smtpd) and by username (imapd)
+	if config.C.ActivityDir != "" {
+		s.files["activity.jsonl"] = filepath.Join(config.C.ActivityDir, name+".jsonl")
+	}
+	if config.C.ContactsDir != "" {
+		s.files["contacts.json"] = filepath.Join(config.C.ContactsDir, strings.ToLower(name)+".json")
+		s.files["contacts-address.json"] = filepath.Join(config.C.ContactsDir, s.addr+".json")
+	}
+	if config.C.LockoutDir != "" {
+		s.files["lockout.json"] = filepath.Join(config.C.LockoutDir, strings.ToLower(name)+".json")
+	}
+	if config.C.WhitelistDir != "" {
+		s.files["whitelist.txt"] = filepath.Join(config.C.WhitelistDir, s.addr+".txt")
+	}
+	return s, nil
+}
+
+// localDomain reports whether domain is one of local_domains
+func localDomain(domain string) bool {
+	for _, d := range config.C.LocalDomains {
+		if strings.EqualFold(d, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// journalCopies returns the journal copies in the account of a local
+// journal_address, in dir, with the user as sender or recipient
+func (s *subject) journalCopies() (dir string, paths []string, err error) {
+	at := strings.LastIndexByte(config.C.JournalAddress, '@')
+	if at < 0 || !localDomain(config.C.JournalAddress[at+1:]) {
+		// None, or kept elsewhere
+		return "", nil, nil
+	}
+	dir = storage.UserDir(config.C.MailDir, "", config.C.JournalAddress)
+
+	err = filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == dir {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(path, ".eml") {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		e, _ := journal.Strip(data)
+		for _, addr := range append(e.To, e.From) {
+			if strings.EqualFold(addr, s.addr) {
+				paths = append(paths, path)
+				break
+			}
+		}
+		return nil
+	})
+	return dir, paths, err
+}
+
+// queue returns the queued messages sent by the user and the ones with the
+// user among their recipients
+func (s *subject) queue() (sent, received []storage.QueuedEmail, err error) {
+	all, err := storage.New().ListQueue()
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, e := range all {
+		if strings.EqualFold(e.From, s.addr) {
+			sent = append(sent, e)
+			continue
+		}
+		for _, r := range e.Recipients {
+			if strings.EqualFold(r.Address, s.addr) {
+				received = append(received, e)
+				break
+			}
+		}
+	}
+	return sent, received, nil
+}
+
+// cmdExport writes everything stored about a user to a zip file (GDPR
+// article 15/20). Daemon logs go to stderr, syslog or journald and are not
+// included.
+func cmdExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	configPath := fs.String("config", "config.json", "Path to smtpd configuration file")
+	domain := fs.String("domain", "", "Domain of the maildir (default first local_domains entry)")
+	out := fs.String("out", "", "Zip file to write (default <username>-export.zip)")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: mymail export [flags] <username>")
+	}
+	if err := config.Load(*configPath); err != nil {
+		return err
+	}
+	s, err := newSubject(fs.Arg(0), *domain)
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		*out = s.name + "-export.zip"
+	}
+
+	f, err := os.OpenFile(*out, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	z := zip.NewWriter(f)
+	err = s.export(z)
+	if cerr := z.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(*out)
+		return err
+	}
+
+	fmt.Println("Exported " + s.name + " to " + *out)
+	auditCLI("export", s.name, *out)
+	return nil
+}
+
+func (s *subject) export(z *zip.Writer) error {
+	if config.C.AuthFile != "" {
+		accounts, err := users.Load(config.C.AuthFile)
+		if err != nil {
+			return err
+		}
+		if acct := accounts[s.name]; acct != nil {
+			info := map[string]any{"username": s.name, "address": s.addr, "roles": acct.Roles, "quota": acct.Quota, "locale": acct.Locale, "identities": acct.Identities}
+			if err := zipJSON(z, "account.json", info); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Messages, flags and trash
+	err := filepath.WalkDir(s.maildir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == s.maildir {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, _ := filepath.Rel(s.maildir, path)
+		return zipFile(z, "maildir/"+filepath.ToSlash(rel), path)
+	})
+	if err != nil {
+		return err
+	}
+
+	for name, path := range s.files {
+		if err := zipFile(z, name, path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if config.C.AuditLog != "" {
+		entries := []audit.Entry{}
+		for _, user := range []string{s.name, s.addr} {
+			e, err := audit.Load(config.C.AuditLog, audit.Filter{User: user})
+			if err != nil {
+				return err
+			}
+			entries = append(entries, e...)
+		}
+		if err := zipJSON(z, "audit.json", entries); err != nil {
+			return err
+		}
+	}
+
+	sent, received, err := s.queue()
+	if err != nil {
+		return err
+	}
+	for _, e := range append(sent, received...) {
+		if err := zipJSON(z, "queue/"+e.ID+".json", e); err != nil {
+			return err
+		}
+	}
+
+	if config.C.StatsDir != "" {
+		dates, err := stats.Dates(config.C.StatsDir)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		counters := make(map[string]*stats.Counters)
+		for _, date := range dates {
+			d, err := stats.LoadDay(config.C.StatsDir, date)
+			if err != nil {
+				return err
+			}
+			if c, ok := d.Users[s.addr]; ok {
+				counters[date] = c
+			}
+		}
+		if err := zipJSON(z, "stats.json", counters); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func zipFile(z *zip.Writer, name, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	w, err := z.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: fi.ModTime()})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, f)
+	return err
+}
+
+func zipJSON(z *zip.Writer, name string, v any) error {
+	w, err := z.Create(name)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// cmdErase deletes an account and overwrites everything stored about it
+// (GDPR article 17). The audit log is append-only and keeps its entries,
+// an erase is recorded there too.
+func cmdErase(args []string) error {
+	fs := flag.NewFlagSet("erase", flag.ExitOnError)
+	configPath := fs.String("config", "config.json", "Path to smtpd configuration file")
+	domain := fs.String("domain", "", "Domain of the maildir (default first local_domains entry)")
+	yes := fs.Bool("yes", false, "Really erase, the data can't be recovered")
+	noReload := fs.Bool("no-reload", false, "Don't signal running daemons")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: mymail erase -yes [flags] <username>")
+	}
+	if err := config.Load(*configPath); err != nil {
+		return err
+	}
+	s, err := newSubject(fs.Arg(0), *domain)
+	if err != nil {
+		return err
+	}
+	if !*yes {
+		return fmt.Errorf("erasing %s can't be undone, add -yes (mymail export first?)", s.name)
+	}
+
+	// Account first so no new mail or logins come in while erasing
+	if config.C.AuthFile != "" {
+		err := users.Update(config.C.AuthFile, func(accounts map[string]*users.Account) error {
+			delete(accounts, s.name)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if !*noReload {
+			reloadDaemons()
+		}
+	}
+
+	files := 0
+	err = filepath.WalkDir(s.maildir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == s.maildir {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		files++
+		return shred(path)
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(s.maildir); err != nil {
+		return err
+	}
+
+	for _, path := range s.files {
+		if err := shred(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	archive, copies, err := s.journalCopies()
+	if err != nil {
+		return err
+	}
+	for _, path := range copies {
+		if err := shred(path); err != nil {
+			return err
+		}
+		if err := shred(path + ".flags"); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if len(copies) > 0 {
+		// imapd's index of the archive has their headers, it's rebuilt
+		if err := shredIndex(archive); err != nil {
+			return err
+		}
+	}
+
+	sent, received, err := s.queue()
+	if err != nil {
+		return err
+	}
+	// The queue entries are edited under their claim like a delivery, the
+	// daemon on this host has the same instance_id
+	config.C.InstanceID = "mymail-" + config.C.InstanceID
+	st := storage.New()
+	var busy []string
+	for _, e := range append(sent, received...) {
+		claimed, err := st.Claim(e.ID)
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			busy = append(busy, e.ID)
+			continue
+		}
+		err = s.eraseQueued(st, e.ID)
+		st.Release(e.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	if config.C.StatsDir != "" {
+		if err := stats.Forget(config.C.StatsDir, s.addr); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	fmt.Printf("Erased %s: %d mail files, %d journal copies, %d queued messages\n", s.name, files, len(copies), len(sent)+len(received)-len(busy))
+	fmt.Println("Restart smtpd to drop today's in-memory counters, backups and the journal chain are not touched")
+	auditCLI("erase", s.name, fmt.Sprintf("%d files", files))
+	if len(busy) > 0 {
+		return fmt.Errorf("queued messages %s are being delivered, run erase again", strings.Join(busy, ", "))
+	}
+	return nil
+}
+
+// eraseQueued removes the user from queue entry id, reloaded now it's
+// claimed. The entry goes when the user sent it or was its only recipient,
+// other recipients still get the message.
+func (s *subject) eraseQueued(st *storage.Storage, id string) error {
+	e, err := st.GetQueuedEmail(id)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	rcpts := e.Recipients[:0]
+	for _, r := range e.Recipients {
+		if !strings.EqualFold(r.Address, s.addr) {
+			rcpts = append(rcpts, r)
+		}
+	}
+	e.Recipients = rcpts
+	if len(rcpts) > 0 && !strings.EqualFold(e.From, s.addr) {
+		return st.UpdateQueuedEmail(e)
+	}
+	if err := shred(filepath.Join(config.C.QueueDir, id+".json")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// Only the hold marker is left
+	st.RemoveFromQueue(id)
+	return nil
+}
+
+// shredIndex overwrites imapd's index of the account in dir
+func shredIndex(dir string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, ".index", "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if err := shred(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// shred overwrites path with random data before removing it. Message files
+// are read-only and may be hard links (COPY), all of them are in the same
+// maildir. Journaling or copy-on-write filesystems and SSDs can still hold
+// old blocks, use full-disk encryption for a real guarantee.
+func shred(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if fi.Mode().IsRegular() && fi.Size() > 0 {
+		if err := os.Chmod(path, 0600); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		_, err = io.CopyN(f, rand.Reader, fi.Size())
+		if err == nil {
+			err = f.Sync()
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return os.Remove(path)
+}
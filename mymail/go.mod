@@ -0,0 +1,9 @@
+module github.com/mpdroog/mymail/mymail
+
+go 1.24
+
+require github.com/mpdroog/mymail/smtpd v0.0.0-00010101000000-000000000000
+
+require github.com/coreos/go-systemd/v22 v22.7.0 // indirect
+
+replace github.com/mpdroog/mymail/smtpd => ../smtpd
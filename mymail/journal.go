@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mpdroog/mymail/smtpd/config"
+	"github.com/mpdroog/mymail/smtpd/journal"
+)
+
+// cmdVerifyJournal checks the journal hash chain and, with -dir, that every
+// journal copy in an archive mailbox is unchanged and in the chain
+func cmdVerifyJournal(args []string) error {
+	fs := flag.NewFlagSet("verify-journal", flag.ExitOnError)
+	configPath := fs.String("config", "config.json", "Path to smtpd configuration file")
+	dir := fs.String("dir", "", "Archive mailbox with journal copies, e.g. maildir/example.com/archive/INBOX")
+	fs.Parse(args)
+
+	if err := config.Load(*configPath); err != nil {
+		return err
+	}
+
+	entries, err := journal.Load(config.C.JournalChain)
+	if err != nil {
+		return err
+	}
+	if err := journal.Verify(entries); err != nil {
+		return fmt.Errorf("%s: %v", config.C.JournalChain, err)
+	}
+	if err := journal.VerifyTail(config.C.JournalChain, entries); err != nil {
+		return fmt.Errorf("%s: %v", config.C.JournalChain, err)
+	}
+	fmt.Printf("Chain %s: %d entries intact\n", config.C.JournalChain, len(entries))
+	if *dir == "" {
+		return nil
+	}
+
+	digests := make(map[string]string, len(entries))
+	for _, e := range entries {
+		digests[e.Hash] = e.Digest
+	}
+	var total, bad int
+	err = filepath.WalkDir(*dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(path, ".eml") {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		total++
+
+		e, original := journal.Strip(data)
+		digest, ok := digests[e.Hash]
+		switch {
+		case e.Hash == "":
+			bad++
+			fmt.Println("NOHASH   " + path)
+		case !ok:
+			bad++
+			fmt.Println("UNKNOWN  " + path)
+		case digest != journal.Digest(original):
+			bad++
+			fmt.Println("CHANGED  " + path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Checked %d journal copies: %d bad\n", total, bad)
+	if bad > 0 {
+		return fmt.Errorf("%d journal copies failed verification", bad)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/mpdroog/mymail/smtpd/audit"
+	"github.com/mpdroog/mymail/smtpd/config"
+	"github.com/mpdroog/mymail/smtpd/logging"
+)
+
+// command is a mymail subcommand, args excludes the command name
+type command struct {
+	run   func(args []string) error
+	usage string
+}
+
+var commands = map[string]command{
+	"deliverability":      {cmdDeliverability, "deliverability [-config smtpd.json] [-days 7] [-min 1]    delivery success, TLS, latency and rejections per destination domain"},
+	"dkim":                {cmdDkim, "dkim keygen|rotate|dns [-config smtpd.json] [-algo rsa|ed25519] [-bits 2048] [-publish 48h] [-overlap 48h] [-grace 168h] <domain>    manage the keys outbound mail is DKIM signed with and print their DNS records"},
+	"erase":               {cmdErase, "erase -yes [-config smtpd.json] [-domain example.com] [-no-reload] <username>    delete an account and overwrite all its data"},
+	"export":              {cmdExport, "export [-config smtpd.json] [-domain example.com] [-out file.zip] <username>    write all data about a user to a zip file"},
+	"restore":             {cmdRestore, "restore [-config smtpd.json] [-domain example.com] <archive.zip> <username>    put the mailboxes of an export back, skipping messages still stored"},
+	"selftest":            {cmdSelftest, "selftest [-config smtpd.json] [-domain example.com] [-smtp localhost:25] [-imap localhost:143] [-admin name] [-timeout 30s] [-keep] [-reflector check-auth@verifier.port25.com] <username>    deliver a probe through smtpd and find it over IMAP, optionally have a reflector check DKIM, the password is read from stdin"},
+	"stats":               {cmdStats, "stats [-config smtpd.json] [-days 7] [-csv]    usage report per user and domain"},
+	"verify-backup":       {cmdVerifyBackup, "verify-backup [-config smtpd.json] [-domain example.com] <archive.zip> <username>    compare an export with the stored mailboxes"},
+	"verify-journal":      {cmdVerifyJournal, "verify-journal [-config smtpd.json] [-dir maildir/example.com/archive/INBOX]    check the journal hash chain and archived copies"},
+	"verify-immutability": {cmdVerifyImmutability, "verify-immutability [-config smtpd.json] [-manifest path] [-fix]    check message files didn't change since the last run"},
+	"undelete":            {cmdUndelete, "undelete [-config smtpd.json] [-domain example.com] [-mailbox INBOX] [-since 24h] [-list] <username>    restore expunged messages from the trash"},
+	"user":                {cmdUser, "user add|del|passwd|list [-config smtpd.json] [-roles admin,user] [-quota 1GB] [-locale nl] [-domain example.com] [-no-reload] <username>    manage accounts, the password is read from stdin\n  user identities [-config smtpd.json] <username> [address|@domain ...]    set the From addresses a user may send as"},
+}
+
+// auditCLI records a change made with mymail in audit_log, the actor is the
+// login that ran it
+func auditCLI(action, target, result string) {
+	user := os.Getenv("SUDO_USER")
+	if user == "" {
+		user = os.Getenv("USER")
+	}
+	e := audit.Entry{Protocol: "cli", User: user, Action: action, Target: target, Result: result}
+	if err := audit.Record(config.C.AuditLog, e); err != nil {
+		fmt.Fprintf(os.Stderr, "Audit log e=%v\n", err)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: mymail <command> [flags]")
+	fmt.Fprintln(os.Stderr, "Commands:")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintln(os.Stderr, "  "+commands[name].usage)
+	}
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	c, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+	}
+	// Shared packages log with a severity prefix
+	logging.Setup("", "", "mymail")
+	if err := c.run(os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "mymail %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
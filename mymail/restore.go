@@ -0,0 +1,355 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mpdroog/mymail/smtpd/config"
+	"github.com/mpdroog/mymail/smtpd/storage"
+)
+
+// backupMessage is a message file of an export archive or of the maildir
+type backupMessage struct {
+	name     string   // {unix}_{uid}.eml
+	sum      string   // Hex SHA-256
+	flags    []string // Sorted
+	modified time.Time
+	open     func() (io.ReadCloser, error)
+}
+
+// readArchive returns the messages of an export archive by mailbox, hidden
+// directories like imapd's .trash are left out
+func readArchive(z *zip.Reader) (map[string][]*backupMessage, error) {
+	flags := make(map[string]*zip.File)
+	for _, f := range z.File {
+		if strings.HasSuffix(f.Name, ".eml.flags") {
+			flags[strings.TrimSuffix(f.Name, ".flags")] = f
+		}
+	}
+
+	boxes := make(map[string][]*backupMessage)
+	for _, f := range z.File {
+		rel, ok := strings.CutPrefix(f.Name, "maildir/")
+		if !ok || !strings.HasSuffix(rel, ".eml") {
+			continue
+		}
+		box, name := path.Split(rel)
+		box = strings.TrimSuffix(box, "/")
+		if box == "" || !validMailbox(box) {
+			continue
+		}
+
+		msg := &backupMessage{name: name, modified: f.Modified, open: f.Open}
+		r, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		msg.sum, err = readerSum(r)
+		r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", f.Name, err)
+		}
+		if ff := flags[f.Name]; ff != nil {
+			r, err := ff.Open()
+			if err != nil {
+				return nil, err
+			}
+			data, err := io.ReadAll(r)
+			r.Close()
+			if err != nil {
+				return nil, err
+			}
+			msg.flags = parseFlags(data)
+		}
+		boxes[box] = append(boxes[box], msg)
+	}
+	return boxes, nil
+}
+
+// validMailbox refuses hidden and relative path components, an archive
+// can't write outside the user's maildir
+func validMailbox(box string) bool {
+	for _, c := range strings.Split(box, "/") {
+		if c == "" || strings.HasPrefix(c, ".") {
+			return false
+		}
+	}
+	return true
+}
+
+// scanMaildir returns the messages of a user's maildir by mailbox, like
+// readArchive
+func scanMaildir(root string) (map[string][]*backupMessage, error) {
+	boxes := make(map[string][]*backupMessage)
+	err := filepath.WalkDir(root, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && p == root {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() && p != root && strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if d.IsDir() || !strings.HasSuffix(p, ".eml") {
+			return nil
+		}
+		rel, _ := filepath.Rel(root, filepath.Dir(p))
+		if rel == "." {
+			return nil
+		}
+
+		sum, err := fileSum(p)
+		if err != nil {
+			return err
+		}
+		msg := &backupMessage{name: d.Name(), sum: sum}
+		if data, err := os.ReadFile(p + ".flags"); err == nil {
+			msg.flags = parseFlags(data)
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		box := filepath.ToSlash(rel)
+		boxes[box] = append(boxes[box], msg)
+		return nil
+	})
+	return boxes, err
+}
+
+func readerSum(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// parseFlags reads a .flags sidecar, one flag per line
+func parseFlags(data []byte) []string {
+	var flags []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			flags = append(flags, line)
+		}
+	}
+	slices.Sort(flags)
+	return flags
+}
+
+// bySum indexes messages by checksum, a mailbox can hold the same message
+// more than once
+func bySum(msgs []*backupMessage) map[string][]*backupMessage {
+	sums := make(map[string][]*backupMessage)
+	for _, msg := range msgs {
+		sums[msg.sum] = append(sums[msg.sum], msg)
+	}
+	return sums
+}
+
+// cmdRestore puts the mailboxes of an export archive back into a user's
+// maildir. Messages get new UIDs and keep their flags and dates, ones that
+// are still stored are skipped so a restore can be repeated. Mailboxes the
+// restore creates get a new UIDVALIDITY, existing ones keep theirs as the
+// new UIDs are above anything a client cached.
+func cmdRestore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	configPath := fs.String("config", "config.json", "Path to smtpd configuration file")
+	domain := fs.String("domain", "", "Domain of the maildir (default first local_domains entry)")
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		return fmt.Errorf("usage: mymail restore [flags] <archive.zip> <username>")
+	}
+	if err := config.Load(*configPath); err != nil {
+		return err
+	}
+	s, err := newSubject(fs.Arg(1), *domain)
+	if err != nil {
+		return err
+	}
+
+	z, err := zip.OpenReader(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer z.Close()
+	archived, err := readArchive(&z.Reader)
+	if err != nil {
+		return err
+	}
+	live, err := scanMaildir(s.maildir)
+	if err != nil {
+		return err
+	}
+
+	var restored, present int
+	for _, box := range sortedKeys(archived) {
+		n, err := restoreMailbox(filepath.Join(s.maildir, filepath.FromSlash(box)), archived[box], bySum(live[box]))
+		restored += n
+		present += len(archived[box]) - n
+		if err != nil {
+			return fmt.Errorf("%s: %v", box, err)
+		}
+	}
+
+	fmt.Printf("Restored %d messages in %d mailboxes, %d were still stored\n", restored, len(archived), present)
+	auditCLI("restore", s.name, fmt.Sprintf("%d restored", restored))
+	return nil
+}
+
+// restoreMailbox writes the archived messages missing from live to dir and
+// returns how many
+func restoreMailbox(dir string, msgs []*backupMessage, live map[string][]*backupMessage) (int, error) {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return 0, err
+		}
+		// imapd takes a mailbox with .uidnext for an old one with UIDVALIDITY 1
+		v := strconv.FormatInt(time.Now().Unix(), 10)
+		if err := os.WriteFile(filepath.Join(dir, ".uidvalidity"), []byte(v), 0600); err != nil {
+			return 0, err
+		}
+	} else if err != nil {
+		return 0, err
+	}
+
+	// imapd and smtpd may be writing the mailbox
+	lock, err := storage.LockMailbox(dir)
+	if err != nil {
+		return 0, err
+	}
+	defer lock.Unlock()
+
+	restored := 0
+	for _, msg := range msgs {
+		if len(live[msg.sum]) > 0 {
+			live[msg.sum] = live[msg.sum][1:]
+			continue
+		}
+
+		r, err := msg.open()
+		if err != nil {
+			return restored, err
+		}
+		data, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return restored, err
+		}
+
+		uid, err := lock.NextUID()
+		if err != nil {
+			return restored, err
+		}
+		// Keep the date part of {unix}_{uid}.eml
+		date, _, _ := strings.Cut(msg.name, "_")
+		name := fmt.Sprintf("%s_%d.eml", date, uid)
+		if len(msg.flags) > 0 {
+			if err := lock.WriteFlags(name, msg.flags); err != nil {
+				return restored, err
+			}
+		}
+		if err := storage.WriteMessage(filepath.Join(dir, name), bytes.NewReader(data), 0640); err != nil {
+			return restored, err
+		}
+		if !msg.modified.IsZero() {
+			os.Chtimes(filepath.Join(dir, name), msg.modified, msg.modified)
+		}
+		restored++
+	}
+	return restored, nil
+}
+
+// cmdVerifyBackup compares an export archive with a user's maildir by
+// message contents, UIDs and filenames differ after a restore. Messages of
+// the archive that are gone or have other flags make it fail, messages
+// only in storage are listed.
+func cmdVerifyBackup(args []string) error {
+	fs := flag.NewFlagSet("verify-backup", flag.ExitOnError)
+	configPath := fs.String("config", "config.json", "Path to smtpd configuration file")
+	domain := fs.String("domain", "", "Domain of the maildir (default first local_domains entry)")
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		return fmt.Errorf("usage: mymail verify-backup [flags] <archive.zip> <username>")
+	}
+	if err := config.Load(*configPath); err != nil {
+		return err
+	}
+	s, err := newSubject(fs.Arg(1), *domain)
+	if err != nil {
+		return err
+	}
+
+	z, err := zip.OpenReader(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer z.Close()
+	archived, err := readArchive(&z.Reader)
+	if err != nil {
+		return err
+	}
+	live, err := scanMaildir(s.maildir)
+	if err != nil {
+		return err
+	}
+
+	var total, missing, changed, added int
+	for _, box := range sortedKeys(archived) {
+		sums := bySum(live[box])
+		for _, msg := range archived[box] {
+			total++
+			stored := sums[msg.sum]
+			if len(stored) == 0 {
+				missing++
+				fmt.Println("MISSING  " + box + "/" + msg.name)
+				continue
+			}
+			sums[msg.sum] = stored[1:]
+			if !slices.Equal(msg.flags, stored[0].flags) {
+				changed++
+				fmt.Printf("FLAGS    %s/%s archive=%v stored=%v\n", box, stored[0].name, msg.flags, stored[0].flags)
+			}
+		}
+		// What is left of the mailbox isn't in the archive
+		live[box] = nil
+		for _, stored := range sums {
+			live[box] = append(live[box], stored...)
+		}
+		slices.SortFunc(live[box], func(a, b *backupMessage) int { return strings.Compare(a.name, b.name) })
+	}
+	for _, box := range sortedKeys(live) {
+		for _, msg := range live[box] {
+			added++
+			fmt.Println("NEW      " + box + "/" + msg.name)
+		}
+	}
+
+	fmt.Printf("Checked %d archived messages: %d missing, %d with other flags, %d only in storage\n", total, missing, changed, added)
+	if missing > 0 || changed > 0 {
+		return fmt.Errorf("%d missing and %d changed messages", missing, changed)
+	}
+	return nil
+}
+
+func sortedKeys(m map[string][]*backupMessage) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mpdroog/mymail/smtpd/config"
+	"github.com/mpdroog/mymail/smtpd/dkim"
+	"github.com/mpdroog/mymail/smtpd/dns"
+)
+
+// cmdSelftest sends a probe to a local account through smtpd and waits for
+// it in the account's INBOX over IMAP, the path every delivered message
+// takes. With -reflector a second probe goes out as the user to an address
+// that answers with its DKIM verdict. It prints PASS, FAIL or SKIP per step
+// and fails when any step did.
+func cmdSelftest(args []string) error {
+	fs := flag.NewFlagSet("selftest", flag.ExitOnError)
+	configPath := fs.String("config", "config.json", "Path to smtpd configuration file")
+	domain := fs.String("domain", "", "Domain of the account (default first local_domains entry)")
+	smtpAddr := fs.String("smtp", "", "smtpd address (default listen_addr on localhost)")
+	imapAddr := fs.String("imap", "localhost:143", "imapd address")
+	timeout := fs.Duration("timeout", 30*time.Second, "How long to wait for the probe in the INBOX")
+	keep := fs.Bool("keep", false, "Leave the probe in the INBOX")
+	reflector := fs.String("reflector", "", "Address answering with the DKIM verdict of a message, e.g. check-auth@verifier.port25.com")
+	reflectorTimeout := fs.Duration("reflector-timeout", 2*time.Minute, "How long to wait for the reflector's answer")
+	admin := fs.String("admin", "", "Log in to imapd as this admin on behalf of the user, with the admin's password")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: mymail selftest [flags] <username>")
+	}
+	if err := config.Load(*configPath); err != nil {
+		return err
+	}
+	dns.Init(config.C.DNSServers)
+	s, err := newSubject(fs.Arg(0), *domain)
+	if err != nil {
+		return err
+	}
+	if *smtpAddr == "" {
+		_, port, err := net.SplitHostPort(config.C.ListenAddr)
+		if err != nil {
+			return fmt.Errorf("listen_addr %q: %v", config.C.ListenAddr, err)
+		}
+		*smtpAddr = net.JoinHostPort("localhost", port)
+	}
+	login := s.name
+	if *admin != "" {
+		login = s.name + "*" + *admin
+	}
+	pass, err := readPassword()
+	if err != nil {
+		return err
+	}
+
+	token := make([]byte, 8)
+	rand.Read(token)
+	subject := "mymail selftest " + hex.EncodeToString(token)
+
+	failed := 0
+	report := func(result, step, detail string) {
+		if result == "FAIL" {
+			failed++
+		}
+		fmt.Printf("%-4s %-8s %s\n", result, step, detail)
+	}
+
+	start := time.Now()
+	from := "postmaster@" + config.C.Hostname
+	if err := sendProbe(*smtpAddr, from, s.addr, subject, nil); err != nil {
+		report("FAIL", "smtp", err.Error())
+	} else {
+		report("PASS", "smtp", fmt.Sprintf("%s accepted the probe to %s in %s", *smtpAddr, s.addr, time.Since(start).Round(time.Millisecond)))
+
+		start = time.Now()
+		if err := awaitProbe(*imapAddr, login, pass, subject, *timeout, *keep); err != nil {
+			report("FAIL", "imap", err.Error())
+		} else {
+			report("PASS", "imap", fmt.Sprintf("probe in INBOX of %s after %s", s.name, time.Since(start).Round(time.Millisecond)))
+		}
+	}
+	checkDkim(config.C.Hostname, report)
+
+	switch {
+	case *reflector == "":
+		report("SKIP", "reflect", "no -reflector given")
+	case *admin != "":
+		report("SKIP", "reflect", "sending as "+s.name+" needs their password, not -admin")
+	default:
+		start = time.Now()
+		host, _, _ := net.SplitHostPort(*smtpAddr)
+		auth := smtp.PlainAuth("", s.name, pass, host)
+		if verdict, err := reflect(*smtpAddr, *imapAddr, s, pass, *reflector, subject, *reflectorTimeout, *keep, auth); err != nil {
+			report("FAIL", "reflect", err.Error())
+		} else if verdict != "pass" {
+			report("FAIL", "reflect", fmt.Sprintf("%s saw dkim=%s", *reflector, verdict))
+		} else {
+			report("PASS", "reflect", fmt.Sprintf("%s saw dkim=pass after %s", *reflector, time.Since(start).Round(time.Millisecond)))
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d steps failed", failed)
+	}
+	return nil
+}
+
+// checkDkim compares the DNS record of each selector that signs mail of
+// domain with its key, the probe's From is in domain
+func checkDkim(domain string, report func(result, step, detail string)) {
+	if config.C.DKIMDir == "" {
+		report("SKIP", "dkim", "dkim_dir not configured")
+		return
+	}
+	active, err := dkim.Active(config.C.DKIMDir, domain, time.Now())
+	if err != nil {
+		report("FAIL", "dkim", err.Error())
+		return
+	}
+	if len(active) == 0 {
+		report("SKIP", "dkim", "no active keys for "+domain)
+		return
+	}
+	for selector, key := range active {
+		name := selector + "._domainkey." + domain
+		p, err := dkim.PublicKey(key)
+		if err != nil {
+			report("FAIL", "dkim", err.Error())
+			continue
+		}
+		txts, err := dns.LookupTXT(name)
+		if err != nil {
+			report("FAIL", "dkim", err.Error())
+			continue
+		}
+		// A record of several strings comes back joined
+		found := false
+		for _, txt := range txts {
+			for _, tag := range strings.Split(txt, ";") {
+				if k, v, _ := strings.Cut(tag, "="); strings.TrimSpace(k) == "p" {
+					found = found || strings.Join(strings.Fields(v), "") == p
+				}
+			}
+		}
+		if found {
+			report("PASS", "dkim", name+" matches the key")
+		} else {
+			report("FAIL", "dkim", name+" doesn't publish the key, see mymail dkim dns "+domain)
+		}
+	}
+}
+
+// sendProbe delivers a probe with subject from from to addr like any other
+// sender, over STARTTLS when smtpd offers it and authenticated with auth
+// unless nil
+func sendProbe(smtpAddr, from, addr, subject string, auth smtp.Auth) error {
+	c, err := smtp.Dial(smtpAddr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err := c.Hello("selftest." + config.C.Hostname); err != nil {
+		return err
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: config.C.Hostname}); err != nil {
+			return fmt.Errorf("starttls: %v", err)
+		}
+	}
+	if auth != nil {
+		if err := c.Auth(auth); err != nil {
+			return fmt.Errorf("AUTH: %v", err)
+		}
+	}
+
+	msg := "From: " + from + "\r\n"
+	msg += "To: " + addr + "\r\n"
+	msg += "Subject: " + subject + "\r\n"
+	msg += "Date: " + time.Now().Format(time.RFC1123Z) + "\r\n"
+	msg += "\r\n"
+	msg += "Sent by mymail selftest, safe to delete.\r\n"
+
+	if err := c.Mail(from); err != nil {
+		return fmt.Errorf("MAIL: %v", err)
+	}
+	if err := c.Rcpt(addr); err != nil {
+		return fmt.Errorf("RCPT: %v", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("DATA: %v", err)
+	}
+	if _, err := w.Write([]byte(msg)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("DATA: %v", err)
+	}
+	return c.Quit()
+}
+
+// imapQuote makes s an IMAP quoted string
+func imapQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+var (
+	fetchUID = regexp.MustCompile(`^\* \d+ FETCH \(.*UID (\d+)`)
+	exists   = regexp.MustCompile(`^\* (\d+) EXISTS`)
+	verdict  = regexp.MustCompile(`(?i)\bdkim(?:=| check: *)(pass|fail|neutral|none|policy|permerror|temperror)\b`)
+)
+
+// imapConn is a logged in IMAP connection, enough to find a message
+type imapConn struct {
+	conn net.Conn
+	c    *textproto.Conn
+	n    int
+}
+
+// dialIMAP logs in to imapd as user over STARTTLS. Without STARTTLS the
+// password is only sent over loopback.
+func dialIMAP(addr, user, pass string, timeout time.Duration) (*imapConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout + 10*time.Second))
+	ic := &imapConn{conn: conn, c: textproto.NewConn(conn)}
+	if _, err := ic.c.ReadLine(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	caps, err := ic.cmd("CAPABILITY")
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("CAPABILITY: %v", err)
+	}
+	if slices.ContainsFunc(caps, func(line string) bool {
+		return strings.HasPrefix(line, "* CAPABILITY ") && slices.Contains(strings.Fields(line), "STARTTLS")
+	}) {
+		if _, err := ic.cmd("STARTTLS"); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("STARTTLS: %v", err)
+		}
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: config.C.Hostname})
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("starttls: %v", err)
+		}
+		ic.conn, ic.c = tlsConn, textproto.NewConn(tlsConn)
+	} else if tcp, ok := conn.RemoteAddr().(*net.TCPAddr); !ok || !tcp.IP.IsLoopback() {
+		conn.Close()
+		return nil, fmt.Errorf("%s doesn't offer STARTTLS, not sending the password in the clear", addr)
+	}
+
+	if _, err := ic.cmd("LOGIN %s %s", imapQuote(user), imapQuote(pass)); err != nil {
+		ic.conn.Close()
+		return nil, fmt.Errorf("LOGIN: %v", err)
+	}
+	return ic, nil
+}
+
+// cmd sends one command and returns the untagged lines of its answer
+func (ic *imapConn) cmd(format string, args ...any) ([]string, error) {
+	ic.n++
+	tag := "s" + strconv.Itoa(ic.n)
+	if err := ic.c.PrintfLine(tag+" "+format, args...); err != nil {
+		return nil, err
+	}
+	var lines []string
+	for {
+		line, err := ic.c.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		if rest, ok := strings.CutPrefix(line, tag+" "); ok {
+			if !strings.HasPrefix(rest, "OK") {
+				return nil, fmt.Errorf("%s", rest)
+			}
+			return lines, nil
+		}
+		lines = append(lines, line)
+	}
+}
+
+// Close logs out
+func (ic *imapConn) Close() error {
+	ic.cmd("LOGOUT")
+	return ic.conn.Close()
+}
+
+// selectInbox selects the INBOX and returns its number of messages
+func (ic *imapConn) selectInbox() (int, error) {
+	lines, err := ic.cmd("SELECT INBOX")
+	if err != nil {
+		return 0, fmt.Errorf("SELECT: %v", err)
+	}
+	for _, line := range lines {
+		if m := exists.FindStringSubmatch(line); m != nil {
+			return strconv.Atoi(m[1])
+		}
+	}
+	return 0, nil
+}
+
+// expunge removes the message with uid from the selected mailbox
+func (ic *imapConn) expunge(uid string) error {
+	if _, err := ic.cmd(`UID STORE %s +FLAGS.SILENT (\Deleted)`, uid); err != nil {
+		return fmt.Errorf("STORE: %v", err)
+	}
+	if _, err := ic.cmd("UID EXPUNGE %s", uid); err != nil {
+		return fmt.Errorf("EXPUNGE: %v", err)
+	}
+	return nil
+}
+
+// awaitProbe logs in to imapd and looks for subject in the INBOX every
+// second until timeout, the probe is expunged unless keep
+func awaitProbe(imapAddr, user, pass, subject string, timeout time.Duration, keep bool) error {
+	ic, err := dialIMAP(imapAddr, user, pass, timeout)
+	if err != nil {
+		return err
+	}
+	defer ic.Close()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		n, err := ic.selectInbox()
+		if err != nil {
+			return err
+		}
+		var lines []string
+		if n > 0 {
+			if lines, err = ic.cmd("FETCH 1:* (UID BODY.PEEK[HEADER.FIELDS (SUBJECT)])"); err != nil {
+				return fmt.Errorf("FETCH: %v", err)
+			}
+		}
+		uid := ""
+		for _, line := range lines {
+			if m := fetchUID.FindStringSubmatch(line); m != nil {
+				uid = m[1]
+			} else if strings.Contains(line, subject) && uid != "" {
+				if keep {
+					return nil
+				}
+				return ic.expunge(uid)
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("probe not in INBOX after %s", timeout)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// reflect sends a probe as the user to reflector and returns the DKIM
+// verdict in its answer, which quotes the probe's subject. The answer is
+// expunged unless keep.
+func reflect(smtpAddr, imapAddr string, s *subject, pass, reflector, subject string, timeout time.Duration, keep bool, auth smtp.Auth) (string, error) {
+	ic, err := dialIMAP(imapAddr, s.name, pass, timeout)
+	if err != nil {
+		return "", err
+	}
+	defer ic.Close()
+	before, err := ic.selectInbox()
+	if err != nil {
+		return "", err
+	}
+	if err := sendProbe(smtpAddr, s.addr, reflector, subject, auth); err != nil {
+		return "", err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		n, err := ic.selectInbox()
+		if err != nil {
+			return "", err
+		}
+		if n > before {
+			lines, err := ic.cmd("FETCH %d:* (UID BODY.PEEK[])", before+1)
+			if err != nil {
+				return "", fmt.Errorf("FETCH: %v", err)
+			}
+			// Messages follow each other, the answer quotes the subject and
+			// has a verdict in its body. Its own headers have the verdict
+			// of smtpd about the answer.
+			uid, found, body, result := "", false, false, ""
+			done := func() (string, bool, error) {
+				if !found || result == "" {
+					return "", false, nil
+				}
+				if !keep {
+					return result, true, ic.expunge(uid)
+				}
+				return result, true, nil
+			}
+			for _, line := range lines {
+				if m := fetchUID.FindStringSubmatch(line); m != nil {
+					if v, ok, err := done(); ok {
+						return v, err
+					}
+					uid, found, body, result = m[1], false, false, ""
+					continue
+				}
+				found = found || strings.Contains(line, subject)
+				body = body || line == ""
+				if m := verdict.FindStringSubmatch(line); m != nil && body && result == "" {
+					result = strings.ToLower(m[1])
+				}
+			}
+			if v, ok, err := done(); ok {
+				return v, err
+			}
+		}
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("no answer from %s after %s", reflector, timeout)
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mpdroog/mymail/smtpd/config"
+	"github.com/mpdroog/mymail/smtpd/stats"
+)
+
+func cmdStats(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	configPath := fs.String("config", "config.json", "Path to smtpd configuration file")
+	days := fs.Int("days", 7, "Number of days to report (including today)")
+	asCSV := fs.Bool("csv", false, "Export per-day rows as CSV")
+	fs.Parse(args)
+	if *days < 1 {
+		return fmt.Errorf("-days must be 1 or more")
+	}
+
+	if err := config.Load(*configPath); err != nil {
+		return err
+	}
+	if config.C.StatsDir == "" {
+		return fmt.Errorf("stats_dir not configured")
+	}
+
+	to := time.Now()
+	from := to.AddDate(0, 0, -(*days - 1))
+	report, err := stats.LoadRange(config.C.StatsDir, from, to)
+	if err != nil {
+		return err
+	}
+
+	if *asCSV {
+		return writeStatsCSV(report)
+	}
+	return writeStatsTable(report)
+}
+
+func writeStatsCSV(days []*stats.Day) error {
+	w := csv.NewWriter(os.Stdout)
+	w.Write([]string{"date", "type", "name", "sent", "received", "rejected", "bounced"})
+	for _, d := range days {
+		for _, kind := range []string{"user", "domain"} {
+			m := d.Users
+			if kind == "domain" {
+				m = d.Domains
+			}
+			for _, name := range stats.SortedKeys(m) {
+				c := m[name]
+				w.Write([]string{d.Date, kind, name,
+					strconv.Itoa(c.Sent), strconv.Itoa(c.Received),
+					strconv.Itoa(c.Rejected), strconv.Itoa(c.Bounced)})
+			}
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func writeStatsTable(days []*stats.Day) error {
+	if len(days) == 0 {
+		fmt.Println("No stats for the period")
+		return nil
+	}
+	users := make(map[string]*stats.Counters)
+	domains := make(map[string]*stats.Counters)
+	for _, d := range days {
+		sum(users, d.Users)
+		sum(domains, d.Domains)
+	}
+
+	fmt.Printf("Period %s - %s\n\n", days[0].Date, days[len(days)-1].Date)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, section := range []struct {
+		title string
+		m     map[string]*stats.Counters
+	}{{"USER", users}, {"DOMAIN", domains}} {
+		fmt.Fprintf(tw, "%s\tSENT\tRECEIVED\tREJECTED\tBOUNCED\n", section.title)
+		for _, name := range stats.SortedKeys(section.m) {
+			c := section.m[name]
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\n", name, c.Sent, c.Received, c.Rejected, c.Bounced)
+		}
+		fmt.Fprintln(tw)
+	}
+	return tw.Flush()
+}
+
+func sum(dst, src map[string]*stats.Counters) {
+	for name, c := range src {
+		if dst[name] == nil {
+			dst[name] = &stats.Counters{}
+		}
+		dst[name].Sent += c.Sent
+		dst[name].Received += c.Received
+		dst[name].Rejected += c.Rejected
+		dst[name].Bounced += c.Bounced
+	}
+}
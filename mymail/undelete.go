@@ -0,0 +1,120 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mpdroog/mymail/smtpd/config"
+	"github.com/mpdroog/mymail/smtpd/storage"
+)
+
+// cmdUndelete moves expunged messages from imapd's trash back into their
+// mailbox, layout {user}/.trash/{mailbox}/{expunged unix}-{unix}_{uid}.eml
+func cmdUndelete(args []string) error {
+	fs := flag.NewFlagSet("undelete", flag.ExitOnError)
+	configPath := fs.String("config", "config.json", "Path to smtpd configuration file")
+	domain := fs.String("domain", "", "Domain of the maildir (default first local_domains entry)")
+	mailbox := fs.String("mailbox", "", "Only restore messages expunged from this mailbox")
+	since := fs.Duration("since", 0, "Only restore messages expunged this long ago or later, e.g. 24h (0=all)")
+	list := fs.Bool("list", false, "Show what would be restored")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: mymail undelete [flags] <username>")
+	}
+	if err := config.Load(*configPath); err != nil {
+		return err
+	}
+	if *domain == "" {
+		if len(config.C.LocalDomains) == 0 {
+			return fmt.Errorf("no -domain and no local_domains configured")
+		}
+		*domain = config.C.LocalDomains[0]
+	}
+
+	userDir := storage.UserDir(config.C.MailDir, *domain, fs.Arg(0))
+	trash := filepath.Join(userDir, ".trash")
+	var cutoff int64
+	if *since > 0 {
+		cutoff = time.Now().Add(-*since).Unix()
+	}
+
+	restored := 0
+	err := filepath.WalkDir(trash, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == trash {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(path, ".eml") {
+			return nil
+		}
+		box, _ := filepath.Rel(trash, filepath.Dir(path))
+		expunged, orig, ok := strings.Cut(d.Name(), "-")
+		if !ok || (*mailbox != "" && box != *mailbox) {
+			return nil
+		}
+		t, err := strconv.ParseInt(expunged, 10, 64)
+		if err != nil || t < cutoff {
+			return nil
+		}
+
+		if *list {
+			fmt.Printf("%s\t%s\t%s\n", time.Unix(t, 0).Format(time.DateTime), box, orig)
+			restored++
+			return nil
+		}
+		if err := restore(path, filepath.Join(userDir, box), orig); err != nil {
+			return err
+		}
+		restored++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if *list {
+		fmt.Printf("%d messages in trash\n", restored)
+	} else {
+		fmt.Printf("Restored %d messages\n", restored)
+		auditCLI("undelete", fs.Arg(0), fmt.Sprintf("%d restored", restored))
+	}
+	return nil
+}
+
+// restore moves a trashed message into dir under a new UID, the old one was
+// expunged and may not be reused
+func restore(path, dir, orig string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	// imapd and smtpd may be writing the mailbox
+	lock, err := storage.LockMailbox(dir)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	uid, err := lock.NextUID()
+	if err != nil {
+		return err
+	}
+
+	// Keep the date part of {unix}_{uid}.eml
+	date, _, _ := strings.Cut(orig, "_")
+	dst := filepath.Join(dir, fmt.Sprintf("%s_%d.eml", date, uid))
+	if err := os.Rename(path, dst); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".flags", dst+".flags"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
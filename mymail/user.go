@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/mpdroog/mymail/smtpd/config"
+	"github.com/mpdroog/mymail/smtpd/storage"
+	"github.com/mpdroog/mymail/smtpd/users"
+)
+
+// daemons get a SIGHUP after the user file changed so they reload it
+var daemons = []string{"smtpd", "imapd"}
+
+func cmdUser(args []string) error {
+	if len(args) == 0 {
+		return errors.New("expected add, del, passwd, identities or list")
+	}
+
+	fs := flag.NewFlagSet("user "+args[0], flag.ExitOnError)
+	configPath := fs.String("config", "config.json", "Path to smtpd configuration file")
+	roles := fs.String("roles", "", "Comma separated roles: admin, user, send-only, receive-only (default user)")
+	quota := fs.String("quota", "", "Mailbox limit, e.g. 1GB (empty=unlimited)")
+	domain := fs.String("domain", "", "Domain of the maildir (default first local_domains entry)")
+	locale := fs.String("locale", "", "Language of generated messages, e.g. nl (empty=domain or default)")
+	noReload := fs.Bool("no-reload", false, "Don't signal running daemons")
+	fs.Parse(args[1:])
+
+	if err := config.Load(*configPath); err != nil {
+		return err
+	}
+	if config.C.AuthFile == "" {
+		return fmt.Errorf("auth_file not configured")
+	}
+
+	if args[0] == "list" {
+		return listUsers()
+	}
+	if args[0] == "identities" && fs.NArg() >= 1 {
+		// Replaces the list, no addresses clears it
+		err := setIdentities(fs.Arg(0), fs.Args()[1:])
+		if err != nil {
+			return err
+		}
+		auditCLI("user identities", fs.Arg(0), strings.Join(fs.Args()[1:], ","))
+		if !*noReload {
+			reloadDaemons()
+		}
+		return nil
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: mymail user %s [flags] <username>", args[0])
+	}
+	name := fs.Arg(0)
+
+	var err error
+	switch args[0] {
+	case "add":
+		err = addUser(name, *roles, *quota, *locale, *domain)
+	case "del":
+		err = users.Update(config.C.AuthFile, func(accounts map[string]*users.Account) error {
+			if accounts[name] == nil {
+				return fmt.Errorf("no user %s", name)
+			}
+			delete(accounts, name)
+			return nil
+		})
+		if err == nil {
+			fmt.Println("Deleted user " + name + ", the maildir was kept (mymail erase removes it)")
+		}
+	case "passwd":
+		err = setPassword(name, *roles, *quota, *locale)
+	default:
+		return fmt.Errorf("unknown subcommand %q", args[0])
+	}
+	if err != nil {
+		return err
+	}
+	auditCLI("user "+args[0], name, "")
+
+	if !*noReload {
+		reloadDaemons()
+	}
+	return nil
+}
+
+func addUser(name, roles, quota, locale, domain string) error {
+	pass, err := readPassword()
+	if err != nil {
+		return err
+	}
+	acct, err := users.NewAccount(pass, splitRoles(roles), quota)
+	if err != nil {
+		return err
+	}
+	acct.Locale = locale
+
+	if domain == "" {
+		if len(config.C.LocalDomains) == 0 {
+			return fmt.Errorf("no -domain and no local_domains configured")
+		}
+		domain = config.C.LocalDomains[0]
+	}
+
+	if err := users.Add(config.C.AuthFile, name, acct); err != nil {
+		return err
+	}
+	if err := users.Bootstrap(config.C.MailDir, config.C.WhitelistDir, domain, name, acct, config.C.WelcomeTemplate); err != nil {
+		return err
+	}
+	fmt.Println("Added user " + name + " with maildir " + storage.UserDir(config.C.MailDir, domain, name))
+	return nil
+}
+
+// setPassword changes the password, and roles, quota and locale when given
+func setPassword(name, roles, quota, locale string) error {
+	pass, err := readPassword()
+	if err != nil {
+		return err
+	}
+	acct, err := users.NewAccount(pass, splitRoles(roles), quota)
+	if err != nil {
+		return err
+	}
+
+	return users.Update(config.C.AuthFile, func(accounts map[string]*users.Account) error {
+		old := accounts[name]
+		if old == nil {
+			return fmt.Errorf("no user %s", name)
+		}
+		if roles == "" {
+			acct.Roles = old.Roles
+		}
+		if quota == "" {
+			acct.Quota = old.Quota
+		}
+		acct.Locale = locale
+		if locale == "" {
+			acct.Locale = old.Locale
+		}
+		acct.Identities = old.Identities
+		accounts[name] = acct
+		return nil
+	})
+}
+
+// setIdentities sets the From addresses name may use next to its own,
+// "@example.com" allows a whole domain
+func setIdentities(name string, addrs []string) error {
+	for _, addr := range addrs {
+		if !strings.Contains(addr, "@") || strings.ContainsAny(addr, " <>,") {
+			return fmt.Errorf("invalid identity %q, expected user@domain or @domain", addr)
+		}
+	}
+	err := users.Update(config.C.AuthFile, func(accounts map[string]*users.Account) error {
+		acct := accounts[name]
+		if acct == nil {
+			return fmt.Errorf("no user %s", name)
+		}
+		acct.Identities = addrs
+		return nil
+	})
+	if err == nil {
+		fmt.Printf("%s may send as %s\n", name, strings.Join(append([]string{users.Address(name)}, addrs...), ", "))
+	}
+	return err
+}
+
+func splitRoles(roles string) []string {
+	var out []string
+	for _, role := range strings.Split(roles, ",") {
+		if role = strings.TrimSpace(role); role != "" {
+			out = append(out, role)
+		}
+	}
+	return out
+}
+
+// readPassword reads the first line of stdin, so it can be piped in
+func readPassword() (string, error) {
+	if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		fmt.Fprint(os.Stderr, "Password: ")
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("reading password: %v", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func listUsers() error {
+	accounts, err := users.Load(config.C.AuthFile)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(accounts))
+	for name := range accounts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "USER\tROLES\tQUOTA\tLOCALE\tHASHED")
+	for _, name := range names {
+		a := accounts[name]
+		roles := strings.Join(a.Roles, ",")
+		if roles == "" {
+			roles = users.RoleUser
+		}
+		quota := a.Quota
+		if quota == "" {
+			quota = "-"
+		}
+		locale := a.Locale
+		if locale == "" {
+			locale = "-"
+		}
+		hashed := strings.HasPrefix(a.Password, "$")
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%t\n", name, roles, quota, locale, hashed)
+	}
+	return tw.Flush()
+}
+
+// reloadDaemons sends SIGHUP to running smtpd and imapd processes
+func reloadDaemons() {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Can't find daemons, reload them by hand: %v\n", err)
+		return
+	}
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		comm, err := os.ReadFile(filepath.Join("/proc", e.Name(), "comm"))
+		if err != nil {
+			continue
+		}
+		name := strings.TrimSpace(string(comm))
+		for _, d := range daemons {
+			if name != d {
+				continue
+			}
+			if err := syscall.Kill(pid, syscall.SIGHUP); err != nil {
+				fmt.Fprintf(os.Stderr, "Reload %s (pid %d) e=%v\n", name, pid, err)
+				continue
+			}
+			fmt.Printf("Reloaded %s (pid %d)\n", name, pid)
+		}
+	}
+}
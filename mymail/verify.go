@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mpdroog/mymail/smtpd/config"
+)
+
+// cmdVerifyImmutability checks the guarantee backups rely on, message files
+// never change after delivery (see smtpd/storage/immutable.go). Checksums are
+// kept in a manifest, a message that differs from it or is writable is
+// reported.
+func cmdVerifyImmutability(args []string) error {
+	fs := flag.NewFlagSet("verify-immutability", flag.ExitOnError)
+	configPath := fs.String("config", "config.json", "Path to smtpd configuration file")
+	manifestPath := fs.String("manifest", "", "Checksum manifest (default mail_dir/.immutability.json)")
+	fix := fs.Bool("fix", false, "Make writable message files read-only")
+	fs.Parse(args)
+
+	if err := config.Load(*configPath); err != nil {
+		return err
+	}
+	if *manifestPath == "" {
+		*manifestPath = filepath.Join(config.C.MailDir, ".immutability.json")
+	}
+
+	// Relative path => hex SHA-256
+	manifest := make(map[string]string)
+	if data, err := os.ReadFile(*manifestPath); err == nil {
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return fmt.Errorf("manifest %s: %v", *manifestPath, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	seen := make(map[string]string, len(manifest))
+	var total, added, changed, writable int
+	err := filepath.WalkDir(config.C.MailDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(path, ".eml") {
+			return nil
+		}
+		rel, _ := filepath.Rel(config.C.MailDir, path)
+		total++
+
+		sum, err := fileSum(path)
+		if err != nil {
+			return err
+		}
+		switch old, ok := manifest[rel]; {
+		case !ok:
+			added++
+			seen[rel] = sum
+		case old != sum:
+			changed++
+			fmt.Println("CHANGED  " + rel)
+			// Keep the delivered checksum so it's reported until resolved
+			seen[rel] = old
+		default:
+			seen[rel] = sum
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.Mode().Perm()&0222 != 0 {
+			if !*fix {
+				writable++
+				fmt.Println("WRITABLE " + rel)
+			} else if err := os.Chmod(path, info.Mode().Perm()&^0222); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := writeManifest(*manifestPath, seen); err != nil {
+		return err
+	}
+	fmt.Printf("Checked %d messages: %d new, %d changed, %d writable, %d removed\n",
+		total, added, changed, writable, len(manifest)+added-len(seen))
+	if changed > 0 || writable > 0 {
+		return fmt.Errorf("%d changed and %d writable message files", changed, writable)
+	}
+	return nil
+}
+
+func fileSum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeManifest replaces path atomically
+func writeManifest(path string, manifest map[string]string) error {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,141 @@
+package activity
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// Rewrite a user's log to its last keepEntries once it grows beyond maxSize
+	maxSize     = 256 * 1024
+	keepEntries = 1000
+)
+
+// Entry is one successful login, stored as a JSON line in {activity_dir}/{user}.jsonl.
+// imapd appends to the same files so the history covers both protocols.
+type Entry struct {
+	Time     time.Time `json:"time"`
+	Protocol string    `json:"protocol"`
+	IP       string    `json:"ip"`
+	Client   string    `json:"client"` // EHLO name or IMAP client ID
+}
+
+func path(dir, user string) (string, error) {
+	if user == "" || strings.ContainsAny(user, "/\\") || strings.HasPrefix(user, ".") {
+		return "", fmt.Errorf("invalid user %q", user)
+	}
+	return filepath.Join(dir, user+".jsonl"), nil
+}
+
+// Record appends e to the history of user, does nothing when dir is empty.
+// The file is flock'ed as smtpd and imapd both write it.
+func Record(dir, user string, e Entry) error {
+	if dir == "" {
+		return nil
+	}
+	p, err := path(dir, user)
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+
+	if info, err := f.Stat(); err == nil && info.Size() > maxSize {
+		return truncate(f)
+	}
+	return nil
+}
+
+// truncate keeps the last keepEntries lines of the locked f, in place so
+// the lock of a waiting writer stays on the same file
+func truncate(f *os.File) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	entries, err := read(f, keepEntries)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	// O_APPEND writes at the new end
+	_, err = f.Write(buf.Bytes())
+	return err
+}
+
+// Load returns up to n most recent entries of user, oldest first
+func Load(dir, user string, n int) ([]Entry, error) {
+	p, err := path(dir, user)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := load(p, n)
+	if os.IsNotExist(err) {
+		return []Entry{}, nil
+	}
+	return entries, err
+}
+
+func load(p string, n int) ([]Entry, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_SH); err != nil {
+		return nil, err
+	}
+	return read(f, n)
+}
+
+// read returns up to the last n entries of r
+func read(r io.Reader, n int) ([]Entry, error) {
+	entries := make([]Entry, 0)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// Skip a partial line left by a crash
+			continue
+		}
+		entries = append(entries, e)
+		if len(entries) > n {
+			entries = entries[1:]
+		}
+	}
+	return entries, scanner.Err()
+}
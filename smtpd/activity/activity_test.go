@@ -0,0 +1,38 @@
+package activity
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestRecordTruncate checks the history is cut back to keepEntries in place
+func TestRecordTruncate(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 3000; i++ {
+		e := Entry{Time: start.Add(time.Duration(i) * time.Second), Protocol: "imap", IP: "192.0.2.1", Client: "test"}
+		if err := Record(dir, "bob", e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "bob.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() > maxSize {
+		t.Errorf("size=%d expect <= %d", info.Size(), maxSize)
+	}
+	entries, err := Load(dir, "bob", 5000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) < keepEntries || len(entries) > 3000 {
+		t.Fatalf("len=%d", len(entries))
+	}
+	if last := entries[len(entries)-1].Time; !last.Equal(start.Add(2999 * time.Second)) {
+		t.Errorf("last=%s, expect the newest entry kept", last)
+	}
+}
@@ -0,0 +1,471 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mpdroog/mymail/smtpd/activity"
+	"github.com/mpdroog/mymail/smtpd/audit"
+	"github.com/mpdroog/mymail/smtpd/calendar"
+	"github.com/mpdroog/mymail/smtpd/config"
+	"github.com/mpdroog/mymail/smtpd/contacts"
+	"github.com/mpdroog/mymail/smtpd/lockout"
+	"github.com/mpdroog/mymail/smtpd/logging"
+	"github.com/mpdroog/mymail/smtpd/server"
+	"github.com/mpdroog/mymail/smtpd/storage"
+	"github.com/mpdroog/mymail/smtpd/users"
+	"github.com/mpdroog/mymail/smtpd/watchdog"
+)
+
+// Admin is the HTTP service for operators and webmail integration
+type Admin struct {
+	srv     *http.Server
+	storage *storage.Storage
+	server  *server.Server
+}
+
+func New(st *storage.Storage, srv *server.Server) *Admin {
+	a := &Admin{storage: st, server: srv}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /attachments/{id}", a.handleAttachment)
+	mux.HandleFunc("GET /queue", a.handleQueue)
+	mux.HandleFunc("POST /queue/hold", a.handleHold(true))
+	mux.HandleFunc("POST /queue/release", a.handleHold(false))
+	mux.HandleFunc("GET /sessions", a.handleSessions)
+	mux.HandleFunc("POST /sessions/{id}/kick", a.handleKick)
+	mux.HandleFunc("GET /metrics", a.handleMetrics)
+	mux.HandleFunc("GET /bans", a.handleBans)
+	mux.HandleFunc("POST /bans", a.handleBan)
+	mux.HandleFunc("DELETE /bans/{ip}", a.handleUnban)
+	mux.HandleFunc("GET /activity/{user}", a.handleActivity)
+	mux.HandleFunc("GET /audit", a.handleAudit)
+	mux.HandleFunc("GET /contacts/{user}", a.handleContacts)
+	mux.HandleFunc("POST /invites/rsvp", a.handleRSVP)
+	mux.HandleFunc("POST /messages/redirect", a.handleRedirect)
+	mux.HandleFunc("GET /suspended", a.handleSuspended)
+	mux.HandleFunc("DELETE /suspended/{user}", a.handleRelease)
+	mux.HandleFunc("GET /lockouts", a.handleLockouts)
+	mux.HandleFunc("POST /users", a.handleAddUser)
+	mux.HandleFunc("DELETE /lockouts/{user}", a.handleUnlock)
+
+	a.srv = &http.Server{Handler: a.authorize(mux)}
+	return a
+}
+
+// authorize requires HTTP basic auth of an admin account, without one in
+// the user file (see `mymail user add -roles admin`) the API refuses
+// everything. Detached attachments are also open to their recipients, see
+// handleAttachment. Requests other than GET end up in the audit log.
+func (a *Admin) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+		if !strings.HasPrefix(r.URL.Path, "/attachments/") {
+			if !ok || !a.server.AuthenticateAdmin(user, pass, ip) {
+				w.Header().Set("WWW-Authenticate", `Basic realm="mymail"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		sw := &audit.StatusWriter{ResponseWriter: w, Status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+		e := audit.Entry{
+			Protocol: "smtpd-admin",
+			User:     user,
+			IP:       ip,
+			Action:   r.Method + " " + r.URL.Path,
+			Target:   r.PathValue("user"),
+			Result:   strconv.Itoa(sw.Status),
+		}
+		if e.Target == "" {
+			e.Target = r.FormValue("user")
+		}
+		if err := audit.Record(config.C.AuditLog, e); err != nil {
+			log.Printf(logging.Err+"audit.Record e=%v", err)
+		}
+	})
+}
+
+func (a *Admin) Start() error {
+	listener, err := net.Listen("tcp", config.C.AdminAddr)
+	if err != nil {
+		return err
+	}
+	log.Printf("Admin service listening on %s", config.C.AdminAddr)
+
+	go func() {
+		if err := a.srv.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf(logging.Err+"Admin serve e=%v", err)
+		}
+	}()
+	return nil
+}
+
+func (a *Admin) Stop() error {
+	return a.srv.Close()
+}
+
+// handleAttachment serves a detached attachment to one of the recipients of
+// its message or an admin, authenticated with HTTP basic auth
+func (a *Admin) handleAttachment(w http.ResponseWriter, r *http.Request) {
+	user, pass, ok := r.BasicAuth()
+	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+	var acct *users.Account
+	if ok {
+		acct = a.server.Authenticate(user, pass, ip)
+	}
+	if acct == nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="mymail"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	f, meta, err := a.storage.OpenAttachment(r.PathValue("id"))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf(logging.Err+"handleAttachment e=%v", err)
+		}
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	// Not found rather than forbidden, IDs of others' attachments stay secret
+	if !acct.Has(users.RoleAdmin) && !a.isRecipient(user, meta.Recipients) {
+		http.NotFound(w, r)
+		return
+	}
+
+	if meta.ContentType != "" {
+		w.Header().Set("Content-Type", meta.ContentType)
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": meta.Filename}))
+	http.ServeContent(w, r, meta.Filename, meta.CreatedAt, f)
+}
+
+// isRecipient reports whether recipients has an address delivered to the
+// mailbox of user
+func (a *Admin) isRecipient(user string, recipients []string) bool {
+	inbox := a.storage.Inbox(users.Address(user))
+	if inbox == "" {
+		return false
+	}
+	for _, rcpt := range recipients {
+		if a.storage.Inbox(rcpt) == inbox {
+			return true
+		}
+	}
+	return false
+}
+
+// queueEntry is the queue listing without the message body
+type queueEntry struct {
+	ID         string               `json:"id"`
+	Priority   string               `json:"priority"`
+	From       string               `json:"from"`
+	Recipients []storage.Recipient  `json:"recipients"`
+	Size       int                  `json:"size"`
+	CreatedAt  time.Time            `json:"created_at"`
+	NextRetry  time.Time            `json:"next_retry"`
+	Held       bool                 `json:"held"`
+	Status     string               `json:"status"`
+	History    []storage.Transition `json:"history"`
+	Instance   string               `json:"instance,omitempty"` // Of the last delivery attempt
+}
+
+func (a *Admin) handleQueue(w http.ResponseWriter, r *http.Request) {
+	emails, err := a.storage.ListQueue()
+	if err != nil {
+		log.Printf(logging.Err+"handleQueue e=%v", err)
+		http.Error(w, "Failed to read queue", http.StatusInternalServerError)
+		return
+	}
+	holds, err := a.storage.GetHolds()
+	if err != nil {
+		log.Printf(logging.Err+"handleQueue e=%v", err)
+		http.Error(w, "Failed to read holds", http.StatusInternalServerError)
+		return
+	}
+
+	entries := make([]queueEntry, 0, len(emails))
+	for _, e := range emails {
+		entries = append(entries, queueEntry{
+			ID:         e.ID,
+			Priority:   e.Priority,
+			From:       e.From,
+			Recipients: e.Recipients,
+			Size:       len(e.Data),
+			CreatedAt:  e.CreatedAt,
+			NextRetry:  e.NextRetry,
+			Held:       e.Held,
+			Status:     e.Status,
+			History:    e.History,
+			Instance:   e.Instance,
+		})
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"holds":  holds,
+		"emails": entries,
+	})
+}
+
+// handleHold holds or releases a message (id=), a domain (domain=) or the whole queue
+func (a *Admin) handleHold(held bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.FormValue("id")
+		domain := r.FormValue("domain")
+
+		var err error
+		switch {
+		case id != "":
+			err = a.storage.SetMessageHold(id, held)
+		case domain != "":
+			err = a.storage.HoldDomain(domain, held)
+		default:
+			err = a.storage.UpdateHolds(func(h *storage.Holds) {
+				h.All = held
+			})
+		}
+
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			log.Printf(logging.Err+"handleHold e=%v", err)
+			http.Error(w, "Failed to update hold", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Queue hold=%t id=%q domain=%q", held, id, domain)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleActivity returns the login history of a user, ?n= limits the entries (default 50)
+func (a *Admin) handleActivity(w http.ResponseWriter, r *http.Request) {
+	if config.C.ActivityDir == "" {
+		http.NotFound(w, r)
+		return
+	}
+	n := 50
+	if v, err := strconv.Atoi(r.FormValue("n")); err == nil && v > 0 {
+		n = v
+	}
+
+	entries, err := activity.Load(config.C.ActivityDir, r.PathValue("user"), n)
+	if err != nil {
+		log.Printf(logging.Err+"handleActivity e=%v", err)
+		http.Error(w, "Failed to read activity", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, entries)
+}
+
+// handleAudit returns the audit log, ?user= filters on actor or target,
+// ?since= takes RFC 3339 and ?n= limits the entries (default 100)
+func (a *Admin) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if config.C.AuditLog == "" {
+		http.NotFound(w, r)
+		return
+	}
+	f := audit.Filter{User: r.FormValue("user"), N: 100}
+	if v, err := strconv.Atoi(r.FormValue("n")); err == nil && v > 0 {
+		f.N = v
+	}
+	if v := r.FormValue("since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, "Invalid since", http.StatusBadRequest)
+			return
+		}
+		f.Since = t
+	}
+
+	entries, err := audit.Load(config.C.AuditLog, f)
+	if err != nil {
+		log.Printf(logging.Err+"handleAudit e=%v", err)
+		http.Error(w, "Failed to read audit log", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, entries)
+}
+
+// handleContacts autocompletes ?q= from the address book of a user, ?n= limits (default 10)
+func (a *Admin) handleContacts(w http.ResponseWriter, r *http.Request) {
+	if config.C.ContactsDir == "" {
+		http.NotFound(w, r)
+		return
+	}
+	n := 10
+	if v, err := strconv.Atoi(r.FormValue("n")); err == nil && v > 0 {
+		n = v
+	}
+
+	list, err := contacts.Search(config.C.ContactsDir, r.PathValue("user"), r.FormValue("q"), n)
+	if err != nil {
+		log.Printf(logging.Err+"handleContacts e=%v", err)
+		http.Error(w, "Failed to read contacts", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, list)
+}
+
+// handleRSVP answers the invite in a stored message for webmail. Form fields:
+// user (attendee address), mailbox (default INBOX), file (.eml name) and
+// partstat (ACCEPTED, DECLINED or TENTATIVE). The reply is sent via the queue.
+func (a *Admin) handleRSVP(w http.ResponseWriter, r *http.Request) {
+	user := r.FormValue("user")
+	mailbox := r.FormValue("mailbox")
+	if mailbox == "" {
+		mailbox = "INBOX"
+	}
+
+	data, err := a.storage.LoadLocal(user, mailbox, r.FormValue("file"))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf(logging.Err+"handleRSVP e=%v", err)
+		}
+		http.NotFound(w, r)
+		return
+	}
+	inv, ok := calendar.Find(data)
+	if !ok {
+		http.Error(w, "No invite in message", http.StatusBadRequest)
+		return
+	}
+	reply, err := inv.Reply(user, strings.ToUpper(r.FormValue("partstat")))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := a.server.ProcessEmail(user, []string{inv.Organizer}, reply, true); err != nil {
+		log.Printf(logging.Err+"handleRSVP e=%v", err)
+		http.Error(w, "Failed to send reply", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("RSVP %s to %s for %s", r.FormValue("partstat"), inv.Organizer, user)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Admin) handleSuspended(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, watchdog.List())
+}
+
+// handleRelease lifts a watchdog suspension before it expires
+func (a *Admin) handleRelease(w http.ResponseWriter, r *http.Request) {
+	user := r.PathValue("user")
+	if !watchdog.Release(user) {
+		http.NotFound(w, r)
+		return
+	}
+	log.Printf("User %s released from watchdog", user)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Admin) handleLockouts(w http.ResponseWriter, r *http.Request) {
+	if config.C.LockoutDir == "" {
+		http.NotFound(w, r)
+		return
+	}
+	list, err := lockout.List(config.C.LockoutDir)
+	if err != nil {
+		log.Printf(logging.Err+"handleLockouts e=%v", err)
+		http.Error(w, "Failed to read lockouts", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, list)
+}
+
+// handleUnlock lifts an account lockout (SMTP and IMAP) before it expires
+func (a *Admin) handleUnlock(w http.ResponseWriter, r *http.Request) {
+	if config.C.LockoutDir == "" {
+		http.NotFound(w, r)
+		return
+	}
+	user := r.PathValue("user")
+	err := lockout.Unlock(config.C.LockoutDir, user)
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf(logging.Err+"handleUnlock e=%v", err)
+		http.Error(w, "Failed to unlock", http.StatusBadRequest)
+		return
+	}
+	log.Printf("User %s unlocked", user)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAddUser provisions an account. Form fields: user, password, roles
+// (comma separated, default user), quota and domain (default first local
+// domain). imapd picks it up after a SIGHUP or `mymail user` run.
+func (a *Admin) handleAddUser(w http.ResponseWriter, r *http.Request) {
+	if config.C.AuthFile == "" {
+		http.NotFound(w, r)
+		return
+	}
+	name := r.FormValue("user")
+	var roles []string
+	for _, role := range strings.Split(r.FormValue("roles"), ",") {
+		if role = strings.TrimSpace(role); role != "" {
+			roles = append(roles, role)
+		}
+	}
+	domain := r.FormValue("domain")
+	if domain == "" && len(config.C.LocalDomains) > 0 {
+		domain = config.C.LocalDomains[0]
+	}
+	if !users.ValidName(name) || !users.ValidName(domain) {
+		http.Error(w, "Invalid user or domain", http.StatusBadRequest)
+		return
+	}
+
+	acct, err := users.NewAccount(r.FormValue("password"), roles, r.FormValue("quota"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = users.Add(config.C.AuthFile, name, acct)
+	if errors.Is(err, users.ErrExists) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err == nil {
+		err = users.Bootstrap(config.C.MailDir, config.C.WhitelistDir, domain, name, acct, config.C.WelcomeTemplate)
+	}
+	if err == nil {
+		err = a.server.LoadUsers(config.C.AuthFile)
+	}
+	if err != nil {
+		log.Printf(logging.Err+"handleAddUser e=%v", err)
+		http.Error(w, "Failed to add user", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("User %s added", name)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Printf(logging.Err+"writeJSON e=%v", err)
+	}
+}
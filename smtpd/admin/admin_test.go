@@ -0,0 +1,116 @@
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mpdroog/mymail/smtpd/config"
+	"github.com/mpdroog/mymail/smtpd/server"
+	"github.com/mpdroog/mymail/smtpd/storage"
+)
+
+func TestAuthorize(t *testing.T) {
+	config.C.AuthFailDelay = 0
+	config.C.LockoutDir = ""
+	srv := server.New()
+	a := New(nil, srv)
+
+	get := func(user, pass string) int {
+		r := httptest.NewRequest("GET", "/bans", nil)
+		if user != "" {
+			r.SetBasicAuth(user, pass)
+		}
+		w := httptest.NewRecorder()
+		a.srv.Handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// No admin account yet, nothing gets in
+	if code := get("", ""); code != http.StatusUnauthorized {
+		t.Errorf("no admins: status=%d", code)
+	}
+
+	path := filepath.Join(t.TempDir(), "users.json")
+	data := `{"root": {"password": "secret", "roles": ["admin"]}, "bob": "secret"}`
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.LoadUsers(path); err != nil {
+		t.Fatal(err)
+	}
+
+	patterns := map[string]int{
+		"root:secret": http.StatusOK,
+		"root:wrong":  http.StatusUnauthorized,
+		"bob:secret":  http.StatusUnauthorized,
+		"eve:secret":  http.StatusUnauthorized,
+		":":           http.StatusUnauthorized,
+	}
+	for creds, expect := range patterns {
+		user, pass, _ := strings.Cut(creds, ":")
+		if code := get(user, pass); code != expect {
+			t.Errorf("%s: status=%d expect=%d", creds, code, expect)
+		}
+	}
+}
+
+func TestAttachmentAuth(t *testing.T) {
+	config.C.AuthFailDelay = 0
+	config.C.LockoutDir = ""
+	config.C.MailDir = t.TempDir()
+	config.C.AttachmentDir = t.TempDir()
+	config.C.LocalDomains = []string{"example.com"}
+	config.C.DetachSize = 10
+	defer func() {
+		config.C.AttachmentDir = ""
+		config.C.LocalDomains = nil
+		config.C.DetachSize = 0
+	}()
+	st := storage.New()
+	srv := server.New()
+	a := New(st, srv)
+
+	path := filepath.Join(t.TempDir(), "users.json")
+	data := `{"root": {"password": "secret", "roles": ["admin"]}, "bob": "secret", "eve": "secret"}`
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.LoadUsers(path); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := "Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\nhi\r\n" +
+		"--b\r\nContent-Type: application/pdf\r\nContent-Disposition: attachment; filename=a.pdf\r\n\r\n" +
+		strings.Repeat("x", 100) + "\r\n--b--\r\n"
+	out := string(st.DetachAttachments([]byte(msg), []string{"Bob@example.com"}))
+	_, url, ok := strings.Cut(out, "X-Detached: ")
+	if !ok {
+		t.Fatalf("not detached: %q", out)
+	}
+	url, _, _ = strings.Cut(url, "\r\n")
+	_, id, _ := strings.Cut(url, "/attachments/")
+
+	patterns := map[string]int{
+		"root:secret": http.StatusOK,
+		"bob:secret":  http.StatusOK,
+		"eve:secret":  http.StatusNotFound,
+		"bob:wrong":   http.StatusUnauthorized,
+		":":           http.StatusUnauthorized,
+	}
+	for creds, expect := range patterns {
+		r := httptest.NewRequest("GET", "/attachments/"+id, nil)
+		if user, pass, _ := strings.Cut(creds, ":"); user != "" {
+			r.SetBasicAuth(user, pass)
+		}
+		w := httptest.NewRecorder()
+		a.srv.Handler.ServeHTTP(w, r)
+		if w.Code != expect {
+			t.Errorf("%s: status=%d expect=%d", creds, w.Code, expect)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package admin
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"net/mail"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mpdroog/mymail/smtpd/config"
+	"github.com/mpdroog/mymail/smtpd/logging"
+)
+
+// handleRedirect resends a stored message unchanged to other addresses, the
+// "bounce to my other account" of mail clients. Form fields: user (who
+// resends), mailbox (default INBOX), file (.eml name) and to (one or more,
+// comma separated). The original headers stay, Resent-* ones are added.
+func (a *Admin) handleRedirect(w http.ResponseWriter, r *http.Request) {
+	user := r.FormValue("user")
+	mailbox := r.FormValue("mailbox")
+	if mailbox == "" {
+		mailbox = "INBOX"
+	}
+
+	var to []string
+	for _, v := range r.Form["to"] {
+		list, err := mail.ParseAddressList(v)
+		if err != nil {
+			http.Error(w, "Invalid to", http.StatusBadRequest)
+			return
+		}
+		for _, addr := range list {
+			to = append(to, addr.Address)
+		}
+	}
+	if len(to) == 0 {
+		http.Error(w, "Missing to", http.StatusBadRequest)
+		return
+	}
+
+	data, err := a.storage.LoadLocal(user, mailbox, r.FormValue("file"))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf(logging.Err+"handleRedirect e=%v", err)
+		}
+		http.NotFound(w, r)
+		return
+	}
+
+	msg := resent(data, user, to, time.Now())
+	if err := a.server.ProcessEmail(user, to, msg, true); err != nil {
+		log.Printf(logging.Err+"handleRedirect e=%v", err)
+		http.Error(w, "Failed to redirect", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Redirect %s/%s of %s to %s", mailbox, r.FormValue("file"), user, strings.Join(to, ", "))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// resent prepends the Resent-* block of RFC 5322 3.6.6 to data, a message
+// resent before keeps its older blocks below the new one
+func resent(data []byte, from string, to []string, now time.Time) []byte {
+	id := make([]byte, 12)
+	rand.Read(id)
+
+	h := "Resent-Date: " + now.Format(time.RFC1123Z) + "\r\n"
+	h += "Resent-From: " + from + "\r\n"
+	h += "Resent-To: " + strings.Join(to, ", ") + "\r\n"
+	h += "Resent-Message-ID: <" + hex.EncodeToString(id) + "@" + config.C.Hostname + ">\r\n"
+	return append([]byte(h), data...)
+}
@@ -0,0 +1,41 @@
+package admin
+
+import (
+	"bytes"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mpdroog/mymail/smtpd/config"
+)
+
+func TestResent(t *testing.T) {
+	config.C.Hostname = "mx.example.com"
+	now := time.Date(2024, 2, 10, 12, 0, 0, 0, time.UTC)
+	orig := []byte("From: a@example.org\r\nTo: mark@example.com\r\nSubject: hi\r\n\r\nbody\r\n")
+	out := resent(orig, "mark@example.com", []string{"mark@example.net", "b@example.net"}, now)
+
+	if !bytes.HasSuffix(out, orig) {
+		t.Fatalf("original changed: %q", out)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	patterns := map[string]string{
+		"Resent-Date": "Sat, 10 Feb 2024 12:00:00 +0000",
+		"Resent-From": "mark@example.com",
+		"Resent-To":   "mark@example.net, b@example.net",
+		"From":        "a@example.org",
+		"Subject":     "hi",
+	}
+	for key, expect := range patterns {
+		if v := msg.Header.Get(key); v != expect {
+			t.Errorf("%s=%s expect=%s", key, v, expect)
+		}
+	}
+	if id := msg.Header.Get("Resent-Message-ID"); !strings.HasSuffix(id, "@mx.example.com>") {
+		t.Errorf("Resent-Message-ID=%s", id)
+	}
+}
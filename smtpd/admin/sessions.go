@@ -0,0 +1,67 @@
+package admin
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// defaultBan is used when POST /bans has no duration
+const defaultBan = time.Hour
+
+func (a *Admin) handleSessions(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, a.server.Sessions())
+}
+
+func (a *Admin) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, a.server.Metrics())
+}
+
+func (a *Admin) handleKick(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil || !a.server.Kick(id) {
+		http.NotFound(w, r)
+		return
+	}
+	log.Printf("Session %d kicked", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Admin) handleBans(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, a.server.Bans())
+}
+
+// handleBan refuses new connections from ip= for duration= (default 1h)
+func (a *Admin) handleBan(w http.ResponseWriter, r *http.Request) {
+	ip := net.ParseIP(r.FormValue("ip"))
+	if ip == nil {
+		http.Error(w, "Invalid ip", http.StatusBadRequest)
+		return
+	}
+
+	d := defaultBan
+	if v := r.FormValue("duration"); v != "" {
+		var err error
+		d, err = time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, "Invalid duration", http.StatusBadRequest)
+			return
+		}
+	}
+
+	a.server.Ban(ip.String(), d)
+	log.Printf("IP %s banned for %s", ip, d)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Admin) handleUnban(w http.ResponseWriter, r *http.Request) {
+	ip := net.ParseIP(r.PathValue("ip"))
+	if ip == nil || !a.server.Unban(ip.String()) {
+		http.NotFound(w, r)
+		return
+	}
+	log.Printf("IP %s unbanned", ip)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,107 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Entry is one destructive operation, stored as a JSON line in audit_log.
+// imapd and the mymail CLI append to the same file, it is never rewritten.
+type Entry struct {
+	Time     time.Time `json:"time"`
+	Protocol string    `json:"protocol"` // imap, smtpd-admin, imapd-admin or cli
+	User     string    `json:"user"`     // Who did it, empty for an open admin API
+	IP       string    `json:"ip,omitempty"`
+	Action   string    `json:"action"`           // e.g. expunge, delete-mailbox, rename-mailbox, "DELETE /lockouts/mark"
+	Target   string    `json:"target,omitempty"` // Affected user or mailbox
+	UIDs     string    `json:"uids,omitempty"`   // IMAP UID set
+	Paths    []string  `json:"paths,omitempty"`  // Affected files
+	Result   string    `json:"result,omitempty"` // HTTP status or error
+}
+
+// Filter selects entries in Load, zero values match everything
+type Filter struct {
+	User  string    // Actor or target
+	Since time.Time // Entries at or after
+	N     int       // Most recent N
+}
+
+var mu sync.Mutex
+
+// Record appends e to the log at path, does nothing when path is empty
+func Record(path string, e Entry) error {
+	if path == "" {
+		return nil
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// O_APPEND with one write per entry, lines of concurrent writers in
+	// other processes don't interleave
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Load returns the entries matching f, oldest first
+func Load(path string, f Filter) ([]Entry, error) {
+	entries := make([]Entry, 0)
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// Skip a partial last line of a concurrent writer
+			continue
+		}
+		if f.User != "" && e.User != f.User && e.Target != f.User {
+			continue
+		}
+		if e.Time.Before(f.Since) {
+			continue
+		}
+		entries = append(entries, e)
+		if f.N > 0 && len(entries) > f.N {
+			entries = entries[1:]
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// StatusWriter remembers the status code of an admin API response for the log
+type StatusWriter struct {
+	http.ResponseWriter
+	Status int
+}
+
+func (w *StatusWriter) WriteHeader(status int) {
+	w.Status = status
+	w.ResponseWriter.WriteHeader(status)
+}
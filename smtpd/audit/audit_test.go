@@ -0,0 +1,40 @@
+package audit
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	now := time.Now()
+	for _, e := range []Entry{
+		{Time: now.Add(-time.Hour), Protocol: "imap", User: "mark", Action: "expunge", Target: "INBOX", UIDs: "1:3"},
+		{Time: now, Protocol: "smtpd-admin", User: "admin", Action: "DELETE /lockouts/mark", Target: "mark", Result: "204"},
+		{Time: now, Protocol: "imap", User: "anna", Action: "delete-mailbox", Target: "Junk"},
+	} {
+		if err := Record(path, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	patterns := map[Filter]int{
+		{}:                             3,
+		{User: "mark"}:                 2,
+		{User: "anna"}:                 1,
+		{Since: now.Add(-time.Minute)}: 2,
+		{User: "mark", Since: now}:     1,
+		{N: 1}:                         1,
+		{User: "nobody"}:               0,
+	}
+	for f, expect := range patterns {
+		entries, err := Load(path, f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != expect {
+			t.Errorf("Load(%+v)=%d entries, expect %d", f, len(entries), expect)
+		}
+	}
+}
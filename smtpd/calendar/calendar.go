@@ -0,0 +1,183 @@
+package calendar
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// Reply participation states (RFC5545 PARTSTAT)
+const (
+	Accepted  = "ACCEPTED"
+	Declined  = "DECLINED"
+	Tentative = "TENTATIVE"
+)
+
+// Invite is the first VEVENT of a text/calendar part
+type Invite struct {
+	Method    string // REQUEST, CANCEL, REPLY..
+	UID       string
+	Summary   string
+	Organizer string // Address without mailto:
+	Sequence  string
+
+	// Raw content lines kept for the reply so parameters (CN, TZID) survive
+	organizerLine string
+	dtstartLine   string
+}
+
+// Find returns the invite of the first text/calendar part in a raw message
+func Find(data []byte) (*Invite, bool) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, false
+	}
+	body, err := io.ReadAll(msg.Body)
+	if err != nil {
+		return nil, false
+	}
+	return findEntity(msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), body)
+}
+
+func findEntity(contentType, cte string, body []byte) (*Invite, bool) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, false
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+		for {
+			part, err := mr.NextRawPart()
+			if err != nil {
+				return nil, false
+			}
+			raw, err := io.ReadAll(part)
+			if err != nil {
+				return nil, false
+			}
+			if inv, ok := findEntity(part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"), raw); ok {
+				return inv, true
+			}
+		}
+	}
+	if mediaType != "text/calendar" {
+		return nil, false
+	}
+
+	decoded, err := decodeTransfer(cte, body)
+	if err != nil {
+		return nil, false
+	}
+	inv := parse(decoded)
+	if inv.Method == "" {
+		inv.Method = strings.ToUpper(params["method"])
+	}
+	return inv, true
+}
+
+// parse reads the METHOD and the properties of the first VEVENT
+func parse(ics []byte) *Invite {
+	inv := &Invite{}
+	// Unfold continuation lines (RFC5545 3.1)
+	text := strings.NewReplacer("\r\n ", "", "\r\n\t", "", "\n ", "", "\n\t", "").Replace(string(ics))
+
+	inEvent, done := false, false
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(line, "\r")
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		name, _, _ = strings.Cut(name, ";")
+		name = strings.ToUpper(name)
+
+		switch {
+		case name == "METHOD" && !inEvent:
+			inv.Method = strings.ToUpper(value)
+		case name == "BEGIN" && strings.EqualFold(value, "VEVENT") && !done:
+			inEvent = true
+		case name == "END" && strings.EqualFold(value, "VEVENT") && inEvent:
+			inEvent, done = false, true
+		case !inEvent:
+		case name == "UID":
+			inv.UID = value
+		case name == "SUMMARY":
+			inv.Summary = value
+		case name == "SEQUENCE":
+			inv.Sequence = value
+		case name == "DTSTART":
+			inv.dtstartLine = line
+		case name == "ORGANIZER":
+			inv.organizerLine = line
+			if len(value) > 7 && strings.EqualFold(value[:7], "mailto:") {
+				value = value[7:]
+			}
+			inv.Organizer = value
+		}
+	}
+	return inv
+}
+
+// Reply builds the iTIP REPLY mail from attendee to the organizer
+func (inv *Invite) Reply(attendee, partstat string) ([]byte, error) {
+	if inv.Method != "REQUEST" || inv.UID == "" || inv.Organizer == "" {
+		return nil, fmt.Errorf("not an invite request")
+	}
+	switch partstat {
+	case Accepted, Declined, Tentative:
+	default:
+		return nil, fmt.Errorf("invalid partstat %q", partstat)
+	}
+
+	now := time.Now().UTC()
+	ics := "BEGIN:VCALENDAR\r\n"
+	ics += "PRODID:-//mymail//EN\r\n"
+	ics += "VERSION:2.0\r\n"
+	ics += "METHOD:REPLY\r\n"
+	ics += "BEGIN:VEVENT\r\n"
+	ics += "UID:" + inv.UID + "\r\n"
+	ics += "DTSTAMP:" + now.Format("20060102T150405Z") + "\r\n"
+	if inv.Sequence != "" {
+		ics += "SEQUENCE:" + inv.Sequence + "\r\n"
+	}
+	if inv.dtstartLine != "" {
+		ics += inv.dtstartLine + "\r\n"
+	}
+	ics += inv.organizerLine + "\r\n"
+	ics += "ATTENDEE;PARTSTAT=" + partstat + ":mailto:" + attendee + "\r\n"
+	if inv.Summary != "" {
+		ics += "SUMMARY:" + inv.Summary + "\r\n"
+	}
+	ics += "END:VEVENT\r\n"
+	ics += "END:VCALENDAR\r\n"
+
+	subject := strings.ToUpper(partstat[:1]) + strings.ToLower(partstat[1:]) + ": " + inv.Summary
+	msg := "From: " + attendee + "\r\n"
+	msg += "To: " + inv.Organizer + "\r\n"
+	msg += "Subject: " + mime.QEncoding.Encode("utf-8", subject) + "\r\n"
+	msg += "Date: " + now.Format(time.RFC1123Z) + "\r\n"
+	msg += "MIME-Version: 1.0\r\n"
+	msg += "Content-Type: text/calendar; method=REPLY; charset=utf-8\r\n"
+	msg += "\r\n"
+	msg += ics
+	return []byte(msg), nil
+}
+
+func decodeTransfer(cte string, body []byte) ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(cte)) {
+	case "base64":
+		clean := strings.NewReplacer("\r", "", "\n", "").Replace(string(body))
+		return base64.StdEncoding.DecodeString(clean)
+	case "quoted-printable":
+		return io.ReadAll(quotedprintable.NewReader(bytes.NewReader(body)))
+	}
+	return body, nil
+}
@@ -0,0 +1,58 @@
+package calendar
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFindAndReply(t *testing.T) {
+	msg := "From: boss@example.com\r\n" +
+		"Content-Type: multipart/mixed; boundary=b1\r\n" +
+		"\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Meeting\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/calendar; method=REQUEST\r\n" +
+		"\r\n" +
+		"BEGIN:VCALENDAR\r\n" +
+		"METHOD:REQUEST\r\n" +
+		"BEGIN:VEVENT\r\n" +
+		"UID:abc@example.com\r\n" +
+		"SUMMARY:Weekly\r\n" +
+		"  sync\r\n" +
+		"DTSTART;TZID=Europe/Amsterdam:20261020T100000\r\n" +
+		"ORGANIZER;CN=Boss:mailto:boss@example.com\r\n" +
+		"END:VEVENT\r\n" +
+		"END:VCALENDAR\r\n" +
+		"--b1--\r\n"
+
+	inv, ok := Find([]byte(msg))
+	if !ok {
+		t.Fatal("invite not found")
+	}
+	if inv.Method != "REQUEST" || inv.UID != "abc@example.com" || inv.Organizer != "boss@example.com" || inv.Summary != "Weekly sync" {
+		t.Errorf("unexpected invite %+v", inv)
+	}
+
+	reply, err := inv.Reply("me@example.org", Accepted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range []string{
+		"To: boss@example.com\r\n",
+		"METHOD:REPLY\r\n",
+		"DTSTART;TZID=Europe/Amsterdam:20261020T100000\r\n",
+		"ORGANIZER;CN=Boss:mailto:boss@example.com\r\n",
+		"ATTENDEE;PARTSTAT=ACCEPTED:mailto:me@example.org\r\n",
+	} {
+		if !strings.Contains(string(reply), expect) {
+			t.Errorf("reply misses %q: %s", expect, reply)
+		}
+	}
+
+	if _, ok := Find([]byte("From: a@example.com\r\nContent-Type: text/plain\r\n\r\nHi\r\n")); ok {
+		t.Error("plain message detected as invite")
+	}
+}
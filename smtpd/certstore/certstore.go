@@ -0,0 +1,128 @@
+// Package certstore serves per-domain TLS certificates by SNI name for smtpd
+// and imapd.
+package certstore
+
+import (
+	"crypto/tls"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mpdroog/mymail/smtpd/logging"
+)
+
+// Store serves per-domain certificates from cert_dir by SNI name, laid
+// out as ACME clients write them: {cert_dir}/{domain}/fullchain.pem and
+// privkey.pem. Renewed files are picked up by their modification time.
+type Store struct {
+	dir   string
+	mu    sync.Mutex
+	certs map[string]*storedCert
+}
+
+type storedCert struct {
+	cert *tls.Certificate
+	mod  time.Time
+}
+
+func New(dir string) *Store {
+	return &Store{dir: dir, certs: make(map[string]*storedCert)}
+}
+
+// GetCertificate returns the certificate for the SNI name or one of its
+// parent for a wildcard, nil lets crypto/tls fall back to the listener's
+func (c *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name == "" || strings.ContainsAny(name, "/\\") || strings.HasPrefix(name, ".") {
+		return nil, nil
+	}
+
+	names := []string{name}
+	if _, parent, ok := strings.Cut(name, "."); ok && strings.Contains(parent, ".") {
+		names = append(names, parent)
+	}
+	for _, n := range names {
+		cert, err := c.load(n)
+		if err != nil {
+			log.Printf(logging.Err+"certstore.load(%s) e=%v", n, err)
+			continue
+		}
+		if cert != nil && hello.SupportsCertificate(cert) == nil {
+			return cert, nil
+		}
+	}
+	return nil, nil
+}
+
+// load returns the certificate in {dir}/{name}, nil if there is none
+func (c *Store) load(name string) (*tls.Certificate, error) {
+	certFile := filepath.Join(c.dir, name, "fullchain.pem")
+	fi, err := os.Stat(certFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s, ok := c.certs[name]; ok && s.mod.Equal(fi.ModTime()) {
+		return s.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, filepath.Join(c.dir, name, "privkey.pem"))
+	if err != nil {
+		return nil, err
+	}
+	c.certs[name] = &storedCert{cert: &cert, mod: fi.ModTime()}
+	return &cert, nil
+}
+
+// Pair is the certificate and key file of a listener
+type Pair struct {
+	Cert string
+	Key  string
+}
+
+// Load loads the certificate of every pair, nil for one without. Pairs
+// without a certificate share def.
+func Load(pairs []Pair, def Pair) ([]*tls.Certificate, error) {
+	loaded := make(map[string]*tls.Certificate)
+	certs := make([]*tls.Certificate, len(pairs))
+	for i, p := range pairs {
+		if p.Cert == "" {
+			p = def
+		}
+		if p.Cert == "" || p.Key == "" {
+			continue
+		}
+		if cert, ok := loaded[p.Cert]; ok {
+			certs[i] = cert
+			continue
+		}
+		cert, err := tls.LoadX509KeyPair(p.Cert, p.Key)
+		if err != nil {
+			return nil, err
+		}
+		loaded[p.Cert] = &cert
+		certs[i] = &cert
+	}
+	return certs, nil
+}
+
+// SNI returns certificate i followed by the others, crypto/tls picks the
+// one matching the SNI name and defaults to the first
+func SNI(certs []*tls.Certificate, i int) []tls.Certificate {
+	seen := map[*tls.Certificate]bool{certs[i]: true}
+	out := []tls.Certificate{*certs[i]}
+	for _, c := range certs {
+		if c != nil && !seen[c] {
+			seen[c] = true
+			out = append(out, *c)
+		}
+	}
+	return out
+}
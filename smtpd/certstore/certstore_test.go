@@ -0,0 +1,116 @@
+package certstore
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed certificate for names to dir/{domain}
+func writeCert(t *testing.T, dir, domain string, names ...string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := filepath.Join(dir, domain)
+	if err := os.MkdirAll(d, 0700); err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(filepath.Join(d, "fullchain.pem"), certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(d, "privkey.pem"), keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStore(t *testing.T) {
+	dir := t.TempDir()
+	writeCert(t, dir, "mail.a.example", "mail.a.example")
+	writeCert(t, dir, "b.example", "*.b.example")
+	store := New(dir)
+
+	patterns := map[string]struct {
+		name   string
+		expect string // CommonName, empty for no certificate
+	}{
+		"exact":       {"mail.a.example", "mail.a.example"},
+		"case":        {"MAIL.A.example.", "mail.a.example"},
+		"wildcard":    {"mail.b.example", "*.b.example"},
+		"no wildcard": {"b.example", ""},
+		"unknown":     {"mail.c.example", ""},
+		"no sni":      {"", ""},
+		"traversal":   {"../b.example", ""},
+	}
+	for name, p := range patterns {
+		hello := &tls.ClientHelloInfo{
+			ServerName:        p.name,
+			SupportedVersions: []uint16{tls.VersionTLS13},
+			SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		}
+		cert, err := store.GetCertificate(hello)
+		if err != nil {
+			t.Errorf("%s: e=%v", name, err)
+			continue
+		}
+		cn := ""
+		if cert != nil {
+			cn = cert.Leaf.Subject.CommonName
+		}
+		if cn != p.expect {
+			t.Errorf("%s: cert=%q expect=%q", name, cn, p.expect)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	writeCert(t, dir, "a", "mail.a.example")
+	writeCert(t, dir, "b", "mail.b.example")
+	a := Pair{Cert: filepath.Join(dir, "a", "fullchain.pem"), Key: filepath.Join(dir, "a", "privkey.pem")}
+	b := Pair{Cert: filepath.Join(dir, "b", "fullchain.pem"), Key: filepath.Join(dir, "b", "privkey.pem")}
+
+	// The second listener falls back to the default certificate
+	certs, err := Load([]Pair{b, {}, a}, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if certs[1] != certs[2] {
+		t.Errorf("default certificate loaded twice")
+	}
+
+	list := SNI(certs, 1)
+	if len(list) != 2 {
+		t.Fatalf("len=%d expect=2", len(list))
+	}
+	if cn := list[0].Leaf.Subject.CommonName; cn != "mail.a.example" {
+		t.Errorf("first=%q, expect the listener's own", cn)
+	}
+}
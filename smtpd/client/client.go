@@ -2,54 +2,124 @@ package client
 
 import (
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"log"
+	"math/rand"
 	"net"
 	"net/smtp"
+	"net/textproto"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/mpdroog/mymail/smtpd/config"
+	"github.com/mpdroog/mymail/smtpd/dns"
+	"github.com/mpdroog/mymail/smtpd/logging"
 )
 
-type Client struct{}
+const (
+	mxFailThreshold = 2               // Failures before a host is skipped
+	mxFailTTL       = 5 * time.Minute // Skip duration, multiplied by failure count
+	mxFailMaxTTL    = 1 * time.Hour
+)
 
-func New() *Client {
-	return &Client{}
+// mxFailure is a negative cache entry for an MX host
+type mxFailure struct {
+	count int
+	until time.Time
+}
+
+type Client struct {
+	mu       sync.Mutex
+	failures map[string]*mxFailure
+	relays   []*relay
 }
 
-// Send sends an email to the specified recipient
-func (c *Client) Send(from, to string, data []byte) error {
-	// If relay host is configured, use it
-	if config.C.RelayHost != "" {
-		return c.sendViaRelay(from, to, data)
+func New() *Client {
+	c := &Client{
+		failures: make(map[string]*mxFailure),
+	}
+	for _, r := range config.C.Relays {
+		c.relays = append(c.relays, &relay{Relay: r, healthy: true})
 	}
+	return c
+}
 
-	// Otherwise, send directly via MX lookup
-	return c.sendDirect(from, to, data)
+// Result is the outcome of a delivery attempt for one recipient
+type Result struct {
+	Host     string // MX or relay that answered last, empty if none was reached
+	TLS      bool   // The transaction ran over TLS
+	Duration time.Duration
+	Err      error
 }
 
-func (c *Client) sendViaRelay(from, to string, data []byte) error {
-	addr := fmt.Sprintf("%s:%d", config.C.RelayHost, config.C.RelayPort)
+// Send sends an email to one or more recipients and returns the result per
+// recipient. Recipients sharing a domain are delivered in one transaction.
+func (c *Client) Send(from string, to []string, data []byte) map[string]Result {
+	results := make(map[string]Result, len(to))
+	start := time.Now()
+	add := func(host string, secure bool, errs map[string]error) {
+		took := time.Since(start)
+		for rcpt, err := range errs {
+			results[rcpt] = Result{Host: host, TLS: secure, Duration: took, Err: err}
+		}
+	}
+
+	// A looping message goes nowhere, a relay would only send it round again
+	if err := checkHops(data); err != nil {
+		add("", false, failAll(to, err))
+		return results
+	}
 
-	var auth smtp.Auth
-	if config.C.RelayUser != "" {
-		auth = smtp.PlainAuth("", config.C.RelayUser, config.C.RelayPassword, config.C.RelayHost)
+	// If relay hosts are configured, use them
+	if len(c.relays) > 0 {
+		add(c.sendViaRelay(from, to, data))
+		return results
+	}
+
+	// Otherwise, send directly via MX lookup
+	byDomain := make(map[string][]string)
+	for _, rcpt := range to {
+		domain := getDomain(rcpt)
+		if domain == "" {
+			results[rcpt] = Result{Err: fmt.Errorf("invalid recipient address: %s", rcpt)}
+			continue
+		}
+		byDomain[domain] = append(byDomain[domain], rcpt)
 	}
 
-	return smtp.SendMail(addr, auth, from, []string{to}, data)
+	for domain, rcpts := range byDomain {
+		// Timed per domain, they're delivered one after the other
+		start = time.Now()
+		add(c.sendDirect(domain, from, rcpts, data))
+	}
+	return results
+}
+
+// IsPermanent returns true if err is a 5xx reply that should not be retried
+func IsPermanent(err error) bool {
+	var te *textproto.Error
+	return errors.As(err, &te) && te.Code >= 500
 }
 
-func (c *Client) sendDirect(from, to string, data []byte) error {
-	domain := getDomain(to)
-	if domain == "" {
-		return fmt.Errorf("invalid recipient address: %s", to)
+// Reply returns the SMTP reply in err, code 0 when err isn't one
+func Reply(err error) (int, string) {
+	var te *textproto.Error
+	if errors.As(err, &te) {
+		return te.Code, te.Msg
 	}
+	return 0, err.Error()
+}
 
+// sendDirect delivers to the MX hosts of domain and returns the host that
+// answered last, whether it was over TLS and the results
+func (c *Client) sendDirect(domain, from string, to []string, data []byte) (string, bool, map[string]error) {
 	// Look up MX records
-	mxRecords, err := net.LookupMX(domain)
+	mxRecords, err := dns.LookupMX(domain)
 	if err != nil {
-		return fmt.Errorf("MX lookup failed for %s: %v", domain, err)
+		return "", false, failAll(to, fmt.Errorf("MX lookup failed for %s: %w", domain, err))
 	}
 
 	if len(mxRecords) == 0 {
@@ -57,42 +127,101 @@ func (c *Client) sendDirect(from, to string, data []byte) error {
 		mxRecords = []*net.MX{{Host: domain, Pref: 0}}
 	}
 
-	// Sort by preference
-	sort.Slice(mxRecords, func(i, j int) bool {
+	mxRecords, err = withoutSelf(domain, mxRecords)
+	if err != nil {
+		log.Printf(logging.Err+"sendDirect(%s) e=%v", domain, err)
+		return "", false, failAll(to, err)
+	}
+
+	var lastErr error
+	var lastHost string
+	for _, host := range c.orderMX(mxRecords) {
+		results, secure, err := c.sendToHost(host, from, to, data)
+		if err == nil {
+			c.markHost(host, nil)
+			return host, secure, results
+		}
+		c.markHost(host, err)
+		lastErr, lastHost = err, host
+	}
+
+	return lastHost, false, failAll(to, fmt.Errorf("all MX hosts failed, last error: %w", lastErr))
+}
+
+// orderMX sorts by preference, randomizes hosts with equal preference and
+// leaves out hosts that failed repeatedly, unless no other host is left
+func (c *Client) orderMX(mxRecords []*net.MX) []string {
+	rand.Shuffle(len(mxRecords), func(i, j int) {
+		mxRecords[i], mxRecords[j] = mxRecords[j], mxRecords[i]
+	})
+	sort.SliceStable(mxRecords, func(i, j int) bool {
 		return mxRecords[i].Pref < mxRecords[j].Pref
 	})
 
-	var lastErr error
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	var healthy, failing []string
 	for _, mx := range mxRecords {
 		host := strings.TrimSuffix(mx.Host, ".")
-
-		err := c.sendToHost(host, from, to, data)
-		if err == nil {
-			return nil
+		if f, ok := c.failures[host]; ok && f.count >= mxFailThreshold && now.Before(f.until) {
+			failing = append(failing, host)
+			continue
 		}
-		lastErr = err
+		healthy = append(healthy, host)
+	}
+
+	if len(healthy) == 0 {
+		return failing
+	}
+	return healthy
+}
+
+// markHost updates the negative cache after a connection attempt
+func (c *Client) markHost(host string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err == nil {
+		delete(c.failures, host)
+		return
 	}
 
-	return fmt.Errorf("all MX hosts failed, last error: %v", lastErr)
+	f, ok := c.failures[host]
+	if !ok {
+		f = &mxFailure{}
+		c.failures[host] = f
+	}
+	f.count++
+	ttl := time.Duration(f.count) * mxFailTTL
+	if ttl > mxFailMaxTTL {
+		ttl = mxFailMaxTTL
+	}
+	f.until = time.Now().Add(ttl)
 }
 
-func (c *Client) sendToHost(host, from, to string, data []byte) error {
+// sendToHost runs one transaction for all recipients and reports whether it
+// ran over TLS. The error is set when the host could not take the
+// transaction at all so the next MX can be tried.
+func (c *Client) sendToHost(host, from string, to []string, data []byte) (map[string]error, bool, error) {
 	// Try port 25 first
-	conn, err := net.DialTimeout("tcp", host+":25", 30*time.Second)
+	conn, err := dial(host + ":25")
 	if err != nil {
-		return err
+		return nil, false, err
 	}
 	defer conn.Close()
+	conn.SetDeadline(txDeadline())
 
 	client, err := smtp.NewClient(conn, host)
 	if err != nil {
-		return err
+		return nil, false, err
 	}
 	defer client.Close()
 
 	// Say hello
 	if err := client.Hello(config.C.Hostname); err != nil {
-		return err
+		return nil, false, err
 	}
 
 	// Try STARTTLS if available
@@ -107,31 +236,58 @@ func (c *Client) sendToHost(host, from, to string, data []byte) error {
 
 	// Set sender
 	if err := client.Mail(from); err != nil {
-		return err
+		return nil, false, err
 	}
 
-	// Set recipient
-	if err := client.Rcpt(to); err != nil {
-		return err
+	_, secure := client.TLSConnectionState()
+	results := deliver(client, to, data)
+	client.Quit()
+	return results, secure, nil
+}
+
+// deliver sends RCPT for every recipient and the DATA once for the accepted
+// ones, RCPT failures only affect that recipient. The connection is left
+// open for the caller to QUIT or reuse.
+func deliver(client *smtp.Client, to []string, data []byte) map[string]error {
+	results := make(map[string]error, len(to))
+
+	var accepted []string
+	for _, rcpt := range to {
+		if err := client.Rcpt(rcpt); err != nil {
+			results[rcpt] = err
+			continue
+		}
+		accepted = append(accepted, rcpt)
+	}
+	if len(accepted) == 0 {
+		client.Reset()
+		return results
 	}
 
-	// Send data
-	w, err := client.Data()
-	if err != nil {
-		return err
+	err := writeData(client, data)
+	for _, rcpt := range accepted {
+		results[rcpt] = err
 	}
+	return results
+}
 
-	_, err = w.Write(data)
+func writeData(client *smtp.Client, data []byte) error {
+	w, err := client.Data()
 	if err != nil {
 		return err
 	}
-
-	err = w.Close()
-	if err != nil {
+	if _, err := w.Write(data); err != nil {
 		return err
 	}
+	return w.Close()
+}
 
-	return client.Quit()
+func failAll(to []string, err error) map[string]error {
+	results := make(map[string]error, len(to))
+	for _, rcpt := range to {
+		results[rcpt] = err
+	}
+	return results
 }
 
 func getDomain(email string) string {
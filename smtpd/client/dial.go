@@ -0,0 +1,203 @@
+package client
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/mpdroog/mymail/smtpd/config"
+)
+
+const (
+	dialTimeout = 30 * time.Second
+	txTimeout   = 10 * time.Minute // Bounds a whole SMTP transaction
+)
+
+// txDeadline is when a transaction starting now gives up, well before
+// another instance would take over the claim of the queue entry
+func txDeadline() time.Time {
+	d := txTimeout
+	if ttl := config.C.QueueClaimTTL; ttl > 0 && ttl/2 < d {
+		d = ttl / 2
+	}
+	return time.Now().Add(d)
+}
+
+// dial opens an outbound connection honouring outbound_bind and outbound_proxy,
+// the caller sets the deadline of the transaction
+func dial(addr string) (net.Conn, error) {
+	d := &net.Dialer{Timeout: dialTimeout}
+	if config.C.OutboundBind != "" {
+		ip := net.ParseIP(config.C.OutboundBind)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid outbound_bind %q", config.C.OutboundBind)
+		}
+		d.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+
+	if config.C.OutboundProxy == "" {
+		return d.Dial("tcp", addr)
+	}
+
+	proxy, err := url.Parse(config.C.OutboundProxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid outbound_proxy: %v", err)
+	}
+	conn, err := d.Dial("tcp", proxy.Host)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+
+	switch proxy.Scheme {
+	case "socks5":
+		err = socks5Connect(conn, proxy.User, addr)
+	case "http":
+		err = httpConnect(conn, proxy.User, addr)
+	default:
+		err = fmt.Errorf("unsupported outbound_proxy scheme %q", proxy.Scheme)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// socks5Connect performs the RFC 1928 handshake with optional RFC 1929 auth
+func socks5Connect(conn net.Conn, user *url.Userinfo, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return err
+	}
+	// Lengths are sent in one byte
+	if len(host) > 255 {
+		return errors.New("socks5: host name longer than 255 bytes")
+	}
+	if user != nil {
+		pass, _ := user.Password()
+		if len(user.Username()) > 255 || len(pass) > 255 {
+			return errors.New("socks5: username or password longer than 255 bytes")
+		}
+	}
+
+	method := byte(0x00) // No authentication
+	if user != nil {
+		method = 0x02 // Username/password
+	}
+	if _, err := conn.Write([]byte{0x05, 0x01, method}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 0x05 || reply[1] != method {
+		return errors.New("socks5: no acceptable authentication method")
+	}
+
+	if user != nil {
+		pass, _ := user.Password()
+		req := []byte{0x01, byte(len(user.Username()))}
+		req = append(req, user.Username()...)
+		req = append(req, byte(len(pass)))
+		req = append(req, pass...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return errors.New("socks5: authentication failed")
+		}
+	}
+
+	// CONNECT with domain name so DNS is resolved at the proxy
+	req := []byte{0x05, 0x01, 0x00, 0x03, byte(len(host))}
+	req = append(req, host...)
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return err
+	}
+	if head[1] != 0x00 {
+		return fmt.Errorf("socks5: connect failed with code %d", head[1])
+	}
+
+	// Skip bound address
+	var skip int
+	switch head[3] {
+	case 0x01:
+		skip = net.IPv4len
+	case 0x04:
+		skip = net.IPv6len
+	case 0x03:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(conn, l); err != nil {
+			return err
+		}
+		skip = int(l[0])
+	default:
+		return errors.New("socks5: invalid address type in reply")
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
+
+// httpConnect tunnels through an HTTP proxy with the CONNECT method
+func httpConnect(conn net.Conn, user *url.Userinfo, addr string) error {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if user != nil {
+		pass, _ := user.Password()
+		req.SetBasicAuth(user.Username(), pass)
+		req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+		req.Header.Del("Authorization")
+	}
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+
+	// Don't read ahead, the SMTP greeting follows the response
+	resp, err := http.ReadResponse(bufio.NewReaderSize(&oneByteReader{conn}, 1), req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("http proxy: CONNECT failed: %s", resp.Status)
+	}
+	return nil
+}
+
+// oneByteReader prevents bufio from consuming bytes after the proxy response
+type oneByteReader struct {
+	r io.Reader
+}
+
+func (o *oneByteReader) Read(p []byte) (int, error) {
+	if len(p) > 1 {
+		p = p[:1]
+	}
+	return o.r.Read(p)
+}
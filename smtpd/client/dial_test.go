@@ -0,0 +1,63 @@
+package client
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// TestSocks5Connect runs the handshake against a fake proxy
+func TestSocks5Connect(t *testing.T) {
+	client, proxy := net.Pipe()
+	defer client.Close()
+	got := make(chan []byte, 1)
+	go func() {
+		defer proxy.Close()
+		buf := make([]byte, 512)
+		io.ReadFull(proxy, buf[:3])
+		proxy.Write([]byte{0x05, 0x02})
+		// Username/password
+		n, _ := proxy.Read(buf)
+		if !bytes.Equal(buf[:n], []byte("\x01\x04mark\x06secret")) {
+			got <- buf[:n]
+			return
+		}
+		proxy.Write([]byte{0x01, 0x00})
+		n, _ = proxy.Read(buf)
+		got <- append([]byte(nil), buf[:n]...)
+		proxy.Write([]byte{0x05, 0x00, 0x00, 0x01, 127, 0, 0, 1, 0, 25})
+	}()
+
+	if err := socks5Connect(client, url.UserPassword("mark", "secret"), "mx.example.com:25"); err != nil {
+		t.Fatal(err)
+	}
+	if req := <-got; !bytes.Equal(req, []byte("\x05\x01\x00\x03\x0emx.example.com\x00\x19")) {
+		t.Errorf("CONNECT=%q", req)
+	}
+}
+
+// TestSocks5Long checks names that don't fit in a length byte are refused
+// before anything is sent
+func TestSocks5Long(t *testing.T) {
+	long := strings.Repeat("a", 256)
+	patterns := map[string]struct {
+		user *url.Userinfo
+		addr string
+	}{
+		"host":     {nil, long + ".example.com:25"},
+		"username": {url.UserPassword(long, "secret"), "mx.example.com:25"},
+		"password": {url.UserPassword("mark", long), "mx.example.com:25"},
+	}
+	for name, p := range patterns {
+		client, proxy := net.Pipe()
+		proxy.Close()
+		err := socks5Connect(client, p.user, p.addr)
+		if err == nil || !strings.Contains(err.Error(), "longer than 255") {
+			t.Errorf("%s: e=%v", name, err)
+		}
+		client.Close()
+	}
+}
@@ -0,0 +1,81 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+
+	"github.com/mpdroog/mymail/smtpd/config"
+	"github.com/mpdroog/mymail/smtpd/dns"
+)
+
+// MaxHops is the maximum number of Received headers before a message is
+// considered to be looping (same default as Postfix)
+const MaxHops = 50
+
+// checkHops rejects messages that passed too many relays
+func checkHops(data []byte) error {
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(data)))
+	header, _ := r.ReadMIMEHeader()
+	hops := len(header.Values("Received"))
+	if hops > MaxHops {
+		return &textproto.Error{Code: 554, Msg: fmt.Sprintf("5.4.6 Too many hops (%d Received headers), mail loop?", hops)}
+	}
+	return nil
+}
+
+// withoutSelf drops ourselves and all less preferred MX hosts (backup MX
+// semantics). If we are the most preferred host the mail would loop back.
+func withoutSelf(domain string, mxRecords []*net.MX) ([]*net.MX, error) {
+	selfPref := -1
+	for _, mx := range mxRecords {
+		if isSelf(strings.TrimSuffix(mx.Host, ".")) && (selfPref == -1 || int(mx.Pref) < selfPref) {
+			selfPref = int(mx.Pref)
+		}
+	}
+	if selfPref == -1 {
+		return mxRecords, nil
+	}
+
+	var out []*net.MX
+	for _, mx := range mxRecords {
+		if int(mx.Pref) < selfPref {
+			out = append(out, mx)
+		}
+	}
+	if len(out) == 0 {
+		return nil, &textproto.Error{Code: 554, Msg: fmt.Sprintf("5.4.6 Mail for %s loops back to myself, add it to local_domains?", domain)}
+	}
+	return out, nil
+}
+
+// isSelf returns true if host is our hostname or resolves to a local address
+func isSelf(host string) bool {
+	if strings.EqualFold(host, config.C.Hostname) {
+		return true
+	}
+
+	ips, err := dns.LookupIP(host)
+	if err != nil {
+		return false
+	}
+	local, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+
+	for _, ip := range ips {
+		if ip.IsLoopback() {
+			return true
+		}
+		for _, addr := range local {
+			if n, ok := addr.(*net.IPNet); ok && n.IP.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
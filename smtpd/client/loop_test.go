@@ -0,0 +1,26 @@
+package client
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mpdroog/mymail/smtpd/config"
+)
+
+// TestHopsViaRelay checks a looping message isn't handed to a relay
+func TestHopsViaRelay(t *testing.T) {
+	// Nothing listens on the relay, a connection attempt fails differently
+	config.C.Relays = []config.Relay{{Host: "127.0.0.1", Port: 1, Weight: 1}}
+	defer func() { config.C.Relays = nil }()
+	c := New()
+	defer c.Close()
+
+	data := strings.Repeat("Received: from a by b\r\n", MaxHops+1) + "Subject: hi\r\n\r\nbody\r\n"
+	res := c.Send("a@example.com", []string{"b@example.org"}, []byte(data))["b@example.org"]
+	if code, text := Reply(res.Err); code != 554 || !strings.Contains(text, "Too many hops") {
+		t.Errorf("Reply=%d %q", code, text)
+	}
+	if res.Host != "" {
+		t.Errorf("Host=%q, expect no relay tried", res.Host)
+	}
+}
@@ -0,0 +1,97 @@
+package client
+
+import (
+	"net"
+	"net/smtp"
+	"time"
+
+	"github.com/mpdroog/mymail/smtpd/config"
+)
+
+// pooledConn is an authenticated relay connection waiting for the next message
+type pooledConn struct {
+	client *smtp.Client
+	conn   net.Conn // Underneath client, for the transaction deadline
+	since  time.Time
+}
+
+// getConn returns an idle connection to r that still answers NOOP, or dials
+// a new one. Expired connections are closed on the way. The connection has
+// until txDeadline for the transaction.
+func (c *Client) getConn(r *relay) (*pooledConn, error) {
+	for {
+		c.mu.Lock()
+		n := len(r.idle)
+		if n == 0 {
+			c.mu.Unlock()
+			return c.dialRelay(r)
+		}
+		pc := r.idle[n-1]
+		r.idle = r.idle[:n-1]
+		c.mu.Unlock()
+
+		if time.Since(pc.since) > config.C.RelayPoolIdle {
+			pc.client.Quit()
+			continue
+		}
+		pc.conn.SetDeadline(txDeadline())
+		if err := pc.client.Noop(); err != nil {
+			// Relay closed it in the meantime
+			pc.client.Close()
+			continue
+		}
+		return pc, nil
+	}
+}
+
+// putConn resets pc after a transaction and keeps it for reuse, unless
+// the pool is full or the connection broke
+func (c *Client) putConn(r *relay, pc *pooledConn) {
+	if err := pc.client.Reset(); err != nil {
+		pc.client.Close()
+		return
+	}
+
+	c.mu.Lock()
+	if r.healthy && len(r.idle) < config.C.RelayPoolSize {
+		pc.since = time.Now()
+		r.idle = append(r.idle, pc)
+		pc = nil
+	}
+	c.mu.Unlock()
+
+	if pc != nil {
+		pc.client.Quit()
+	}
+}
+
+// dropConns closes the idle connections of r, or of all relays when r is nil,
+// that are older than maxIdle
+func (c *Client) dropConns(r *relay, maxIdle time.Duration) {
+	var old []*pooledConn
+	c.mu.Lock()
+	for _, cur := range c.relays {
+		if r != nil && cur != r {
+			continue
+		}
+		keep := cur.idle[:0]
+		for _, pc := range cur.idle {
+			if time.Since(pc.since) >= maxIdle {
+				old = append(old, pc)
+			} else {
+				keep = append(keep, pc)
+			}
+		}
+		cur.idle = keep
+	}
+	c.mu.Unlock()
+
+	for _, pc := range old {
+		pc.client.Quit()
+	}
+}
+
+// Close says goodbye on all pooled relay connections
+func (c *Client) Close() {
+	c.dropConns(nil, 0)
+}
@@ -0,0 +1,197 @@
+package client
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mpdroog/mymail/smtpd/config"
+)
+
+// TestRelayPool sends several messages to a fake relay, they should share
+// one connection
+func TestRelayPool(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	var conns, mails atomic.Int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conns.Add(1)
+			go fakeRelay(conn, &mails)
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	config.C.Hostname = "test.example.com"
+	config.C.Relays = []config.Relay{{Host: "127.0.0.1", Port: addr.Port, Weight: 1}}
+	config.C.RelayPoolSize = 2
+	config.C.RelayPoolIdle = time.Minute
+	defer func() { config.C.Relays = nil }()
+
+	c := New()
+	defer c.Close()
+	for i := 0; i < 3; i++ {
+		for rcpt, res := range c.Send("a@example.com", []string{"b@example.org"}, []byte("Subject: hi\r\n\r\nbody\r\n")) {
+			if res.Err != nil || res.Host != "127.0.0.1" {
+				t.Fatalf("send %d to %s host=%s e=%v", i, rcpt, res.Host, res.Err)
+			}
+		}
+	}
+	if n := mails.Load(); n != 3 {
+		t.Errorf("relay got %d mails, expect 3", n)
+	}
+	if n := conns.Load(); n != 1 {
+		t.Errorf("%d connections, expect 1", n)
+	}
+
+	// Expired connections are replaced
+	config.C.RelayPoolIdle = 0
+	c.Send("a@example.com", []string{"b@example.org"}, []byte("Subject: hi\r\n\r\nbody\r\n"))
+	if n := conns.Load(); n != 2 {
+		t.Errorf("%d connections after expiry, expect 2", n)
+	}
+}
+
+// fakeRelay answers just enough SMTP for net/smtp
+func fakeRelay(conn net.Conn, mails *atomic.Int32) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	conn.Write([]byte("220 relay ready\r\n"))
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.Fields(line + " x")[0])
+		switch cmd {
+		case "EHLO":
+			conn.Write([]byte("250-relay\r\n250 8BITMIME\r\n"))
+		case "DATA":
+			conn.Write([]byte("354 go ahead\r\n"))
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+			}
+			mails.Add(1)
+			conn.Write([]byte("250 queued\r\n"))
+		case "QUIT":
+			conn.Write([]byte("221 bye\r\n"))
+			return
+		default:
+			conn.Write([]byte("250 ok\r\n"))
+		}
+	}
+}
+
+// TestRejectedBanner checks a relay refusing the connection fails delivery
+// with its reply, wrapped but not hidden from IsPermanent and Reply
+func TestRejectedBanner(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("554 5.7.1 Client host blocked using zen.spamhaus.org\r\n"))
+			conn.Close()
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	config.C.Hostname = "test.example.com"
+	config.C.Relays = []config.Relay{{Host: "127.0.0.1", Port: addr.Port, Weight: 1}}
+	defer func() { config.C.Relays = nil }()
+
+	c := New()
+	defer c.Close()
+	res := c.Send("a@example.com", []string{"b@example.org"}, []byte("Subject: hi\r\n\r\nbody\r\n"))["b@example.org"]
+	if !IsPermanent(res.Err) {
+		t.Errorf("IsPermanent(%v) false", res.Err)
+	}
+	if code, text := Reply(res.Err); code != 554 || !strings.Contains(text, "spamhaus") {
+		t.Errorf("Reply=%d %q", code, text)
+	}
+}
+
+// TestRelayHealth checks only a dead or busy relay is marked unhealthy, not
+// one rejecting the sender
+func TestRelayHealth(t *testing.T) {
+	patterns := map[string]struct {
+		greeting string
+		mail     string
+		healthy  bool
+	}{
+		"sender rejected": {"220 relay ready", "553 5.7.1 Sender not allowed", true},
+		"busy":            {"421 4.3.2 Too busy", "", false},
+		"blocked":         {"554 5.7.1 Client host blocked", "", true},
+	}
+	for name, p := range patterns {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer conn.Close()
+					conn.Write([]byte(p.greeting + "\r\n"))
+					r := bufio.NewReader(conn)
+					for {
+						line, err := r.ReadString('\n')
+						if err != nil {
+							return
+						}
+						switch strings.ToUpper(strings.Fields(line + " x")[0]) {
+						case "EHLO":
+							conn.Write([]byte("250 relay\r\n"))
+						case "MAIL":
+							conn.Write([]byte(p.mail + "\r\n"))
+						default:
+							conn.Write([]byte("250 ok\r\n"))
+						}
+					}
+				}()
+			}
+		}()
+
+		addr := ln.Addr().(*net.TCPAddr)
+		config.C.Hostname = "test.example.com"
+		config.C.Relays = []config.Relay{{Host: "127.0.0.1", Port: addr.Port, Weight: 1}}
+		c := New()
+		res := c.Send("a@example.com", []string{"b@example.org"}, []byte("Subject: hi\r\n\r\nbody\r\n"))["b@example.org"]
+		if res.Err == nil {
+			t.Errorf("%s: delivered", name)
+		}
+		if healthy := c.relays[0].healthy; healthy != p.healthy {
+			t.Errorf("%s: healthy=%t expect=%t (e=%v)", name, healthy, p.healthy, res.Err)
+		}
+		c.Close()
+		ln.Close()
+	}
+	config.C.Relays = nil
+}
@@ -0,0 +1,188 @@
+package client
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"net/smtp"
+	"net/textproto"
+	"sort"
+	"time"
+
+	"github.com/mpdroog/mymail/smtpd/config"
+	"github.com/mpdroog/mymail/smtpd/logging"
+)
+
+const relayCheckInterval = 1 * time.Minute
+
+// relay is a smarthost from the pool with its last known health and its
+// idle connections, see pool.go
+type relay struct {
+	config.Relay
+	healthy bool
+	idle    []*pooledConn
+}
+
+func (r *relay) addr() string {
+	return fmt.Sprintf("%s:%d", r.Host, r.Port)
+}
+
+// sendViaRelay tries the relays in weighted random order, failing over to the
+// next relay when one cannot take the transaction
+func (c *Client) sendViaRelay(from string, to []string, data []byte) (string, bool, map[string]error) {
+	var lastErr error
+	var lastHost string
+	for _, r := range c.orderRelays() {
+		results, secure, err := c.sendToRelay(r, from, to, data)
+		c.markRelay(r, err)
+		if err == nil {
+			return r.Host, secure, results
+		}
+		log.Printf(logging.Warning+"Relay %s failed, trying next: %v", r.addr(), err)
+		lastErr, lastHost = err, r.Host
+	}
+	return lastHost, false, failAll(to, fmt.Errorf("all relays failed, last error: %w", lastErr))
+}
+
+// orderRelays returns healthy relays weighted-shuffled, unhealthy ones last
+func (c *Client) orderRelays() []*relay {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Weighted random ordering (Efraimidis-Spirakis)
+	keys := make(map[*relay]float64, len(c.relays))
+	var healthy, unhealthy []*relay
+	for _, r := range c.relays {
+		keys[r] = math.Pow(rand.Float64(), 1/float64(r.Weight))
+		if r.healthy {
+			healthy = append(healthy, r)
+		} else {
+			unhealthy = append(unhealthy, r)
+		}
+	}
+	sort.Slice(healthy, func(i, j int) bool {
+		return keys[healthy[i]] > keys[healthy[j]]
+	})
+	return append(healthy, unhealthy...)
+}
+
+// errRelayBusy marks a relay that answered the connection with a 4xx greeting
+var errRelayBusy = errors.New("relay busy")
+
+// relayDown reports whether err means the relay can't take mail at all: the
+// connection failed or it greeted with a 4xx. A rejected command is about
+// the message or our account and leaves the relay healthy.
+func relayDown(err error) bool {
+	var te *textproto.Error
+	return errors.Is(err, errRelayBusy) || !errors.As(err, &te)
+}
+
+// markRelay updates the health of r after a transaction or probe that ended
+// with err
+func (c *Client) markRelay(r *relay, err error) {
+	down := err != nil && relayDown(err)
+	c.mu.Lock()
+	if r.healthy && down {
+		log.Printf(logging.Warning+"Relay %s marked unhealthy: %v", r.addr(), err)
+	} else if !r.healthy && !down {
+		log.Printf("Relay %s healthy again", r.addr())
+	}
+	r.healthy = !down
+	c.mu.Unlock()
+
+	if down {
+		c.dropConns(r, 0)
+	}
+}
+
+// dialRelay connects, upgrades to TLS when offered and authenticates
+func (c *Client) dialRelay(r *relay) (*pooledConn, error) {
+	conn, err := dial(r.addr())
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(txDeadline())
+
+	client, err := smtp.NewClient(conn, r.Host)
+	if err != nil {
+		conn.Close()
+		var te *textproto.Error
+		if errors.As(err, &te) && te.Code/100 == 4 {
+			err = fmt.Errorf("%w: %w", errRelayBusy, err)
+		}
+		return nil, err
+	}
+	if err := client.Hello(config.C.Hostname); err != nil {
+		client.Close()
+		return nil, err
+	}
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: r.Host}); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+	if r.User != "" {
+		auth := smtp.PlainAuth("", r.User, r.Password, r.Host)
+		if err := client.Auth(auth); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+	return &pooledConn{client: client, conn: conn}, nil
+}
+
+// sendToRelay runs one transaction on a pooled connection and reports
+// whether it ran over TLS, the error is set when the relay itself failed
+func (c *Client) sendToRelay(r *relay, from string, to []string, data []byte) (map[string]error, bool, error) {
+	pc, err := c.getConn(r)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if err := pc.client.Mail(from); err != nil {
+		pc.client.Close()
+		return nil, false, err
+	}
+	_, secure := pc.client.TLSConnectionState()
+	results := deliver(pc.client, to, data)
+	c.putConn(r, pc)
+	return results, secure, nil
+}
+
+// StartHealthCheck periodically probes all relays and closes expired pooled
+// connections until quit is closed, the pool is emptied on quit
+func (c *Client) StartHealthCheck(quit <-chan struct{}) {
+	if len(c.relays) == 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(relayCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				c.dropConns(nil, config.C.RelayPoolIdle)
+				if len(c.relays) < 2 {
+					// Nothing to fail over to
+					continue
+				}
+				for _, r := range c.relays {
+					pc, err := c.dialRelay(r)
+					if err == nil {
+						err = pc.client.Quit()
+					}
+					c.markRelay(r, err)
+				}
+			case <-quit:
+				c.Close()
+				return
+			}
+		}
+	}()
+}
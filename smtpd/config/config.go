@@ -4,9 +4,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type Config struct {
@@ -16,23 +18,172 @@ type Config struct {
 	MaxSizeStr    string `json:"max_size"`       // Human-readable size (e.g., "10MB")
 	MaxSize       int64  `json:"-"`              // Parsed size in bytes
 	MaxRecipients int    `json:"max_recipients"` // Max recipients per message
+	Banner        string `json:"banner"`         // 220 text after the hostname, \n for multiple lines (default "ESMTP ready")
+
+	// Header limits checked while reading DATA
+	MaxHeaderSizeStr string `json:"max_header_size"` // Total header bytes (default "64KB")
+	MaxHeaderSize    int64  `json:"-"`               // Parsed size in bytes
+	MaxHeaderLine    int    `json:"max_header_line"` // Longest header line (default 4096)
+	MaxReceived      int    `json:"max_received"`    // Most Received headers before assuming a loop (default 50)
+
+	Timeouts Timeouts `json:"timeouts"` // Per session phase
+
+	// Pregreet check, wait before the banner and drop clients that talk first
+	GreetDelayStr string        `json:"greet_delay"` // e.g. "2s" (empty=disabled)
+	GreetDelay    time.Duration `json:"-"`           // Parsed delay
 
 	// TLS settings
 	TLSCert string `json:"tls_cert"`
 	TLSKey  string `json:"tls_key"`
 
+	// Client certificates (mutual TLS), trusted machines log in without a password
+	TLSClientCA string            `json:"tls_client_ca"` // PEM bundle of CAs that sign client certificates (empty=disabled)
+	ClientCerts map[string]string `json:"client_certs"`  // Common name or "sha256:<hex fingerprint>" => account
+
+	// Extra addresses with their own hostname and certificate, e.g. one IP per
+	// hosted domain. Every certificate is also offered by SNI name on the others.
+	Listeners []Listener `json:"listeners"`
+
+	// Per-domain certificates by SNI name, {cert_dir}/{domain}/fullchain.pem and
+	// privkey.pem as ACME clients (certbot, lego) write them, renewals are picked up
+	CertDir string `json:"cert_dir"` // e.g. "/etc/letsencrypt/live" (empty=disabled)
+
+	// Unix socket for local services, the peer's system user maps to an account
+	ListenSocket string            `json:"listen_socket"` // e.g. "/run/mymail/smtpd.sock" (empty=disabled)
+	SocketUsers  map[string]string `json:"socket_users"`  // System user => account, others stay anonymous
+
 	// Authentication
-	AuthFile string `json:"auth_file"` // Path to user credentials file
+	AuthFile         string        `json:"auth_file"`         // Path to user credentials file
+	AuthFailDelayStr string        `json:"auth_fail_delay"`   // Answer a failed AUTH after this plus up to 50% jitter (default "2s")
+	AuthFailDelay    time.Duration `json:"-"`                 // Parsed delay
+	MaxAuthFailures  int           `json:"max_auth_failures"` // Failed AUTHs per connection before 421 (default 3)
+	MaxConnections   int           `json:"max_connections"`   // Open connections before new ones get 421 (default 100)
+	WelcomeTemplate  string        `json:"welcome_template"`  // text/template for new accounts (empty=built-in, "-"=none)
+	FromPolicy       string        `json:"from_policy"`       // Header From of AUTH users not their address or identities: reject (default), rewrite or allow
+
+	// Generated messages (bounces, welcome, lockout notices) per locale, the
+	// account's own locale goes first, see smtpd/messages
+	TemplateDir   string            `json:"template_dir"`   // {template_dir}/{locale}/{name}.tmpl replaces the built-in English (empty=built-in only)
+	DefaultLocale string            `json:"default_locale"` // e.g. "nl" (default "en")
+	DomainLocales map[string]string `json:"domain_locales"` // Domain => locale
+
+	DelayWarningStr string        `json:"delay_warning"` // Tell the sender once a message is deferred this long (default "4h", "0"=never)
+	DelayWarning    time.Duration `json:"-"`
+	QuotaWarning    int           `json:"quota_warning"` // Tell the user once their maildir is this % of the quota (default 90, -1=never)
+
+	// Account lockout after failed logins over all connections, shared with imapd
+	LockoutDir         string        `json:"lockout_dir"`       // Empty=disabled
+	LockoutThreshold   int           `json:"lockout_threshold"` // Failed logins within the window (default 10)
+	LockoutWindowStr   string        `json:"lockout_window"`    // e.g. "15m" (default)
+	LockoutWindow      time.Duration `json:"-"`
+	LockoutDurationStr string        `json:"lockout_duration"` // e.g. "30m" (default)
+	LockoutDuration    time.Duration `json:"-"`
+	LockoutAdmin       string        `json:"lockout_admin"` // Address that gets an alert per lock (empty=none)
 
 	// Storage
 	MailDir  string `json:"mail_dir"`  // Directory to store received emails
 	QueueDir string `json:"queue_dir"` // Directory for outgoing mail queue
 
+	// Instances sharing queue_dir (NFS or replicated) claim a message before
+	// delivering it, see storage/claim.go
+	InstanceID       string        `json:"instance_id"`     // Unique per instance (default the system hostname)
+	QueueClaimTTLStr string        `json:"queue_claim_ttl"` // Claims of a crashed instance are taken over after e.g. "15m" (default), the holder refreshes its claims meanwhile
+	QueueClaimTTL    time.Duration `json:"-"`
+
+	// Delivery to a domain that rejected us for our reputation pauses, twice
+	// as long each time it keeps rejecting, see reputation/. The operator is
+	// alerted through watchdog_webhook and watchdog_email.
+	ReputationPauseStr string        `json:"reputation_pause"` // e.g. "30m" (default)
+	ReputationPause    time.Duration `json:"-"`
+
+	// Local delivery workers, DATA is answered with 452 when the queue is full
+	DeliveryWorkers int `json:"delivery_workers"` // Concurrent mailbox writes (default 4)
+	DeliveryQueue   int `json:"delivery_queue"`   // Messages waiting for a worker (default 100)
+
+	// Calendar invites get the $Invite keyword, and are copied here (e.g. "Calendar", empty=don't copy)
+	CalendarMailbox string `json:"calendar_mailbox"`
+
+	// Attachment detaching (local delivery only)
+	AttachmentDir string `json:"attachment_dir"` // Blob store for detached attachments (empty=disabled)
+	AttachmentURL string `json:"attachment_url"` // Public base URL of the admin service (e.g. "https://mail.example.com:8025")
+	DetachSizeStr string `json:"detach_size"`    // Human-readable threshold (e.g., "1MB")
+	DetachSize    int64  `json:"-"`              // Parsed threshold in bytes
+
+	// Logging
+	LogOutput  string `json:"log_output"`  // stderr (default), syslog or journald
+	SyslogAddr string `json:"syslog_addr"` // unix:///dev/log (default), udp://host:514 or tcp://host:514
+
+	// Statistics
+	StatsDir string `json:"stats_dir"` // Per-day counters (empty=disabled)
+
+	// Outbound volume watchdog, compares hourly sends of authenticated users
+	// against their average from stats_dir
+	WatchdogFactor     float64       `json:"watchdog_factor"`     // Alert above factor x baseline (0=disabled)
+	WatchdogMinHourly  int           `json:"watchdog_min_hourly"` // Never alert below this many recipients/hour (default 50)
+	WatchdogWebhook    string        `json:"watchdog_webhook"`    // URL to POST alerts to (optional)
+	WatchdogEmail      string        `json:"watchdog_email"`      // Operator address to mail alerts to (optional)
+	WatchdogSuspendStr string        `json:"watchdog_suspend"`    // Suspend relay for this long (e.g. "1h", empty=alert only)
+	WatchdogSuspend    time.Duration `json:"-"`                   // Parsed suspend duration
+
+	// Address book per user for autocomplete, shared with imapd
+	ContactsDir string `json:"contacts_dir"` // Empty=disabled
+
+	// Login history per user, shared with imapd
+	ActivityDir string `json:"activity_dir"` // Empty=disabled
+
+	// Append-only log of destructive operations, shared with imapd and mymail
+	AuditLog string `json:"audit_log"` // File path (empty=disabled)
+
+	// X-Connection-Info on received mail with the client's IP and PTR, and
+	// country and ASN from local MaxMind DB files (reloaded on SIGHUP)
+	ConnectionInfo bool     `json:"connection_info"`
+	GeoIPDBs       []string `json:"geoip_dbs"` // e.g. GeoLite2-Country.mmdb and GeoLite2-ASN.mmdb (empty=IP and PTR only)
+
+	// Journaling for compliance, a copy of every message of journal_domains goes
+	// to journal_address and into a hash chain, see mymail verify-journal
+	JournalDomains   []string `json:"journal_domains"`   // Recipient domain inbound, sender domain outbound (empty=disabled)
+	JournalDirection string   `json:"journal_direction"` // inbound, outbound or both (default)
+	JournalAddress   string   `json:"journal_address"`   // Archive mailbox, local or remote (e.g. "archive@example.com")
+	JournalChain     string   `json:"journal_chain"`     // Hash chain file (default mail_dir/.journal.chain)
+
+	// DKIM signing of queued mail with the keys of the From domain, rotated
+	// with mymail dkim, see smtpd/dkim
+	DKIMDir string `json:"dkim_dir"` // {dkim_dir}/{domain}/keys.json and {selector}.pem (empty=disabled)
+
+	// Admin HTTP service
+	AdminAddr string `json:"admin_addr"` // Listen address (e.g. "127.0.0.1:8025", empty=disabled)
+
+	// Hot standby, the primary sends what changed in mail_dir (deliveries,
+	// flags, expunges) to the standby every replica_interval, see smtpd/replica
+	ReplicaURL         string        `json:"replica_url"`      // Standby to send to, e.g. "https://spare.example.com:8026" (empty=disabled)
+	ReplicaListen      string        `json:"replica_listen"`   // Be the standby, receive on this address over tls_cert (empty=disabled)
+	ReplicaToken       string        `json:"replica_token"`    // Shared secret of primary and standby
+	ReplicaIntervalStr string        `json:"replica_interval"` // e.g. "5s" (default)
+	ReplicaInterval    time.Duration `json:"-"`
+
 	// Relay settings for sending
-	RelayHost     string `json:"relay_host"` // External SMTP relay (optional)
-	RelayPort     int    `json:"relay_port"`
-	RelayUser     string `json:"relay_user"`
-	RelayPassword string `json:"relay_password"`
+	RelayHost     string  `json:"relay_host"` // External SMTP relay (optional)
+	RelayPort     int     `json:"relay_port"`
+	RelayUser     string  `json:"relay_user"`
+	RelayPassword string  `json:"relay_password"`
+	Relays        []Relay `json:"relays"` // Relay pool with failover, relay_host is added as first entry
+
+	// Authenticated relay connections kept open between deliveries
+	RelayPoolSize    int           `json:"relay_pool_size"` // Idle connections per relay (default 2, -1=disabled)
+	RelayPoolIdleStr string        `json:"relay_pool_idle"` // Close idle connections after e.g. "30s" (default)
+	RelayPoolIdle    time.Duration `json:"-"`
+
+	// Outbound connections
+	OutboundProxy string `json:"outbound_proxy"` // socks5://[user:pass@]host:port or http://host:port (empty=direct)
+	OutboundBind  string `json:"outbound_bind"`  // Local IP to send from, e.g. a WireGuard address (empty=default)
+
+	// Upstream resolvers for MX and other per message lookups, answers are
+	// cached for their TTL
+	DNSServers []string `json:"dns_servers"` // "host" or "host:port" (empty=/etc/resolv.conf)
+
+	// Queue workers per priority lane
+	QueueWorkersInteractive int `json:"queue_workers_interactive"` // Default 4
+	QueueWorkersBulk        int `json:"queue_workers_bulk"`        // Default 1
 
 	// Domain settings
 	LocalDomains []string `json:"local_domains"` // Domains we accept mail for
@@ -40,10 +191,40 @@ type Config struct {
 	// Sender whitelist
 	EnableWhitelist bool     `json:"enable_whitelist"` // Enable sender whitelist
 	WhitelistEmails []string `json:"whitelist_emails"` // Whitelisted email addresses
+	WhitelistDir    string   `json:"whitelist_dir"`    // Per user additions, made by mailing whitelist+example.com@ (empty=disabled)
 
 	RejectMsg string `json:"reject_msg"`
 }
 
+// Timeouts per session phase, RFC5321 4.5.3.2 (durations like "5m")
+type Timeouts struct {
+	BannerStr  string        `json:"banner"`  // Sending the 220 banner (default 1m)
+	CommandStr string        `json:"command"` // Waiting for the next command (default 5m)
+	DataStr    string        `json:"data"`    // Between lines of DATA (default 3m)
+	SessionStr string        `json:"session"` // Whole connection (default 30m)
+	Banner     time.Duration `json:"-"`
+	Command    time.Duration `json:"-"`
+	Data       time.Duration `json:"-"`
+	Session    time.Duration `json:"-"`
+}
+
+type Relay struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+	Weight   int    `json:"weight"` // Relative share of traffic (default 1)
+}
+
+// Listener is an address next to listen_addr
+type Listener struct {
+	Addr        string `json:"addr"`         // e.g. "192.0.2.2:587"
+	Hostname    string `json:"hostname"`     // Banner and EHLO name (default hostname)
+	TLSCert     string `json:"tls_cert"`     // Default tls_cert
+	TLSKey      string `json:"tls_key"`      // Default tls_key
+	ImplicitTLS bool   `json:"implicit_tls"` // TLS from the first byte (465), else STARTTLS
+}
+
 var (
 	C       Config
 	Verbose bool
@@ -62,20 +243,189 @@ func Load(path string) error {
 
 	// Parse human-readable size
 	if C.MaxSizeStr != "" {
-		size, err := parseSize(C.MaxSizeStr)
+		size, err := ParseSize(C.MaxSizeStr)
 		if err != nil {
 			return fmt.Errorf("invalid max_size %q: %v", C.MaxSizeStr, err)
 		}
 		C.MaxSize = size
 	}
+	C.MaxHeaderSize = 64 * 1024
+	if C.MaxHeaderSizeStr != "" {
+		size, err := ParseSize(C.MaxHeaderSizeStr)
+		if err != nil {
+			return fmt.Errorf("invalid max_header_size %q: %v", C.MaxHeaderSizeStr, err)
+		}
+		C.MaxHeaderSize = size
+	}
+	if C.MaxHeaderLine <= 0 {
+		C.MaxHeaderLine = 4096
+	}
+	if C.MaxReceived <= 0 {
+		C.MaxReceived = 50
+	}
+	if C.DetachSizeStr != "" {
+		size, err := ParseSize(C.DetachSizeStr)
+		if err != nil {
+			return fmt.Errorf("invalid detach_size %q: %v", C.DetachSizeStr, err)
+		}
+		C.DetachSize = size
+	}
+
+	t := &C.Timeouts
+	for _, p := range []struct {
+		name string
+		str  string
+		dst  *time.Duration
+		def  time.Duration
+	}{
+		{"banner", t.BannerStr, &t.Banner, 1 * time.Minute},
+		{"command", t.CommandStr, &t.Command, 5 * time.Minute},
+		{"data", t.DataStr, &t.Data, 3 * time.Minute},
+		{"session", t.SessionStr, &t.Session, 30 * time.Minute},
+	} {
+		*p.dst = p.def
+		if p.str == "" {
+			continue
+		}
+		d, err := time.ParseDuration(p.str)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid timeouts.%s %q", p.name, p.str)
+		}
+		*p.dst = d
+	}
+
+	if C.GreetDelayStr != "" {
+		d, err := time.ParseDuration(C.GreetDelayStr)
+		if err != nil {
+			return fmt.Errorf("invalid greet_delay %q: %v", C.GreetDelayStr, err)
+		}
+		C.GreetDelay = d
+	}
+	C.AuthFailDelay = 2 * time.Second
+	if C.AuthFailDelayStr != "" {
+		d, err := time.ParseDuration(C.AuthFailDelayStr)
+		if err != nil {
+			return fmt.Errorf("invalid auth_fail_delay %q: %v", C.AuthFailDelayStr, err)
+		}
+		C.AuthFailDelay = d
+	}
+	if C.MaxAuthFailures <= 0 {
+		C.MaxAuthFailures = 3
+	}
+	if C.MaxConnections <= 0 {
+		C.MaxConnections = 100
+	}
+	if C.LockoutThreshold <= 0 {
+		C.LockoutThreshold = 10
+	}
+	for _, p := range []struct {
+		name string
+		str  string
+		dst  *time.Duration
+		def  time.Duration
+	}{
+		{"lockout_window", C.LockoutWindowStr, &C.LockoutWindow, 15 * time.Minute},
+		{"lockout_duration", C.LockoutDurationStr, &C.LockoutDuration, 30 * time.Minute},
+		{"relay_pool_idle", C.RelayPoolIdleStr, &C.RelayPoolIdle, 30 * time.Second},
+		{"replica_interval", C.ReplicaIntervalStr, &C.ReplicaInterval, 5 * time.Second},
+		{"queue_claim_ttl", C.QueueClaimTTLStr, &C.QueueClaimTTL, 15 * time.Minute},
+		{"reputation_pause", C.ReputationPauseStr, &C.ReputationPause, 30 * time.Minute},
+	} {
+		*p.dst = p.def
+		if p.str == "" {
+			continue
+		}
+		d, err := time.ParseDuration(p.str)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid %s %q", p.name, p.str)
+		}
+		*p.dst = d
+	}
+	if C.WatchdogSuspendStr != "" {
+		d, err := time.ParseDuration(C.WatchdogSuspendStr)
+		if err != nil {
+			return fmt.Errorf("invalid watchdog_suspend %q: %v", C.WatchdogSuspendStr, err)
+		}
+		C.WatchdogSuspend = d
+	}
+	C.DelayWarning = 4 * time.Hour
+	if C.DelayWarningStr != "" {
+		d, err := time.ParseDuration(C.DelayWarningStr)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid delay_warning %q", C.DelayWarningStr)
+		}
+		C.DelayWarning = d
+	}
+	if C.QuotaWarning == 0 {
+		C.QuotaWarning = 90
+	}
+	if C.WatchdogMinHourly <= 0 {
+		C.WatchdogMinHourly = 50
+	}
+
+	switch C.FromPolicy {
+	case "":
+		C.FromPolicy = "reject"
+	case "reject", "rewrite", "allow":
+	default:
+		return fmt.Errorf("invalid from_policy %q", C.FromPolicy)
+	}
+
+	switch C.JournalDirection {
+	case "":
+		C.JournalDirection = "both"
+	case "inbound", "outbound", "both":
+	default:
+		return fmt.Errorf("invalid journal_direction %q", C.JournalDirection)
+	}
+	if C.JournalChain == "" {
+		C.JournalChain = filepath.Join(C.MailDir, ".journal.chain")
+	}
+
+	if C.InstanceID == "" {
+		C.InstanceID, _ = os.Hostname()
+	}
+	if strings.ContainsAny(C.InstanceID, "/\\\n") {
+		return fmt.Errorf("invalid instance_id %q", C.InstanceID)
+	}
+
+	if C.ReplicaURL != "" || C.ReplicaListen != "" {
+		// Whole mailboxes go over the wire
+		if C.ReplicaToken == "" {
+			return fmt.Errorf("replica_token required with replica_url and replica_listen")
+		}
+		if C.ReplicaURL != "" && !strings.HasPrefix(C.ReplicaURL, "https://") {
+			return fmt.Errorf("invalid replica_url %q, must be https://", C.ReplicaURL)
+		}
+		if C.ReplicaListen != "" && (C.TLSCert == "" || C.TLSKey == "") {
+			return fmt.Errorf("replica_listen requires tls_cert and tls_key")
+		}
+	}
+
+	if C.RelayHost != "" {
+		C.Relays = append([]Relay{{
+			Host:     C.RelayHost,
+			Port:     C.RelayPort,
+			User:     C.RelayUser,
+			Password: C.RelayPassword,
+		}}, C.Relays...)
+	}
+	if C.RelayPoolSize == 0 {
+		C.RelayPoolSize = 2
+	}
+	for i := range C.Relays {
+		if C.Relays[i].Weight <= 0 {
+			C.Relays[i].Weight = 1
+		}
+	}
 
 	return CheckPaths()
 }
 
-// parseSize converts human-readable size strings to bytes.
+// ParseSize converts human-readable size strings to bytes.
 // Supports: B, KB, MB, GB (case-insensitive)
 // Examples: "10MB", "512KB", "1GB", "1024"
-func parseSize(s string) (int64, error) {
+func ParseSize(s string) (int64, error) {
 	s = strings.TrimSpace(strings.ToUpper(s))
 	if s == "" {
 		return 0, fmt.Errorf("empty size")
@@ -103,8 +453,6 @@ func parseSize(s string) (int64, error) {
 	case "B", "":
 		return value, nil
 	default:
-		return 0, fmt.Errorf("Invalid unit=" + unit)
+		return 0, fmt.Errorf("Invalid unit=%s", unit)
 	}
-
-	return value, nil
 }
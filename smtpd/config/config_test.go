@@ -13,12 +13,12 @@ func TestParseSize(t *testing.T) {
 		"1B":   true,
 	}
 	for pattern, valid := range patterns {
-		_, err := parseSize(pattern)
+		_, err := ParseSize(pattern)
 		if valid && err != nil {
-			t.Errorf("Valid but pattern invalid: " + pattern)
+			t.Errorf("Valid but pattern invalid: %s", pattern)
 		}
 		if !valid && err == nil {
-			t.Errorf("Invalid but pattern accepted: " + pattern)
+			t.Errorf("Invalid but pattern accepted: %s", pattern)
 		}
 	}
 }
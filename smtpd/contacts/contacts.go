@@ -0,0 +1,154 @@
+package contacts
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Contact is one correspondent of a user, stored in {contacts_dir}/{user}.json.
+// imapd adds the recipients of messages appended to Sent to the same files.
+type Contact struct {
+	Address string    `json:"address"`
+	Name    string    `json:"name"`
+	Count   int       `json:"count"`
+	Last    time.Time `json:"last"`
+}
+
+// score ranks by frequency, decaying by age so old contacts sink
+func (c *Contact) score(now time.Time) float64 {
+	days := now.Sub(c.Last).Hours() / 24
+	return float64(c.Count) / (1 + days/30)
+}
+
+func path(dir, user string) (string, error) {
+	if user == "" || strings.ContainsAny(user, "/\\") || strings.HasPrefix(user, ".") {
+		return "", fmt.Errorf("invalid user %q", user)
+	}
+	return filepath.Join(dir, strings.ToLower(user)+".json"), nil
+}
+
+// Record adds addrs to the index of user, does nothing when dir is empty.
+// The file is flock'ed as imapd updates it too.
+func Record(dir, user string, addrs []*mail.Address) error {
+	if dir == "" || len(addrs) == 0 {
+		return nil
+	}
+	p, err := path(dir, user)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_RDWR, 0640)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+
+	index := make(map[string]*Contact)
+	if err := json.NewDecoder(f).Decode(&index); err != nil && err != io.EOF {
+		return err
+	}
+
+	now := time.Now()
+	owner := strings.ToLower(user)
+	for _, a := range addrs {
+		key := strings.ToLower(a.Address)
+		if key == "" || key == owner {
+			continue
+		}
+		c := index[key]
+		if c == nil {
+			c = &Contact{Address: key}
+			index[key] = c
+		}
+		if a.Name != "" {
+			c.Name = a.Name
+		}
+		c.Count++
+		c.Last = now
+	}
+
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	_, err = f.WriteAt(data, 0)
+	return err
+}
+
+// Search returns up to n contacts of user whose address or name contains q, best first
+func Search(dir, user, q string, n int) ([]Contact, error) {
+	p, err := path(dir, user)
+	if err != nil {
+		return nil, err
+	}
+
+	index := make(map[string]*Contact)
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return []Contact{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	// Record rewrites the file in place
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_SH); err != nil {
+		return nil, err
+	}
+	if err := json.NewDecoder(f).Decode(&index); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	q = strings.ToLower(q)
+	out := make([]Contact, 0)
+	for _, c := range index {
+		if q == "" || strings.Contains(c.Address, q) || strings.Contains(strings.ToLower(c.Name), q) {
+			out = append(out, *c)
+		}
+	}
+
+	now := time.Now()
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].score(now) > out[j].score(now)
+	})
+	if len(out) > n {
+		out = out[:n]
+	}
+	return out, nil
+}
+
+// Addresses parses the named address headers of a raw message
+func Addresses(data []byte, headers ...string) []*mail.Address {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+
+	var out []*mail.Address
+	for _, h := range headers {
+		list, err := msg.Header.AddressList(h)
+		if err != nil {
+			continue
+		}
+		out = append(out, list...)
+	}
+	return out
+}
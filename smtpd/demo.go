@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/mpdroog/mymail/smtpd/config"
+	"github.com/mpdroog/mymail/smtpd/users"
+)
+
+// demoUsers AUTH to smtpd -demo with password "demo"
+var demoUsers = []string{"alice", "bob"}
+
+// setupDemo writes the config of -demo to a temporary directory, mail and
+// queue go below it too, and returns the config path
+func setupDemo() (string, error) {
+	dir, err := os.MkdirTemp("", "smtpd-demo-")
+	if err != nil {
+		return "", err
+	}
+	for _, d := range []string{"mail", "queue"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0750); err != nil {
+			return "", err
+		}
+	}
+	data, err := json.MarshalIndent(map[string]any{
+		"hostname":       "localhost",
+		"listen_addr":    "127.0.0.1:2525",
+		"max_size":       "10MB",
+		"max_recipients": 50,
+		"auth_file":      filepath.Join(dir, "users.json"),
+		"mail_dir":       filepath.Join(dir, "mail"),
+		"queue_dir":      filepath.Join(dir, "queue"),
+		"local_domains":  []string{"example.com"},
+	}, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, "config.json")
+	return path, os.WriteFile(path, data, 0600)
+}
+
+// seedDemo adds the demo users, each gets a welcome message like accounts
+// made with mymail user add
+func seedDemo() error {
+	for _, name := range demoUsers {
+		acct, err := users.NewAccount("demo", nil, "")
+		if err != nil {
+			return err
+		}
+		if err := users.Add(config.C.AuthFile, name, acct); err != nil {
+			return err
+		}
+		if err := users.Bootstrap(config.C.MailDir, config.C.WhitelistDir, config.C.LocalDomains[0], name, acct, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
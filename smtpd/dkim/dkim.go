@@ -0,0 +1,157 @@
+// Package dkim signs outbound mail (RFC 6376) with rsa-sha256 or
+// ed25519-sha256 (RFC 8463), relaxed/relaxed. The keys of a domain and when
+// each signs are kept in dkim_dir, see keys.go.
+package dkim
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// signedHeaders are signed when present, a From is required
+var signedHeaders = []string{
+	"from", "reply-to", "subject", "date", "to", "cc", "message-id",
+	"in-reply-to", "references", "mime-version", "content-type",
+	"content-transfer-encoding", "list-unsubscribe", "list-unsubscribe-post",
+}
+
+// header is a header field as it appears in the message, folding included
+type header struct {
+	name string // Lowercase
+	raw  string // Without the final CRLF
+}
+
+// split returns the header fields and body of msg, LF line ends are read
+// as CRLF
+func split(msg []byte) ([]header, []byte) {
+	var headers []header
+	rest := msg
+	for len(rest) > 0 {
+		i := bytes.IndexByte(rest, '\n')
+		line := rest
+		if i >= 0 {
+			line, rest = rest[:i], rest[i+1:]
+		} else {
+			rest = nil
+		}
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if len(line) == 0 {
+			break
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(headers) > 0 {
+			headers[len(headers)-1].raw += "\r\n" + string(line)
+			continue
+		}
+		name, _, ok := bytes.Cut(line, []byte(":"))
+		if !ok {
+			continue
+		}
+		headers = append(headers, header{
+			name: strings.ToLower(strings.TrimSpace(string(name))),
+			raw:  string(line),
+		})
+	}
+	return headers, rest
+}
+
+// relaxedHeader canonicalizes a header field, RFC 6376 3.4.2
+func relaxedHeader(raw string) string {
+	name, value, _ := strings.Cut(raw, ":")
+	value = strings.NewReplacer("\r\n", "", "\n", "").Replace(value)
+	value = strings.Join(strings.FieldsFunc(value, isWSP), " ")
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + value
+}
+
+// relaxedBody canonicalizes a body, RFC 6376 3.4.4
+func relaxedBody(body []byte) []byte {
+	var out bytes.Buffer
+	blank := 0
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		fields := strings.FieldsFunc(line, isWSP)
+		if len(fields) == 0 {
+			// Empty lines at the end are dropped
+			blank++
+			continue
+		}
+		for ; blank > 0; blank-- {
+			out.WriteString("\r\n")
+		}
+		if isWSP(rune(line[0])) {
+			out.WriteByte(' ')
+		}
+		out.WriteString(strings.Join(fields, " "))
+		out.WriteString("\r\n")
+	}
+	return out.Bytes()
+}
+
+func isWSP(r rune) bool {
+	return r == ' ' || r == '\t'
+}
+
+// Sign returns the DKIM-Signature header field of msg for domain with the
+// key of selector, CRLF included, to put in front of msg
+func Sign(msg []byte, domain, selector string, key crypto.Signer, now time.Time) (string, error) {
+	algo := "rsa-sha256"
+	if _, ok := key.(ed25519.PrivateKey); ok {
+		algo = "ed25519-sha256"
+	}
+	headers, body := split(msg)
+	bh := sha256.Sum256(relaxedBody(body))
+
+	// Multiple instances are signed from the bottom up, RFC 6376 5.4.2
+	var names []string
+	var signed []string
+	for _, name := range signedHeaders {
+		for i := len(headers) - 1; i >= 0; i-- {
+			if headers[i].name == name {
+				names = append(names, name)
+				signed = append(signed, relaxedHeader(headers[i].raw))
+			}
+		}
+	}
+	if len(names) == 0 || names[0] != "from" {
+		return "", fmt.Errorf("no From header")
+	}
+
+	sig := "DKIM-Signature: v=1; a=" + algo + "; c=relaxed/relaxed; d=" + domain + "; s=" + selector + ";\r\n" +
+		"\tt=" + strconv.FormatInt(now.Unix(), 10) + "; h=" + strings.Join(names, ":") + ";\r\n" +
+		"\tbh=" + base64.StdEncoding.EncodeToString(bh[:]) + ";\r\n" +
+		"\tb="
+	h := sha256.New()
+	for _, s := range signed {
+		h.Write([]byte(s + "\r\n"))
+	}
+	// The signature field itself without the b= value and final CRLF
+	h.Write([]byte(relaxedHeader(sig)))
+
+	var opts crypto.SignerOpts = crypto.SHA256
+	if algo == "ed25519-sha256" {
+		// RFC 8463 signs the SHA-256 hash as the message
+		opts = crypto.Hash(0)
+	}
+	b, err := key.Sign(rand.Reader, h.Sum(nil), opts)
+	if err != nil {
+		return "", err
+	}
+	return sig + fold(base64.StdEncoding.EncodeToString(b)) + "\r\n", nil
+}
+
+// fold breaks a b= value into lines of 72, verifiers ignore the whitespace
+func fold(s string) string {
+	var lines []string
+	for len(s) > 72 {
+		lines = append(lines, s[:72])
+		s = s[72:]
+	}
+	return strings.Join(append(lines, s), "\r\n\t ")
+}
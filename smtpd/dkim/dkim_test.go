@@ -0,0 +1,103 @@
+package dkim
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRelaxed has the example of RFC 6376 3.4.5
+func TestRelaxed(t *testing.T) {
+	headers, body := split([]byte("A: X\r\nB : Y\t\r\n\tZ  \r\n\r\n C \r\nD \t E\r\n\r\n\r\n"))
+	var got []string
+	for _, h := range headers {
+		got = append(got, relaxedHeader(h.raw))
+	}
+	if s := strings.Join(got, "\r\n"); s != "a:X\r\nb:Y Z" {
+		t.Errorf("headers=%q", s)
+	}
+	if s := string(relaxedBody(body)); s != " C\r\nD E\r\n" {
+		t.Errorf("body=%q", s)
+	}
+
+	patterns := map[string]string{
+		"":             "",
+		"\r\n\r\n":     "",
+		"no newline":   "no newline\r\n",
+		"lf\n\nonly\n": "lf\r\n\r\nonly\r\n",
+	}
+	for in, expect := range patterns {
+		if out := string(relaxedBody([]byte(in))); out != expect {
+			t.Errorf("relaxedBody(%q)=%q expect=%q", in, out, expect)
+		}
+	}
+}
+
+// TestSign verifies signatures of both algorithms as a receiver would
+func TestSign(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	msg := []byte("From: Mark <mark@example.com>\r\nTo: a@example.org\r\nSubject: hi\r\n\r\nHello\r\n")
+	for _, algo := range []string{"rsa", "ed25519"} {
+		// A selector per domain and second
+		k, err := Generate(dir, algo+".example.com", algo, 1024, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := loadKey(dir, algo+".example.com", k.Selector)
+		if err != nil {
+			t.Fatal(err)
+		}
+		field, err := Sign(msg, "example.com", k.Selector, key, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b := regexp.MustCompile(`b=([^;]*)$`).FindStringSubmatch(strings.TrimSuffix(field, "\r\n"))
+		sig, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(b[1]), ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := sha256.New()
+		h.Write([]byte("from:Mark <mark@example.com>\r\nsubject:hi\r\nto:a@example.org\r\n"))
+		h.Write([]byte(relaxedHeader(strings.TrimSuffix(field, "\r\n")[:len(field)-2-len(b[1])])))
+		switch pub := key.Public().(type) {
+		case *rsa.PublicKey:
+			err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, h.Sum(nil), sig)
+		case ed25519.PublicKey:
+			if !ed25519.Verify(pub, h.Sum(nil), sig) {
+				t.Errorf("%s: invalid signature", algo)
+			}
+		}
+		if err != nil {
+			t.Errorf("%s: %v", algo, err)
+		}
+		if !strings.Contains(field, "h=from:subject:to;") {
+			t.Errorf("%s: field=%s", algo, field)
+		}
+	}
+}
+
+func TestState(t *testing.T) {
+	day := 24 * time.Hour
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	k := Key{SignFrom: start, SignUntil: start.Add(10 * day), RetireAt: start.Add(20 * day)}
+	patterns := map[time.Duration]string{
+		-day:     StatePending,
+		0:        StateActive,
+		9 * day:  StateActive,
+		10 * day: StateRetiring,
+		20 * day: StateRetired,
+	}
+	for at, expect := range patterns {
+		if s := k.State(start.Add(at)); s != expect {
+			t.Errorf("State(+%s)=%s expect=%s", at, s, expect)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package dkim
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mpdroog/mymail/smtpd/logging"
+)
+
+// A domain's keys live in {dkim_dir}/{domain}/, the private key of each
+// selector in {selector}.pem and their schedule in keys.json. A key goes
+//
+//	pending -> active -> retiring -> retired
+//
+// pending until its DNS record had time to spread, active while it signs,
+// retiring while mail it signed may still be verified and retired once its
+// record can go. Rotating makes the next key active before the current one
+// stops, both sign in between.
+
+// Key is a selector of a domain and its schedule
+type Key struct {
+	Selector  string    `json:"selector"`
+	Algorithm string    `json:"algorithm"` // rsa or ed25519
+	Created   time.Time `json:"created"`
+	SignFrom  time.Time `json:"sign_from"`
+	SignUntil time.Time `json:"sign_until"` // Zero until a rotation
+	RetireAt  time.Time `json:"retire_at"`  // Zero until a rotation
+}
+
+// Key states
+const (
+	StatePending  = "pending"
+	StateActive   = "active"
+	StateRetiring = "retiring"
+	StateRetired  = "retired"
+)
+
+// State returns where k is in its schedule at now
+func (k Key) State(now time.Time) string {
+	switch {
+	case now.Before(k.SignFrom):
+		return StatePending
+	case k.SignUntil.IsZero() || now.Before(k.SignUntil):
+		return StateActive
+	case k.RetireAt.IsZero() || now.Before(k.RetireAt):
+		return StateRetiring
+	}
+	return StateRetired
+}
+
+func domainDir(dir, domain string) string {
+	return filepath.Join(dir, strings.ToLower(domain))
+}
+
+// Keys returns the keys of domain, none when it has no keys.json
+func Keys(dir, domain string) ([]Key, error) {
+	data, err := os.ReadFile(filepath.Join(domainDir(dir, domain), "keys.json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var keys []Key
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("%s keys.json: %v", domain, err)
+	}
+	return keys, nil
+}
+
+// SaveKeys replaces the keys.json of domain
+func SaveKeys(dir, domain string, keys []Key) error {
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(domainDir(dir, domain), "keys.json")
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Generate creates a key for domain that signs from signFrom on, bits is
+// ignored for ed25519. The caller adds it to the domain's keys.
+func Generate(dir, domain, algorithm string, bits int, signFrom time.Time) (Key, error) {
+	now := time.Now()
+	k := Key{
+		Selector:  "mymail" + now.UTC().Format("20060102150405"),
+		Algorithm: algorithm,
+		Created:   now,
+		SignFrom:  signFrom,
+	}
+	var priv crypto.Signer
+	var err error
+	switch algorithm {
+	case "rsa":
+		if bits < 1024 {
+			return k, fmt.Errorf("rsa keys need 1024 bits or more")
+		}
+		priv, err = rsa.GenerateKey(rand.Reader, bits)
+	case "ed25519":
+		_, priv, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return k, fmt.Errorf("unknown algorithm %q, expected rsa or ed25519", algorithm)
+	}
+	if err != nil {
+		return k, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return k, err
+	}
+
+	if err := os.MkdirAll(domainDir(dir, domain), 0750); err != nil {
+		return k, err
+	}
+	// Exclusive so a selector is never overwritten
+	f, err := os.OpenFile(keyPath(dir, domain, k.Selector), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return k, err
+	}
+	if err := pem.Encode(f, &pem.Block{Type: "PRIVATE KEY", Bytes: der}); err != nil {
+		f.Close()
+		return k, err
+	}
+	return k, f.Close()
+}
+
+func keyPath(dir, domain, selector string) string {
+	return filepath.Join(domainDir(dir, domain), selector+".pem")
+}
+
+// Remove deletes the private key of a retired selector
+func Remove(dir, domain, selector string) error {
+	return os.Remove(keyPath(dir, domain, selector))
+}
+
+func loadKey(dir, domain, selector string) (crypto.Signer, error) {
+	data, err := os.ReadFile(keyPath(dir, domain, selector))
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM key", selector)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s: unsupported key", selector)
+	}
+	return signer, nil
+}
+
+// Record returns the TXT record of selector, split into strings of at most
+// 255 bytes as DNS requires
+func Record(dir, domain string, k Key) (string, error) {
+	key, err := loadKey(dir, domain, k.Selector)
+	if err != nil {
+		return "", err
+	}
+	p, err := PublicKey(key)
+	if err != nil {
+		return "", err
+	}
+	txt := "v=DKIM1; k=" + k.Algorithm + "; p=" + p
+	var parts []string
+	for len(txt) > 255 {
+		parts = append(parts, `"`+txt[:255]+`"`)
+		txt = txt[255:]
+	}
+	parts = append(parts, `"`+txt+`"`)
+	return k.Selector + "._domainkey." + domain + ". IN TXT " + strings.Join(parts, " "), nil
+}
+
+// PublicKey returns the p= value of the DNS record of key
+func PublicKey(key crypto.Signer) (string, error) {
+	if pub, ok := key.Public().(ed25519.PublicKey); ok {
+		return base64.StdEncoding.EncodeToString(pub), nil
+	}
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(der), nil
+}
+
+// Active returns the selectors of domain that sign at now with their keys
+func Active(dir, domain string, now time.Time) (map[string]crypto.Signer, error) {
+	keys, err := Keys(dir, domain)
+	if err != nil {
+		return nil, err
+	}
+	active := make(map[string]crypto.Signer)
+	for _, k := range keys {
+		if k.State(now) != StateActive {
+			continue
+		}
+		key, err := loadKey(dir, domain, k.Selector)
+		if err != nil {
+			// The other selector still signs during a rotation
+			log.Printf(logging.Err+"dkim.loadKey(%s) e=%v", k.Selector, err)
+			continue
+		}
+		active[k.Selector] = key
+	}
+	return active, nil
+}
+
+// SignMessage signs msg with every active key of the domain of its From,
+// two signatures during a rotation. Without keys msg comes back unchanged.
+func SignMessage(dir string, msg []byte, now time.Time) []byte {
+	m, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		return msg
+	}
+	from, err := mail.ParseAddress(m.Header.Get("From"))
+	if err != nil {
+		return msg
+	}
+	_, domain, _ := strings.Cut(from.Address, "@")
+	if domain == "" || strings.ContainsAny(domain, `/\`) {
+		return msg
+	}
+	active, err := Active(dir, domain, now)
+	if err != nil {
+		log.Printf(logging.Err+"dkim.Active(%s) e=%v", domain, err)
+		return msg
+	}
+
+	var sigs []byte
+	for selector, key := range active {
+		sig, err := Sign(msg, strings.ToLower(domain), selector, key, now)
+		if err != nil {
+			log.Printf(logging.Err+"dkim.Sign(%s) e=%v", selector, err)
+			continue
+		}
+		sigs = append(sigs, sig...)
+	}
+	return append(sigs, msg...)
+}
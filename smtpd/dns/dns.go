@@ -0,0 +1,194 @@
+// Package dns is a caching resolver for the lookups done per message (MX,
+// TXT for SPF/DKIM, A/AAAA for RBLs, PTR of the client). Queries go through
+// the Go resolver of the standard library, which validates the names in
+// answers, sent to the configured servers. As it doesn't tell the TTL,
+// answers are kept for a fixed time.
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	queryTimeout = 5 * time.Second
+	answerTTL    = 5 * time.Minute
+	negativeTTL  = 5 * time.Minute // NXDOMAIN
+	errorTTL     = 30 * time.Second
+	maxEntries   = 10000
+)
+
+type entry struct {
+	value   any
+	err     error
+	expires time.Time
+}
+
+// Resolver asks upstream recursive resolvers and caches answers
+type Resolver struct {
+	r *net.Resolver
+
+	mu    sync.Mutex
+	cache map[string]*entry
+}
+
+var std atomic.Pointer[Resolver]
+
+// Init sets the upstream servers ("host" or "host:port") of the shared
+// resolver, without servers the nameservers of /etc/resolv.conf are used
+func Init(servers []string) {
+	std.Store(New(servers))
+}
+
+func resolver() *Resolver {
+	if r := std.Load(); r != nil {
+		return r
+	}
+	// Lookups before Init, or without it in tools and tests
+	std.CompareAndSwap(nil, New(nil))
+	return std.Load()
+}
+
+// New returns a resolver for servers, see Init
+func New(servers []string) *Resolver {
+	r := &Resolver{r: net.DefaultResolver, cache: make(map[string]*entry)}
+	if len(servers) == 0 {
+		return r
+	}
+
+	var addrs []string
+	for _, s := range servers {
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			s = net.JoinHostPort(s, "53")
+		}
+		addrs = append(addrs, s)
+	}
+	// Each attempt of the Go resolver dials the next server, so one that
+	// is down is skipped on the retry
+	var next atomic.Uint32
+	r.r = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			server := addrs[int(next.Add(1)-1)%len(addrs)]
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}
+	return r
+}
+
+// LookupMX is like net.LookupMX on the shared resolver, but a domain without
+// MX records returns no records instead of an error
+func LookupMX(name string) ([]*net.MX, error) { return resolver().LookupMX(name) }
+
+// LookupTXT is like net.LookupTXT on the shared resolver
+func LookupTXT(name string) ([]string, error) { return resolver().LookupTXT(name) }
+
+// LookupIP is like net.LookupIP on the shared resolver
+func LookupIP(host string) ([]net.IP, error) { return resolver().LookupIP(host) }
+
+// LookupAddr is like net.LookupAddr on the shared resolver
+func LookupAddr(addr string) ([]string, error) { return resolver().LookupAddr(addr) }
+
+func (r *Resolver) LookupMX(name string) ([]*net.MX, error) {
+	v, err := r.cached("MX", name, func(ctx context.Context) (any, error) {
+		mx, err := r.r.LookupMX(ctx, name)
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			// The Go resolver reports a name without MX records like one
+			// that doesn't exist, the first falls back to its address
+			if _, err := r.r.LookupIPAddr(ctx, name); err == nil {
+				return []*net.MX(nil), nil
+			}
+		}
+		return mx, err
+	})
+	mx, _ := v.([]*net.MX)
+	return mx, err
+}
+
+func (r *Resolver) LookupTXT(name string) ([]string, error) {
+	v, err := r.cached("TXT", name, func(ctx context.Context) (any, error) {
+		return r.r.LookupTXT(ctx, name)
+	})
+	txt, _ := v.([]string)
+	return txt, err
+}
+
+// LookupIP returns the A and AAAA records of host, IP literals are returned
+// as is
+func (r *Resolver) LookupIP(host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	v, err := r.cached("IP", host, func(ctx context.Context) (any, error) {
+		return r.r.LookupIP(ctx, "ip", host)
+	})
+	ips, _ := v.([]net.IP)
+	return ips, err
+}
+
+// LookupAddr returns the PTR names of addr
+func (r *Resolver) LookupAddr(addr string) ([]string, error) {
+	v, err := r.cached("PTR", addr, func(ctx context.Context) (any, error) {
+		return r.r.LookupAddr(ctx, addr)
+	})
+	names, _ := v.([]string)
+	return names, err
+}
+
+// cached returns the cached answer of kind for name or calls lookup
+func (r *Resolver) cached(kind, name string, lookup func(ctx context.Context) (any, error)) (any, error) {
+	key := kind + " " + strings.ToLower(strings.TrimSuffix(name, "."))
+
+	r.mu.Lock()
+	e, ok := r.cache[key]
+	r.mu.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.value, e.err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	v, err := lookup(ctx)
+	e = &entry{value: v, err: err, expires: time.Now().Add(ttl(err))}
+
+	r.mu.Lock()
+	if len(r.cache) >= maxEntries {
+		r.expire()
+	}
+	r.cache[key] = e
+	r.mu.Unlock()
+	return e.value, e.err
+}
+
+// ttl is how long an answer or error may be cached
+func ttl(err error) time.Duration {
+	var dnsErr *net.DNSError
+	switch {
+	case err == nil:
+		return answerTTL
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		return negativeTTL
+	}
+	return errorTTL
+}
+
+// expire drops expired entries, or everything when that doesn't free space.
+// Called with r.mu held.
+func (r *Resolver) expire() {
+	now := time.Now()
+	for k, e := range r.cache {
+		if now.After(e.expires) {
+			delete(r.cache, k)
+		}
+	}
+	if len(r.cache) >= maxEntries {
+		clear(r.cache)
+	}
+}
@@ -0,0 +1,148 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeServer answers MX and TXT for example.com, A for nomx.example.com,
+// PTR for 203.0.113.5 and 203.0.113.6 (a name with CRLF in it) and NXDOMAIN
+// for everything else
+func fakeServer(t *testing.T) (string, *atomic.Int32) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	var hits atomic.Int32
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			hits.Add(1)
+			conn.WriteTo(answer(buf[:n]), addr)
+		}
+	}()
+	return conn.LocalAddr().String(), &hits
+}
+
+// answer replies to query, whose question name is uncompressed as in any
+// query
+func answer(query []byte) []byte {
+	var labels []string
+	off := 12
+	for query[off] != 0 {
+		l := int(query[off])
+		labels = append(labels, string(query[off+1:off+1+l]))
+		off += 1 + l
+	}
+	name := strings.ToLower(strings.Join(labels, "."))
+	qtype := binary.BigEndian.Uint16(query[off+1:])
+	off += 5
+
+	// Header and question of the query, without its EDNS record
+	msg := append([]byte(nil), query[:off]...)
+	binary.BigEndian.PutUint16(msg[2:], 1<<15|1<<8|1<<7) // QR, RD, RA
+	binary.BigEndian.PutUint16(msg[10:], 0)
+	rr := func(typ uint16, rdata []byte) {
+		binary.BigEndian.PutUint16(msg[6:], binary.BigEndian.Uint16(msg[6:])+1)
+		msg = append(msg, 0xC0, 12) // Pointer to the question name
+		msg = binary.BigEndian.AppendUint16(msg, typ)
+		msg = binary.BigEndian.AppendUint16(msg, 1)
+		msg = binary.BigEndian.AppendUint32(msg, 300)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(len(rdata)))
+		msg = append(msg, rdata...)
+	}
+
+	const typeA, typePTR, typeMX, typeTXT = 1, 12, 15, 16
+	switch name {
+	case "example.com":
+		switch qtype {
+		case typeMX:
+			rr(typeMX, []byte{0, 20, 3, 'm', 'x', '2', 0xC0, 12})
+			rr(typeMX, []byte{0, 10, 2, 'm', 'x', 0xC0, 12})
+		case typeTXT:
+			rr(typeTXT, []byte("\x07v=spf1 \x04-all"))
+		}
+	case "nomx.example.com":
+		if qtype == typeA {
+			rr(typeA, []byte{192, 0, 2, 1})
+		}
+	case "5.113.0.203.in-addr.arpa":
+		rr(typePTR, []byte("\x04mail\x07example\x03com\x00"))
+	case "6.113.0.203.in-addr.arpa":
+		rr(typePTR, []byte("\x0amail\r\nX-Y:\x07example\x03com\x00"))
+	default:
+		msg[3] |= 3 // NXDOMAIN
+	}
+	return msg
+}
+
+func TestResolver(t *testing.T) {
+	addr, hits := fakeServer(t)
+	r := New([]string{addr})
+
+	for i := 0; i < 2; i++ {
+		mx, err := r.LookupMX("Example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The name is answered as asked
+		if len(mx) != 2 || mx[0].Host != "mx.Example.com." || mx[0].Pref != 10 || mx[1].Host != "mx2.Example.com." {
+			t.Fatalf("LookupMX=%+v", mx)
+		}
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("%d queries for two MX lookups, expect 1", n)
+	}
+
+	txt, err := r.LookupTXT("example.com")
+	if err != nil || len(txt) != 1 || txt[0] != "v=spf1 -all" {
+		t.Errorf("LookupTXT=%q e=%v", txt, err)
+	}
+	if mx, err := r.LookupMX("nomx.example.com"); err != nil || len(mx) != 0 {
+		t.Errorf("LookupMX(nomx)=%v e=%v, expect no records", mx, err)
+	}
+
+	ptr, err := r.LookupAddr("203.0.113.5")
+	if err != nil || len(ptr) != 1 || ptr[0] != "mail.example.com." {
+		t.Errorf("LookupAddr=%q e=%v", ptr, err)
+	}
+	if ptr, _ := r.LookupAddr("203.0.113.6"); len(ptr) != 0 {
+		t.Errorf("LookupAddr=%q, expect the invalid name to be refused", ptr)
+	}
+
+	before := hits.Load()
+	for i := 0; i < 2; i++ {
+		_, err := r.LookupMX("nx.example.com")
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			t.Fatalf("LookupMX(nx) e=%v, expect not found", err)
+		}
+	}
+	if n := hits.Load() - before; n > 3 {
+		t.Errorf("%d queries for two lookups, expect NXDOMAIN to be cached", n)
+	}
+}
+
+// TestInit checks lookups racing with Init use one of the resolvers
+func TestInit(t *testing.T) {
+	done := make(chan bool)
+	go func() {
+		resolver()
+		done <- true
+	}()
+	Init([]string{"127.0.0.1"})
+	<-done
+	if resolver() == nil {
+		t.Errorf("no resolver")
+	}
+}
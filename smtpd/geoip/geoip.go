@@ -0,0 +1,76 @@
+// Package geoip looks up the country and network (ASN) of an IP address in
+// local MaxMind DB files, GeoLite2 Country/City/ASN and the DB-IP lite
+// databases use this format.
+package geoip
+
+import (
+	"net"
+	"sync"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Info is what the databases know about an IP address
+type Info struct {
+	Country string // ISO 3166 code, e.g. "NL"
+	ASN     uint
+	Org     string // Owner of the ASN
+}
+
+// record holds the fields of Info in any of the databases
+type record struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	ASN uint   `maxminddb:"autonomous_system_number"`
+	Org string `maxminddb:"autonomous_system_organization"`
+}
+
+var (
+	mu  sync.RWMutex
+	dbs []*maxminddb.Reader
+)
+
+// Load opens the databases used by Lookup, a Country or City database and
+// an ASN one
+func Load(paths []string) error {
+	var out []*maxminddb.Reader
+	for _, path := range paths {
+		db, err := maxminddb.Open(path)
+		if err != nil {
+			for _, db := range out {
+				db.Close()
+			}
+			return err
+		}
+		out = append(out, db)
+	}
+	mu.Lock()
+	old := dbs
+	dbs = out
+	mu.Unlock()
+	for _, db := range old {
+		db.Close()
+	}
+	return nil
+}
+
+// Lookup combines the records of ip in the loaded databases
+func Lookup(ip net.IP) Info {
+	mu.RLock()
+	defer mu.RUnlock()
+	var info Info
+	for _, db := range dbs {
+		var r record
+		if err := db.Lookup(ip, &r); err != nil {
+			continue
+		}
+		if info.Country == "" {
+			info.Country = r.Country.ISOCode
+		}
+		if r.ASN != 0 && info.ASN == 0 {
+			info.ASN, info.Org = r.ASN, r.Org
+		}
+	}
+	return info
+}
@@ -0,0 +1,85 @@
+package geoip
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// mmdb encodes values in the data section format, enough for the test
+type mmdb []byte
+
+func (b mmdb) str(s string) mmdb {
+	if len(s) >= 29 {
+		b = append(b, 2<<5|29, byte(len(s)-29))
+	} else {
+		b = append(b, 2<<5|byte(len(s)))
+	}
+	return append(b, s...)
+}
+func (b mmdb) uint32(n uint32) mmdb {
+	return append(b, 6<<5|4, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+func (b mmdb) mapOf(n int) mmdb { return append(b, 7<<5|byte(n)) }
+
+// testDB writes an IPv4 database with 24 bit records that knows 192.0.2.0/24
+func testDB(t *testing.T) string {
+	const nodes = 24
+	var data mmdb
+	data = data.mapOf(3).
+		str("country").mapOf(1).str("iso_code").str("NL").
+		str("autonomous_system_number").uint32(64496).
+		str("autonomous_system_organization").str("Example B.V.")
+
+	prefix := []byte{192, 0, 2}
+	var tree []byte
+	for i := 0; i < nodes; i++ {
+		bit := prefix[i/8] >> (7 - i%8) & 1
+		next := uint32(i + 1)
+		if i == nodes-1 {
+			next = nodes + 16 // Offset 0 in the data section
+		}
+		rec := [2]uint32{nodes, nodes} // No data off the prefix
+		rec[bit] = next
+		for _, r := range rec {
+			tree = append(tree, byte(r>>16), byte(r>>8), byte(r))
+		}
+	}
+
+	var meta mmdb
+	meta = meta.mapOf(4).
+		str("binary_format_major_version").uint32(2).
+		str("node_count").uint32(nodes).
+		str("record_size").uint32(24).
+		str("ip_version").uint32(4)
+
+	file := append(tree, make([]byte, 16)...)
+	file = append(file, data...)
+	file = append(file, "\xab\xcd\xefMaxMind.com"...)
+	file = append(file, meta...)
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, file, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLookup(t *testing.T) {
+	if err := Load([]string{testDB(t)}); err != nil {
+		t.Fatal(err)
+	}
+	defer Load(nil)
+
+	patterns := map[string]Info{
+		"192.0.2.1":   {"NL", 64496, "Example B.V."},
+		"192.0.2.255": {"NL", 64496, "Example B.V."},
+		"192.0.3.1":   {},
+		"2001:db8::1": {},
+	}
+	for ip, expect := range patterns {
+		if info := Lookup(net.ParseIP(ip)); info != expect {
+			t.Errorf("Lookup(%s)=%+v expect=%+v", ip, info, expect)
+		}
+	}
+}
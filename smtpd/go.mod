@@ -1,8 +1,9 @@
 module github.com/mpdroog/mymail/smtpd
 
-go 1.23
+go 1.24
 
 require (
 	github.com/coreos/go-systemd/v22 v22.7.0 // indirect
-	golang.org/x/sys v0.1.0 // indirect
+	github.com/oschwald/maxminddb-golang v1.13.1
+	golang.org/x/sys v0.21.0 // indirect
 )
@@ -0,0 +1,262 @@
+package journal
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Journal copies are delivered with these headers in front of the original
+// message, Strip removes them again
+const headerPrefix = "X-Journal-"
+
+// maxLine is the longest entry read back
+const maxLine = 1024 * 1024
+
+// Entry is one journaled message in the hash chain, a JSON line per entry.
+// Each Hash covers the previous one, so changing or removing an entry (or
+// the journal copy it describes) breaks every hash after it.
+type Entry struct {
+	Time      time.Time `json:"time"`
+	Direction string    `json:"direction"` // inbound or outbound
+	From      string    `json:"from"`
+	To        []string  `json:"to"`
+	Digest    string    `json:"digest"` // SHA-256 of the original message
+	Prev      string    `json:"prev"`   // Hash of the previous entry, empty for the first
+	Hash      string    `json:"hash"`
+}
+
+// Digest returns the hex SHA-256 of data
+func Digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// sum is the hash of e over Prev and all other fields but Hash
+func (e Entry) sum() string {
+	s := strings.Join([]string{
+		e.Prev,
+		e.Time.UTC().Format(time.RFC3339Nano),
+		e.Direction,
+		e.From,
+		strings.Join(e.To, ","),
+		e.Digest,
+	}, "\n")
+	return Digest([]byte(s))
+}
+
+// tail anchors the end of a chain, {chain}.tail. Removing entries from the
+// end leaves a valid chain, the tail tells it's shorter than written.
+type tail struct {
+	Entries int    `json:"entries"`
+	Hash    string `json:"hash"`
+}
+
+func tailPath(path string) string {
+	return path + ".tail"
+}
+
+// readTail returns the tail of the chain at path, ok is false when it has
+// none (yet)
+func readTail(path string) (t tail, ok bool, err error) {
+	data, err := os.ReadFile(tailPath(path))
+	if os.IsNotExist(err) {
+		return t, false, nil
+	} else if err != nil {
+		return t, false, err
+	}
+	return t, true, json.Unmarshal(data, &t)
+}
+
+// Append links e to the chain at path and appends it. Instances sharing the
+// chain (NFS) take turns on its flock and read the previous hash from the
+// file each time.
+func Append(path string, e Entry) (Entry, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0640)
+	if err != nil {
+		return e, err
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return e, err
+	}
+
+	prev, err := lastEntry(f)
+	if err != nil {
+		return e, err
+	}
+	t, ok, err := readTail(path)
+	if err != nil {
+		return e, err
+	}
+	if !ok || t.Hash != prev.Hash {
+		// Chain of before tails existed, or a crash between appending and
+		// writing the tail
+		entries, err := Load(path)
+		if err != nil {
+			return e, err
+		}
+		t = tail{Entries: len(entries), Hash: prev.Hash}
+	}
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.Prev = prev.Hash
+	e.Hash = e.sum()
+	line, err := json.Marshal(e)
+	if err != nil {
+		return e, err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return e, err
+	}
+	if err := f.Sync(); err != nil {
+		return e, err
+	}
+
+	data, err := json.Marshal(tail{Entries: t.Entries + 1, Hash: e.Hash})
+	if err != nil {
+		return e, err
+	}
+	tmp := tailPath(path) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0640); err != nil {
+		return e, err
+	}
+	return e, os.Rename(tmp, tailPath(path))
+}
+
+// lastEntry returns the last entry of the chain in f, empty for an empty
+// chain
+func lastEntry(f *os.File) (Entry, error) {
+	var e Entry
+	fi, err := f.Stat()
+	if err != nil || fi.Size() == 0 {
+		return e, err
+	}
+	n := min(fi.Size(), maxLine)
+	buf := make([]byte, n)
+	if _, err := f.ReadAt(buf, fi.Size()-n); err != nil {
+		return e, err
+	}
+	buf = bytes.TrimSuffix(buf, []byte("\n"))
+	if i := bytes.LastIndexByte(buf, '\n'); i != -1 {
+		buf = buf[i+1:]
+	}
+	if err := json.Unmarshal(buf, &e); err != nil {
+		return e, fmt.Errorf("%s last line: %v", f.Name(), err)
+	}
+	return e, nil
+}
+
+// Load returns the entries of the chain at path, oldest first
+func Load(path string) ([]Entry, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []Entry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), maxLine)
+	for n := 1; scanner.Scan(); n++ {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", path, n, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// Verify checks every link of the chain, the error names the first broken
+// entry
+func Verify(entries []Entry) error {
+	prev := ""
+	for i, e := range entries {
+		if e.Prev != prev {
+			return fmt.Errorf("entry %d: previous hash %s, expected %s", i+1, e.Prev, prev)
+		}
+		if e.sum() != e.Hash {
+			return fmt.Errorf("entry %d: hash mismatch, entry was changed", i+1)
+		}
+		prev = e.Hash
+	}
+	return nil
+}
+
+// VerifyTail checks that entries, loaded from the chain at path, end where
+// the tail says so no entries were cut off
+func VerifyTail(path string, entries []Entry) error {
+	t, ok, err := readTail(path)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if len(entries) == 0 {
+			return nil
+		}
+		return fmt.Errorf("%s missing, can't tell whether entries were removed", tailPath(path))
+	}
+	last := ""
+	if len(entries) > 0 {
+		last = entries[len(entries)-1].Hash
+	}
+	if len(entries) != t.Entries || last != t.Hash {
+		return fmt.Errorf("chain ends at entry %d, tail expects %d ending in %s", len(entries), t.Entries, t.Hash)
+	}
+	return nil
+}
+
+// Wrap returns the journal copy of data, the original message with the
+// envelope and chain hash of e in front
+func Wrap(e Entry, data []byte) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%sDirection: %s\r\n", headerPrefix, e.Direction)
+	fmt.Fprintf(&b, "%sSender: <%s>\r\n", headerPrefix, e.From)
+	fmt.Fprintf(&b, "%sRecipients: %s\r\n", headerPrefix, strings.Join(e.To, ", "))
+	fmt.Fprintf(&b, "%sHash: %s\r\n", headerPrefix, e.Hash)
+	b.Write(data)
+	return b.Bytes()
+}
+
+// Strip splits a journal copy in the envelope and chain hash in front, as
+// written by Wrap, and the original message. Without that block e is empty
+// and original is data, headers of the original message are left alone even
+// when they start with X-Journal-.
+func Strip(data []byte) (e Entry, original []byte) {
+	rest := data
+	var fields [4]string
+	for i, name := range []string{"Direction", "Sender", "Recipients", "Hash"} {
+		end := bytes.IndexByte(rest, '\n')
+		if end == -1 {
+			return Entry{}, data
+		}
+		line := strings.TrimSuffix(string(rest[:end]), "\r")
+		v, ok := strings.CutPrefix(line, headerPrefix+name+": ")
+		if !ok {
+			return Entry{}, data
+		}
+		fields[i] = v
+		rest = rest[end+1:]
+	}
+
+	e.Direction = fields[0]
+	e.From = strings.TrimSuffix(strings.TrimPrefix(fields[1], "<"), ">")
+	if fields[2] != "" {
+		e.To = strings.Split(fields[2], ", ")
+	}
+	e.Hash = fields[3]
+	return e, rest
+}
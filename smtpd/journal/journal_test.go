@@ -0,0 +1,97 @@
+package journal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.chain")
+	msg := []byte("Subject: hi\r\n\r\nbody\r\n")
+	for _, dir := range []string{"inbound", "outbound", "inbound"} {
+		e, err := Append(path, Entry{Direction: dir, From: "a@example.com", To: []string{"b@example.com"}, Digest: Digest(msg)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, original := Strip(Wrap(e, msg))
+		if got.Hash != e.Hash || got.From != e.From || len(got.To) != 1 || string(original) != string(msg) {
+			t.Errorf("Strip=%+v original=%q", got, original)
+		}
+	}
+
+	entries, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("entries=%d expect=3", len(entries))
+	}
+	if err := Verify(entries); err != nil {
+		t.Errorf("Verify e=%v", err)
+	}
+	if err := VerifyTail(path, entries); err != nil {
+		t.Errorf("VerifyTail e=%v", err)
+	}
+	if err := VerifyTail(path, entries[:2]); err == nil {
+		t.Errorf("VerifyTail passed a truncated chain")
+	}
+
+	patterns := map[string]func(e []Entry) []Entry{
+		"changed digest": func(e []Entry) []Entry { e[1].Digest = Digest([]byte("other")); return e },
+		"changed rcpt":   func(e []Entry) []Entry { e[0].To = []string{"c@example.com"}; return e },
+		"removed":        func(e []Entry) []Entry { return append(e[:1], e[2:]...) },
+		"reordered":      func(e []Entry) []Entry { e[0], e[1] = e[1], e[0]; return e },
+	}
+	for name, tamper := range patterns {
+		e := append([]Entry(nil), entries...)
+		if err := Verify(tamper(e)); err == nil {
+			t.Errorf("%s: Verify passed", name)
+		}
+	}
+}
+
+// TestStrip checks only the block of Wrap is removed
+func TestStrip(t *testing.T) {
+	msg := "X-Journal-Hash: forged\r\nSubject: hi\r\n\r\nbody\r\n"
+	if e, original := Strip([]byte(msg)); e.Hash != "" || string(original) != msg {
+		t.Errorf("Strip of an unwrapped message=%+v %q", e, original)
+	}
+
+	wrapped := Wrap(Entry{Direction: "inbound", From: "a@example.com", To: []string{"b@example.com"}, Hash: "abc"}, []byte(msg))
+	if e, original := Strip(wrapped); e.Hash != "abc" || string(original) != msg {
+		t.Errorf("Strip=%+v %q, expect the original's own headers kept", e, original)
+	}
+}
+
+// TestAppendCrash continues the chain after a crash left the tail behind
+func TestAppendCrash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.chain")
+	if _, err := Append(path, Entry{Direction: "inbound"}); err != nil {
+		t.Fatal(err)
+	}
+	stale, err := os.ReadFile(tailPath(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Append(path, Entry{Direction: "inbound"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tailPath(path), stale, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Append(path, Entry{Direction: "inbound"}); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(entries); err != nil {
+		t.Errorf("Verify e=%v", err)
+	}
+	if err := VerifyTail(path, entries); err != nil {
+		t.Errorf("VerifyTail e=%v", err)
+	}
+}
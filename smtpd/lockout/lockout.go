@@ -0,0 +1,241 @@
+package lockout
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mpdroog/mymail/smtpd/logging"
+	"github.com/mpdroog/mymail/smtpd/messages"
+)
+
+// State of one account, stored in {lockout_dir}/{user}.json. imapd updates
+// the same files so failures over SMTP and IMAP add up.
+type State struct {
+	User        string    `json:"user"`
+	Failures    []Failure `json:"failures"` // Within the window, oldest first
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+// Failure is one failed login
+type Failure struct {
+	Time     time.Time `json:"time"`
+	Protocol string    `json:"protocol"`
+	IP       string    `json:"ip"`
+}
+
+// Policy is when to lock and for how long
+type Policy struct {
+	Threshold int           // Failures within Window that lock the account
+	Window    time.Duration // How far back failures count
+	Duration  time.Duration // How long the lock lasts
+}
+
+func path(dir, user string) (string, error) {
+	if user == "" || strings.ContainsAny(user, "/\\") || strings.HasPrefix(user, ".") {
+		return "", fmt.Errorf("invalid user %q", user)
+	}
+	return filepath.Join(dir, strings.ToLower(user)+".json"), nil
+}
+
+// Fail records a failed login of user. It returns the state and whether this
+// failure locked the account, so only one daemon sends the notifications.
+// Does nothing when dir is empty.
+func Fail(dir, user string, f Failure, p Policy) (*State, bool, error) {
+	if dir == "" || p.Threshold <= 0 {
+		return nil, false, nil
+	}
+	var locked bool
+	st, err := update(dir, user, func(st *State) {
+		// Forget failures outside the window
+		since := f.Time.Add(-p.Window)
+		keep := st.Failures[:0]
+		for _, old := range st.Failures {
+			if old.Time.After(since) {
+				keep = append(keep, old)
+			}
+		}
+		st.Failures = append(keep, f)
+
+		if len(st.Failures) >= p.Threshold && !f.Time.Before(st.LockedUntil) {
+			st.LockedUntil = f.Time.Add(p.Duration)
+			locked = true
+		}
+	})
+	return st, locked, err
+}
+
+// Locked returns until when user is locked out, zero if not
+func Locked(dir, user string) time.Time {
+	if dir == "" {
+		return time.Time{}
+	}
+	p, err := path(dir, user)
+	if err != nil {
+		return time.Time{}
+	}
+	st, err := read(p)
+	if err != nil || !time.Now().Before(st.LockedUntil) {
+		return time.Time{}
+	}
+	return st.LockedUntil
+}
+
+// read loads the state in p under a shared flock, update rewrites it in place
+func read(p string) (*State, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_SH); err != nil {
+		return nil, err
+	}
+	st := &State{}
+	if err := json.NewDecoder(f).Decode(st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// Unlock lifts the lock of user and forgets the failures
+func Unlock(dir, user string) error {
+	p, err := path(dir, user)
+	if err != nil {
+		return err
+	}
+	return os.Remove(p)
+}
+
+// List returns the accounts that are locked right now
+func List(dir string) ([]State, error) {
+	out := make([]State, 0)
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return out, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		st, err := read(filepath.Join(dir, e.Name()))
+		if err == nil && now.Before(st.LockedUntil) {
+			out = append(out, *st)
+		}
+	}
+	return out, nil
+}
+
+// Delay slows down a failed login by d plus random jitter, so every failure
+// takes about as long no matter whether the user exists and guessing gets
+// expensive
+func Delay(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	time.Sleep(d + time.Duration(rand.Int63n(int64(d/2)+1)))
+}
+
+// update applies fn to the state of user under an flock
+func update(dir, user string, fn func(st *State)) (*State, error) {
+	p, err := path(dir, user)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_RDWR, 0640)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return nil, err
+	}
+
+	st := &State{}
+	if err := json.NewDecoder(f).Decode(st); err != nil && err != io.EOF {
+		return nil, err
+	}
+	st.User = strings.ToLower(user)
+	fn(st)
+
+	data, err := json.Marshal(st)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(0); err != nil {
+		return nil, err
+	}
+	_, err = f.WriteAt(data, 0)
+	return st, err
+}
+
+// noticeTemplate is the built-in English lockout notice, see smtpd/messages
+const noticeTemplate = `From: {{.From}}
+To: {{.To}}
+Date: {{.Date}}
+Subject: Your account was temporarily locked
+Content-Type: text/plain; charset=utf-8
+
+After {{len .Failures}} failed logins your account is locked until {{.Until}}.
+If these weren't you, someone may be guessing your password. Please change it.
+
+{{range .Failures}}{{.Time.Format "2006-01-02T15:04:05Z07:00"}}  {{printf "%-4s" .Protocol}}  {{.IP}}
+{{end}}`
+
+// NoticeData holds the fields of the lockout-notice template
+type NoticeData struct {
+	From     string
+	To       string
+	Date     string
+	Until    string
+	Failures []Failure
+}
+
+// Notice is the message for the user whose account got locked, in locale
+func Notice(st *State, from, to, locale string) []byte {
+	d := NoticeData{
+		From:     from,
+		To:       to,
+		Date:     time.Now().Format(time.RFC1123Z),
+		Until:    st.LockedUntil.Format(time.RFC1123Z),
+		Failures: st.Failures,
+	}
+	msg, err := messages.Render("lockout-notice", noticeTemplate, messages.Locale(locale, to), d)
+	if err != nil {
+		log.Printf(logging.Err+"lockout.Notice e=%v", err)
+		msg, _ = messages.Execute("lockout-notice", noticeTemplate, d)
+	}
+	return msg
+}
+
+// Alert is the message for the administrator
+func Alert(st *State, from, to string) []byte {
+	msg := "From: " + from + "\r\n"
+	msg += "To: " + to + "\r\n"
+	msg += "Date: " + time.Now().Format(time.RFC1123Z) + "\r\n"
+	msg += "Subject: Account " + st.User + " locked after failed logins\r\n"
+	msg += "Content-Type: text/plain; charset=utf-8\r\n"
+	msg += "\r\n"
+	msg += fmt.Sprintf("Account %s is locked until %s after %d failed logins:\r\n\r\n", st.User, st.LockedUntil.Format(time.RFC1123Z), len(st.Failures))
+	for _, f := range st.Failures {
+		msg += fmt.Sprintf("%s  %-4s  %s\r\n", f.Time.Format(time.RFC3339), f.Protocol, f.IP)
+	}
+	msg += "\r\nUnlock early with DELETE /lockouts/" + st.User + " on the admin API.\r\n"
+	return []byte(msg)
+}
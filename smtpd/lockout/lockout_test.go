@@ -0,0 +1,42 @@
+package lockout
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFail(t *testing.T) {
+	dir := t.TempDir()
+	p := Policy{Threshold: 3, Window: time.Minute, Duration: time.Hour}
+	now := time.Now()
+
+	// Old failure outside the window doesn't count
+	fails := []time.Duration{-2 * time.Minute, -30 * time.Second, -20 * time.Second, -10 * time.Second}
+	for i, d := range fails {
+		_, locked, err := Fail(dir, "Mark", Failure{Time: now.Add(d), Protocol: "smtp", IP: "192.0.2.1"}, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if locked != (i == len(fails)-1) {
+			t.Errorf("failure %d locked=%t", i, locked)
+		}
+	}
+	if Locked(dir, "mark").IsZero() {
+		t.Errorf("mark not locked")
+	}
+
+	// Another failure doesn't lock again
+	if _, locked, _ := Fail(dir, "mark", Failure{Time: now}, p); locked {
+		t.Errorf("locked twice")
+	}
+
+	if list, _ := List(dir); len(list) != 1 || list[0].User != "mark" {
+		t.Errorf("List=%v", list)
+	}
+	if err := Unlock(dir, "mark"); err != nil {
+		t.Fatal(err)
+	}
+	if !Locked(dir, "mark").IsZero() {
+		t.Errorf("mark still locked")
+	}
+}
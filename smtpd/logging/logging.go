@@ -0,0 +1,158 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/journal"
+)
+
+const facilityMail = 2
+
+// Severity prefixes of log lines as in sd-daemon(3), e.g.
+// log.Printf(logging.Err+"fn e=%v", err). A line without one is
+// informational.
+const (
+	Crit    = "<2>"
+	Err     = "<3>"
+	Warning = "<4>"
+)
+
+// Setup sends the standard logger to output: "" or "stderr" (default),
+// "syslog" (RFC 5424 to addr, e.g. unix:///dev/log or udp://host:514) or
+// "journald". app is used as syslog identifier.
+func Setup(output, addr, app string) error {
+	switch output {
+	case "", "stderr":
+		log.SetFlags(0)
+		// systemd reads the prefixes of a service's stderr itself
+		log.SetOutput(&stderrWriter{journal: os.Getenv("JOURNAL_STREAM") != ""})
+	case "syslog":
+		w, err := newSyslogWriter(addr, app)
+		if err != nil {
+			return err
+		}
+		log.SetFlags(0)
+		log.SetOutput(w)
+	case "journald":
+		if !journal.Enabled() {
+			return fmt.Errorf("journald not available")
+		}
+		log.SetFlags(0)
+		log.SetOutput(&journalWriter{app: app})
+	default:
+		return fmt.Errorf("unknown log_output %q", output)
+	}
+	return nil
+}
+
+// priority splits the severity prefix off a log line
+func priority(line string) (journal.Priority, string) {
+	if len(line) >= 3 && line[0] == '<' && line[2] == '>' && line[1] >= '0' && line[1] <= '7' {
+		return journal.Priority(line[1] - '0'), line[3:]
+	}
+	return journal.PriInfo, line
+}
+
+type stderrWriter struct {
+	journal bool
+}
+
+func (w *stderrWriter) Write(p []byte) (int, error) {
+	if w.journal {
+		return os.Stderr.Write(p)
+	}
+	_, msg := priority(string(p))
+	_, err := os.Stderr.WriteString(time.Now().Format("2006/01/02 15:04:05 ") + msg)
+	return len(p), err
+}
+
+type journalWriter struct {
+	app string
+}
+
+func (w *journalWriter) Write(p []byte) (int, error) {
+	pri, msg := priority(strings.TrimRight(string(p), "\n"))
+	err := journal.Send(msg, pri, map[string]string{"SYSLOG_IDENTIFIER": w.app})
+	return len(p), err
+}
+
+type syslogWriter struct {
+	mu       sync.Mutex
+	conn     net.Conn
+	network  string
+	address  string
+	app      string
+	hostname string
+}
+
+func newSyslogWriter(addr, app string) (*syslogWriter, error) {
+	if addr == "" {
+		addr = "unix:///dev/log"
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid syslog_addr: %v", err)
+	}
+
+	w := &syslogWriter{app: app}
+	switch u.Scheme {
+	case "unix":
+		w.network, w.address = "unixgram", u.Path
+	case "udp", "tcp":
+		w.network, w.address = u.Scheme, u.Host
+	default:
+		return nil, fmt.Errorf("unsupported syslog_addr scheme %q", u.Scheme)
+	}
+
+	w.hostname, _ = os.Hostname()
+	if w.hostname == "" {
+		w.hostname = "-"
+	}
+	if err := w.connect(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *syslogWriter) connect() error {
+	conn, err := net.Dial(w.network, w.address)
+	if err != nil {
+		return err
+	}
+	w.conn = conn
+	return nil
+}
+
+func (w *syslogWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	pri, msg := priority(strings.TrimRight(string(p), "\n"))
+	line := fmt.Sprintf("<%d>1 %s %s %s %d - - %s",
+		facilityMail*8+int(pri), time.Now().Format(time.RFC3339Nano),
+		w.hostname, w.app, os.Getpid(), msg)
+	if w.network == "tcp" {
+		// Octet counting framing (RFC 6587)
+		line = fmt.Sprintf("%d %s", len(line), line)
+	}
+
+	if _, err := io.WriteString(w.conn, line); err != nil {
+		// Syslog daemon restarted, reconnect once
+		w.conn.Close()
+		if err := w.connect(); err != nil {
+			return 0, err
+		}
+		if _, err := io.WriteString(w.conn, line); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
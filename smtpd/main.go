@@ -9,60 +9,156 @@ import (
 	"syscall"
 
 	"github.com/coreos/go-systemd/v22/daemon"
+	"github.com/mpdroog/mymail/smtpd/admin"
 	"github.com/mpdroog/mymail/smtpd/config"
+	"github.com/mpdroog/mymail/smtpd/dns"
+	"github.com/mpdroog/mymail/smtpd/geoip"
+	"github.com/mpdroog/mymail/smtpd/logging"
+	"github.com/mpdroog/mymail/smtpd/messages"
 	"github.com/mpdroog/mymail/smtpd/queue"
+	"github.com/mpdroog/mymail/smtpd/replica"
 	"github.com/mpdroog/mymail/smtpd/server"
+	"github.com/mpdroog/mymail/smtpd/stats"
 	"github.com/mpdroog/mymail/smtpd/storage"
+	"github.com/mpdroog/mymail/smtpd/watchdog"
 )
 
 func main() {
 	configPath := flag.String("config", "config.json", "Path to configuration file")
+	demo := flag.Bool("demo", false, "Try smtpd on 127.0.0.1:2525 as alice or bob (password demo) with mail in a temporary directory, outgoing mail stays queued")
 	flag.BoolVar(&config.Verbose, "v", false, "Verbose-mode (log more)")
 	flag.Parse()
 
+	if *demo {
+		path, err := setupDemo()
+		if err != nil {
+			log.Fatalf(logging.Crit+"Failed to setup demo: %v", err)
+		}
+		*configPath = path
+	}
+
 	if err := config.Load(*configPath); err != nil {
-		log.Fatalf("Warning: Could not load config file: %v", err)
+		log.Fatalf(logging.Crit+"Warning: Could not load config file: %v", err)
 	}
 	if config.Verbose {
 		fmt.Printf("config.C=%+v\n", config.C)
 	}
+	if err := logging.Setup(config.C.LogOutput, config.C.SyslogAddr, "smtpd"); err != nil {
+		log.Fatalf(logging.Crit+"Failed to setup logging: %v", err)
+	}
+
+	// Broken templates show up now instead of at the first bounce, edits
+	// are picked up without a restart
+	if err := messages.Load(); err != nil {
+		log.Fatalf(logging.Crit+"Failed to load templates: %v", err)
+	}
+	if *demo {
+		if err := seedDemo(); err != nil {
+			log.Fatalf(logging.Crit+"Failed to seed demo: %v", err)
+		}
+		log.Printf("Demo with mail in %s", config.C.MailDir)
+	}
+
+	dns.Init(config.C.DNSServers)
+	if err := geoip.Load(config.C.GeoIPDBs); err != nil {
+		log.Fatalf(logging.Crit+"Failed to load geoip_dbs: %v", err)
+	}
+
+	if err := stats.Init(config.C.StatsDir); err != nil {
+		log.Fatalf(logging.Crit+"Failed to initialize stats: %v", err)
+	}
 
 	st := storage.New()
 	if err := st.Init(); err != nil {
-		log.Fatalf("Failed to initialize storage: %v", err)
+		log.Fatalf(logging.Crit+"Failed to initialize storage: %v", err)
+	}
+	if err := st.Recover(); err != nil {
+		log.Fatalf(logging.Crit+"Failed to recover storage: %v", err)
 	}
 
+	watchdog.Init(st)
+
 	// Create and start SMTP server
 	srv := server.New()
 	srv.SetStorage(st)
 
 	if config.C.AuthFile != "" {
 		if err := srv.LoadUsers(config.C.AuthFile); err != nil {
-			log.Fatalf("Warning: Could not load auth file: %v", err)
+			log.Fatalf(logging.Crit+"Warning: Could not load auth file: %v", err)
 		}
 	}
 
 	if err := srv.Start(); err != nil {
-		log.Fatalf("Failed to start SMTP server: %v", err)
+		log.Fatalf(logging.Crit+"Failed to start SMTP server: %v", err)
 	}
 
 	// Start queue processor
 	proc := queue.NewProcessor(st)
-	proc.Start()
+	if !*demo {
+		proc.Start()
+	}
+
+	var adm *admin.Admin
+	if config.C.AdminAddr != "" {
+		adm = admin.New(st, srv)
+		if err := adm.Start(); err != nil {
+			log.Fatalf(logging.Crit+"Failed to start admin service: %v", err)
+		}
+	}
+
+	var primary *replica.Primary
+	if config.C.ReplicaURL != "" {
+		primary = replica.NewPrimary(config.C.MailDir, config.C.ReplicaURL, config.C.ReplicaToken, config.C.ReplicaInterval)
+		primary.Start()
+	}
+	var standby *replica.Standby
+	if config.C.ReplicaListen != "" {
+		standby = replica.NewStandby(config.C.MailDir, config.C.ReplicaToken)
+		if err := standby.Start(config.C.ReplicaListen, config.C.TLSCert, config.C.TLSKey); err != nil {
+			log.Fatalf(logging.Crit+"Failed to start replica standby: %v", err)
+		}
+	}
 
 	daemon.SdNotify(false, daemon.SdNotifyReady)
 
-	// Wait for shutdown signal
+	// Wait for shutdown signal, SIGHUP reloads the user file (mymail user)
+	// and updated geoip_dbs
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := <-sigChan; sig == syscall.SIGHUP; sig = <-sigChan {
+		log.Println("Reloading users...")
+		if err := srv.LoadUsers(config.C.AuthFile); err != nil {
+			log.Printf(logging.Err+"LoadUsers e=%v", err)
+		}
+		if err := geoip.Load(config.C.GeoIPDBs); err != nil {
+			log.Printf(logging.Err+"geoip.Load e=%v", err)
+		}
+	}
 
 	daemon.SdNotify(false, daemon.SdNotifyStopping)
 	log.Println("Shutting down...")
 	if e := proc.Stop(); e != nil {
-		log.Printf("proc.Stop e=" + e.Error())
+		log.Printf(logging.Err+"proc.Stop e=%v", e)
 	}
 	if e := srv.Stop(); e != nil {
-		log.Printf("proc.Stop e=" + e.Error())
+		log.Printf(logging.Err+"proc.Stop e=%v", e)
+	}
+	if adm != nil {
+		if e := adm.Stop(); e != nil {
+			log.Printf(logging.Err+"adm.Stop e=%v", e)
+		}
+	}
+	if primary != nil {
+		if e := primary.Stop(); e != nil {
+			log.Printf(logging.Err+"primary.Stop e=%v", e)
+		}
+	}
+	if standby != nil {
+		if e := standby.Stop(); e != nil {
+			log.Printf(logging.Err+"standby.Stop e=%v", e)
+		}
+	}
+	if e := stats.Stop(); e != nil {
+		log.Printf(logging.Err+"stats.Stop e=%v", e)
 	}
 }
@@ -0,0 +1,161 @@
+// Package messages renders the messages smtpd generates from text/template
+// files per locale, {template_dir}/{locale}/{name}.tmpl. Names and the data
+// types documented next to their built-in English text:
+//
+//	bounce          queue.Bounce, delivery failed permanently (DSN)
+//	delay-warning   queue.Delay, not delivered after delay_warning
+//	quota-warning   server.QuotaWarning, mailbox over quota_warning percent
+//	welcome         users.Welcome, first message of a new account
+//	lockout-notice  lockout.NoticeData, account locked after failed logins
+package messages
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/mpdroog/mymail/smtpd/config"
+	"github.com/mpdroog/mymail/smtpd/logging"
+)
+
+// DefaultLocale is the language of the built-in templates
+const DefaultLocale = "en"
+
+// Locale picks the locale of a message to addr: the account's own, then
+// domain_locales, then default_locale
+func Locale(accountLocale, addr string) string {
+	if accountLocale != "" {
+		return accountLocale
+	}
+	if at := strings.LastIndex(addr, "@"); at != -1 {
+		for domain, locale := range config.C.DomainLocales {
+			if strings.EqualFold(domain, addr[at+1:]) {
+				return locale
+			}
+		}
+	}
+	if config.C.DefaultLocale != "" {
+		return config.C.DefaultLocale
+	}
+	return DefaultLocale
+}
+
+// candidates are the locales to try for locale, "pt-BR" falls back to "pt"
+// and then to default_locale
+func candidates(locale string) []string {
+	var out []string
+	for _, l := range []string{locale, config.C.DefaultLocale} {
+		l = strings.ToLower(strings.ReplaceAll(l, "_", "-"))
+		if l == "" || strings.ContainsAny(l, "/\\.") {
+			continue
+		}
+		lang, _, _ := strings.Cut(l, "-")
+		for _, c := range []string{l, lang} {
+			if !slices.Contains(out, c) {
+				out = append(out, c)
+			}
+		}
+	}
+	return out
+}
+
+// Render executes {template_dir}/{locale}/{name}.tmpl with data, falling
+// back through candidates and finally to builtin (English)
+func Render(name, builtin, locale string, data any) ([]byte, error) {
+	if config.C.TemplateDir != "" {
+		for _, l := range candidates(locale) {
+			t, err := parse(filepath.Join(config.C.TemplateDir, l, name+".tmpl"))
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			return execute(t, data)
+		}
+	}
+	return Execute(name, builtin, data)
+}
+
+// Execute runs template text with data
+func Execute(name, text string, data any) ([]byte, error) {
+	t, err := template.New(name).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("%s template: %v", name, err)
+	}
+	return execute(t, data)
+}
+
+// execute returns the message with CRLF line endings
+func execute(t *template.Template, data any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("%s template: %v", t.Name(), err)
+	}
+	// Templates are edited by hand, make the line endings RFC5322
+	msg := strings.ReplaceAll(strings.ReplaceAll(buf.String(), "\r\n", "\n"), "\n", "\r\n")
+	return []byte(msg), nil
+}
+
+type cached struct {
+	mod time.Time
+	t   *template.Template
+}
+
+var (
+	mu    sync.Mutex
+	cache = make(map[string]*cached) // File path => parsed template
+)
+
+// Load parses every template in template_dir so mistakes show at startup,
+// after that Render picks up edits by modification time
+func Load() error {
+	if config.C.TemplateDir == "" {
+		return nil
+	}
+	return filepath.WalkDir(config.C.TemplateDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(path, ".tmpl") {
+			return err
+		}
+		_, err = parse(path)
+		return err
+	})
+}
+
+// parse returns the template in path, parsed again once the file changed.
+// A broken edit keeps the previous version so messages still go out.
+func parse(path string) (*template.Template, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	c := cache[path]
+	if c != nil && c.mod.Equal(fi.ModTime()) {
+		return c.t, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	t, err := template.New(strings.TrimSuffix(filepath.Base(path), ".tmpl")).Parse(string(data))
+	if err != nil {
+		if c != nil {
+			log.Printf(logging.Err+"messages.parse %s e=%v, keeping the previous version", path, err)
+			c.mod = fi.ModTime()
+			return c.t, nil
+		}
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	cache[path] = &cached{mod: fi.ModTime(), t: t}
+	return t, nil
+}
@@ -0,0 +1,82 @@
+package messages
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mpdroog/mymail/smtpd/config"
+)
+
+func TestRender(t *testing.T) {
+	dir := t.TempDir()
+	for locale, text := range map[string]string{
+		"nl":    "Hallo {{.}}\n",
+		"pt":    "Olá {{.}}\n",
+		"pt-br": "Oi {{.}}\n",
+	} {
+		os.MkdirAll(filepath.Join(dir, locale), 0700)
+		if err := os.WriteFile(filepath.Join(dir, locale, "greet.tmpl"), []byte(text), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config.C.TemplateDir = dir
+	config.C.DefaultLocale = ""
+	config.C.DomainLocales = map[string]string{"example.nl": "nl"}
+	defer func() { config.C.TemplateDir, config.C.DomainLocales = "", nil }()
+
+	patterns := map[string]struct {
+		account string
+		addr    string
+		expect  string
+	}{
+		"account":        {"pt-BR", "mark@example.nl", "Oi mark\r\n"},
+		"account lang":   {"pt_PT", "mark@example.nl", "Olá mark\r\n"},
+		"domain":         {"", "mark@EXAMPLE.nl", "Hallo mark\r\n"},
+		"builtin":        {"", "mark@example.com", "Hello mark\r\n"},
+		"unknown locale": {"de", "mark@example.nl", "Hello mark\r\n"},
+		"traversal":      {"../nl", "mark@example.com", "Hello mark\r\n"},
+	}
+	for name, p := range patterns {
+		msg, err := Render("greet", "Hello {{.}}\n", Locale(p.account, p.addr), "mark")
+		if err != nil {
+			t.Errorf("%s: e=%v", name, err)
+			continue
+		}
+		if string(msg) != p.expect {
+			t.Errorf("%s: msg=%q expect=%q", name, msg, p.expect)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "en", "greet.tmpl")
+	os.MkdirAll(filepath.Dir(path), 0700)
+	config.C.TemplateDir = dir
+	defer func() { config.C.TemplateDir = "" }()
+
+	// Edits within the same second still need a new modification time
+	mod := time.Now()
+	patterns := []struct {
+		text   string
+		expect string
+	}{
+		{"Hello {{.}}\n", "Hello mark\r\n"},
+		{"Hi {{.}}\n", "Hi mark\r\n"},
+		{"Hi {{.\n", "Hi mark\r\n"}, // Broken edit keeps the previous version
+	}
+	for i, p := range patterns {
+		if err := os.WriteFile(path, []byte(p.text), 0600); err != nil {
+			t.Fatal(err)
+		}
+		mod = mod.Add(time.Second)
+		os.Chtimes(path, mod, mod)
+
+		msg, err := Render("greet", "builtin", "en", "mark")
+		if err != nil || string(msg) != p.expect {
+			t.Errorf("%d: msg=%q e=%v expect=%q", i, msg, err, p.expect)
+		}
+	}
+}
@@ -3,10 +3,19 @@ package queue
 import (
 	"fmt"
 	"log"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/mpdroog/mymail/smtpd/client"
+	"github.com/mpdroog/mymail/smtpd/config"
+	"github.com/mpdroog/mymail/smtpd/logging"
+	"github.com/mpdroog/mymail/smtpd/messages"
+	"github.com/mpdroog/mymail/smtpd/reputation"
+	"github.com/mpdroog/mymail/smtpd/stats"
 	"github.com/mpdroog/mymail/smtpd/storage"
+	"github.com/mpdroog/mymail/smtpd/users"
 )
 
 const (
@@ -14,46 +23,74 @@ const (
 	RetryInterval = 15 * time.Minute
 )
 
-type Processor struct {
-	storage  *storage.Storage
-	client   *client.Client
-	quit     chan struct{}
+// lane is a priority class with its own worker pool and scan interval so
+// a bounce storm or newsletter blast doesn't delay interactive mail
+type lane struct {
+	priority string
+	workers  int
 	interval time.Duration
 }
 
+type Processor struct {
+	storage *storage.Storage
+	client  *client.Client
+	quit    chan struct{}
+	wg      sync.WaitGroup
+	lanes   []lane
+}
+
 func NewProcessor(st *storage.Storage) *Processor {
 	return &Processor{
-		storage:  st,
-		client:   client.New(),
-		quit:     make(chan struct{}),
-		interval: 1 * time.Minute,
+		storage: st,
+		client:  client.New(),
+		quit:    make(chan struct{}),
+		lanes: []lane{
+			{priority: storage.PriorityInteractive, workers: workers(config.C.QueueWorkersInteractive, 4), interval: 10 * time.Second},
+			{priority: storage.PriorityBulk, workers: workers(config.C.QueueWorkersBulk, 1), interval: 1 * time.Minute},
+		},
 	}
 }
 
+func workers(n, def int) int {
+	if n <= 0 {
+		return def
+	}
+	return n
+}
+
 func (p *Processor) Start() {
 	log.Println("Queue processor started")
-	go p.run()
+	p.client.StartHealthCheck(p.quit)
+	for _, l := range p.lanes {
+		p.wg.Add(1)
+		go p.run(l)
+	}
 }
 
 func (p *Processor) Stop() error {
 	close(p.quit)
+	p.wg.Wait()
 	log.Println("Queue processor stopped")
 	return nil
 }
 
-func (p *Processor) run() {
-	ticker := time.NewTicker(p.interval)
+func (p *Processor) run(l lane) {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(l.interval)
 	defer ticker.Stop()
 
 	// Process immediately on start
-	p.processQueue()
+	if e := p.processQueue(l); e != nil {
+		log.Printf(logging.Err+"processQueue(%s) e=%v", l.priority, e)
+	}
 
 	for {
 		select {
 		case <-ticker.C:
-			e := p.processQueue()
+			e := p.processQueue(l)
 			if e != nil {
-				log.Printf("processQueue e=%v", e)
+				log.Printf(logging.Err+"processQueue(%s) e=%v", l.priority, e)
 			}
 		case <-p.quit:
 			return
@@ -61,87 +98,326 @@ func (p *Processor) run() {
 	}
 }
 
-func (p *Processor) processQueue() error {
-	emails, err := p.storage.GetQueuedEmails()
+// processQueue delivers all due emails of a lane with l.workers in parallel
+// and returns once the batch is done so no email is picked up twice
+func (p *Processor) processQueue(l lane) error {
+	holds, err := p.storage.GetHolds()
+	if err != nil {
+		return err
+	}
+	if holds.All {
+		// Whole queue on hold
+		return nil
+	}
+
+	emails, err := p.storage.GetQueuedEmails(l.priority)
 	if err != nil {
 		return err
 	}
 
-	for _, email := range emails {
-		if e := p.processEmail(&email); e != nil {
-			log.Printf("processEmail e=%s", e.Error())
+	jobs := make(chan *storage.QueuedEmail)
+	var wg sync.WaitGroup
+	for i := 0; i < l.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for email := range jobs {
+				if e := p.processEmail(email, holds); e != nil {
+					log.Printf(logging.Err+"processEmail e=%s", e.Error())
+				}
+			}
+		}()
+	}
+
+feed:
+	for i := range emails {
+		select {
+		case jobs <- &emails[i]:
+		case <-p.quit:
+			break feed
 		}
 	}
+	close(jobs)
+	wg.Wait()
 
 	return nil
 }
 
-func (p *Processor) processEmail(email *storage.QueuedEmail) error {
-	log.Printf("Processing queued email %s to %s", email.ID, email.To)
+func (p *Processor) processEmail(email *storage.QueuedEmail, holds *storage.Holds) error {
+	// Another instance sharing queue_dir may be delivering it, or just did
+	// since the queue was listed
+	claimed, err := p.storage.Claim(email.ID)
+	if err != nil || !claimed {
+		return err
+	}
+	defer func() {
+		if err := p.storage.Release(email.ID); err != nil {
+			log.Printf(logging.Err+"Release(%s) e=%v", email.ID, err)
+		}
+	}()
+	email, err = p.storage.GetQueuedEmail(email.ID)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if email.Held {
+		return nil
+	}
 
-	err := p.client.Send(email.From, email.To, email.Data)
-	if err != nil {
-		email.Attempts++
-		email.LastError = err.Error()
+	now := time.Now()
+	var bounced []*storage.Recipient
 
-		if email.Attempts >= MaxRetries {
-			// Move to dead letter queue or notify sender
-			p.handlePermanentFailure(email)
-			return fmt.Errorf("Email %s failed permanently after %d attempts: %v", email.ID, email.Attempts, err)
+	// Deliver all due recipients at once so recipients sharing a
+	// destination get one transaction
+	var due []*storage.Recipient
+	var to []string
+	for i := range email.Recipients {
+		rcpt := &email.Recipients[i]
+		domain := getDomain(rcpt.Address)
+		if rcpt.Done() || rcpt.NextRetry.After(now) || holds.DomainHeld(domain) || !reputation.Paused(domain, now).IsZero() {
+			continue
+		}
+		due = append(due, rcpt)
+		to = append(to, rcpt.Address)
+	}
+	if len(due) == 0 {
+		return nil
+	}
+
+	// Recorded first so a crash during Send doesn't strand the recipients,
+	// see storage.Recover
+	for _, rcpt := range due {
+		rcpt.Status = storage.RcptInFlight
+	}
+	email.SetStatus(storage.StatusDelivering)
+	email.Instance = config.C.InstanceID
+	if err := p.storage.UpdateQueuedEmail(email); err != nil {
+		return fmt.Errorf("Error marking email %s in-flight: %v", email.ID, err)
+	}
+
+	log.Printf("Processing queued email %s to %s", email.ID, strings.Join(to, ", "))
+	start := time.Now()
+	stop := p.storage.KeepClaim(email.ID)
+	results := p.client.Send(email.From, to, email.Data)
+	stop()
+	took := time.Since(start).Round(time.Millisecond).String()
+
+	for _, rcpt := range due {
+		res := results[rcpt.Address]
+		err := res.Err
+		rcpt.History = append(rcpt.History, newAttempt(start, res.Host, took, err))
+		if err == nil {
+			rcpt.Status = storage.RcptDelivered
+			rcpt.LastError = ""
+			rcpt.Reputation = ""
+			stats.Record(stats.Sent, email.From, getDomain(rcpt.Address))
+			stats.RecordDelivery(getDomain(rcpt.Address), stats.Delivered, res.TLS, res.Duration, "")
+			log.Printf("Email %s delivered successfully to %s", email.ID, rcpt.Address)
+			continue
+		}
+
+		rcpt.Attempts++
+		rcpt.LastError = err.Error()
+		rcpt.Reputation = ""
+		if hint, ok := reputation.Classify(client.Reply(err)); ok {
+			rcpt.Reputation = hint.Category
+			p.reputationHit(rcpt, hint, now)
+		}
 
+		if rcpt.Attempts >= MaxRetries || client.IsPermanent(err) {
+			rcpt.Status = storage.RcptBounced
+			bounced = append(bounced, rcpt)
+			stats.Record(stats.Bounced, email.From, getDomain(rcpt.Address))
+			stats.RecordDelivery(getDomain(rcpt.Address), stats.Failed, res.TLS, res.Duration, rcpt.Reputation)
+			log.Printf(logging.Warning+"Email %s to %s failed permanently after %d attempts: %v", email.ID, rcpt.Address, rcpt.Attempts, err)
+			continue
 		}
 
 		// Schedule retry with exponential backoff
-		backoff := time.Duration(email.Attempts) * RetryInterval
-		email.NextRetry = time.Now().Add(backoff)
+		rcpt.Status = storage.RcptDeferred
+		rcpt.NextRetry = now.Add(time.Duration(rcpt.Attempts) * RetryInterval)
+		if until := reputation.Paused(getDomain(rcpt.Address), now); rcpt.NextRetry.Before(until) {
+			rcpt.NextRetry = until
+		}
+		stats.RecordDelivery(getDomain(rcpt.Address), stats.Deferred, res.TLS, res.Duration, rcpt.Reputation)
+		log.Printf(logging.Warning+"Email %s to %s failed (attempt %d), will retry at %v: %v",
+			email.ID, rcpt.Address, rcpt.Attempts, rcpt.NextRetry, err)
+	}
 
-		log.Printf("Email %s failed (attempt %d), will retry at %v: %v",
-			email.ID, email.Attempts, email.NextRetry, err)
+	if len(bounced) > 0 {
+		p.handlePermanentFailure(email, bounced)
+	}
+	if !email.Warned && config.C.DelayWarning > 0 && now.Sub(email.CreatedAt) >= config.C.DelayWarning {
+		p.handleDelay(email)
+	}
 
-		if err := p.storage.UpdateQueuedEmail(email); err != nil {
-			return fmt.Errorf("Error updating queued email %s: %v", email.ID, err)
+	if email.Done() {
+		// All recipients handled - remove from queue
+		email.SetStatus(email.FinalStatus())
+		log.Printf("Email %s %s, queued %s ago", email.ID, email.Status, now.Sub(email.CreatedAt).Round(time.Second))
+		if err := p.storage.RemoveFromQueue(email.ID); err != nil {
+			return fmt.Errorf("Error removing email %s from queue: %v", email.ID, err)
 		}
 		return nil
 	}
 
-	// Success - remove from queue
-	if err := p.storage.RemoveFromQueue(email.ID); err != nil {
-		return fmt.Errorf("Error removing email %s from queue: %v", email.ID, err)
+	email.SetStatus(storage.StatusDeferred)
+	email.UpdateNextRetry()
+	if err := p.storage.UpdateQueuedEmail(email); err != nil {
+		return fmt.Errorf("Error updating queued email %s: %v", email.ID, err)
 	}
-	log.Printf("Email %s delivered successfully to %s", email.ID, email.To)
-
 	return nil
 }
 
-func (p *Processor) handlePermanentFailure(email *storage.QueuedEmail) {
-	// Generate bounce message
-	bounce := p.generateBounce(email)
+// newAttempt describes a delivery try for the queue entry, with the SMTP
+// reply when the remote side gave one
+func newAttempt(start time.Time, host, took string, err error) storage.Attempt {
+	a := storage.Attempt{Time: start, Host: host, Duration: took, Code: 250, Text: "OK"}
+	if err != nil {
+		a.Code, a.Text = client.Reply(err)
+	}
+	return a
+}
+
+func (p *Processor) handlePermanentFailure(email *storage.QueuedEmail, failed []*storage.Recipient) {
+	if email.From == "" {
+		// Never bounce a bounce
+		log.Printf(logging.Warning+"Dropping bounce %s, recipients failed permanently", email.ID)
+		return
+	}
 
 	// Queue bounce to original sender
-	if err := p.storage.QueueForRelay("", email.From, bounce); err != nil {
-		log.Printf("Error queueing bounce for %s: %v", email.ID, err)
+	bounce := p.generateBounce(email, failed)
+	if err := p.storage.QueueForRelay("", []string{email.From}, bounce); err != nil {
+		log.Printf(logging.Err+"Error queueing bounce for %s: %v", email.ID, err)
+	}
+}
+
+// bounceTemplate is the built-in English bounce, see smtpd/messages
+const bounceTemplate = `From: MAILER-DAEMON@{{.Hostname}}
+To: {{.To}}
+Date: {{.Date}}
+Subject: Mail delivery failed: returning message to sender
+Content-Type: text/plain; charset=utf-8
+
+This message was created automatically by mail delivery software.
+
+A message that you sent could not be delivered to one or more of its
+recipients. This is a permanent error.
+
+{{range .Failed}}Recipient: {{.Address}}
+Error: {{.LastError}}
+{{range .History}}Attempt: {{.Time.Format "2006-01-02 15:04:05 -0700"}} {{with .Host}}{{.}} {{end}}{{with .Code}}{{.}} {{end}}{{.Text}}
+{{end}}
+{{end}}--- Original message follows ---
+
+{{.Original}}`
+
+// Bounce holds the fields of the bounce template
+type Bounce struct {
+	Hostname string
+	To       string // Original sender
+	Date     string
+	QueueID  string
+	Failed   []*storage.Recipient
+	Original string
+}
+
+// handleDelay tells the sender once which recipients are still deferred
+func (p *Processor) handleDelay(email *storage.QueuedEmail) {
+	var deferred []*storage.Recipient
+	for i := range email.Recipients {
+		if email.Recipients[i].Status == storage.RcptDeferred {
+			deferred = append(deferred, &email.Recipients[i])
+		}
 	}
+	if len(deferred) == 0 || email.From == "" {
+		return
+	}
+	email.Warned = true
 
-	// Remove failed email from queue
-	if err := p.storage.RemoveFromQueue(email.ID); err != nil {
-		log.Printf("Error removing failed email %s: %v", email.ID, err)
+	d := Delay{
+		Hostname: config.C.Hostname,
+		To:       email.From,
+		Date:     time.Now().Format(time.RFC1123Z),
+		QueueID:  email.ID,
+		Queued:   email.CreatedAt.Format(time.RFC1123Z),
+		Deferred: deferred,
+	}
+	msg, err := messages.Render("delay-warning", delayTemplate, senderLocale(email.From), d)
+	if err != nil {
+		log.Printf(logging.Err+"handleDelay e=%v", err)
+		msg, _ = messages.Execute("delay-warning", delayTemplate, d)
+	}
+	if err := p.storage.QueueForRelay("", []string{email.From}, msg); err != nil {
+		log.Printf(logging.Err+"Error queueing delay warning for %s: %v", email.ID, err)
 	}
 }
 
-func (p *Processor) generateBounce(email *storage.QueuedEmail) []byte {
-	bounce := "From: MAILER-DAEMON@" + email.From + "\r\n"
-	bounce += "To: " + email.From + "\r\n"
-	bounce += "Subject: Mail delivery failed: returning message to sender\r\n"
-	bounce += "Content-Type: text/plain; charset=utf-8\r\n"
-	bounce += "\r\n"
-	bounce += "This message was created automatically by mail delivery software.\r\n\r\n"
-	bounce += "A message that you sent could not be delivered to one or more of its\r\n"
-	bounce += "recipients. This is a permanent error.\r\n\r\n"
-	bounce += "Recipient: " + email.To + "\r\n"
-	bounce += "Error: " + email.LastError + "\r\n"
-	bounce += "\r\n"
-	bounce += "--- Original message follows ---\r\n\r\n"
-	bounce += string(email.Data)
+// delayTemplate is the built-in English delay warning, see smtpd/messages
+const delayTemplate = `From: MAILER-DAEMON@{{.Hostname}}
+To: {{.To}}
+Date: {{.Date}}
+Subject: Delivery delayed: message not yet delivered
+Content-Type: text/plain; charset=utf-8
+
+This message was created automatically by mail delivery software.
+
+A message that you sent on {{.Queued}} has not been delivered to all of
+its recipients yet. Delivery will be retried, you don't need to resend it.
 
-	return []byte(bounce)
+{{range .Deferred}}Recipient: {{.Address}}
+Error: {{.LastError}}
+Next attempt: {{.NextRetry.Format "Mon, 02 Jan 2006 15:04:05 -0700"}}
+
+{{end}}Queue ID: {{.QueueID}}
+`
+
+// Delay holds the fields of the delay-warning template
+type Delay struct {
+	Hostname string
+	To       string // Original sender
+	Date     string
+	QueueID  string
+	Queued   string // When the message was accepted
+	Deferred []*storage.Recipient
+}
+
+// senderLocale picks the locale of a message back to addr, see messages.Locale
+func senderLocale(addr string) string {
+	locale := ""
+	if accounts, err := users.Load(config.C.AuthFile); err == nil {
+		if acct := users.Lookup(accounts, addr); acct != nil {
+			locale = acct.Locale
+		}
+	}
+	return messages.Locale(locale, addr)
+}
+
+func (p *Processor) generateBounce(email *storage.QueuedEmail, failed []*storage.Recipient) []byte {
+	b := Bounce{
+		Hostname: config.C.Hostname,
+		To:       email.From,
+		Date:     time.Now().Format(time.RFC1123Z),
+		QueueID:  email.ID,
+		Failed:   failed,
+		Original: string(email.Data),
+	}
+
+	msg, err := messages.Render("bounce", bounceTemplate, senderLocale(email.From), b)
+	if err != nil {
+		// A broken template must not lose the bounce
+		log.Printf(logging.Err+"generateBounce e=%v", err)
+		msg, _ = messages.Execute("bounce", bounceTemplate, b)
+	}
+	return msg
+}
+
+func getDomain(email string) string {
+	parts := strings.Split(email, "@")
+	if len(parts) == 2 {
+		return parts[1]
+	}
+	return ""
 }
@@ -0,0 +1,66 @@
+package queue
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mpdroog/mymail/smtpd/config"
+	"github.com/mpdroog/mymail/smtpd/reputation"
+	"github.com/mpdroog/mymail/smtpd/storage"
+)
+
+// TestReputationPause feeds the 554 banner of a relay that blocklists us
+// through the client, delivery to the destination should pause
+func TestReputationPause(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("554 5.7.1 Service unavailable; client host blocked using zen.spamhaus.org\r\n"))
+			conn.Close()
+		}
+	}()
+
+	config.C.Hostname = "test.example.com"
+	config.C.MailDir = t.TempDir()
+	config.C.QueueDir = t.TempDir()
+	config.C.InstanceID = "test"
+	config.C.QueueClaimTTL = time.Minute
+	config.C.ReputationPause = time.Hour
+	config.C.Relays = []config.Relay{{Host: "127.0.0.1", Port: ln.Addr().(*net.TCPAddr).Port, Weight: 1}}
+	defer func() { config.C.Relays = nil }()
+
+	st := storage.New()
+	if err := st.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.QueueForRelay("a@example.com", []string{"b@blocked.example"}, []byte("Subject: hi\r\n\r\nbody\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	emails, err := st.GetQueuedEmails(storage.PriorityInteractive)
+	if err != nil || len(emails) != 1 {
+		t.Fatalf("queued=%d e=%v", len(emails), err)
+	}
+	holds, _ := st.GetHolds()
+
+	p := NewProcessor(st)
+	start := time.Now()
+	if err := p.processEmail(&emails[0], holds); err != nil {
+		t.Fatal(err)
+	}
+	until := reputation.Paused("blocked.example", time.Now())
+	if until.Before(start.Add(config.C.ReputationPause)) {
+		t.Errorf("paused until %v, expect %s from now", until, config.C.ReputationPause)
+	}
+	if !reputation.Paused("other.example", time.Now()).IsZero() {
+		t.Errorf("other destination paused")
+	}
+}
@@ -0,0 +1,39 @@
+package queue
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/mpdroog/mymail/smtpd/config"
+	"github.com/mpdroog/mymail/smtpd/logging"
+	"github.com/mpdroog/mymail/smtpd/reputation"
+	"github.com/mpdroog/mymail/smtpd/storage"
+	"github.com/mpdroog/mymail/smtpd/watchdog"
+)
+
+// ReputationAlert is sent to the operator when delivery to a domain pauses
+type ReputationAlert struct {
+	Domain string `json:"domain"`
+	reputation.Hint
+	Recipient   string    `json:"recipient"`
+	Reply       string    `json:"reply"`
+	PausedUntil time.Time `json:"paused_until"`
+}
+
+// reputationHit pauses delivery to the domain of rcpt after it rejected us
+// for our reputation, and alerts once per pause
+func (p *Processor) reputationHit(rcpt *storage.Recipient, hint reputation.Hint, now time.Time) {
+	domain := getDomain(rcpt.Address)
+	until, started := reputation.Pause(domain, config.C.ReputationPause, now)
+	if !started {
+		return
+	}
+	log.Printf(logging.Warning+"Reputation domain=%s category=%s provider=%s paused_until=%v: %s", domain, hint.Category, hint.Provider, until, rcpt.LastError)
+
+	a := ReputationAlert{Domain: domain, Hint: hint, Recipient: rcpt.Address, Reply: rcpt.LastError, PausedUntil: until}
+	text := fmt.Sprintf("%s rejected mail to %s for our reputation (%s):\r\n\r\n  %s\r\n\r\n", domain, rcpt.Address, hint.Category, rcpt.LastError)
+	text += fmt.Sprintf("Delivery to %s is paused until %s.\r\n\r\n", domain, until.Format(time.RFC1123Z))
+	text += hint.Remediation + ".\r\n"
+	go watchdog.Notify("Delivery to "+domain+" paused: "+hint.Category, text, a)
+}
@@ -0,0 +1,162 @@
+package replica
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mpdroog/mymail/smtpd/logging"
+)
+
+// Primary sends the changes of its mail_dir to a standby
+type Primary struct {
+	root     string
+	url      string
+	token    string
+	interval time.Duration
+	client   *http.Client
+	quit     chan struct{}
+	wg       sync.WaitGroup
+
+	local   Manifest // Of the last scan
+	standby Manifest // What the standby holds, nil to ask it
+	failing bool
+}
+
+func NewPrimary(root, url, token string, interval time.Duration) *Primary {
+	return &Primary{
+		root:     root,
+		url:      url,
+		token:    token,
+		interval: interval,
+		client:   &http.Client{},
+		quit:     make(chan struct{}),
+	}
+}
+
+func (p *Primary) Start() {
+	log.Printf("Replicating %s to %s", p.root, p.url)
+	p.wg.Add(1)
+	go p.run()
+}
+
+func (p *Primary) Stop() error {
+	close(p.quit)
+	p.wg.Wait()
+	return nil
+}
+
+func (p *Primary) run() {
+	defer p.wg.Done()
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		// Errors are logged once, not every interval while the standby is down
+		if err := p.Sync(); err != nil && !p.failing {
+			log.Printf(logging.Err+"replica.Sync e=%v", err)
+			p.failing = true
+		} else if err == nil && p.failing {
+			log.Printf("Replica %s in sync again", p.url)
+			p.failing = false
+		}
+		select {
+		case <-ticker.C:
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+// Sync sends what changed since the last Sync, on the first call or after
+// a failure everything the standby lacks
+func (p *Primary) Sync() error {
+	if p.standby == nil {
+		m, err := p.manifest()
+		if err != nil {
+			return err
+		}
+		p.standby = m
+	}
+	local, err := Scan(p.root, p.local)
+	if err != nil {
+		return err
+	}
+	p.local = local
+
+	ops := diff(local, p.standby)
+	if len(ops) == 0 {
+		return nil
+	}
+	next, err := p.apply(ops)
+	if err != nil {
+		p.standby = nil
+		return err
+	}
+	p.standby = next
+	return nil
+}
+
+func (p *Primary) manifest() (Manifest, error) {
+	req, err := http.NewRequest(http.MethodGet, p.url+"/manifest", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.token)
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("manifest: %s", res.Status)
+	}
+	m := make(Manifest)
+	if err := json.NewDecoder(res.Body).Decode(&m); err != nil {
+		return nil, fmt.Errorf("manifest: %v", err)
+	}
+	return m, nil
+}
+
+// apply streams ops to the standby and returns what it holds afterwards
+func (p *Primary) apply(ops []op) (Manifest, error) {
+	pr, pw := io.Pipe()
+	type result struct {
+		m   Manifest
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		m, err := writeOps(pw, p.root, ops, p.standby)
+		pw.CloseWithError(err)
+		done <- result{m, err}
+	}()
+
+	req, err := http.NewRequest(http.MethodPost, p.url+"/apply", pr)
+	if err != nil {
+		pr.Close()
+		<-done
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.token)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	res, err := p.client.Do(req)
+	// Unblocks the writer when the request failed before reading it all
+	pr.Close()
+	r := <-done
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return nil, fmt.Errorf("apply: %s %s", res.Status, body)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return r.m, nil
+}
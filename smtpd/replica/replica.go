@@ -0,0 +1,194 @@
+package replica
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A primary keeps a standby's mail_dir equal to its own. Message files never
+// change and everything else in a mailbox (flags, .uidnext, .uidvalidity) is
+// replaced by rename, so a file is sent again when its size or mtime differ
+// and a directory is only read again when its mtime changed. That covers
+// what smtpd delivers as well as flags and expunges done by imapd.
+//
+// On start and after any failure the primary asks the standby what it holds
+// (GET /manifest) and sends the difference as one stream of ops (POST
+// /apply), so an interrupted sync continues where it stopped.
+
+// Entry is a file or directory of a manifest
+type Entry struct {
+	Size  int64       `json:"size"`
+	Mtime int64       `json:"mtime"` // In ns, 0 for a directory that changed during the scan
+	Mode  fs.FileMode `json:"mode"`
+}
+
+// Manifest is a mail_dir by slash separated path relative to it
+type Manifest map[string]Entry
+
+// op is the header of a change in the /apply stream, Size bytes of file
+// contents follow a put
+type op struct {
+	Op   string `json:"op"` // put, mkdir or remove
+	Path string `json:"path"`
+	Entry
+}
+
+// skip leaves out locks, half written files and imapd's index, the standby
+// builds its own
+func skip(name string, dir bool) bool {
+	if dir {
+		return name == ".index"
+	}
+	return name == ".lock" || strings.HasPrefix(name, ".tmp-")
+}
+
+// Scan returns the manifest of root. Files of a directory whose mtime is the
+// same as in prev are taken from prev without a stat.
+func Scan(root string, prev Manifest) (Manifest, error) {
+	scanned := time.Now()
+	m := make(Manifest)
+	unchanged := make(map[string]bool)
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Removed since its directory was read, or no mail yet
+				return nil
+			}
+			return err
+		}
+		if p == root {
+			return nil
+		}
+		if skip(d.Name(), d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel := filepath.ToSlash(p[len(root)+1:])
+		dir, _ := filepath.Split(rel)
+		dir = strings.TrimSuffix(dir, "/")
+
+		if !d.IsDir() && unchanged[dir] {
+			if e, ok := prev[rel]; ok {
+				m[rel] = e
+				return nil
+			}
+		}
+		info, err := d.Info()
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if !d.IsDir() && !info.Mode().IsRegular() {
+			return nil
+		}
+
+		e := Entry{Size: info.Size(), Mtime: info.ModTime().UnixNano(), Mode: info.Mode()}
+		if d.IsDir() {
+			e.Size = 0
+			// A change within the same mtime tick as the scan would go
+			// unnoticed, the directory is only trusted once it was quiet
+			if scanned.Sub(info.ModTime()) <= time.Second {
+				e.Mtime = 0
+			}
+			unchanged[rel] = e.Mtime != 0 && prev[rel].Mtime == e.Mtime
+		}
+		m[rel] = e
+		return nil
+	})
+	return m, err
+}
+
+// diff returns the ops that turn have into want, directories before their
+// contents and removals last
+func diff(want, have Manifest) []op {
+	var puts, removes []op
+	for p, e := range want {
+		h, ok := have[p]
+		switch {
+		case e.Mode.IsDir():
+			if !ok || !h.Mode.IsDir() {
+				puts = append(puts, op{Op: "mkdir", Path: p, Entry: e})
+			}
+		case !ok || h.Size != e.Size || h.Mtime != e.Mtime || h.Mode != e.Mode:
+			puts = append(puts, op{Op: "put", Path: p, Entry: e})
+		}
+	}
+	for p := range have {
+		if _, ok := want[p]; !ok {
+			removes = append(removes, op{Op: "remove", Path: p})
+		}
+	}
+	sort.Slice(puts, func(i, j int) bool { return puts[i].Path < puts[j].Path })
+	sort.Slice(removes, func(i, j int) bool { return removes[i].Path > removes[j].Path })
+	return append(puts, removes...)
+}
+
+// authorized checks the bearer token of r in constant time
+func authorized(r *http.Request, token string) bool {
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// writeOps streams ops to w with the contents of the files under root, a
+// file gone since the scan is left out. It returns what the standby holds
+// once all ops are applied.
+func writeOps(w io.Writer, root string, ops []op, have Manifest) (Manifest, error) {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	next := make(Manifest, len(have))
+	for p, e := range have {
+		next[p] = e
+	}
+
+	for _, o := range ops {
+		switch o.Op {
+		case "remove":
+			delete(next, o.Path)
+		case "mkdir":
+			next[o.Path] = o.Entry
+		case "put":
+			f, err := os.Open(filepath.Join(root, filepath.FromSlash(o.Path)))
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			// The open file stays the same even if it's replaced meanwhile,
+			// the next scan sees the new one
+			info, err := f.Stat()
+			if err != nil {
+				f.Close()
+				return nil, err
+			}
+			o.Size, o.Mtime = info.Size(), info.ModTime().UnixNano()
+			if err := enc.Encode(o); err != nil {
+				f.Close()
+				return nil, err
+			}
+			_, err = io.CopyN(bw, f, o.Size)
+			f.Close()
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", o.Path, err)
+			}
+			next[o.Path] = o.Entry
+			continue
+		}
+		if err := enc.Encode(o); err != nil {
+			return nil, err
+		}
+	}
+	return next, bw.Flush()
+}
@@ -0,0 +1,73 @@
+package replica
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestSync replicates a mailbox, then a delivery, a flag change and an
+// expunge as imapd and smtpd make them
+func TestSync(t *testing.T) {
+	primary, standby := t.TempDir(), t.TempDir()
+	ts := httptest.NewTLSServer(NewStandby(standby, "secret").srv.Handler)
+	defer ts.Close()
+	p := NewPrimary(primary, ts.URL, "secret", time.Second)
+	p.client = ts.Client()
+
+	inbox := filepath.Join(primary, "example.com", "mark", "INBOX")
+	write := func(name, data string, perm os.FileMode) {
+		if err := os.MkdirAll(inbox, 0700); err != nil {
+			t.Fatal(err)
+		}
+		tmp := filepath.Join(inbox, ".tmp-"+name)
+		if err := os.WriteFile(tmp, []byte(data), perm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, filepath.Join(inbox, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(step string) {
+		if err := p.Sync(); err != nil {
+			t.Fatalf("%s: Sync e=%v", step, err)
+		}
+		want, _ := Scan(primary, nil)
+		have, _ := Scan(standby, nil)
+		if ops := diff(want, have); len(ops) > 0 {
+			t.Errorf("%s: standby differs %+v", step, ops)
+		}
+		if _, err := os.Stat(filepath.Join(standby, "example.com", "mark", ".index")); !os.IsNotExist(err) {
+			t.Errorf("%s: .index replicated", step)
+		}
+	}
+
+	write("1700000000_1.eml", "Subject: one\r\n\r\n", 0400)
+	write("1700000000_1.eml.flags", "\\Seen", 0600)
+	write(".uidnext", "2", 0600)
+	write(".lock", "", 0600)
+	os.MkdirAll(filepath.Join(primary, "example.com", "mark", ".index"), 0700)
+	check("initial")
+
+	write("1700000100_2.eml", "Subject: two\r\n\r\n", 0400)
+	write(".uidnext", "3", 0600)
+	check("delivery")
+
+	write("1700000000_1.eml.flags", "\\Seen\n\\Flagged", 0600)
+	check("flags")
+
+	os.Remove(filepath.Join(inbox, "1700000000_1.eml"))
+	os.Remove(filepath.Join(inbox, "1700000000_1.eml.flags"))
+	check("expunge")
+
+	os.RemoveAll(inbox)
+	check("delete mailbox")
+
+	p = NewPrimary(primary, ts.URL, "wrong", time.Second)
+	p.client = ts.Client()
+	if err := p.Sync(); err == nil {
+		t.Error("Sync with a wrong token allowed")
+	}
+}
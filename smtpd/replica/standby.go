@@ -0,0 +1,149 @@
+package replica
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mpdroog/mymail/smtpd/logging"
+	"github.com/mpdroog/mymail/smtpd/storage"
+)
+
+// Standby receives the changes of a primary into its mail_dir. imapd can run
+// on it to read the copy, but nothing else should write the mail_dir until
+// it's promoted by turning replica_listen off.
+type Standby struct {
+	root  string
+	token string
+	srv   *http.Server
+}
+
+func NewStandby(root, token string) *Standby {
+	s := &Standby{root: root, token: token}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /manifest", s.handleManifest)
+	mux.HandleFunc("POST /apply", s.handleApply)
+	s.srv = &http.Server{Handler: s.authorize(mux)}
+	return s
+}
+
+func (s *Standby) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, s.token) {
+			log.Printf("Replica unauthorized request from %s", r.RemoteAddr)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Start receives on addr, over TLS only as whole mailboxes go over the wire
+func (s *Standby) Start(addr, certFile, keyFile string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("Replica standby listening on %s", addr)
+
+	go func() {
+		if err := s.srv.ServeTLS(listener, certFile, keyFile); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf(logging.Err+"Replica serve e=%v", err)
+		}
+	}()
+	return nil
+}
+
+func (s *Standby) Stop() error {
+	return s.srv.Close()
+}
+
+func (s *Standby) handleManifest(w http.ResponseWriter, r *http.Request) {
+	m, err := Scan(s.root, nil)
+	if err != nil {
+		log.Printf(logging.Err+"handleManifest e=%v", err)
+		http.Error(w, "Failed to scan", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m)
+}
+
+func (s *Standby) handleApply(w http.ResponseWriter, r *http.Request) {
+	n, err := s.apply(bufio.NewReader(r.Body))
+	if err != nil {
+		log.Printf(logging.Err+"handleApply e=%v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n > 0 {
+		log.Printf("Replica applied %d changes", n)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apply carries out the ops of an /apply stream and returns how many
+func (s *Standby) apply(r *bufio.Reader) (int, error) {
+	n := 0
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+		var o op
+		if err := json.Unmarshal(line, &o); err != nil {
+			return n, err
+		}
+		if !filepath.IsLocal(filepath.FromSlash(o.Path)) {
+			return n, fmt.Errorf("invalid path %q", o.Path)
+		}
+		path := filepath.Join(s.root, filepath.FromSlash(o.Path))
+
+		switch o.Op {
+		case "mkdir":
+			err = os.MkdirAll(path, 0700)
+		case "put":
+			err = s.put(path, o.Entry, r)
+		case "remove":
+			err = os.RemoveAll(path)
+		default:
+			err = fmt.Errorf("unknown op %q", o.Op)
+		}
+		if err != nil {
+			return n, fmt.Errorf("%s %s: %v", o.Op, o.Path, err)
+		}
+		n++
+	}
+}
+
+// put replaces path with the next e.Size bytes of r, keeping the mode and
+// mtime of the primary's file
+func (s *Standby) put(path string, e Entry, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	lr := &io.LimitedReader{R: r, N: e.Size}
+	tmp, err := storage.WriteTemp(filepath.Dir(path), lr, e.Mode.Perm())
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	if lr.N > 0 {
+		return io.ErrUnexpectedEOF
+	}
+	mtime := time.Unix(0, e.Mtime)
+	if err := os.Chtimes(tmp, mtime, mtime); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
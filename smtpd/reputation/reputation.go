@@ -0,0 +1,122 @@
+// Package reputation recognizes remote rejections that are about the
+// sending server rather than the recipient, a throttle, a blocklist or
+// failed authentication, and pauses delivery to the destination so a
+// provider that distrusts us isn't hammered further.
+package reputation
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Categories of rejections
+const (
+	RateLimit      = "rate-limit"
+	Blocklist      = "blocklist"
+	Authentication = "authentication"
+	Content        = "content"
+)
+
+// maxPause caps the doubling of pauses of a destination that keeps rejecting
+const maxPause = 24 * time.Hour
+
+// Hint is what a rejection tells about our reputation and what to do about it
+type Hint struct {
+	Category    string `json:"category"`
+	Provider    string `json:"provider"` // Whose wording matched, "" for generic ones
+	Remediation string `json:"remediation"`
+}
+
+type pattern struct {
+	re   *regexp.Regexp // On the lowercase reply text
+	hint Hint
+}
+
+// patterns are tried in order, provider specific ones first
+var patterns = []pattern{
+	{regexp.MustCompile(`4\.7\.28|unusual rate of unsolicited`), Hint{RateLimit, "gmail",
+		"Gmail throttles the sending IP for unsolicited mail, lower the volume and check Postmaster Tools at https://postmaster.google.com"}},
+	{regexp.MustCompile(`5\.7\.2[356]|not pass authentication|unauthenticated|dmarc`), Hint{Authentication, "",
+		"Mail failed authentication, check the PTR of the sending IP and SPF, DKIM (mymail dkim dns) and DMARC of the sending domain"}},
+	{regexp.MustCompile(`likely unsolicited mail|likely suspicious due to the very low reputation`), Hint{Content, "gmail",
+		"Gmail rates the mail as spam, check complaint rates in Postmaster Tools at https://postmaster.google.com"}},
+	{regexp.MustCompile(`\bs3150\b|\bs3140\b|\bs3113\b|banned sending ip`), Hint{Blocklist, "outlook",
+		"Microsoft blocks the sending IP, request delisting at https://sender.office.com"}},
+	{regexp.MustCompile(`\btss?0[1-4]\b`), Hint{RateLimit, "yahoo",
+		"Yahoo defers mail of the sending IP for complaints or volume, see https://senders.yahooinc.com/smtp-error-codes"}},
+	{regexp.MustCompile(`spamhaus`), Hint{Blocklist, "spamhaus",
+		"The sending IP or domain is on a Spamhaus list, look it up and request removal at https://check.spamhaus.org"}},
+	{regexp.MustCompile(`block ?list|black ?list|\blisted\b|\brbl\b|\bdnsbl\b`), Hint{Blocklist, "",
+		"The sending IP is on a blocklist, the rejection names which, request removal there"}},
+	{regexp.MustCompile(`rate limit|too many (messages|connections)`), Hint{RateLimit, "",
+		"The destination throttles the sending IP, delivery to it is slowed down"}},
+	{regexp.MustCompile(`\bspam\b|unsolicited`), Hint{Content, "",
+		"The destination rates the mail as spam, check its content and the complaint rate"}},
+}
+
+// Classify returns the hint of an SMTP reply, false when the reply isn't
+// about reputation (unknown user, full mailbox) or there was none
+func Classify(code int, text string) (Hint, bool) {
+	if code < 400 {
+		return Hint{}, false
+	}
+	text = strings.ToLower(text)
+	for _, p := range patterns {
+		if p.re.MatchString(text) {
+			return p.hint, true
+		}
+	}
+	return Hint{}, false
+}
+
+// pause of a destination
+type pause struct {
+	until    time.Time
+	duration time.Duration
+}
+
+var (
+	mu     sync.Mutex
+	paused = make(map[string]*pause)
+)
+
+// Pause stops delivery to domain for d after a rejection, doubled when it
+// rejected again within a day after the last pause. It returns the end of
+// the pause and whether one started, hits during a pause don't extend it.
+func Pause(domain string, d time.Duration, now time.Time) (time.Time, bool) {
+	domain = strings.ToLower(domain)
+	mu.Lock()
+	defer mu.Unlock()
+
+	p := paused[domain]
+	if p != nil && now.Before(p.until) {
+		return p.until, false
+	}
+	if p != nil && now.Sub(p.until) < maxPause {
+		d = min(2*p.duration, maxPause)
+	}
+	paused[domain] = &pause{until: now.Add(d), duration: d}
+	return now.Add(d), true
+}
+
+// Paused returns the end of the pause of domain, zero when it isn't paused
+func Paused(domain string, now time.Time) time.Time {
+	mu.Lock()
+	defer mu.Unlock()
+
+	domain = strings.ToLower(domain)
+	p := paused[domain]
+	if p == nil {
+		return time.Time{}
+	}
+	if now.Sub(p.until) >= maxPause {
+		// Quiet for a day, the next pause starts over
+		delete(paused, domain)
+	}
+	if now.Before(p.until) {
+		return p.until
+	}
+	return time.Time{}
+}
@@ -0,0 +1,49 @@
+package reputation
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClassify(t *testing.T) {
+	patterns := map[string]string{
+		"421-4.7.28 [1.2.3.4] Our system has detected an unusual rate of unsolicited mail":                 RateLimit,
+		"550-5.7.26 Unauthenticated email from example.com is not accepted due to domain's DMARC policy":   Authentication,
+		"550-5.7.1 Our system has detected that this message is likely unsolicited mail":                   Content,
+		"550 5.7.1 Unfortunately, messages from [1.2.3.4] weren't sent. (S3150) [AM0PR01.eop.outlook.com]": Blocklist,
+		"421 4.7.0 [TSS04] Messages from 1.2.3.4 temporarily deferred":                                     RateLimit,
+		"554 5.7.1 Service unavailable; Client host [1.2.3.4] blocked using zen.spamhaus.org":              Blocklist,
+		"550 5.1.1 <a@example.com>: Recipient address rejected: User unknown":                              "",
+		"452 4.2.2 Mailbox full":                       "",
+		"450 4.2.0 Greylisted, please try again later": "",
+	}
+	for text, expect := range patterns {
+		hint, ok := Classify(550, text)
+		if hint.Category != expect || ok != (expect != "") {
+			t.Errorf("Classify(%q)=%s expect=%s", text, hint.Category, expect)
+		}
+	}
+	if _, ok := Classify(0, "dial tcp: spamhaus"); ok {
+		t.Errorf("Classify without a reply")
+	}
+}
+
+func TestPause(t *testing.T) {
+	now := time.Now()
+	pause := func(at time.Duration, expect time.Duration, started bool) {
+		t.Helper()
+		until, ok := Pause("Example.com", time.Hour, now.Add(at))
+		if ok != started || !until.Equal(now.Add(expect)) {
+			t.Fatalf("Pause(+%s)=+%s,%v expect=+%s,%v", at, until.Sub(now), ok, expect, started)
+		}
+	}
+	pause(0, time.Hour, true)
+	pause(time.Minute, time.Hour, false)
+	if Paused("example.com", now.Add(time.Minute)).IsZero() || !Paused("example.org", now).IsZero() {
+		t.Errorf("Paused")
+	}
+	// Rejected again right after, twice as long
+	pause(time.Hour, 3*time.Hour, true)
+	// Quiet for a day, starts over
+	pause(30*time.Hour, 31*time.Hour, true)
+}
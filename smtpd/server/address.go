@@ -0,0 +1,164 @@
+package server
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	errPathSyntax   = errors.New("Syntax error in path")
+	errLocalSyntax  = errors.New("Syntax error in local part")
+	errDomainSyntax = errors.New("Syntax error in domain")
+)
+
+// parsePath parses the argument of MAIL FROM: / RCPT TO: (RFC5321 4.1.2)
+// into the mailbox and the raw ESMTP parameters after it. The local part
+// keeps its case, the domain is lowercased. A null path "<>" returns "".
+func parsePath(arg, keyword string) (string, string, error) {
+	if len(arg) < len(keyword) || !strings.EqualFold(arg[:len(keyword)], keyword) {
+		return "", "", errPathSyntax
+	}
+	// Tolerate "MAIL FROM: <a@b>", a common client deviation
+	arg = strings.TrimLeft(arg[len(keyword):], " ")
+
+	if !strings.HasPrefix(arg, "<") {
+		return "", "", errPathSyntax
+	}
+	end := pathEnd(arg)
+	if end == -1 {
+		return "", "", errPathSyntax
+	}
+	path, params := arg[1:end], arg[end+1:]
+	if params != "" && params[0] != ' ' {
+		return "", "", errPathSyntax
+	}
+	params = strings.TrimSpace(params)
+
+	if path == "" {
+		return "", params, nil
+	}
+
+	// Source routes ("@a,@b:user@c") are obsolete and MUST be ignored
+	if path[0] == '@' {
+		i := strings.IndexByte(path, ':')
+		if i == -1 {
+			return "", "", errPathSyntax
+		}
+		path = path[i+1:]
+	}
+
+	mailbox, err := parseMailbox(path)
+	if err != nil {
+		return "", "", err
+	}
+	return mailbox, params, nil
+}
+
+// pathEnd returns the index of the '>' closing the path, skipping quoted strings
+func pathEnd(arg string) int {
+	quoted := false
+	for i := 1; i < len(arg); i++ {
+		switch {
+		case quoted && arg[i] == '\\':
+			i++
+		case arg[i] == '"':
+			quoted = !quoted
+		case !quoted && arg[i] == '>':
+			return i
+		}
+	}
+	return -1
+}
+
+// parseMailbox validates Local-part "@" ( Domain / address-literal )
+func parseMailbox(s string) (string, error) {
+	at := strings.LastIndexByte(s, '@')
+	if at <= 0 {
+		return "", errPathSyntax
+	}
+	local, domain := s[:at], s[at+1:]
+
+	if !validLocalPart(local) {
+		return "", errLocalSyntax
+	}
+	if !validDomain(domain) {
+		return "", errDomainSyntax
+	}
+	return local + "@" + strings.ToLower(domain), nil
+}
+
+func validLocalPart(local string) bool {
+	if len(local) > 64 || !utf8.ValidString(local) {
+		return false
+	}
+
+	// Quoted-string, qtextSMTP or quoted-pairSMTP
+	if strings.HasPrefix(local, "\"") {
+		if len(local) < 2 || !strings.HasSuffix(local, "\"") {
+			return false
+		}
+		q := local[1 : len(local)-1]
+		for i := 0; i < len(q); i++ {
+			c := q[i]
+			if c == '\\' {
+				i++
+				if i == len(q) || q[i] < 32 || q[i] > 126 {
+					return false
+				}
+				continue
+			}
+			if c == '"' || c < 32 || c == 127 {
+				return false
+			}
+		}
+		return true
+	}
+
+	// Dot-string
+	for _, atom := range strings.Split(local, ".") {
+		if atom == "" {
+			return false
+		}
+		for _, r := range atom {
+			if !isAtext(r) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// isAtext reports RFC5322 atext, UTF-8 is allowed for SMTPUTF8 (RFC6531)
+func isAtext(r rune) bool {
+	if r >= 0x80 {
+		return true
+	}
+	if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-/=?^_`{|}~", r)
+}
+
+func validDomain(domain string) bool {
+	if domain == "" || len(domain) > 255 {
+		return false
+	}
+
+	// address-literal, e.g. [192.0.2.1] or [IPv6:2001:db8::1]
+	if domain[0] == '[' {
+		return domain[len(domain)-1] == ']' && len(domain) > 2
+	}
+
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, r := range label {
+			if r < 0x80 && !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestParsePath(t *testing.T) {
+	type result struct {
+		addr   string
+		params string
+		valid  bool
+	}
+	patterns := map[string]result{
+		"FROM:<a@b.nl>":                        {"a@b.nl", "", true},
+		"from: <Mark@Example.COM>":             {"Mark@example.com", "", true},
+		"FROM:<>":                              {"", "", true},
+		"FROM:<a@b.nl> SIZE=123 BODY=8BITMIME": {"a@b.nl", "SIZE=123 BODY=8BITMIME", true},
+		"FROM:<@relay.nl,@x.nl:a@b.nl>":        {"a@b.nl", "", true},
+		`FROM:<"john doe"@b.nl>`:               {`"john doe"@b.nl`, "", true},
+		`FROM:<"a>b"@b.nl>`:                    {`"a>b"@b.nl`, "", true},
+		"FROM:<a@[192.0.2.1]>":                 {"a@[192.0.2.1]", "", true},
+		"FROM:a@b.nl":                          {"", "", false},
+		"FROM:<a@b.nl>SIZE=1":                  {"", "", false},
+		"FROM:<a@b.nl SIZE=1>":                 {"", "", false},
+		"FROM:<a..b@b.nl>":                     {"", "", false},
+		"FROM:<a@-b.nl>":                       {"", "", false},
+		"FROM:<a@b.nl":                         {"", "", false},
+		"TO:<a@b.nl>":                          {"", "", false},
+	}
+	for pattern, expect := range patterns {
+		addr, params, err := parsePath(pattern, "FROM:")
+		if !expect.valid {
+			if err == nil {
+				t.Errorf("Invalid but pattern accepted: %s", pattern)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Valid but pattern invalid: %s e=%v", pattern, err)
+			continue
+		}
+		if addr != expect.addr || params != expect.params {
+			t.Errorf("parsePath(%s)=%q,%q expect=%q,%q", pattern, addr, params, expect.addr, expect.params)
+		}
+	}
+}
+
+func TestPtrName(t *testing.T) {
+	patterns := map[string]string{
+		"mail.example.com.":          "mail.example.com",
+		"mail.example.com":           "mail.example.com",
+		"mail.example.com\r\nX-Y: z": "invalid",
+		"a; country=NL":              "invalid",
+		`a"b.example.com`:            "invalid",
+		"[192.0.2.1]":                "invalid",
+		"mäil.example.com":           "invalid",
+		"":                           "invalid",
+	}
+	for name, expect := range patterns {
+		if out := ptrName(name); out != expect {
+			t.Errorf("ptrName(%q)=%s expect=%s", name, out, expect)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mpdroog/mymail/smtpd/config"
+	"github.com/mpdroog/mymail/smtpd/storage"
+)
+
+// step is what the client sends in one write, several pipelined commands
+// at once, and the reply codes it expects back in order
+type step struct {
+	send   string
+	expect []int
+}
+
+// startConformance runs a server on a random local port with its mail in a
+// temp dir and returns the address
+func startConformance(t *testing.T) string {
+	config.C.Hostname = "localhost"
+	config.C.LocalDomains = []string{"example.com"}
+	config.C.MailDir, config.C.QueueDir = t.TempDir(), t.TempDir()
+	config.C.MaxSize, config.C.MaxRecipients, config.C.MaxConnections = 1<<20, 10, 10
+	config.C.MaxHeaderSize, config.C.MaxHeaderLine, config.C.MaxReceived = 64*1024, 4096, 50
+	t.Cleanup(func() { config.C.MailDir, config.C.QueueDir, config.C.LocalDomains = "", "", nil })
+
+	s := New()
+	s.SetStorage(storage.New())
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.listeners = []*listener{{Listener: l, hostname: config.C.Hostname}}
+	s.startDeliveries()
+	go s.acceptLoop(s.listeners[0])
+	t.Cleanup(func() { s.Stop() })
+	return l.Addr().String()
+}
+
+// dialogue runs steps on a new connection and reports replies that differ
+func dialogue(t *testing.T, addr, name string, steps []step) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := textproto.NewConn(conn)
+
+	if code, msg, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s: greeting %d %s e=%v", name, code, msg, err)
+	}
+	for _, st := range steps {
+		if _, err := conn.Write([]byte(st.send)); err != nil {
+			t.Fatalf("%s: write %q e=%v", name, st.send, err)
+		}
+		for _, expect := range st.expect {
+			code, msg, _ := c.ReadResponse(0)
+			if code != expect {
+				t.Errorf("%s: %q got %d %s, expect %d", name, st.send, code, msg, expect)
+				return
+			}
+		}
+	}
+}
+
+// TestConformance drives RFC5321 edge cases through a live listener
+func TestConformance(t *testing.T) {
+	addr := startConformance(t)
+
+	ehlo := step{"EHLO localhost\r\n", []int{250}}
+	mail := step{"MAIL FROM:<a@example.org>\r\n", []int{250}}
+	rcpt := step{"RCPT TO:<mark@example.com>\r\n", []int{250}}
+	patterns := map[string][]step{
+		"mail before ehlo":  {{"MAIL FROM:<a@example.org>\r\n", []int{503}}},
+		"rcpt before mail":  {ehlo, {"RCPT TO:<mark@example.com>\r\n", []int{503}}},
+		"data before rcpt":  {ehlo, mail, {"DATA\r\n", []int{503}}},
+		"unknown command":   {ehlo, {"VRFY mark\r\n", []int{502}}, {"NOOP\r\n", []int{250}}},
+		"ehlo wrong domain": {{"EHLO example.net\r\n", []int{501}}, {"MAIL FROM:<a@example.org>\r\n", []int{503}}},
+		"helo":              {{"HELO client.example.org\r\n", []int{250}}, mail, rcpt},
+		"relay denied":      {ehlo, mail, {"RCPT TO:<b@example.net>\r\n", []int{550}}, {"DATA\r\n", []int{503}}},
+		"rset clears transaction": {ehlo, mail, rcpt, {"RSET\r\n", []int{250}},
+			{"DATA\r\n", []int{503}}, {"RCPT TO:<mark@example.com>\r\n", []int{503}}},
+		"rset keeps helo":     {ehlo, {"RSET\r\n", []int{250}}, mail},
+		"rset before helo":    {{"RSET\r\n", []int{250}}, {"MAIL FROM:<a@example.org>\r\n", []int{503}}},
+		"mail twice restarts": {ehlo, mail, rcpt, mail, {"DATA\r\n", []int{503}}},
+		"data then new transaction": {ehlo, mail, rcpt, {"DATA\r\n", []int{354}},
+			{"Subject: one\r\n\r\none\r\n.\r\n", []int{250}}, {"DATA\r\n", []int{503}}, mail, rcpt},
+		"null sender": {ehlo, {"MAIL FROM:<>\r\n", []int{250}}, rcpt},
+		"8bitmime": {ehlo, {"MAIL FROM:<a@example.org> BODY=8BITMIME\r\n", []int{250}}, rcpt,
+			{"DATA\r\n", []int{354}}, {"Subject: caf\xc3\xa9\r\n\r\nna\xc3\xafve\r\n.\r\n", []int{250}}},
+		"unknown body":     {ehlo, {"MAIL FROM:<a@example.org> BODY=9BIT\r\n", []int{555}}},
+		"non-ascii sender": {ehlo, {"MAIL FROM:<j\xc3\xb8rn@example.org>\r\n", []int{553}}},
+		"smtputf8":         {ehlo, {"MAIL FROM:<j\xc3\xb8rn@example.org> SMTPUTF8\r\n", []int{250}}, rcpt},
+		"pipelining": {ehlo, {"MAIL FROM:<a@example.org>\r\nRCPT TO:<mark@example.com>\r\nRCPT TO:<b@example.net>\r\nDATA\r\n",
+			[]int{250, 250, 550, 354}}, {"Subject: hi\r\n\r\nhi\r\n.\r\nQUIT\r\n", []int{250, 221}}},
+		"bare lf in data": {ehlo, mail, rcpt, {"DATA\r\n", []int{354}},
+			{"Subject: hi\r\n\r\nhi\n.\r\n", []int{554}}, {"NOOP\r\n", []int{250}}},
+		"quit": {ehlo, mail, {"QUIT\r\n", []int{221}}},
+	}
+	for name, steps := range patterns {
+		dialogue(t, addr, name, steps)
+	}
+}
+
+// TestConformanceRoundTrip checks the stored message is what the client
+// meant to send, with dot-stuffing undone and 8-bit bytes untouched
+func TestConformanceRoundTrip(t *testing.T) {
+	addr := startConformance(t)
+
+	body := "Subject: caf\xc3\xa9\r\n\r\n.leading dot\r\n..two dots\r\n.\tdot tab\r\n\r\nlast\r\n"
+	stuffed := "Subject: caf\xc3\xa9\r\n\r\n..leading dot\r\n...two dots\r\n..\tdot tab\r\n\r\nlast\r\n"
+	dialogue(t, addr, "round trip", []step{
+		{"EHLO localhost\r\n", []int{250}},
+		{"MAIL FROM:<a@example.org> BODY=8BITMIME\r\n", []int{250}},
+		{"RCPT TO:<mark@example.com>\r\n", []int{250}},
+		{"DATA\r\n", []int{354}},
+		{stuffed + ".\r\n", []int{250}},
+	})
+
+	files, _ := filepath.Glob(filepath.Join(config.C.MailDir, "example.com", "mark", "INBOX", "*.eml"))
+	if len(files) != 1 {
+		t.Fatalf("stored %d messages, expect 1", len(files))
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != body {
+		t.Errorf("stored %q, expect %q", data, body)
+	}
+}
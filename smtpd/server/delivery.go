@@ -0,0 +1,112 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/mpdroog/mymail/smtpd/config"
+	"github.com/mpdroog/mymail/smtpd/stats"
+)
+
+// errBusy is returned by ProcessEmail when the delivery queue is full, the
+// session answers 452 so the client retries later
+var errBusy = errors.New("local delivery queue full")
+
+// delivery is one message for the local recipients of a transaction
+type delivery struct {
+	from       string
+	recipients []string
+	data       []byte
+	done       chan error
+}
+
+// deliveryPool bounds the number of concurrent mailbox writes, sessions hand
+// their message to a worker and only answer 250 once it is stored
+type deliveryPool struct {
+	mu     sync.RWMutex
+	closed bool
+	queue  chan *delivery
+	wg     sync.WaitGroup
+}
+
+func (s *Server) startDeliveries() {
+	workers := config.C.DeliveryWorkers
+	if workers <= 0 {
+		workers = 4
+	}
+	size := config.C.DeliveryQueue
+	if size <= 0 {
+		size = 100
+	}
+
+	p := &deliveryPool{queue: make(chan *delivery, size)}
+	for i := 0; i < workers; i++ {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for d := range p.queue {
+				d.done <- s.storeLocal(d.from, d.recipients, d.data)
+			}
+		}()
+	}
+	s.deliveries = p
+}
+
+// stopDeliveries finishes the queued deliveries, later ones are stored inline
+func (s *Server) stopDeliveries() {
+	p := s.deliveries
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.closed = true
+	close(p.queue)
+	p.mu.Unlock()
+	p.wg.Wait()
+}
+
+// deliverLocal stores data for the local recipients through the pool, or
+// inline when the server isn't running (admin API during shutdown, tests)
+func (s *Server) deliverLocal(from string, recipients []string, data []byte) error {
+	p := s.deliveries
+	if p == nil {
+		return s.storeLocal(from, recipients, data)
+	}
+
+	d := &delivery{from: from, recipients: recipients, data: data, done: make(chan error, 1)}
+	p.mu.RLock()
+	if p.closed {
+		p.mu.RUnlock()
+		return s.storeLocal(from, recipients, data)
+	}
+	select {
+	case p.queue <- d:
+		p.mu.RUnlock()
+	default:
+		p.mu.RUnlock()
+		log.Printf("deliverLocal: queue full, deferring mail from %s", from)
+		return errBusy
+	}
+	return <-d.done
+}
+
+func (s *Server) storeLocal(from string, recipients []string, data []byte) error {
+	// Large attachments are detached once for all recipients
+	local := s.storage.DetachAttachments(data, recipients)
+	senderDomain, _ := getDomain(from)
+	// One copy per physical mailbox, the per-user INBOX, for To+Cc
+	// duplicates and addresses sharing a maildir
+	delivered := make(map[string]bool)
+	for _, recipient := range recipients {
+		if inbox := s.storage.Inbox(recipient); !delivered[inbox] {
+			if err := s.storage.StoreLocal(recipient, from, local); err != nil {
+				return err
+			}
+			delivered[inbox] = true
+			s.checkQuota(recipient, int64(len(local)))
+		}
+		stats.Record(stats.Received, recipient, senderDomain)
+	}
+	return nil
+}
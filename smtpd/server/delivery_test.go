@@ -0,0 +1,71 @@
+package server
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mpdroog/mymail/smtpd/config"
+	"github.com/mpdroog/mymail/smtpd/storage"
+	"github.com/mpdroog/mymail/smtpd/users"
+)
+
+// TestDeliverLocalBusy checks a full delivery queue is refused instead of
+// blocking the session
+func TestDeliverLocalBusy(t *testing.T) {
+	s := New()
+	s.deliveries = &deliveryPool{queue: make(chan *delivery, 1)}
+	s.deliveries.queue <- &delivery{}
+
+	if err := s.deliverLocal("a@example.org", []string{"b@example.com"}, nil); !errors.Is(err, errBusy) {
+		t.Errorf("deliverLocal e=%v, expect errBusy", err)
+	}
+}
+
+// TestStoreLocalOnce checks recipients sharing a mailbox get one copy, and
+// every user of a domain gets their own
+func TestStoreLocalOnce(t *testing.T) {
+	config.C.MailDir = t.TempDir()
+	defer func() { config.C.MailDir = "" }()
+	s := New()
+	s.SetStorage(storage.New())
+
+	rcpts := []string{"mark@example.com", "Mark@example.com", "anna@example.com", "mark@example.org"}
+	if err := s.storeLocal("a@example.net", rcpts, []byte("Subject: hi\r\n\r\nhi\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	patterns := map[string]int{"example.com/mark": 1, "example.com/anna": 1, "example.org/mark": 1}
+	for dir, expect := range patterns {
+		files, _ := filepath.Glob(filepath.Join(config.C.MailDir, dir, "INBOX", "*.eml"))
+		if len(files) != expect {
+			t.Errorf("%s: %d copies, expect %d", dir, len(files), expect)
+		}
+	}
+}
+
+// TestQuota checks a full mailbox is refused, counting deliveries between
+// scans of the maildir
+func TestQuota(t *testing.T) {
+	config.C.MailDir = t.TempDir()
+	config.C.QuotaWarning = -1
+	config.C.LocalDomains = []string{"example.com"}
+	defer func() { config.C.MailDir, config.C.QuotaWarning, config.C.LocalDomains = "", 0, nil }()
+	s := New()
+	s.SetStorage(storage.New())
+	s.users = map[string]*users.Account{"mark": {Quota: "1KB"}}
+
+	if s.overQuota("mark@example.com", 100) {
+		t.Fatalf("empty mailbox over quota")
+	}
+	msg := []byte("Subject: hi\r\n\r\n" + strings.Repeat("x", 900) + "\r\n")
+	if err := s.storeLocal("a@example.net", []string{"mark@example.com"}, msg); err != nil {
+		t.Fatal(err)
+	}
+	if !s.overQuota("mark@example.com", 200) {
+		t.Errorf("delivery not counted")
+	}
+	if s.overQuota("anna@example.com", 1<<20) {
+		t.Errorf("account without quota refused")
+	}
+}
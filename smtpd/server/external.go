@@ -0,0 +1,48 @@
+package server
+
+import (
+	"log"
+	"net"
+
+	"github.com/mpdroog/mymail/smtpd/config"
+	"github.com/mpdroog/mymail/smtpd/lockout"
+	"github.com/mpdroog/mymail/smtpd/logging"
+)
+
+// setExternal remembers the account the transport vouches for (client
+// certificate or unix socket peer). The client logs in as it with AUTH
+// EXTERNAL, or implicitly on MAIL without AUTH.
+func (s *Session) setExternal(user, source string) {
+	if user == "" {
+		return
+	}
+	if !s.server.hasUser(user) {
+		log.Printf("%s of %s maps to unknown account %s", source, s.remoteAddr, user)
+		return
+	}
+	s.external = user
+	log.Printf("%s of %s maps to %s", source, s.remoteAddr, user)
+}
+
+// authenticatePeer takes the account socket_users maps the peer's system
+// user to as the transport identity
+func (s *Session) authenticatePeer(conn *net.UnixConn) {
+	name, err := peerName(conn)
+	if err != nil {
+		log.Printf(logging.Err+"peerName e=%v", err)
+		return
+	}
+	s.setExternal(config.C.SocketUsers[name], "Unix socket peer "+name)
+}
+
+// loginExternal authenticates the session as the transport identity unless
+// the account is locked
+func (s *Session) loginExternal() {
+	if until := lockout.Locked(config.C.LockoutDir, s.external); !until.IsZero() {
+		log.Printf(logging.Warning+"Login for %s from %s refused, locked until %s", s.external, s.remoteAddr, until)
+		return
+	}
+	log.Printf("Login for %s from %s by transport identity", s.external, s.remoteAddr)
+	s.auth = true
+	s.setUser(s.external)
+}
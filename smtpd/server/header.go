@@ -0,0 +1,106 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/mpdroog/mymail/smtpd/dns"
+	"github.com/mpdroog/mymail/smtpd/geoip"
+)
+
+// verdictField is the header saying why a message was held or tagged, it's
+// removed from received mail so only smtpd's own can reach a mailbox
+const verdictField = "X-MyMail-Verdict"
+
+// replaceHeader replaces the fields called name in the header of data,
+// including folded lines, with line at the position of the first. An empty
+// line only removes them.
+func replaceHeader(data []byte, name, line string) []byte {
+	var out bytes.Buffer
+	skip, done := false, false
+	rest := data
+	for len(rest) > 0 {
+		end := bytes.IndexByte(rest, '\n') + 1
+		if end == 0 {
+			end = len(rest)
+		}
+		field := rest[:end]
+		rest = rest[end:]
+
+		if len(bytes.TrimRight(field, "\r\n")) == 0 {
+			// End of header
+			out.Write(field)
+			out.Write(rest)
+			break
+		}
+		if skip && (field[0] == ' ' || field[0] == '\t') {
+			continue
+		}
+		skip = false
+		key, _, _ := strings.Cut(string(field), ":")
+		if strings.EqualFold(strings.TrimSpace(key), name) {
+			skip = true
+			if !done {
+				out.WriteString(line)
+				done = true
+			}
+			continue
+		}
+		out.Write(field)
+	}
+	return out.Bytes()
+}
+
+// connectionInfo is the X-Connection-Info field for the client of the
+// session, "" when it didn't connect over IP
+func (s *Session) connectionInfo() string {
+	if s.connInfo != "" {
+		return s.connInfo
+	}
+	host, _, err := net.SplitHostPort(s.remoteAddr)
+	ip := net.ParseIP(host)
+	if err != nil || ip == nil {
+		return ""
+	}
+
+	info := "ip=" + ip.String()
+	ptr := "none"
+	if names, err := dns.LookupAddr(ip.String()); err == nil && len(names) > 0 {
+		ptr = ptrName(names[0])
+	}
+	info += "; ptr=" + ptr
+	g := geoip.Lookup(ip)
+	if g.ASN != 0 {
+		info += fmt.Sprintf("; asn=%d", g.ASN)
+		if org := headerSafe(g.Org); org != "" {
+			info += fmt.Sprintf("; as-org=%q", org)
+		}
+	}
+	if g.Country != "" {
+		info += "; country=" + headerSafe(g.Country)
+	}
+	s.connInfo = "X-Connection-Info: " + info + "\r\n"
+	return s.connInfo
+}
+
+// ptrName is name as it goes into X-Connection-Info, "invalid" unless it's
+// a plain hostname. The client controls its PTR record.
+func ptrName(name string) string {
+	name = strings.TrimSuffix(name, ".")
+	if !validDomain(name) || strings.HasPrefix(name, "[") || headerSafe(name) != name {
+		return "invalid"
+	}
+	return name
+}
+
+// headerSafe drops what could end or break out of a quoted header value
+func headerSafe(v string) string {
+	return strings.Map(func(r rune) rune {
+		if r < ' ' || r == '"' || r == '\\' || r > '~' {
+			return -1
+		}
+		return r
+	}, v)
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"bytes"
+	"log"
+	"net/mail"
+
+	"github.com/mpdroog/mymail/smtpd/config"
+	"github.com/mpdroog/mymail/smtpd/users"
+)
+
+// checkFrom applies config.C.FromPolicy to the header From of a submission,
+// so an authenticated user can't send as a colleague. It returns the
+// message to deliver, with From rewritten when the policy says so.
+func (s *Session) checkFrom(data []byte) ([]byte, *smtpError) {
+	if config.C.FromPolicy == "allow" {
+		return data, nil
+	}
+	username := s.username()
+	acct := s.server.account(username)
+	if acct == nil {
+		// Socket users without an account, nothing to compare with
+		return data, nil
+	}
+
+	// A message the policy can't be checked on doesn't pass it
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, &smtpError{550, "5.6.0 Malformed message header"}
+	}
+	switch len(msg.Header["From"]) {
+	case 0:
+		return nil, &smtpError{550, "5.6.0 Message has no From header"}
+	case 1:
+	default:
+		return nil, &smtpError{550, "5.6.0 Message has more than one From header"}
+	}
+	from, err := msg.Header.AddressList("From")
+	if err != nil || len(from) == 0 {
+		return nil, &smtpError{550, "5.7.1 Invalid From header"}
+	}
+	allowed := true
+	for _, a := range from {
+		if !acct.CanSendAs(username, a.Address) {
+			allowed = false
+		}
+	}
+	if allowed {
+		return data, nil
+	}
+
+	if config.C.FromPolicy == "rewrite" {
+		own := &mail.Address{Name: from[0].Name, Address: users.Address(username)}
+		log.Printf("Rewrote From %s of %s to %s", msg.Header.Get("From"), username, own.Address)
+		return rewriteFrom(data, own.String()), nil
+	}
+	log.Printf("Rejected From %s of %s, not one of its identities", msg.Header.Get("From"), username)
+	return nil, &smtpError{550, "5.7.1 Not allowed to send as " + from[0].Address}
+}
+
+// rewriteFrom replaces the From field of the header with from
+func rewriteFrom(data []byte, from string) []byte {
+	return replaceHeader(data, "From", "From: "+from+"\r\n")
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/mpdroog/mymail/smtpd/config"
+	"github.com/mpdroog/mymail/smtpd/users"
+)
+
+func TestRewriteFrom(t *testing.T) {
+	patterns := map[string]struct {
+		msg    string
+		expect string
+	}{
+		"plain":  {"From: boss@example.com\r\nTo: a@example.org\r\n\r\nFrom: body\r\n", "From: <mark@example.com>\r\nTo: a@example.org\r\n\r\nFrom: body\r\n"},
+		"folded": {"Subject: hi\r\nfrom: \"Boss\"\r\n <boss@example.com>\r\nTo: a@example.org\r\n\r\nhi\r\n", "Subject: hi\r\nFrom: <mark@example.com>\r\nTo: a@example.org\r\n\r\nhi\r\n"},
+		"twice":  {"From: a@example.com\r\nFrom: b@example.com\r\n\r\nhi\r\n", "From: <mark@example.com>\r\n\r\nhi\r\n"},
+		"lf":     {"From: boss@example.com\nTo: a@example.org\n\nhi\n", "From: <mark@example.com>\r\nTo: a@example.org\n\nhi\n"},
+	}
+	for name, p := range patterns {
+		if out := string(rewriteFrom([]byte(p.msg), "<mark@example.com>")); out != p.expect {
+			t.Errorf("%s: %q expect=%q", name, out, p.expect)
+		}
+	}
+}
+
+// TestCheckFrom checks a submission passes the from_policy only with one
+// From field of the user's own addresses
+func TestCheckFrom(t *testing.T) {
+	config.C.FromPolicy = "reject"
+	config.C.LocalDomains = []string{"example.com"}
+	srv := New()
+	srv.users["mark"] = &users.Account{Identities: []string{"info@example.com"}}
+	s := &Session{server: srv, user: "mark"}
+
+	patterns := map[string]bool{
+		"From: mark@example.com\r\n\r\nhi\r\n":                           true,
+		"From: Info <info@example.com>\r\n\r\nhi\r\n":                    true,
+		"From: boss@example.com\r\n\r\nhi\r\n":                           false,
+		"Subject: no from\r\n\r\nhi\r\n":                                 false,
+		"From: mark@example.com\r\nFrom: boss@example.com\r\n\r\nhi\r\n": false,
+		"From: <<mark@example.com\r\n\r\nhi\r\n":                         false,
+		"From: mark@example.com, boss@example.com\r\n\r\nhi\r\n":         false,
+		"From: mark@example.com\r\nbroken header line\r\n\r\nhi\r\n":     false,
+	}
+	for msg, ok := range patterns {
+		if _, reject := s.checkFrom([]byte(msg)); (reject == nil) != ok {
+			t.Errorf("checkFrom(%q) reject=%v, expect ok=%v", msg, reject, ok)
+		}
+	}
+}
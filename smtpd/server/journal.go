@@ -0,0 +1,71 @@
+package server
+
+import (
+	"log"
+	"strings"
+
+	"github.com/mpdroog/mymail/smtpd/config"
+	"github.com/mpdroog/mymail/smtpd/journal"
+	"github.com/mpdroog/mymail/smtpd/logging"
+)
+
+// journal copies a message to journal_address once per direction when one
+// of journal_domains is involved, inbound by recipient and outbound by
+// sender domain
+func (s *Server) journal(from string, local, relay []string, data []byte) {
+	if config.C.JournalAddress == "" || len(config.C.JournalDomains) == 0 {
+		return
+	}
+	dir := config.C.JournalDirection
+
+	if dir != "outbound" && len(local) > 0 && journaled(local...) {
+		s.journalCopy("inbound", from, local, data)
+	}
+	if dir != "inbound" && len(relay) > 0 && from != "" && journaled(from) {
+		s.journalCopy("outbound", from, relay, data)
+	}
+}
+
+// journaled reports whether the domain of any of addrs is in journal_domains
+func journaled(addrs ...string) bool {
+	for _, addr := range addrs {
+		domain, err := getDomain(addr)
+		if err != nil {
+			continue
+		}
+		for _, d := range config.C.JournalDomains {
+			if strings.EqualFold(d, domain) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// journalCopy chains the message and delivers the copy straight to storage,
+// not through ProcessEmail so it's never journaled itself. The null sender
+// keeps bounces of a remote archive away from the original sender.
+func (s *Server) journalCopy(direction, from string, to []string, data []byte) {
+	e, err := journal.Append(config.C.JournalChain, journal.Entry{
+		Direction: direction,
+		From:      from,
+		To:        to,
+		Digest:    journal.Digest(data),
+	})
+	if err != nil {
+		log.Printf(logging.Err+"journal.Append e=%v", err)
+		return
+	}
+	archived := journal.Wrap(e, data)
+
+	addr := config.C.JournalAddress
+	domain, _ := getDomain(addr)
+	if s.isLocalDomain(domain) {
+		err = s.storage.StoreLocal(addr, "", archived)
+	} else {
+		err = s.storage.QueueForRelay("", []string{addr}, archived)
+	}
+	if err != nil {
+		log.Printf(logging.Err+"journalCopy(%s) e=%v", addr, err)
+	}
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"crypto/tls"
+	"net"
+
+	"github.com/mpdroog/mymail/smtpd/certstore"
+	"github.com/mpdroog/mymail/smtpd/config"
+)
+
+// listener is an address smtpd serves with the hostname and certificate it
+// presents there
+type listener struct {
+	net.Listener
+	hostname  string
+	tlsConfig *tls.Config // Own certificate first, nil without one
+	implicit  bool        // TLS from the first byte, else STARTTLS
+}
+
+// listen opens listen_addr and the extra listeners. A certificate on
+// listen_addr means implicit TLS, as before listeners existed. Certificates
+// in cert_dir go before the listener's own when the SNI name matches.
+func listen() ([]*listener, error) {
+	confs := append([]config.Listener{{
+		Addr:        config.C.ListenAddr,
+		TLSCert:     config.C.TLSCert,
+		TLSKey:      config.C.TLSKey,
+		ImplicitTLS: config.C.TLSCert != "" && config.C.TLSKey != "",
+	}}, config.C.Listeners...)
+
+	pairs := make([]certstore.Pair, len(confs))
+	for i, c := range confs {
+		pairs[i] = certstore.Pair{Cert: c.TLSCert, Key: c.TLSKey}
+	}
+	certs, err := certstore.Load(pairs, certstore.Pair{Cert: config.C.TLSCert, Key: config.C.TLSKey})
+	if err != nil {
+		return nil, err
+	}
+
+	var store *certstore.Store
+	if config.C.CertDir != "" {
+		store = certstore.New(config.C.CertDir)
+	}
+
+	var ls []*listener
+	for i, c := range confs {
+		l := &listener{hostname: c.Hostname, implicit: c.ImplicitTLS && certs[i] != nil}
+		if l.hostname == "" {
+			l.hostname = config.C.Hostname
+		}
+		if certs[i] != nil {
+			if l.tlsConfig, err = tlsConfig(certstore.SNI(certs, i)); err != nil {
+				closeListeners(ls)
+				return nil, err
+			}
+			if store != nil {
+				l.tlsConfig.GetCertificate = store.GetCertificate
+			}
+		}
+
+		if l.implicit {
+			l.Listener, err = tls.Listen("tcp", c.Addr, l.tlsConfig)
+		} else {
+			l.Listener, err = net.Listen("tcp", c.Addr)
+		}
+		if err != nil {
+			closeListeners(ls)
+			return nil, err
+		}
+		ls = append(ls, l)
+	}
+	return ls, nil
+}
+
+func closeListeners(ls []*listener) {
+	for _, l := range ls {
+		l.Close()
+	}
+}
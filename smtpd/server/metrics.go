@@ -0,0 +1,41 @@
+package server
+
+import (
+	"runtime"
+
+	"github.com/mpdroog/mymail/smtpd/config"
+	"github.com/mpdroog/mymail/smtpd/stats"
+	"github.com/mpdroog/mymail/smtpd/tracker"
+)
+
+// Metrics are the gauges of GET /metrics, enough to see a small VPS run out
+// of memory before it does
+type Metrics struct {
+	Connections    int64  `json:"connections"`
+	MaxConnections int    `json:"max_connections"`
+	Goroutines     int    `json:"goroutines"`
+	Buffered       int64  `json:"buffered"` // DATA held in memory, bytes
+	HeapAlloc      uint64 `json:"heap_alloc"`
+	Sys            uint64 `json:"sys"` // Memory obtained from the OS
+
+	// Today's delivery attempts by destination domain, none without stats_dir
+	Outbound map[string]stats.Outbound `json:"outbound"`
+}
+
+// Metrics returns the current gauges
+func (s *Server) Metrics() Metrics {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	m := Metrics{
+		Connections:    s.conns.Load(),
+		MaxConnections: config.C.MaxConnections,
+		Goroutines:     runtime.NumGoroutine(),
+		HeapAlloc:      ms.HeapAlloc,
+		Sys:            ms.Sys,
+		Outbound:       stats.OutboundToday(),
+	}
+	s.Each(func(sess tracker.Session) {
+		m.Buffered += sess.(*Session).buffered.Load()
+	})
+	return m
+}
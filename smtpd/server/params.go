@@ -0,0 +1,182 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/mpdroog/mymail/smtpd/config"
+)
+
+// paramHandler validates one ESMTP parameter of MAIL or RCPT and stores it
+// in s.tx, value is "" for parameters without "="
+type paramHandler func(s *Session, value string) *smtpError
+
+// mailParams and rcptParams are the ESMTP parameters we understand, anything
+// else is rejected with 555 (RFC5321 4.1.1.11). Add extensions here.
+var (
+	mailParams = map[string]paramHandler{
+		"SIZE":     paramSize,
+		"BODY":     paramBody,
+		"SMTPUTF8": paramSMTPUTF8,
+		"AUTH":     paramAuth,
+		"RET":      paramRet,
+		"ENVID":    paramEnvID,
+	}
+	rcptParams = map[string]paramHandler{
+		"NOTIFY": paramNotify,
+		"ORCPT":  paramORCPT,
+	}
+)
+
+// transaction holds the parameters given with MAIL and RCPT, reset with
+// every new transaction
+type transaction struct {
+	size     int64
+	body     string // 7BIT or 8BITMIME
+	smtputf8 bool
+	auth     string // RFC4954 AUTH=, the original submitter
+	ret      string // DSN FULL or HDRS
+	envid    string
+	rcpt     rcptOptions   // parameters of the RCPT being parsed
+	rcpts    []rcptOptions // accepted, in the order of rcptTo
+
+	whitelist []whitelistAdd // From whitelist+ recipients, added after DATA
+}
+
+// whitelistAdd is an entry for the personal whitelist of addr
+type whitelistAdd struct {
+	addr  string // The authenticated user in the domain of the whitelist+ recipient
+	entry string
+}
+
+type rcptOptions struct {
+	notify string // DSN NOTIFY
+	orcpt  string // DSN ORCPT
+}
+
+// applyParams dispatches the parameters after a MAIL or RCPT path
+func (s *Session) applyParams(params string, registry map[string]paramHandler) *smtpError {
+	seen := make(map[string]bool)
+	for _, p := range strings.Fields(params) {
+		key, value, _ := strings.Cut(p, "=")
+		key = strings.ToUpper(key)
+		if key == "" || !validParamValue(value) {
+			return &smtpError{501, "Syntax error in parameter " + p}
+		}
+		if seen[key] {
+			return &smtpError{501, "Duplicate parameter " + key}
+		}
+		seen[key] = true
+
+		handler, ok := registry[key]
+		if !ok {
+			return &smtpError{555, "Parameter " + key + " not recognized or not implemented"}
+		}
+		if e := handler(s, value); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// validParamValue checks esmtp-value, printable US-ASCII except "=" and SP
+func validParamValue(v string) bool {
+	for i := 0; i < len(v); i++ {
+		if v[i] < 33 || v[i] > 126 || v[i] == '=' {
+			return false
+		}
+	}
+	return true
+}
+
+func paramSize(s *Session, value string) *smtpError {
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return &smtpError{501, "Syntax error in SIZE"}
+	}
+	if config.C.MaxSize > 0 && n > config.C.MaxSize {
+		return &smtpError{552, fmt.Sprintf("Message size exceeds fixed maximum message size (limit=%s)", config.C.MaxSizeStr)}
+	}
+	s.tx.size = n
+	return nil
+}
+
+func paramBody(s *Session, value string) *smtpError {
+	switch v := strings.ToUpper(value); v {
+	case "7BIT", "8BITMIME":
+		s.tx.body = v
+		return nil
+	}
+	return &smtpError{555, "BODY=" + value + " not supported"}
+}
+
+func paramSMTPUTF8(s *Session, value string) *smtpError {
+	if value != "" {
+		return &smtpError{501, "SMTPUTF8 takes no value"}
+	}
+	s.tx.smtputf8 = true
+	return nil
+}
+
+func paramAuth(s *Session, value string) *smtpError {
+	if value == "" {
+		return &smtpError{501, "Syntax error in AUTH"}
+	}
+	s.tx.auth = value
+	return nil
+}
+
+func paramRet(s *Session, value string) *smtpError {
+	switch v := strings.ToUpper(value); v {
+	case "FULL", "HDRS":
+		s.tx.ret = v
+		return nil
+	}
+	return &smtpError{501, "Syntax error in RET"}
+}
+
+func paramEnvID(s *Session, value string) *smtpError {
+	if value == "" || len(value) > 100 {
+		return &smtpError{501, "Syntax error in ENVID"}
+	}
+	s.tx.envid = value
+	return nil
+}
+
+func paramNotify(s *Session, value string) *smtpError {
+	values := strings.Split(strings.ToUpper(value), ",")
+	for _, v := range values {
+		switch v {
+		case "SUCCESS", "FAILURE", "DELAY":
+		case "NEVER":
+			if len(values) > 1 {
+				return &smtpError{501, "NOTIFY=NEVER can't be combined"}
+			}
+		default:
+			return &smtpError{501, "Syntax error in NOTIFY"}
+		}
+	}
+	s.tx.rcpt.notify = strings.ToUpper(value)
+	return nil
+}
+
+func paramORCPT(s *Session, value string) *smtpError {
+	// addr-type ";" xtext, e.g. rfc822;user@example.com
+	typ, addr, ok := strings.Cut(value, ";")
+	if !ok || typ == "" || addr == "" {
+		return &smtpError{501, "Syntax error in ORCPT"}
+	}
+	s.tx.rcpt.orcpt = value
+	return nil
+}
+
+// isASCII returns false for addresses that need SMTPUTF8
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/mpdroog/mymail/smtpd/config"
+)
+
+func TestApplyParams(t *testing.T) {
+	config.C.MaxSize = 1000
+	patterns := map[string]int{
+		"":                       0,
+		"SIZE=999 BODY=8BITMIME": 0,
+		"size=10 smtputf8":       0,
+		"RET=HDRS ENVID=abc":     0,
+		"AUTH=<>":                0,
+		"SIZE=1001":              552,
+		"SIZE=abc":               501,
+		"SIZE=1 SIZE=2":          501,
+		"BODY=BINARYMIME":        555,
+		"SMTPUTF8=yes":           501,
+		"XFOO=bar":               555,
+		"NOTIFY=NEVER":           555,
+		"SIZE=1=2":               501,
+	}
+	for params, code := range patterns {
+		s := &Session{}
+		e := s.applyParams(params, mailParams)
+		if code == 0 && e != nil {
+			t.Errorf("applyParams(%s) e=%v", params, e)
+		}
+		if code != 0 && (e == nil || e.code != code) {
+			t.Errorf("applyParams(%s)=%v expect=%d", params, e, code)
+		}
+	}
+
+	rcpt := map[string]int{
+		"NOTIFY=SUCCESS,FAILURE": 0,
+		"NOTIFY=NEVER":           0,
+		"ORCPT=rfc822;a@b.nl":    0,
+		"NOTIFY=NEVER,DELAY":     501,
+		"NOTIFY=SOMETIMES":       501,
+		"ORCPT=a@b.nl":           501,
+		"SIZE=1":                 555,
+	}
+	for params, code := range rcpt {
+		s := &Session{}
+		e := s.applyParams(params, rcptParams)
+		if code == 0 && e != nil {
+			t.Errorf("applyParams(%s) e=%v", params, e)
+		}
+		if code != 0 && (e == nil || e.code != code) {
+			t.Errorf("applyParams(%s)=%v expect=%d", params, e, code)
+		}
+	}
+}
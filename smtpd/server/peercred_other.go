@@ -0,0 +1,13 @@
+//go:build !linux
+
+package server
+
+import (
+	"errors"
+	"net"
+)
+
+// peerName needs SO_PEERCRED, unix socket peers stay anonymous elsewhere
+func peerName(conn *net.UnixConn) (string, error) {
+	return "", errors.New("unix socket peer credentials not supported on this platform")
+}
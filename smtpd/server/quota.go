@@ -0,0 +1,208 @@
+package server
+
+import (
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/mpdroog/mymail/smtpd/config"
+	"github.com/mpdroog/mymail/smtpd/logging"
+	"github.com/mpdroog/mymail/smtpd/messages"
+	"github.com/mpdroog/mymail/smtpd/users"
+)
+
+// quotaMarker is created in the maildir once the warning is sent, so a full
+// mailbox gets one warning until it drops below the threshold again
+const quotaMarker = ".quota-warned"
+
+// quotaTemplate is the built-in English quota warning, see smtpd/messages
+const quotaTemplate = `From: MAILER-DAEMON@{{.Hostname}}
+To: {{.To}}
+Date: {{.Date}}
+Subject: Your mailbox is almost full
+Content-Type: text/plain; charset=utf-8
+
+Hello {{.User}},
+
+Your mailbox uses {{.Used}} of its {{.Quota}} quota ({{.Percent}}%).
+Please delete or archive old messages, new mail is refused once it is
+full.
+`
+
+// QuotaWarning holds the fields of the quota-warning template
+type QuotaWarning struct {
+	Hostname string
+	To       string
+	Date     string
+	User     string
+	Used     string // Human-readable, e.g. "912MB"
+	Quota    string // As in the user file
+	Percent  int
+}
+
+// quotaRescan is how long the usage of a maildir is kept up to date by
+// counting deliveries, before it's summed again to see what imapd removed
+const quotaRescan = 10 * time.Minute
+
+// usage is the cached size of a maildir
+type usage struct {
+	bytes   int64
+	scanned time.Time
+}
+
+// quota returns the quota of the account of recipient in bytes and its
+// maildir, 0 without a quota
+func (s *Server) quota(recipient string) (int64, string, *users.Account) {
+	s.usersMu.RLock()
+	acct := users.Lookup(s.users, recipient)
+	s.usersMu.RUnlock()
+	if acct == nil || acct.Quota == "" || s.storage == nil {
+		return 0, "", nil
+	}
+	quota, err := config.ParseSize(acct.Quota)
+	if err != nil || quota <= 0 {
+		log.Printf("quota(%s) invalid quota %q", recipient, acct.Quota)
+		return 0, "", nil
+	}
+	inbox := s.storage.Inbox(recipient)
+	if inbox == "" {
+		return 0, "", nil
+	}
+	return quota, filepath.Dir(inbox), acct
+}
+
+// used returns the size of the maildir in dir, summed at most every
+// quotaRescan
+func (s *Server) used(dir string) (int64, error) {
+	s.usageMu.Lock()
+	u, ok := s.usage[dir]
+	s.usageMu.Unlock()
+	if ok && time.Since(u.scanned) < quotaRescan {
+		return u.bytes, nil
+	}
+
+	size, err := dirSize(dir)
+	if err != nil {
+		return 0, err
+	}
+	s.usageMu.Lock()
+	s.usage[dir] = usage{bytes: size, scanned: time.Now()}
+	s.usageMu.Unlock()
+	return size, nil
+}
+
+// addUsage counts n bytes delivered to the maildir in dir
+func (s *Server) addUsage(dir string, n int64) {
+	s.usageMu.Lock()
+	defer s.usageMu.Unlock()
+	if u, ok := s.usage[dir]; ok {
+		u.bytes += n
+		s.usage[dir] = u
+	}
+}
+
+// overQuota reports whether the account of recipient has no room for a
+// message of size bytes
+func (s *Server) overQuota(recipient string, size int64) bool {
+	quota, dir, _ := s.quota(recipient)
+	if quota == 0 {
+		return false
+	}
+	used, err := s.used(dir)
+	if err != nil {
+		log.Printf(logging.Err+"overQuota::used e=%v", err)
+		return false
+	}
+	return used+size > quota
+}
+
+// checkQuota counts size bytes delivered to recipient and warns the account
+// once its maildir passes config.C.QuotaWarning percent of the quota
+func (s *Server) checkQuota(recipient string, size int64) {
+	quota, dir, acct := s.quota(recipient)
+	if quota == 0 {
+		return
+	}
+	s.addUsage(dir, size)
+	if config.C.QuotaWarning < 0 {
+		return
+	}
+	used, err := s.used(dir)
+	if err != nil {
+		log.Printf(logging.Err+"checkQuota::used e=%v", err)
+		return
+	}
+	marker := filepath.Join(dir, quotaMarker)
+	percent := int(used * 100 / quota)
+	if percent < config.C.QuotaWarning {
+		os.Remove(marker)
+		return
+	}
+	if _, err := os.Stat(marker); err == nil {
+		return
+	}
+
+	q := QuotaWarning{
+		Hostname: config.C.Hostname,
+		To:       recipient,
+		Date:     time.Now().Format(time.RFC1123Z),
+		User:     filepath.Base(dir),
+		Used:     formatSize(used),
+		Quota:    acct.Quota,
+		Percent:  percent,
+	}
+	msg, err := messages.Render("quota-warning", quotaTemplate, messages.Locale(acct.Locale, recipient), q)
+	if err != nil {
+		log.Printf(logging.Err+"checkQuota::Render e=%v", err)
+		msg, _ = messages.Execute("quota-warning", quotaTemplate, q)
+	}
+	if err := s.storage.StoreLocal(recipient, "MAILER-DAEMON@"+config.C.Hostname, msg); err != nil {
+		log.Printf(logging.Err+"checkQuota::StoreLocal e=%v", err)
+		return
+	}
+	s.addUsage(dir, int64(len(msg)))
+	if err := os.MkdirAll(dir, 0750); err == nil {
+		err = os.WriteFile(marker, nil, 0640)
+	}
+	if err != nil {
+		log.Printf(logging.Err+"checkQuota::marker e=%v", err)
+	}
+}
+
+// dirSize sums the regular files below dir, a missing dir is empty
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == dir {
+				return nil
+			}
+			return err
+		}
+		if d.Type().IsRegular() {
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// formatSize is the reverse of config.ParseSize, rounded down
+func formatSize(n int64) string {
+	for _, u := range []struct {
+		unit string
+		size int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}} {
+		if n >= u.size {
+			return strconv.FormatInt(n/u.size, 10) + u.unit
+		}
+	}
+	return strconv.FormatInt(n, 10) + "B"
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+)
+
+var (
+	// errAuthFailed is a wrong username or password, replied with 535
+	errAuthFailed = errors.New("authentication failed")
+	// errAuthSyntax is a malformed client response, replied with 501
+	errAuthSyntax = errors.New("malformed authentication response")
+)
+
+// saslServer is one authentication exchange (RFC4422), Session.handleAUTH
+// takes care of base64, cancellation and the SMTP replies
+type saslServer interface {
+	// Next takes the client response (nil if there is none yet) and returns
+	// the next challenge, or done once the client is authenticated
+	Next(response []byte) (challenge []byte, done bool, err error)
+	// User is the username the client gave, authenticated once Next
+	// returned done
+	User() string
+}
+
+// saslMechanisms are the supported AUTH mechanisms, advertised in EHLO
+var saslMechanisms = map[string]func(verify func(user, pass string) bool) saslServer{
+	"PLAIN": func(verify func(user, pass string) bool) saslServer { return &plainServer{verify: verify} },
+	"LOGIN": func(verify func(user, pass string) bool) saslServer { return &loginServer{verify: verify} },
+}
+
+// plainServer implements PLAIN (RFC4616), authzid\0authcid\0passwd
+type plainServer struct {
+	verify func(user, pass string) bool
+	user   string
+}
+
+func (p *plainServer) Next(response []byte) ([]byte, bool, error) {
+	if response == nil {
+		// Ask for the credentials with an empty challenge
+		return []byte{}, false, nil
+	}
+
+	parts := bytes.Split(response, []byte{0})
+	if len(parts) != 3 || len(parts[1]) == 0 {
+		return nil, false, errAuthSyntax
+	}
+	authzid, pass := string(parts[0]), string(parts[2])
+	p.user = string(parts[1])
+	if authzid != "" && authzid != p.user {
+		// No acting on behalf of another user
+		return nil, false, errAuthFailed
+	}
+	if !p.verify(p.user, pass) {
+		return nil, false, errAuthFailed
+	}
+	return nil, true, nil
+}
+
+func (p *plainServer) User() string {
+	return p.user
+}
+
+// loginServer implements the obsolete but widely used LOGIN mechanism
+type loginServer struct {
+	verify func(user, pass string) bool
+	step   int
+	user   string
+}
+
+func (l *loginServer) Next(response []byte) ([]byte, bool, error) {
+	switch l.step {
+	case 0:
+		if response == nil {
+			l.step = 1
+			return []byte("Username:"), false, nil
+		}
+		// Initial response holds the username
+		l.step = 1
+		fallthrough
+	case 1:
+		l.user = string(response)
+		l.step = 2
+		return []byte("Password:"), false, nil
+	}
+
+	if !l.verify(l.user, string(response)) {
+		return nil, false, errAuthFailed
+	}
+	return nil, true, nil
+}
+
+func (l *loginServer) User() string {
+	return l.user
+}
+
+// externalServer implements EXTERNAL (RFC4422 appendix A), the identity
+// comes from the transport, the optional authzid must equal it
+type externalServer struct {
+	identity string
+	user     string
+}
+
+func (e *externalServer) Next(response []byte) ([]byte, bool, error) {
+	if response == nil {
+		return []byte{}, false, nil
+	}
+	if e.identity == "" || (len(response) > 0 && string(response) != e.identity) {
+		return nil, false, errAuthFailed
+	}
+	e.user = e.identity
+	return nil, true, nil
+}
+
+func (e *externalServer) User() string {
+	return e.user
+}
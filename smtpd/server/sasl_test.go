@@ -0,0 +1,61 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestSASL(t *testing.T) {
+	verify := func(user, pass string) bool {
+		return user == "mark" && pass == "secret"
+	}
+	type result struct {
+		user string
+		err  error
+	}
+	patterns := map[string]struct {
+		mech      string
+		responses []string
+		expect    result
+	}{
+		"plain":          {"PLAIN", []string{"\x00mark\x00secret"}, result{"mark", nil}},
+		"plain authzid":  {"PLAIN", []string{"mark\x00mark\x00secret"}, result{"mark", nil}},
+		"plain other":    {"PLAIN", []string{"root\x00mark\x00secret"}, result{"", errAuthFailed}},
+		"plain wrong":    {"PLAIN", []string{"\x00mark\x00guess"}, result{"", errAuthFailed}},
+		"plain syntax":   {"PLAIN", []string{"marksecret"}, result{"", errAuthSyntax}},
+		"login":          {"LOGIN", []string{"mark", "secret"}, result{"mark", nil}},
+		"login wrong":    {"LOGIN", []string{"mark", "guess"}, result{"", errAuthFailed}},
+		"external":       {"EXTERNAL", []string{""}, result{"mark", nil}},
+		"external self":  {"EXTERNAL", []string{"mark"}, result{"mark", nil}},
+		"external other": {"EXTERNAL", []string{"root"}, result{"", errAuthFailed}},
+	}
+	for name, p := range patterns {
+		var mech saslServer
+		if p.mech == "EXTERNAL" {
+			// Identity of the client certificate or unix socket peer
+			mech = &externalServer{identity: "mark"}
+		} else {
+			mech = saslMechanisms[p.mech](verify)
+		}
+		// No initial response, the first challenge asks for it
+		if _, done, err := mech.Next(nil); done || err != nil {
+			t.Errorf("%s: first Next done=%t e=%v", name, done, err)
+			continue
+		}
+
+		var err error
+		done := false
+		for _, r := range p.responses {
+			_, done, err = mech.Next([]byte(r))
+			if err != nil {
+				break
+			}
+		}
+		if err != p.expect.err {
+			t.Errorf("%s: e=%v expect=%v", name, err, p.expect.err)
+			continue
+		}
+		if p.expect.err == nil && (!done || mech.User() != p.expect.user) {
+			t.Errorf("%s: done=%t user=%q expect=%q", name, done, mech.User(), p.expect.user)
+		}
+	}
+}
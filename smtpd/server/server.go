@@ -1,48 +1,77 @@
 package server
 
 import (
-	"crypto/tls"
-	"encoding/base64"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"net"
+	"net/mail"
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/mpdroog/mymail/smtpd/config"
+	"github.com/mpdroog/mymail/smtpd/contacts"
+	"github.com/mpdroog/mymail/smtpd/lockout"
+	"github.com/mpdroog/mymail/smtpd/logging"
 	"github.com/mpdroog/mymail/smtpd/storage"
+	"github.com/mpdroog/mymail/smtpd/tracker"
+	"github.com/mpdroog/mymail/smtpd/users"
 )
 
 type Server struct {
-	listener net.Listener
-	wg       sync.WaitGroup
-	quit     chan struct{}
-	users    map[string]string // username -> password
-	storage  *storage.Storage
+	listeners []*listener // listen_addr, listeners and listen_socket, see listeners.go
+	wg        sync.WaitGroup
+	quit      chan struct{}
+	usersMu   sync.RWMutex
+	users     map[string]*users.Account
+	storage   *storage.Storage
+
+	// Local delivery workers, see delivery.go
+	deliveries *deliveryPool
+
+	// Maildir sizes for quotas, see quota.go
+	usageMu sync.Mutex
+	usage   map[string]usage
+
+	// Live sessions and temporary IP bans
+	*tracker.Tracker
+	conns atomic.Int64 // Open connections, see metrics.go
 }
 
 func New() *Server {
 	return &Server{
-		quit:  make(chan struct{}),
-		users: make(map[string]string),
+		quit:    make(chan struct{}),
+		users:   make(map[string]*users.Account),
+		usage:   make(map[string]usage),
+		Tracker: tracker.New(),
 	}
 }
 
+// LoadUsers (re)reads the user file, see users.Account for the format
 func (s *Server) LoadUsers(path string) error {
 	if path == "" {
 		return nil
 	}
 
-	f, err := os.Open(path)
+	accounts, err := users.Load(path)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
+	s.usersMu.Lock()
+	s.users = accounts
+	s.usersMu.Unlock()
+	return nil
+}
 
-	return json.NewDecoder(f).Decode(&s.users)
+// account returns the account of username, nil if unknown
+func (s *Server) account(username string) *users.Account {
+	s.usersMu.RLock()
+	defer s.usersMu.RUnlock()
+	return s.users[username]
 }
 
 func (s *Server) SetStorage(st *storage.Storage) {
@@ -50,54 +79,79 @@ func (s *Server) SetStorage(st *storage.Storage) {
 }
 
 func (s *Server) Start() error {
-	var err error
-	var listener net.Listener
+	listeners, err := listen()
+	if err != nil {
+		return err
+	}
 
-	if config.C.TLSCert != "" && config.C.TLSKey != "" {
-		// Try to load TLS config for implicit TLS (port 465)
-		cert, err := tls.LoadX509KeyPair(config.C.TLSCert, config.C.TLSKey)
+	if config.C.ListenSocket != "" {
+		socket, err := listenSocket(config.C.ListenSocket)
 		if err != nil {
+			closeListeners(listeners)
 			return err
 		}
-
-		tlsConfig := &tls.Config{
-			Certificates: []tls.Certificate{cert},
-		}
-		listener, err = tls.Listen("tcp", config.C.ListenAddr, tlsConfig)
-	} else {
-		listener, err = net.Listen("tcp", config.C.ListenAddr)
+		listeners = append(listeners, &listener{Listener: socket, hostname: config.C.Hostname})
 	}
 
-	if err != nil {
-		return err
+	s.listeners = listeners
+	s.startDeliveries()
+	for _, l := range s.listeners {
+		// TODO: Verbosity
+		log.Printf("SMTP server listening on %s as %s", l.Addr(), l.hostname)
+		go s.acceptLoop(l)
 	}
 
-	s.listener = listener
-	// TODO: Verbosity
-	log.Printf("SMTP server listening on %s", config.C.ListenAddr)
-
-	go s.acceptLoop()
-
 	return nil
 }
 
-func (s *Server) acceptLoop() {
+// listenSocket creates the unix socket for local services. Its peers may
+// be logged in by socket_users, so it is created with mode 0660: the umask
+// keeps others from connecting before a chmod could.
+func listenSocket(path string) (net.Listener, error) {
+	// Stale socket of a previous run
+	os.Remove(path)
+	old := syscall.Umask(0117)
+	defer syscall.Umask(old)
+	return net.Listen("unix", path)
+}
+
+func (s *Server) acceptLoop(listener *listener) {
 	for {
-		conn, err := s.listener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
 			select {
 			case <-s.quit:
 				return
 			default:
-				log.Printf("Accept error: %v", err)
+				log.Printf(logging.Err+"Accept error: %v", err)
 				continue
 			}
 		}
 
+		if s.Banned(conn.RemoteAddr()) {
+			conn.Write([]byte("421 " + listener.hostname + " Access temporarily denied by the administrator\r\n"))
+			conn.Close()
+			continue
+		}
+		// Every session may buffer a message up to max_size, cap them so
+		// a flood can't exhaust memory
+		if s.conns.Load() >= int64(config.C.MaxConnections) {
+			log.Printf("Refused %s, max_connections reached", conn.RemoteAddr())
+			conn.Write([]byte("421 " + listener.hostname + " Too many connections, try again later\r\n"))
+			conn.Close()
+			continue
+		}
+
+		s.conns.Add(1)
 		s.wg.Add(1)
 		go func() {
 			defer s.wg.Done()
+			defer s.conns.Add(-1)
 			session := NewSession(conn, s)
+			session.hostname = listener.hostname
+			session.tlsConfig = listener.tlsConfig
+			session.id = s.Add(session, session.counter)
+			defer s.Remove(session.id)
 			session.Handle()
 		}()
 	}
@@ -105,13 +159,20 @@ func (s *Server) acceptLoop() {
 
 func (s *Server) Stop() error {
 	close(s.quit)
-	e := s.listener.Close()
+	var e error
+	for _, l := range s.listeners {
+		if err := l.Close(); err != nil && e == nil {
+			e = err
+		}
+	}
 	s.wg.Wait()
+	s.stopDeliveries()
 	log.Println("SMTP server stopped")
 	return e
 }
 
 func (s *Server) ProcessEmail(from string, to []string, data []byte, auth bool) error {
+	var local, relay []string
 	for _, recipient := range to {
 		domain, err := getDomain(recipient)
 		if err != nil {
@@ -119,57 +180,167 @@ func (s *Server) ProcessEmail(from string, to []string, data []byte, auth bool)
 		}
 
 		if s.isLocalDomain(domain) {
-			// Local delivery
-			if err := s.storage.StoreLocal(recipient, from, data); err != nil {
-				return err
-			}
+			local = append(local, recipient)
 		} else {
 			if !auth {
 				return fmt.Errorf("Cannot relay without auth")
 			}
 
-			// Queue for relay
-			if err := s.storage.QueueForRelay(from, recipient, data); err != nil {
-				return err
-			}
+			relay = append(relay, recipient)
 		}
 	}
 
+	if len(local) > 0 {
+		if err := s.deliverLocal(from, local, data); err != nil {
+			return err
+		}
+	}
+
+	if len(relay) > 0 {
+		// Relay recipients share one queue entry
+		if err := s.storage.QueueForRelay(from, relay, data); err != nil {
+			return err
+		}
+	}
+
+	s.recordContacts(from, to, data, auth)
+	s.journal(from, local, relay, data)
 	return nil
 }
 
-func (s *Server) AuthenticatePlain(credentials string) bool {
-	decoded, err := base64.StdEncoding.DecodeString(credentials)
-	if err != nil {
-		return false
+// recordContacts indexes the sender for local recipients and, for authenticated
+// senders, all recipients (including Bcc) with display names from To/Cc
+func (s *Server) recordContacts(from string, to []string, data []byte, auth bool) {
+	if config.C.ContactsDir == "" {
+		return
+	}
+
+	for _, recipient := range to {
+		domain, _ := getDomain(recipient)
+		if !s.isLocalDomain(domain) {
+			continue
+		}
+		if err := contacts.Record(config.C.ContactsDir, recipient, contacts.Addresses(data, "From")); err != nil {
+			log.Printf(logging.Err+"contacts.Record e=%v", err)
+		}
+	}
+
+	if !auth || from == "" {
+		return
+	}
+	names := make(map[string]string)
+	for _, a := range contacts.Addresses(data, "To", "Cc") {
+		names[strings.ToLower(a.Address)] = a.Name
+	}
+	var addrs []*mail.Address
+	for _, recipient := range to {
+		addrs = append(addrs, &mail.Address{Name: names[recipient], Address: recipient})
+	}
+	if err := contacts.Record(config.C.ContactsDir, from, addrs); err != nil {
+		log.Printf(logging.Err+"contacts.Record e=%v", err)
+	}
+}
+
+// checkPassword verifies credentials from AUTH
+func (s *Server) checkPassword(username, password string) bool {
+	s.usersMu.RLock()
+	defer s.usersMu.RUnlock()
+	_, ok := users.Check(s.users, username, password)
+	return ok
+}
+
+// Authenticate verifies credentials given to the admin API from ip and
+// returns the account, nil if they are wrong. Failures count towards the
+// account lockout and are slowed down like a failed AUTH.
+func (s *Server) Authenticate(username, password, ip string) *users.Account {
+	if until := lockout.Locked(config.C.LockoutDir, username); !until.IsZero() {
+		log.Printf(logging.Warning+"Admin login for %s from %s refused, locked until %s", username, ip, until)
+		lockout.Delay(config.C.AuthFailDelay)
+		return nil
+	}
+
+	s.usersMu.RLock()
+	acct, ok := users.Check(s.users, username, password)
+	s.usersMu.RUnlock()
+	if ok {
+		return acct
+	}
+	log.Printf(logging.Warning+"Admin login failed for %q from %s", username, ip)
+	if acct != nil {
+		s.loginFailed(username, "smtpd-admin", ip)
 	}
+	lockout.Delay(config.C.AuthFailDelay)
+	return nil
+}
 
-	// PLAIN format: \0username\0password
-	parts := strings.Split(string(decoded), "\x00")
-	if len(parts) != 3 {
+// AuthenticateAdmin is Authenticate for an account with RoleAdmin, without
+// admin accounts every request is refused
+func (s *Server) AuthenticateAdmin(username, password, ip string) bool {
+	acct := s.Authenticate(username, password, ip)
+	if acct == nil {
 		return false
 	}
+	if !acct.Has(users.RoleAdmin) {
+		log.Printf(logging.Warning+"Admin login for %s from %s refused, not an admin", username, ip)
+		lockout.Delay(config.C.AuthFailDelay)
+		return false
+	}
+	return true
+}
 
-	username := parts[1]
-	password := parts[2]
+// canSend reports whether an authenticated user may relay
+func (s *Server) canSend(username string) bool {
+	acct := s.account(username)
+	return acct != nil && acct.CanSend()
+}
 
-	storedPass, ok := s.users[username]
-	return ok && storedPass == password
+// hasUser reports whether username exists, failures for unknown users
+// aren't tracked so guessing names can't fill the lockout dir
+func (s *Server) hasUser(username string) bool {
+	return s.account(username) != nil
 }
 
-func (s *Server) AuthenticateLogin(usernameB64, passwordB64 string) (bool, error) {
-	username, err := base64.StdEncoding.DecodeString(usernameB64)
+// loginFailed counts a failed login over protocol towards the account
+// lockout and tells the user and config.C.LockoutAdmin when it locks the
+// account
+func (s *Server) loginFailed(username, protocol, ip string) {
+	policy := lockout.Policy{
+		Threshold: config.C.LockoutThreshold,
+		Window:    config.C.LockoutWindow,
+		Duration:  config.C.LockoutDuration,
+	}
+	f := lockout.Failure{Time: time.Now(), Protocol: protocol, IP: ip}
+	st, locked, err := lockout.Fail(config.C.LockoutDir, username, f, policy)
 	if err != nil {
-		return false, err
+		log.Printf(logging.Err+"lockout.Fail e=%v", err)
+		return
 	}
+	if !locked {
+		return
+	}
+	log.Printf(logging.Warning+"Account %s locked until %s after %d failed logins", username, st.LockedUntil, len(st.Failures))
 
-	password, err := base64.StdEncoding.DecodeString(passwordB64)
-	if err != nil {
-		return false, err
+	from := "MAILER-DAEMON@" + config.C.Hostname
+	addr := users.Address(username)
+	locale := ""
+	if acct := s.account(username); acct != nil {
+		locale = acct.Locale
+	}
+	if err := s.storage.StoreLocal(addr, from, lockout.Notice(st, from, addr, locale)); err != nil {
+		log.Printf(logging.Err+"loginFailed::StoreLocal e=%v", err)
 	}
 
-	storedPass, ok := s.users[string(username)]
-	return ok && storedPass == string(password), nil
+	if admin := config.C.LockoutAdmin; admin != "" {
+		msg := lockout.Alert(st, from, admin)
+		if domain, _ := getDomain(admin); s.isLocalDomain(domain) {
+			err = s.storage.StoreLocal(admin, from, msg)
+		} else {
+			err = s.storage.QueueForRelay("", []string{admin}, msg)
+		}
+		if err != nil {
+			log.Printf(logging.Err+"loginFailed::alert e=%v", err)
+		}
+	}
 }
 
 func (s *Server) isLocalDomain(domain string) bool {
@@ -182,9 +353,10 @@ func (s *Server) isLocalDomain(domain string) bool {
 }
 
 func getDomain(email string) (string, error) {
-	parts := strings.Split(email, "@")
-	if len(parts) != 2 {
+	// Last @ as a quoted local part may contain one
+	i := strings.LastIndex(email, "@")
+	if i == -1 {
 		return "", errors.New("invalid email")
 	}
-	return parts[1], nil
+	return email[i+1:], nil
 }
@@ -0,0 +1,29 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestListenSocket checks the socket isn't reachable for other users
+func TestListenSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "smtpd.sock")
+	// A stale socket of a previous run is replaced
+	if err := os.WriteFile(path, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := listenSocket(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := fi.Mode().Perm(); mode != 0660 {
+		t.Errorf("mode=%o expect=660", mode)
+	}
+}
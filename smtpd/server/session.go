@@ -2,16 +2,32 @@ package server
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/tls"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/textproto"
+	"os"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/mpdroog/mymail/smtpd/activity"
+	"github.com/mpdroog/mymail/smtpd/audit"
 	"github.com/mpdroog/mymail/smtpd/config"
+	"github.com/mpdroog/mymail/smtpd/lockout"
+	"github.com/mpdroog/mymail/smtpd/logging"
+	"github.com/mpdroog/mymail/smtpd/reputation"
+	"github.com/mpdroog/mymail/smtpd/stats"
+	"github.com/mpdroog/mymail/smtpd/tracker"
+	"github.com/mpdroog/mymail/smtpd/watchdog"
+	"github.com/mpdroog/mymail/smtpd/whitelist"
 )
 
 type Session struct {
@@ -19,43 +35,128 @@ type Session struct {
 	reader     *textproto.Reader
 	writer     *textproto.Writer
 	remoteAddr string
+	hostname   string      // Of the listener, see listeners.go
+	tlsConfig  *tls.Config // STARTTLS, nil if not offered
 
 	// State
 	helo     string
+	mail     bool // MAIL accepted, mailFrom is "" for the null sender
 	mailFrom string
 	rcptTo   []string
+	tx       transaction // ESMTP parameters, see params.go
 	data     []byte
 	tls      bool
 	auth     bool
+	external string // Account of the client certificate or unix socket peer, see external.go
+	connInfo string // X-Connection-Info field, looked up once, see header.go
+
+	authFailures int // Failed AUTH attempts on this connection
+
+	buffered atomic.Int64 // Bytes of DATA held in memory, see metrics.go
 
 	// Server reference
 	server *Server
+
+	// Admin view, see tracker.Session
+	id      uint64
+	started time.Time
+	counter *tracker.Conn
+	mu      sync.Mutex
+	user    string
+	state   string
 }
 
 func NewSession(conn net.Conn, server *Server) *Session {
+	counter := &tracker.Conn{Conn: conn}
 	return &Session{
-		conn:       conn,
-		reader:     textproto.NewReader(bufio.NewReader(conn)),
-		writer:     textproto.NewWriter(bufio.NewWriter(conn)),
+		conn:       counter,
+		reader:     textproto.NewReader(bufio.NewReader(counter)),
+		writer:     textproto.NewWriter(bufio.NewWriter(counter)),
 		remoteAddr: conn.RemoteAddr().String(),
+		hostname:   config.C.Hostname,
 		server:     server,
 		rcptTo:     make([]string, 0),
+		started:    time.Now(),
+		counter:    counter,
+		state:      "connected",
+	}
+}
+
+func (s *Session) setState(state string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = state
+}
+
+func (s *Session) username() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.user
+}
+
+// setUser marks the session authenticated and records the login
+func (s *Session) setUser(user string) {
+	s.mu.Lock()
+	s.user = user
+	s.mu.Unlock()
+
+	ip, _, _ := net.SplitHostPort(s.remoteAddr)
+	e := activity.Entry{Time: time.Now(), Protocol: "smtp", IP: ip, Client: s.helo}
+	if err := activity.Record(config.C.ActivityDir, user, e); err != nil {
+		log.Printf(logging.Err+"activity.Record e=%v", err)
+	}
+}
+
+// Info returns a snapshot for the admin API
+func (s *Session) Info() tracker.Info {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return tracker.Info{
+		Protocol:   "smtp",
+		RemoteAddr: s.remoteAddr,
+		User:       s.user,
+		State:      s.state,
+		Started:    s.started,
+		Memory:     s.buffered.Load(),
 	}
 }
 
 func (s *Session) Handle() {
 	defer s.conn.Close()
 
+	// Implicit TLS, handshake now for the client certificate
+	if tlsConn, ok := s.counter.Conn.(*tls.Conn); ok {
+		s.setDeadline(config.C.Timeouts.Banner)
+		if err := tlsConn.Handshake(); err != nil {
+			log.Printf(logging.Err+"TLS handshake from %s e=%v", s.remoteAddr, err)
+			return
+		}
+		s.tls = true
+		s.authenticateCert(tlsConn.ConnectionState())
+	}
+	if unixConn, ok := s.counter.Conn.(*net.UnixConn); ok {
+		s.authenticatePeer(unixConn)
+	}
+
+	if s.pregreet() {
+		return
+	}
+
 	// Send greeting
-	s.reply(220, fmt.Sprintf("%s ESMTP ready", config.C.Hostname))
+	s.setDeadline(config.C.Timeouts.Banner)
+	s.greet()
 
 	for {
-		s.conn.SetDeadline(time.Now().Add(5 * time.Minute))
+		s.setDeadline(config.C.Timeouts.Command)
 
 		line, err := s.reader.ReadLine()
 		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				s.timeout()
+				return
+			}
 			if err != io.EOF {
-				log.Printf("Read error from %s: %v", s.remoteAddr, err)
+				log.Printf(logging.Err+"Read error from %s: %v", s.remoteAddr, err)
 			}
 			return
 		}
@@ -93,13 +194,68 @@ func (s *Session) Handle() {
 			e = s.reply(502, "Command not implemented")
 		}
 		if e != nil {
-			log.Printf("Process error from %s: %v", s.remoteAddr, e)
+			log.Printf(logging.Err+"Process error from %s: %v", s.remoteAddr, e)
 			// Throw client out
 			return
 		}
 	}
 }
 
+// pregreet waits config.C.GreetDelay before the banner and returns true if
+// the client talked first. Real MTAs wait for the 220, spambots often don't.
+func (s *Session) pregreet() bool {
+	if config.C.GreetDelay <= 0 {
+		return false
+	}
+
+	s.conn.SetReadDeadline(time.Now().Add(config.C.GreetDelay))
+	_, err := s.reader.R.Peek(1)
+	s.conn.SetReadDeadline(time.Time{})
+
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return false
+	}
+	if err == nil {
+		log.Printf("Rejected pregreet from %s", s.remoteAddr)
+		s.reply(554, "SMTP protocol violation")
+	}
+	return true
+}
+
+// setDeadline limits the next phase to d, capped by the session lifetime.
+// Zero durations mean no limit.
+func (s *Session) setDeadline(d time.Duration) {
+	var t time.Time
+	if d > 0 {
+		t = time.Now().Add(d)
+	}
+	if config.C.Timeouts.Session > 0 {
+		if end := s.started.Add(config.C.Timeouts.Session); t.IsZero() || end.Before(t) {
+			t = end
+		}
+	}
+	s.conn.SetDeadline(t)
+}
+
+// timeout tells the client why we hang up (RFC5321 4.5.3.2)
+func (s *Session) timeout() {
+	log.Printf("Timeout from %s in state %s", s.remoteAddr, s.Info().State)
+	s.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	s.reply(421, fmt.Sprintf("%s Timeout, closing connection", s.hostname))
+}
+
+// greet sends the 220 banner, a multi-line config.C.Banner becomes a
+// multi-line reply. The first line always starts with our hostname (RFC5321 4.2).
+func (s *Session) greet() error {
+	banner := config.C.Banner
+	if banner == "" {
+		banner = "ESMTP ready"
+	}
+	lines := strings.Split(strings.TrimRight(banner, "\n"), "\n")
+	lines[0] = s.hostname + " " + lines[0]
+	return s.replyMulti(220, lines)
+}
+
 func (s *Session) parseCommand(line string) (cmd, arg string) {
 	// TODO: Loose, tighten up?
 	parts := strings.SplitN(line, " ", 2)
@@ -137,6 +293,7 @@ func (s *Session) handleHELO(arg string) error {
 		return s.reply(501, "HELO requires domain argument")
 	}
 	s.helo = arg
+	s.setState("helo")
 	return s.reply(250, fmt.Sprintf("Hello %s", arg))
 }
 
@@ -144,21 +301,34 @@ func (s *Session) handleEHLO(arg string) error {
 	if arg == "" {
 		return s.reply(501, "EHLO requires domain argument")
 	}
-	if arg != config.C.Hostname {
+	if arg != s.hostname {
 		return s.reply(501, "EHLO invalid domain")
 	}
 	s.helo = arg
+	s.setState("helo")
 
 	extensions := []string{
 		fmt.Sprintf("Hello %s", arg),
 		fmt.Sprintf("SIZE %d", config.C.MaxSize),
 		"8BITMIME",
 		"PIPELINING",
+		"SMTPUTF8",
 	}
 
-	if !s.tls && config.C.TLSCert != "" {
+	if !s.tls && s.tlsConfig != nil {
 		extensions = append(extensions, "STARTTLS")
 	}
+	if !s.auth {
+		mechanisms := make([]string, 0, len(saslMechanisms)+1)
+		for name := range saslMechanisms {
+			mechanisms = append(mechanisms, name)
+		}
+		if s.external != "" {
+			mechanisms = append(mechanisms, "EXTERNAL")
+		}
+		sort.Strings(mechanisms)
+		extensions = append(extensions, "AUTH "+strings.Join(mechanisms, " "))
+	}
 
 	return s.replyMulti(250, extensions)
 }
@@ -167,35 +337,60 @@ func (s *Session) handleMAIL(arg string) error {
 	if s.helo == "" {
 		return s.reply(503, "EHLO/HELO first")
 	}
+	// A client certificate or unix socket peer needs no AUTH
+	if !s.auth && s.external != "" {
+		s.loginExternal()
+	}
 
-	arg = strings.TrimPrefix(strings.ToUpper(arg), "FROM:")
-	arg = strings.TrimSpace(arg)
-
-	// Parse email address
-	email := s.extractEmail(arg)
-	if email == "" {
-		return s.reply(501, "Invalid sender address")
+	// Parse reverse-path, "<>" is the null sender of bounces
+	email, params, err := parsePath(arg, "FROM:")
+	if err != nil {
+		return s.reply(501, err.Error())
+	}
+	s.tx = transaction{}
+	if e := s.applyParams(params, mailParams); e != nil {
+		return s.reply(e.code, e.msg)
+	}
+	if !s.tx.smtputf8 && !isASCII(email) {
+		return s.reply(553, "Non-ASCII address requires SMTPUTF8")
 	}
 
-	// Check sender whitelist (skip for authenticated users)
-	if config.C.EnableWhitelist && !s.auth {
+	// Check sender whitelist (skip for authenticated users), with personal
+	// whitelists it depends on the recipient and is checked per RCPT
+	if config.C.EnableWhitelist && !s.auth && config.C.WhitelistDir == "" {
 		if !s.isSenderWhitelisted(email) {
 			// TODO: hide behind verbosity?
 			// TODO: Some webhook so we can do something with it later?
 			log.Printf("Rejected mail from non-whitelisted sender: %s", email)
+			senderDomain, _ := getDomain(email)
+			stats.Record(stats.Rejected, "", senderDomain)
 			return s.reply(550, "Sender not on whitelist. "+config.C.RejectMsg)
 		}
 	}
 
+	if s.auth && !s.server.canSend(s.username()) {
+		log.Printf("Rejected mail from receive-only user %s", s.username())
+		return s.reply(550, "Account may not send mail")
+	}
+
+	if s.auth {
+		if until, ok := watchdog.Suspended(s.username()); ok {
+			log.Printf("Rejected mail from suspended user %s", s.username())
+			return s.reply(452, "4.7.0 Sending suspended for unusual volume, "+retryAfter(until)+" or contact your administrator")
+		}
+	}
+
+	s.mail = true
 	s.mailFrom = email
 	s.rcptTo = make([]string, 0)
 	s.data = nil
+	s.setState("mail")
 
 	return s.reply(250, "OK")
 }
 
 func (s *Session) handleRCPT(arg string) error {
-	if s.mailFrom == "" {
+	if !s.mail {
 		return s.reply(503, "MAIL first")
 	}
 
@@ -203,42 +398,102 @@ func (s *Session) handleRCPT(arg string) error {
 		return s.reply(452, "Too many recipients")
 	}
 
-	arg = strings.TrimPrefix(strings.ToUpper(arg), "TO:")
-	arg = strings.TrimSpace(arg)
-
-	email := s.extractEmail(arg)
+	email, params, err := parsePath(arg, "TO:")
+	if err != nil {
+		return s.reply(501, err.Error())
+	}
 	if email == "" {
 		return s.reply(501, "Invalid recipient address")
 	}
+	s.tx.rcpt = rcptOptions{}
+	if e := s.applyParams(params, rcptParams); e != nil {
+		return s.reply(e.code, e.msg)
+	}
+	if !s.tx.smtputf8 && !isASCII(email) {
+		return s.reply(553, "Non-ASCII address requires SMTPUTF8")
+	}
 
 	// Check if we accept mail for this domain
 	domain, err := getDomain(email)
 	if err != nil {
-		log.Printf("handleRCPT::getDomain e=" + err.Error())
+		log.Printf(logging.Err+"handleRCPT::getDomain e=%v", err)
 		return s.reply(550, "Relay cannot process email")
 	}
 
 	if !s.isLocalDomain(domain) && !s.auth {
+		stats.Record(stats.Rejected, "", domain)
 		return s.reply(550, "Relay access denied")
 	}
+	if !s.isLocalDomain(domain) {
+		// Would wait in the queue, the sender may as well know
+		if until := reputation.Paused(domain, time.Now()); !until.IsZero() {
+			return s.reply(452, "4.7.0 Delivery to "+domain+" is paused, it rejects us for our sending reputation, "+retryAfter(until))
+		}
+	}
+
+	local := email[:len(email)-len(domain)-1]
+	if entry, ok, err := whitelist.Parse(local); ok && s.isLocalDomain(domain) {
+		switch {
+		case !s.auth:
+			return s.reply(550, "Authentication required")
+		case config.C.WhitelistDir == "":
+			return s.reply(550, "Personal whitelists are not enabled")
+		case err != nil:
+			return s.reply(501, err.Error())
+		}
+		// A bare username has a whitelist in every local domain, the
+		// recipient's domain says which one
+		addr := s.username()
+		if !strings.Contains(addr, "@") {
+			addr += "@" + domain
+		}
+		s.tx.whitelist = append(s.tx.whitelist, whitelistAdd{addr: addr, entry: entry})
+		return s.reply(250, "OK, adding "+entry+" to your whitelist")
+	}
+
+	if config.C.EnableWhitelist && !s.auth && config.C.WhitelistDir != "" {
+		if !s.isSenderWhitelisted(s.mailFrom) && !whitelist.Allowed(config.C.WhitelistDir, email, s.mailFrom) {
+			log.Printf("Rejected mail from non-whitelisted sender: %s to %s", s.mailFrom, email)
+			senderDomain, _ := getDomain(s.mailFrom)
+			stats.Record(stats.Rejected, "", senderDomain)
+			return s.reply(550, "Sender not on whitelist. "+config.C.RejectMsg)
+		}
+	}
+
+	if s.isLocalDomain(domain) && s.server.overQuota(email, s.tx.size) {
+		return s.reply(452, "4.2.2 Mailbox of "+email+" is full")
+	}
 
 	s.rcptTo = append(s.rcptTo, email)
+	s.tx.rcpts = append(s.tx.rcpts, s.tx.rcpt)
+	s.setState("rcpt")
 	return s.reply(250, "OK")
 }
 
 func (s *Session) handleDATA() error {
-	if len(s.rcptTo) == 0 {
+	if len(s.rcptTo) == 0 && len(s.tx.whitelist) == 0 {
 		return s.reply(503, "RCPT first")
 	}
 
 	if e := s.reply(354, "Start mail input; end with <CRLF>.<CRLF>"); e != nil {
 		return e
 	}
+	s.setState("data")
+	defer s.buffered.Store(0)
 
 	// Read message data
 	data, err := s.readData()
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		s.timeout()
+		return err
+	}
+	var reject *smtpError
+	if errors.As(err, &reject) {
+		log.Printf("Rejected DATA from %s: %v", s.remoteAddr, err)
+		return s.reply(reject.code, reject.msg)
+	}
 	if err != nil {
-		log.Printf("Error reading DATA from %s: %v", s.remoteAddr, err)
+		log.Printf(logging.Err+"Error reading DATA from %s: %v", s.remoteAddr, err)
 		return s.reply(451, "Error reading message")
 	}
 
@@ -246,37 +501,134 @@ func (s *Session) handleDATA() error {
 		return s.reply(552, fmt.Sprintf("Message too large (limit=%s)", config.C.MaxSizeStr))
 	}
 
+	// Only smtpd itself may say why a message was held
+	data = replaceHeader(data, verdictField, "")
+	if s.auth {
+		var reject *smtpError
+		if data, reject = s.checkFrom(data); reject != nil {
+			return s.reply(reject.code, reject.msg)
+		}
+	} else if config.C.ConnectionInfo {
+		// Any copy from the sender is forged
+		data = append([]byte(s.connectionInfo()), replaceHeader(data, "X-Connection-Info", "")...)
+	}
 	s.data = data
 
+	if err := s.addToWhitelist(); err != nil {
+		log.Printf(logging.Err+"addToWhitelist e=%v", err)
+		return s.reply(451, "Error updating whitelist")
+	}
+	if len(s.rcptTo) == 0 {
+		// Only whitelist+ recipients, nothing to deliver
+		s.resetTransaction()
+		return s.reply(250, "OK whitelist updated")
+	}
+
 	// Process the email
 	err = s.server.ProcessEmail(s.mailFrom, s.rcptTo, s.data, s.auth)
+	if errors.Is(err, errBusy) {
+		return s.reply(452, "4.3.1 Insufficient system resources, try again later")
+	}
 	if err != nil {
-		log.Printf("Error processing email: %v", err)
+		log.Printf(logging.Err+"Error processing email: %v", err)
 		return s.reply(451, "Error processing message")
 	}
 
-	if e := s.reply(250, "OK message queued"); e != nil {
+	queued := "OK message queued"
+	if s.auth {
+		relayed := 0
+		for _, rcpt := range s.rcptTo {
+			if domain, _ := getDomain(rcpt); !s.isLocalDomain(domain) {
+				relayed++
+			}
+		}
+		watchdog.Record(s.username(), relayed)
+		queued += relayAllowance(s.username())
+	}
+
+	if e := s.reply(250, queued); e != nil {
 		return e
 	}
 
-	// Reset state
+	s.resetTransaction()
+	return nil
+}
+
+// resetTransaction clears the state after a finished transaction
+func (s *Session) resetTransaction() {
+	s.mail = false
 	s.mailFrom = ""
 	s.rcptTo = make([]string, 0)
+	s.tx = transaction{}
 	s.data = nil
+	s.setState("helo")
+}
 
+// addToWhitelist stores the entries of whitelist+ recipients for the
+// authenticated user
+func (s *Session) addToWhitelist() error {
+	ip, _, _ := net.SplitHostPort(s.remoteAddr)
+	for _, w := range s.tx.whitelist {
+		if err := whitelist.Add(config.C.WhitelistDir, w.addr, w.entry); err != nil {
+			return err
+		}
+		log.Printf("Whitelist of %s: added %s", w.addr, w.entry)
+		e := audit.Entry{Protocol: "smtp", User: s.username(), IP: ip, Action: "whitelist-add", Target: w.entry}
+		if err := audit.Record(config.C.AuditLog, e); err != nil {
+			log.Printf(logging.Err+"audit.Record e=%v", err)
+		}
+	}
 	return nil
 }
 
+// smtpError is a rejection to reply with, readData returns it after the
+// rest of the DATA was read and discarded
+type smtpError struct {
+	code int
+	msg  string
+}
+
+func (e *smtpError) Error() string {
+	return fmt.Sprintf("%d %s", e.code, e.msg)
+}
+
 func (s *Session) readData() ([]byte, error) {
 	var data []byte
+	var reject *smtpError
+
+	inHeader := true
+	headerSize, received := 0, 0
 
 	for {
-		line, err := s.reader.ReadLineBytes()
+		s.setDeadline(config.C.Timeouts.Data)
+		limit := config.C.MaxSize
+		if inHeader {
+			limit = int64(config.C.MaxHeaderLine)
+		}
+		line, bare, long, err := s.readDataLine(limit)
 		if err != nil {
 			return nil, err
 		}
+		if long {
+			if reject == nil {
+				reject = &smtpError{552, fmt.Sprintf("Message too large (limit=%s)", config.C.MaxSizeStr)}
+				if inHeader {
+					reject = &smtpError{552, "Header line too long"}
+				}
+				data = nil
+			}
+			continue
+		}
 
-		// Check for end of data
+		// Only <CRLF>.<CRLF> ends the data, <LF>.<LF> and friends are
+		// smuggling attempts that other MTAs may split differently
+		if bare {
+			if reject == nil {
+				reject = &smtpError{554, "Bare CR or LF not allowed, use CRLF line endings"}
+				data = nil
+			}
+			continue
+		}
 		if len(line) == 1 && line[0] == '.' {
 			break
 		}
@@ -286,17 +638,97 @@ func (s *Session) readData() ([]byte, error) {
 			line = line[1:]
 		}
 
+		if reject != nil {
+			// Drain until the end of DATA so the session stays in sync
+			continue
+		}
+
+		if inHeader {
+			if len(line) == 0 {
+				inHeader = false
+			} else {
+				headerSize += len(line) + 2
+				if len(line) > 9 && strings.EqualFold(string(line[:9]), "received:") {
+					received++
+				}
+
+				switch {
+				case len(line) > config.C.MaxHeaderLine:
+					reject = &smtpError{552, "Header line too long"}
+				case int64(headerSize) > config.C.MaxHeaderSize:
+					reject = &smtpError{552, "Message header too large"}
+				case received > config.C.MaxReceived:
+					reject = &smtpError{554, "Too many Received headers, mail loop?"}
+				}
+				if reject != nil {
+					data = nil
+					continue
+				}
+			}
+		}
+
+		if int64(len(data)+len(line)+2) > config.C.MaxSize {
+			// Stop buffering, the rest is drained
+			reject = &smtpError{552, fmt.Sprintf("Message too large (limit=%s)", config.C.MaxSizeStr)}
+			data = nil
+			continue
+		}
 		data = append(data, line...)
 		data = append(data, '\r', '\n')
+		s.buffered.Store(int64(cap(data)))
 	}
 
+	if reject != nil {
+		return nil, reject
+	}
 	return data, nil
 }
 
+// readDataLine returns the next DATA line without its CRLF. Unlike
+// textproto it doesn't accept a bare LF as line end, bare is true if the
+// line ended in a LF without CR or contains a CR elsewhere. A line longer
+// than limit is read up to its LF but not kept, long is true then.
+func (s *Session) readDataLine(limit int64) (line []byte, bare, long bool, err error) {
+	for {
+		chunk, err := s.reader.R.ReadSlice('\n')
+		if int64(len(line)+len(chunk)) > limit+2 {
+			long, line = true, nil
+		}
+		if !long {
+			line = append(line, chunk...)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, false, false, err
+		}
+		break
+	}
+	if long {
+		return nil, false, true, nil
+	}
+
+	n := len(line)
+	if n < 2 || line[n-2] != '\r' {
+		return line[:n-1], true, false, nil
+	}
+	line = line[:n-2]
+	return line, bytes.IndexByte(line, '\r') != -1, false, nil
+}
+
 func (s *Session) handleRSET() error {
+	s.mail = false
 	s.mailFrom = ""
 	s.rcptTo = make([]string, 0)
+	s.tx = transaction{}
 	s.data = nil
+	if s.helo != "" {
+		s.setState("helo")
+	}
 	return s.reply(250, "OK")
 }
 
@@ -305,26 +737,15 @@ func (s *Session) handleSTARTTLS() error {
 		return s.reply(503, "TLS already active")
 	}
 
-	if config.C.TLSCert == "" {
+	if s.tlsConfig == nil {
 		return s.reply(502, "TLS not available")
 	}
 
-	cert, err := tls.LoadX509KeyPair(config.C.TLSCert, config.C.TLSKey)
-	if err != nil {
-		// TODO: Move to config so this is only done once?
-		log.Printf("TLS cert error: %v", err)
-		return s.reply(454, "TLS not available")
-	}
-
-	tlsConfig := &tls.Config{
-		Certificates: []tls.Certificate{cert},
-	}
-
 	if e := s.reply(220, "Ready to start TLS"); e != nil {
 		return e
 	}
 
-	tlsConn := tls.Server(s.conn, tlsConfig)
+	tlsConn := tls.Server(s.conn, s.tlsConfig)
 	if err := tlsConn.Handshake(); err != nil {
 		return err
 	}
@@ -336,101 +757,102 @@ func (s *Session) handleSTARTTLS() error {
 
 	// Reset state after STARTTLS
 	s.helo = ""
+	s.mail = false
 	s.mailFrom = ""
 	s.rcptTo = make([]string, 0)
+	s.tx = transaction{}
+	s.setState("connected")
+	s.authenticateCert(tlsConn.ConnectionState())
 
 	return nil
 }
 
+// handleAUTH runs a SASL exchange (RFC4954), the mechanisms live in sasl.go
 func (s *Session) handleAUTH(arg string) error {
 	if s.auth {
 		return s.reply(503, "Already authenticated")
 	}
+	if s.mail {
+		return s.reply(503, "AUTH not permitted during a mail transaction")
+	}
 
-	parts := strings.SplitN(arg, " ", 2)
-	mechanism := strings.ToUpper(parts[0])
-
-	switch mechanism {
-	case "PLAIN":
-		return s.handleAuthPlain(parts)
-	case "LOGIN":
-		return s.handleAuthLogin()
+	mechanism, initial, hasInitial := strings.Cut(arg, " ")
+	var mech saslServer
+	if strings.EqualFold(mechanism, "EXTERNAL") && s.external != "" {
+		mech = &externalServer{identity: s.external}
+	} else {
+		newMech, ok := saslMechanisms[strings.ToUpper(mechanism)]
+		if !ok {
+			return s.reply(504, "Authentication mechanism not supported")
+		}
+		// A locked account is refused before its password is hashed, EXTERNAL
+		// is checked once done
+		mech = newMech(func(user, pass string) bool {
+			if until := lockout.Locked(config.C.LockoutDir, user); !until.IsZero() {
+				log.Printf(logging.Warning+"AUTH for %s from %s refused, locked until %s", user, s.remoteAddr, until)
+				return false
+			}
+			return s.server.checkPassword(user, pass)
+		})
 	}
 
-	return s.reply(504, "Authentication mechanism not supported")
-}
+	var response []byte
+	if hasInitial {
+		// "=" is an empty initial response
+		if initial != "=" {
+			var err error
+			if response, err = base64.StdEncoding.DecodeString(initial); err != nil {
+				return s.reply(501, "Invalid base64 data")
+			}
+		} else {
+			response = []byte{}
+		}
+	}
 
-func (s *Session) handleAuthPlain(parts []string) error {
-	var credentials string
+	for {
+		challenge, done, err := mech.Next(response)
+		if errors.Is(err, errAuthSyntax) {
+			return s.reply(501, "Invalid authentication data")
+		}
+		if done {
+			if until := lockout.Locked(config.C.LockoutDir, mech.User()); !until.IsZero() {
+				log.Printf(logging.Warning+"AUTH for %s from %s refused, locked until %s", mech.User(), s.remoteAddr, until)
+				done, err = false, errAuthFailed
+			}
+		} else if err != nil && s.server.hasUser(mech.User()) {
+			ip, _, _ := net.SplitHostPort(s.remoteAddr)
+			s.server.loginFailed(mech.User(), "smtp", ip)
+		}
+		if err != nil {
+			log.Printf(logging.Warning+"AUTH %s failed from %s", strings.ToUpper(mechanism), s.remoteAddr)
+			s.authFailures++
+			lockout.Delay(config.C.AuthFailDelay)
+			if s.authFailures >= config.C.MaxAuthFailures {
+				s.reply(421, fmt.Sprintf("%s Too many failed authentications, closing connection", s.hostname))
+				return fmt.Errorf("%d failed AUTH attempts", s.authFailures)
+			}
+			return s.reply(535, "Authentication failed")
+		}
+		if done {
+			s.auth = true
+			s.setUser(mech.User())
+			return s.reply(235, "Authentication successful")
+		}
 
-	if len(parts) > 1 {
-		credentials = parts[1]
-	} else {
-		if e := s.reply(334, ""); e != nil {
+		if e := s.reply(334, base64.StdEncoding.EncodeToString(challenge)); e != nil {
 			return e
 		}
 		line, err := s.reader.ReadLine()
 		if err != nil {
 			return err
 		}
-		credentials = line
-	}
-
-	// Decode and verify credentials
-	if s.server.AuthenticatePlain(credentials) {
-		s.auth = true
-		return s.reply(235, "Authentication successful")
-	}
-
-	return s.reply(535, "Authentication failed")
-}
-
-func (s *Session) handleAuthLogin() error {
-	// Request username
-	if e := s.reply(334, "VXNlcm5hbWU6"); e != nil {
-		return e // "Username:" base64
-	}
-
-	username, err := s.reader.ReadLine()
-	if err != nil {
-		return err
-	}
-
-	// Request password
-	if e := s.reply(334, "UGFzc3dvcmQ6"); e != nil {
-		return e // "Password:" base64
-	}
-	password, err := s.reader.ReadLine()
-	if err != nil {
-		return err
-	}
-
-	ok, err := s.server.AuthenticateLogin(username, password)
-	log.Printf("handleAuthLogin e=" + err.Error())
-	if ok {
-		s.auth = true
-		return s.reply(235, "Authentication successful")
-	}
-
-	return s.reply(535, "Authentication failed")
-}
-
-func (s *Session) extractEmail(arg string) string {
-	// Handle <email> format
-	start := strings.Index(arg, "<")
-	end := strings.Index(arg, ">")
-
-	if start != -1 && end != -1 && end > start {
-		return strings.ToLower(arg[start+1 : end])
-	}
-
-	// Handle plain email
-	arg = strings.ToLower(strings.TrimSpace(arg))
-	if strings.Contains(arg, "@") {
-		return arg
+		if line == "*" {
+			return s.reply(501, "Authentication cancelled")
+		}
+		if response, err = base64.StdEncoding.DecodeString(line); err != nil {
+			return s.reply(501, "Invalid base64 data")
+		}
 	}
-
-	return ""
 }
 
 func (s *Session) isLocalDomain(domain string) bool {
@@ -445,7 +867,7 @@ func (s *Session) isLocalDomain(domain string) bool {
 func (s *Session) isSenderWhitelisted(email string) bool {
 	// Check using suffixmatch
 	for _, w := range config.C.WhitelistEmails {
-		if strings.HasSuffix(email, w) {
+		if strings.HasSuffix(strings.ToLower(email), strings.ToLower(w)) {
 			return true
 		}
 	}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/mpdroog/mymail/smtpd/config"
+	"github.com/mpdroog/mymail/smtpd/whitelist"
+)
+
+// TestReadDataSmuggling feeds the SMTP smuggling vectors to readData, only
+// <CRLF>.<CRLF> may end the data and anything with a bare CR or LF is rejected
+func TestReadDataSmuggling(t *testing.T) {
+	config.C.MaxHeaderSize = 64 * 1024
+	config.C.MaxHeaderLine = 4096
+	config.C.MaxReceived = 50
+
+	type result struct {
+		data string
+		code int
+	}
+	smuggled := "MAIL FROM:<x@y.nl>\r\nRCPT TO:<a@b.nl>\r\nDATA\r\nevil"
+	patterns := map[string]result{
+		"Subject: hi\r\n\r\nbody\r\n.\r\n":  {"Subject: hi\r\n\r\nbody\r\n", 0},
+		"a\r\n..b\r\n.\r\n":                 {"a\r\n.b\r\n", 0},
+		"a\n.\n" + smuggled + "\r\n.\r\n":   {"", 554},
+		"a\r\n.\n" + smuggled + "\r\n.\r\n": {"", 554},
+		"a\n.\r\n" + smuggled + "\r\n.\r\n": {"", 554},
+		"a\r.\r" + smuggled + "\r\n.\r\n":   {"", 554},
+		"a\r\n.\r" + smuggled + "\r\n.\r\n": {"", 554},
+		"a\r\n\r\nb\rc\r\n.\r\n":            {"", 554},
+	}
+	for input, expect := range patterns {
+		client, server := net.Pipe()
+		s := NewSession(server, nil)
+		go func() {
+			client.Write([]byte(input))
+			client.Close()
+		}()
+
+		data, err := s.readData()
+		server.Close()
+
+		var reject *smtpError
+		if expect.code != 0 {
+			if !errors.As(err, &reject) || reject.code != expect.code {
+				t.Errorf("readData(%q) e=%v expect=%d", input, err, expect.code)
+			}
+			continue
+		}
+		if err != nil || string(data) != expect.data {
+			t.Errorf("readData(%q)=%q e=%v expect=%q", input, data, err, expect.data)
+		}
+	}
+}
+
+// TestReadDataLongLine sends lines without LF longer than the limits, they
+// are rejected without being buffered and the data is drained to its end
+func TestReadDataLongLine(t *testing.T) {
+	config.C.MaxSize, config.C.MaxSizeStr = 1024, "1KB"
+	config.C.MaxHeaderSize = 64 * 1024
+	config.C.MaxHeaderLine = 100
+	config.C.MaxReceived = 50
+	defer func() {
+		config.C.MaxSize, config.C.MaxSizeStr = 0, ""
+	}()
+
+	long := strings.Repeat("x", 64*1024)
+	patterns := map[string]int{
+		"Subject: " + long + "\r\n\r\nhi\r\n.\r\n":         552,
+		"Subject: hi\r\n\r\n" + long + "\r\n.\r\n":         552,
+		"Subject: hi\r\n\r\n" + long + "\r\nmore\r\n.\r\n": 552,
+	}
+	for input, expect := range patterns {
+		client, server := net.Pipe()
+		s := NewSession(server, nil)
+		go func() {
+			client.Write([]byte(input + "NOOP\r\n"))
+			client.Close()
+		}()
+
+		_, err := s.readData()
+		var reject *smtpError
+		if !errors.As(err, &reject) || reject.code != expect {
+			t.Errorf("readData(%.20q) e=%v expect=%d", input, err, expect)
+		}
+		if next, err := s.reader.ReadLine(); err != nil || next != "NOOP" {
+			t.Errorf("readData(%.20q) didn't drain to the end, next=%q e=%v", input, next, err)
+		}
+		server.Close()
+	}
+}
+
+// TestWhitelistDomain checks a whitelist+ recipient extends the list of the
+// user in the recipient's domain, not in the first local domain
+func TestWhitelistDomain(t *testing.T) {
+	config.C.LocalDomains = []string{"example.com", "example.org"}
+	config.C.WhitelistDir = t.TempDir()
+	config.C.MaxRecipients = 10
+	defer func() {
+		config.C.LocalDomains = nil
+		config.C.WhitelistDir = ""
+	}()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	s := NewSession(server, nil)
+	s.mail, s.auth, s.user = true, true, "mark"
+	go bufio.NewReader(client).ReadString('\n')
+	if err := s.handleRCPT("TO:<whitelist+john=example.net@example.org>"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.addToWhitelist(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !whitelist.Allowed(config.C.WhitelistDir, "mark@example.org", "john@example.net") {
+		t.Errorf("mark@example.org doesn't allow john@example.net")
+	}
+	if whitelist.Allowed(config.C.WhitelistDir, "mark@example.com", "john@example.net") {
+		t.Errorf("mark@example.com allows john@example.net")
+	}
+}
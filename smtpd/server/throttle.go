@@ -0,0 +1,29 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/mpdroog/mymail/smtpd/watchdog"
+)
+
+// Authenticated senders hear about throttles from the reply instead of their
+// mail waiting in the queue: a suspension or a destination paused for our
+// reputation is a 452 with when to retry, and the reply to DATA says how
+// much of the watchdog's hourly allowance is left.
+
+// retryAfter is a Retry-After style hint for a throttle that ends at until
+func retryAfter(until time.Time) string {
+	return "retry after " + until.UTC().Format(http.TimeFormat)
+}
+
+// relayAllowance is appended to the reply to DATA of user, empty when the
+// watchdog is disabled
+func relayAllowance(user string) string {
+	left, reset, ok := watchdog.Remaining(user)
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf(", %d relay recipients left until %s", left, reset.UTC().Format(http.TimeFormat))
+}
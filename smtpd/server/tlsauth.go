@@ -0,0 +1,58 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"os"
+
+	"github.com/mpdroog/mymail/smtpd/config"
+)
+
+// tlsConfig returns the server TLS config presenting certs, the first is
+// the default when the client sends no SNI name any of them matches. With
+// tls_client_ca clients may present a certificate, see certUser.
+func tlsConfig(certs []tls.Certificate) (*tls.Config, error) {
+	c := &tls.Config{
+		Certificates: certs,
+	}
+
+	if config.C.TLSClientCA != "" {
+		pem, err := os.ReadFile(config.C.TLSClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in tls_client_ca %s", config.C.TLSClientCA)
+		}
+		c.ClientCAs = pool
+		c.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return c, nil
+}
+
+// certUser returns the account a verified client certificate maps to in
+// client_certs, by SHA-256 fingerprint first and then by common name
+func certUser(state tls.ConnectionState) string {
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	leaf := state.PeerCertificates[0]
+	sum := sha256.Sum256(leaf.Raw)
+	if user, ok := config.C.ClientCerts["sha256:"+hex.EncodeToString(sum[:])]; ok {
+		return user
+	}
+	if leaf.Subject.CommonName != "" {
+		return config.C.ClientCerts[leaf.Subject.CommonName]
+	}
+	return ""
+}
+
+// authenticateCert takes the account of the client certificate, if any, as
+// the transport identity
+func (s *Session) authenticateCert(state tls.ConnectionState) {
+	s.setExternal(certUser(state), "Client certificate")
+}
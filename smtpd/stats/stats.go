@@ -0,0 +1,370 @@
+package stats
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mpdroog/mymail/smtpd/logging"
+)
+
+// Event kinds
+const (
+	Sent     = "sent"
+	Received = "received"
+	Rejected = "rejected"
+	Bounced  = "bounced"
+)
+
+const dateFormat = "2006-01-02"
+
+type Counters struct {
+	Sent     int `json:"sent"`
+	Received int `json:"received"`
+	Rejected int `json:"rejected"`
+	Bounced  int `json:"bounced"`
+}
+
+func (c *Counters) add(kind string) {
+	switch kind {
+	case Sent:
+		c.Sent++
+	case Received:
+		c.Received++
+	case Rejected:
+		c.Rejected++
+	case Bounced:
+		c.Bounced++
+	}
+}
+
+// Outcomes of a delivery attempt
+const (
+	Delivered = "delivered"
+	Deferred  = "deferred"
+	Failed    = "failed"
+)
+
+// Outbound counts the delivery attempts to one destination domain, an
+// attempt is one recipient tried once
+type Outbound struct {
+	Attempts   int            `json:"attempts"`
+	Delivered  int            `json:"delivered"`
+	Deferred   int            `json:"deferred"`
+	Failed     int            `json:"failed"`
+	TLS        int            `json:"tls"`                  // Attempts over TLS
+	LatencyMS  int64          `json:"latency_ms"`           // Sum over the attempts
+	Rejections map[string]int `json:"rejections,omitempty"` // By reputation category
+}
+
+// Add sums o2 into o
+func (o *Outbound) Add(o2 *Outbound) {
+	o.Attempts += o2.Attempts
+	o.Delivered += o2.Delivered
+	o.Deferred += o2.Deferred
+	o.Failed += o2.Failed
+	o.TLS += o2.TLS
+	o.LatencyMS += o2.LatencyMS
+	for category, n := range o2.Rejections {
+		if o.Rejections == nil {
+			o.Rejections = make(map[string]int)
+		}
+		o.Rejections[category] += n
+	}
+}
+
+// Latency returns the average duration of an attempt
+func (o *Outbound) Latency() time.Duration {
+	if o.Attempts == 0 {
+		return 0
+	}
+	return time.Duration(o.LatencyMS/int64(o.Attempts)) * time.Millisecond
+}
+
+// Day holds all counters of one day, stored as {stats_dir}/{date}.json
+type Day struct {
+	Date     string               `json:"date"`
+	Users    map[string]*Counters `json:"users"`
+	Domains  map[string]*Counters `json:"domains"`
+	Outbound map[string]*Outbound `json:"outbound"` // By destination domain
+}
+
+func newDay(date string) *Day {
+	return &Day{
+		Date:     date,
+		Users:    make(map[string]*Counters),
+		Domains:  make(map[string]*Counters),
+		Outbound: make(map[string]*Outbound),
+	}
+}
+
+var (
+	mu    sync.Mutex
+	dir   string
+	today *Day
+	dirty bool
+	quit  chan struct{}
+)
+
+// Init loads today's counters from statsDir and flushes them every minute.
+// When statsDir is empty recording is disabled.
+func Init(statsDir string) error {
+	if statsDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(statsDir, 0750); err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	dir = statsDir
+	d, err := LoadDay(dir, time.Now().Format(dateFormat))
+	if err != nil {
+		return err
+	}
+	today = d
+	quit = make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(1 * time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := Flush(); err != nil {
+					log.Printf(logging.Err+"stats.Flush e=%v", err)
+				}
+			case <-quit:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop writes pending counters to disk
+func Stop() error {
+	mu.Lock()
+	if quit != nil {
+		close(quit)
+		quit = nil
+	}
+	mu.Unlock()
+	return Flush()
+}
+
+// Record counts an event for the local user and the remote domain
+func Record(kind, user, domain string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if today == nil {
+		return
+	}
+
+	rollover()
+	if user != "" {
+		if today.Users[user] == nil {
+			today.Users[user] = &Counters{}
+		}
+		today.Users[user].add(kind)
+	}
+	if domain != "" {
+		if today.Domains[domain] == nil {
+			today.Domains[domain] = &Counters{}
+		}
+		today.Domains[domain].add(kind)
+	}
+	dirty = true
+}
+
+// RecordDelivery counts an attempt to deliver to a recipient at domain with
+// its outcome, category is the reputation category of a rejection
+func RecordDelivery(domain, outcome string, tls bool, took time.Duration, category string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if today == nil || domain == "" {
+		return
+	}
+	rollover()
+	if today.Outbound == nil {
+		// A day written before outbound counters
+		today.Outbound = make(map[string]*Outbound)
+	}
+	o := today.Outbound[domain]
+	if o == nil {
+		o = &Outbound{}
+		today.Outbound[domain] = o
+	}
+	o.Attempts++
+	switch outcome {
+	case Delivered:
+		o.Delivered++
+	case Deferred:
+		o.Deferred++
+	case Failed:
+		o.Failed++
+	}
+	if tls {
+		o.TLS++
+	}
+	o.LatencyMS += took.Milliseconds()
+	if category != "" {
+		if o.Rejections == nil {
+			o.Rejections = make(map[string]int)
+		}
+		o.Rejections[category]++
+	}
+	dirty = true
+}
+
+// OutboundToday returns a copy of today's delivery counters by domain, nil
+// when recording is disabled
+func OutboundToday() map[string]Outbound {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if today == nil {
+		return nil
+	}
+	rollover()
+	out := make(map[string]Outbound, len(today.Outbound))
+	for domain, o := range today.Outbound {
+		c := Outbound{}
+		c.Add(o)
+		out[domain] = c
+	}
+	return out
+}
+
+// rollover starts a new day at midnight, mu must be held
+func rollover() {
+	date := time.Now().Format(dateFormat)
+	if date != today.Date {
+		if err := save(today); err != nil {
+			log.Printf(logging.Err+"stats.save e=%v", err)
+		}
+		today = newDay(date)
+	}
+}
+
+// Flush writes today's counters if they changed
+func Flush() error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if today == nil || !dirty {
+		return nil
+	}
+	if err := save(today); err != nil {
+		return err
+	}
+	dirty = false
+	return nil
+}
+
+func save(d *Day) error {
+	return saveIn(dir, d)
+}
+
+func saveIn(statsDir string, d *Day) error {
+	data, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write+rename so readers never see a partial file
+	path := filepath.Join(statsDir, d.Date+".json")
+	if err := os.WriteFile(path+".tmp", data, 0640); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// LoadDay reads the counters of one day, a missing file is an empty day
+func LoadDay(statsDir, date string) (*Day, error) {
+	data, err := os.ReadFile(filepath.Join(statsDir, date+".json"))
+	if os.IsNotExist(err) {
+		return newDay(date), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	d := newDay(date)
+	if err := json.Unmarshal(data, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// LoadRange reads all days from..to (inclusive), oldest first
+func LoadRange(statsDir string, from, to time.Time) ([]*Day, error) {
+	var days []*Day
+	for t := from; !t.After(to); t = t.AddDate(0, 0, 1) {
+		d, err := LoadDay(statsDir, t.Format(dateFormat))
+		if err != nil {
+			return nil, err
+		}
+		days = append(days, d)
+	}
+	return days, nil
+}
+
+// Dates returns the days with counters in statsDir, oldest first
+func Dates(statsDir string) ([]string, error) {
+	entries, err := os.ReadDir(statsDir)
+	if err != nil {
+		return nil, err
+	}
+	var dates []string
+	for _, e := range entries {
+		date, ok := strings.CutSuffix(e.Name(), ".json")
+		if _, err := time.Parse(dateFormat, date); ok && err == nil {
+			dates = append(dates, date)
+		}
+	}
+	sort.Strings(dates)
+	return dates, nil
+}
+
+// Forget removes the counters of user from every day in statsDir, a
+// running smtpd still has today's in memory and writes them back
+func Forget(statsDir, user string) error {
+	dates, err := Dates(statsDir)
+	if err != nil {
+		return err
+	}
+	for _, date := range dates {
+		d, err := LoadDay(statsDir, date)
+		if err != nil {
+			return err
+		}
+		if _, ok := d.Users[user]; !ok {
+			continue
+		}
+		delete(d.Users, user)
+		if err := saveIn(statsDir, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SortedKeys returns the map keys in alphabetical order
+func SortedKeys(m map[string]*Counters) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
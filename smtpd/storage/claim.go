@@ -0,0 +1,183 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mpdroog/mymail/smtpd/logging"
+)
+
+// Instances sharing queue_dir (NFS or a replicated directory) deliver a
+// queue entry only while they hold its {id}.claim. The claim is created
+// exclusively and holds the instance_id, so of two instances picking up the
+// same entry one gets it and the other skips it. A claim older than
+// queue_claim_ttl is left by an instance that died while delivering and is
+// taken over, the holder refreshes it while delivering (see KeepClaim). One
+// instance on its own claims as well, its claims are simply never contended.
+
+var (
+	claimsMu sync.Mutex
+	claims   = make(map[string]bool) // instance_id and claim path => held by this process
+)
+
+func (s *Storage) claimPath(id string) string {
+	return filepath.Join(s.queueDir, id+".claim")
+}
+
+// Claim takes the claim of queue entry id, false when another instance holds
+// it or it's held elsewhere in this process. A claim with this instance's own
+// instance_id held by no one in this process is left from before a restart
+// and taken again.
+func (s *Storage) Claim(id string) (bool, error) {
+	path := s.claimPath(id)
+	key := s.instance + " " + path
+	claimsMu.Lock()
+	defer claimsMu.Unlock()
+	if claims[key] {
+		return false, nil
+	}
+
+	ok, err := s.claim(id, path)
+	if ok && err == nil {
+		claims[key] = true
+	}
+	return ok, err
+}
+
+func (s *Storage) claim(id, path string) (bool, error) {
+	for attempt := 0; attempt < 3; attempt++ {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+		if err == nil {
+			_, err = f.WriteString(s.instance)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				os.Remove(path)
+				return false, err
+			}
+			return true, nil
+		}
+		if !os.IsExist(err) {
+			return false, err
+		}
+
+		holder, info, err := readClaim(path)
+		if os.IsNotExist(err) {
+			// Released meanwhile
+			continue
+		} else if err != nil {
+			return false, err
+		}
+		if holder == s.instance {
+			return true, os.Chtimes(path, time.Now(), time.Now())
+		}
+		if time.Since(info.ModTime()) < s.claimTTL {
+			return false, nil
+		}
+
+		// Move the expired claim aside under a name of our own, of several
+		// instances doing so at once only one finds it there
+		stale := path + ".stale-" + s.instance
+		if err := os.Rename(path, stale); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return false, err
+		}
+		if _, info, err := readClaim(stale); err == nil && time.Since(info.ModTime()) < s.claimTTL {
+			// Another instance took it over between readClaim and Rename,
+			// it's theirs
+			os.Link(stale, path)
+			os.Remove(stale)
+			return false, nil
+		}
+		os.Remove(stale)
+		log.Printf("Claim of %s by %s expired, taking over", id, holder)
+	}
+	return false, nil
+}
+
+// KeepClaim refreshes the claim of id every third of queue_claim_ttl until
+// the returned stop is called, so a delivery that takes long isn't taken over
+// by another instance
+func (s *Storage) KeepClaim(id string) (stop func()) {
+	if s.claimTTL <= 0 {
+		return func() {}
+	}
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(s.claimTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := s.refreshClaim(id); err != nil {
+					log.Printf(logging.Err+"refreshClaim(%s) e=%v", id, err)
+				}
+			case <-quit:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(quit)
+		<-done
+	}
+}
+
+// refreshClaim renews the claim of id, unless it was taken over meanwhile
+func (s *Storage) refreshClaim(id string) error {
+	path := s.claimPath(id)
+	holder, _, err := readClaim(path)
+	if err != nil {
+		return err
+	}
+	if holder != s.instance {
+		return fmt.Errorf("claim taken over by %s", holder)
+	}
+	now := time.Now()
+	return os.Chtimes(path, now, now)
+}
+
+// Release gives up the claim of id, unless it was taken over meanwhile
+func (s *Storage) Release(id string) error {
+	path := s.claimPath(id)
+	claimsMu.Lock()
+	delete(claims, s.instance+" "+path)
+	claimsMu.Unlock()
+
+	holder, _, err := readClaim(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if holder != s.instance {
+		log.Printf("Claim of %s was taken over by %s", id, holder)
+		return nil
+	}
+	return os.Remove(path)
+}
+
+// readClaim returns the instance_id in the claim at path and its file info
+func readClaim(path string) (string, os.FileInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", nil, err
+	}
+	buf := make([]byte, 256)
+	n, _ := f.Read(buf)
+	return string(bytes.TrimSpace(buf[:n])), info, nil
+}
@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// TestClaim shares one queue_dir between two instances
+func TestClaim(t *testing.T) {
+	dir := t.TempDir()
+	a := &Storage{queueDir: dir, instance: "a", claimTTL: time.Minute}
+	b := &Storage{queueDir: dir, instance: "b", claimTTL: time.Minute}
+
+	claim := func(s *Storage, id string, expect bool) {
+		t.Helper()
+		ok, err := s.Claim(id)
+		if err != nil || ok != expect {
+			t.Fatalf("%s Claim=%v e=%v expect=%v", s.instance, ok, err, expect)
+		}
+	}
+	claim(a, "1-1", true)
+	claim(b, "1-1", false)
+	// Held by another goroutine of a
+	claim(a, "1-1", false)
+	// Left from before a restart of a
+	delete(claims, "a "+a.claimPath("1-1"))
+	claim(a, "1-1", true)
+	if err := a.Release("1-1"); err != nil {
+		t.Fatal(err)
+	}
+	claim(b, "1-1", true)
+
+	// b died while delivering
+	old := time.Now().Add(-2 * time.Minute)
+	os.Chtimes(b.claimPath("1-1"), old, old)
+	claim(a, "1-1", true)
+	if err := b.Release("1-1"); err != nil {
+		t.Fatal(err)
+	}
+	if holder, _, err := readClaim(a.claimPath("1-1")); err != nil || holder != "a" {
+		t.Errorf("holder=%q e=%v, b released the claim it lost", holder, err)
+	}
+
+	// Recover leaves what b is delivering alone
+	email := &QueuedEmail{ID: "2-1", Status: StatusDelivering, Recipients: []Recipient{
+		{Address: "a@example.com", Status: RcptInFlight},
+	}}
+	if err := a.UpdateQueuedEmail(email); err != nil {
+		t.Fatal(err)
+	}
+	claim(b, "2-1", true)
+	a.mailDir = t.TempDir()
+	if err := a.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := a.GetQueuedEmail("2-1")
+	if err != nil || got.Recipients[0].Status != RcptInFlight {
+		t.Errorf("Recover reset a claimed entry: %+v e=%v", got, err)
+	}
+}
+
+// TestKeepClaim checks a long delivery isn't taken over
+func TestKeepClaim(t *testing.T) {
+	dir := t.TempDir()
+	a := &Storage{queueDir: dir, instance: "a", claimTTL: 300 * time.Millisecond}
+	b := &Storage{queueDir: dir, instance: "b", claimTTL: 300 * time.Millisecond}
+
+	if ok, err := a.Claim("1-1"); !ok || err != nil {
+		t.Fatalf("Claim=%v e=%v", ok, err)
+	}
+	stop := a.KeepClaim("1-1")
+	time.Sleep(500 * time.Millisecond)
+	if ok, err := b.Claim("1-1"); ok || err != nil {
+		t.Errorf("b took over a refreshed claim, e=%v", err)
+	}
+	stop()
+	time.Sleep(400 * time.Millisecond)
+	if ok, err := b.Claim("1-1"); !ok || err != nil {
+		t.Errorf("b didn't take over after stop, e=%v", err)
+	}
+}
+
+// TestHoldClaimed checks a hold doesn't write the entry another instance is
+// delivering
+func TestHoldClaimed(t *testing.T) {
+	dir := t.TempDir()
+	a := &Storage{queueDir: dir, instance: "a", claimTTL: time.Minute}
+	b := &Storage{queueDir: dir, instance: "b", claimTTL: time.Minute}
+
+	email := &QueuedEmail{ID: "1-1", Status: StatusDeferred}
+	if err := a.UpdateQueuedEmail(email); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := b.Claim("1-1"); !ok || err != nil {
+		t.Fatalf("Claim=%v e=%v", ok, err)
+	}
+	if err := a.SetMessageHold("1-1", true); err != nil {
+		t.Fatal(err)
+	}
+	got, err := a.GetQueuedEmail("1-1")
+	if err != nil || !got.Held || got.Status != StatusDeferred {
+		t.Errorf("claimed: %+v e=%v, expect held by marker only", got, err)
+	}
+
+	b.Release("1-1")
+	if err := a.SetMessageHold("1-1", true); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := a.GetQueuedEmail("1-1"); err != nil || got.Status != StatusHeld {
+		t.Errorf("released: %+v e=%v", got, err)
+	}
+}
@@ -0,0 +1,221 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mpdroog/mymail/smtpd/config"
+	"github.com/mpdroog/mymail/smtpd/logging"
+)
+
+// Attachment is the metadata stored next to a detached attachment blob
+type Attachment struct {
+	ID          string    `json:"id"`
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	CreatedAt   time.Time `json:"created_at"`
+	Recipients  []string  `json:"recipients"` // Who may download it
+}
+
+// DetachAttachments moves attachments larger than config.C.DetachSize into the
+// attachment store and replaces them with a short text part carrying an
+// X-Detached header with the download URL, for recipients and admins only. On
+// any error the original message is returned so delivery never fails because
+// of detaching.
+func (s *Storage) DetachAttachments(data []byte, recipients []string) []byte {
+	if s.attachmentDir == "" || config.C.DetachSize <= 0 || int64(len(data)) < config.C.DetachSize {
+		return data
+	}
+
+	header, body, ok := splitMessage(data)
+	if !ok {
+		return data
+	}
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return data
+	}
+
+	newBody, err := s.detachMultipart(body, params["boundary"], recipients)
+	if err != nil {
+		log.Printf(logging.Err+"DetachAttachments e=%v", err)
+		return data
+	}
+
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:len(data)-len(body)]...)
+	return append(out, newBody...)
+}
+
+func (s *Storage) detachMultipart(body []byte, boundary string, recipients []string) ([]byte, error) {
+	if boundary == "" {
+		return body, nil
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	if err := mw.SetBoundary(boundary); err != nil {
+		return nil, err
+	}
+
+	mr := multipart.NewReader(bytes.NewReader(body), boundary)
+	for {
+		part, err := mr.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		raw, err := io.ReadAll(part)
+		if err != nil {
+			return nil, err
+		}
+
+		partHeader := part.Header
+		mediaType, params, _ := mime.ParseMediaType(partHeader.Get("Content-Type"))
+		if strings.HasPrefix(mediaType, "multipart/") {
+			raw, err = s.detachMultipart(raw, params["boundary"], recipients)
+			if err != nil {
+				return nil, err
+			}
+		} else if part.FileName() != "" && int64(len(raw)) >= config.C.DetachSize {
+			partHeader, raw, err = s.detachPart(part, raw, recipients)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		pw, err := mw.CreatePart(partHeader)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := pw.Write(raw); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// detachPart stores the decoded attachment and returns the replacement part
+func (s *Storage) detachPart(part *multipart.Part, raw []byte, recipients []string) (textproto.MIMEHeader, []byte, error) {
+	content, err := decodeTransfer(part.Header.Get("Content-Transfer-Encoding"), raw)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	a := Attachment{
+		ID:          generateAttachmentID(),
+		Filename:    part.FileName(),
+		ContentType: part.Header.Get("Content-Type"),
+		Size:        int64(len(content)),
+		CreatedAt:   time.Now(),
+		Recipients:  recipients,
+	}
+	if err := s.storeAttachment(&a, content); err != nil {
+		return nil, nil, err
+	}
+
+	url := strings.TrimSuffix(config.C.AttachmentURL, "/") + "/attachments/" + a.ID
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": a.Filename + ".txt"}))
+	header.Set("X-Detached", url)
+
+	note := fmt.Sprintf("The attachment %q (%d bytes) was detached from this message.\r\nDownload: %s\r\n", a.Filename, a.Size, url)
+	return header, []byte(note), nil
+}
+
+func (s *Storage) storeAttachment(a *Attachment, content []byte) error {
+	if err := os.WriteFile(filepath.Join(s.attachmentDir, a.ID), content, 0640); err != nil {
+		return err
+	}
+
+	f, err := os.Create(filepath.Join(s.attachmentDir, a.ID+".json"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(a)
+}
+
+// OpenAttachment returns the blob and metadata of a detached attachment
+func (s *Storage) OpenAttachment(id string) (*os.File, *Attachment, error) {
+	if s.attachmentDir == "" {
+		return nil, nil, os.ErrNotExist
+	}
+	if _, err := hex.DecodeString(id); err != nil || id == "" {
+		return nil, nil, os.ErrNotExist
+	}
+
+	meta, err := os.ReadFile(filepath.Join(s.attachmentDir, id+".json"))
+	if err != nil {
+		return nil, nil, err
+	}
+	var a Attachment
+	if err := json.Unmarshal(meta, &a); err != nil {
+		return nil, nil, err
+	}
+
+	f, err := os.Open(filepath.Join(s.attachmentDir, id))
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, &a, nil
+}
+
+// splitMessage parses the top-level header and returns the body
+func splitMessage(data []byte) (textproto.MIMEHeader, []byte, bool) {
+	sep := []byte("\r\n\r\n")
+	idx := bytes.Index(data, sep)
+	if idx == -1 {
+		sep = []byte("\n\n")
+		idx = bytes.Index(data, sep)
+	}
+	if idx == -1 {
+		return nil, nil, false
+	}
+
+	header, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(data[:idx+len(sep)]))).ReadMIMEHeader()
+	if err != nil {
+		return nil, nil, false
+	}
+	return header, data[idx+len(sep):], true
+}
+
+func decodeTransfer(cte string, body []byte) ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(cte)) {
+	case "base64":
+		clean := strings.NewReplacer("\r", "", "\n", "").Replace(string(body))
+		return base64.StdEncoding.DecodeString(clean)
+	case "quoted-printable":
+		return io.ReadAll(quotedprintable.NewReader(bytes.NewReader(body)))
+	}
+	return body, nil
+}
+
+func generateAttachmentID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
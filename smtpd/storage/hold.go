@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// holdsMu serializes read-modify-write of the holds file
+var holdsMu sync.Mutex
+
+// Holds are queue-wide and per-domain delivery holds, stored in queue_dir/.holds.
+// Individual messages are held with a {id}.hold marker so delivery updates
+// of the queue entry can't clear it.
+type Holds struct {
+	All     bool     `json:"all"`
+	Domains []string `json:"domains"`
+}
+
+// DomainHeld returns true if delivery to domain is on hold
+func (h *Holds) DomainHeld(domain string) bool {
+	for _, d := range h.Domains {
+		if strings.EqualFold(d, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Storage) GetHolds() (*Holds, error) {
+	h := &Holds{}
+	data, err := os.ReadFile(filepath.Join(s.queueDir, ".holds"))
+	if os.IsNotExist(err) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, h); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// UpdateHolds applies fn to the current holds and saves the result
+func (s *Storage) UpdateHolds(fn func(h *Holds)) error {
+	holdsMu.Lock()
+	defer holdsMu.Unlock()
+
+	h, err := s.GetHolds()
+	if err != nil {
+		return err
+	}
+	fn(h)
+
+	data, err := json.MarshalIndent(h, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(s.queueDir, ".holds"), data, 0640)
+}
+
+// HoldDomain puts delivery to domain on hold (held=true) or releases it
+func (s *Storage) HoldDomain(domain string, held bool) error {
+	return s.UpdateHolds(func(h *Holds) {
+		var domains []string
+		for _, d := range h.Domains {
+			if !strings.EqualFold(d, domain) {
+				domains = append(domains, d)
+			}
+		}
+		if held {
+			domains = append(domains, strings.ToLower(domain))
+		}
+		h.Domains = domains
+	})
+}
+
+// SetMessageHold puts a single queued message on hold or releases it
+func (s *Storage) SetMessageHold(id string, held bool) error {
+	if id == "" || strings.ContainsAny(id, `/\`) {
+		return os.ErrNotExist
+	}
+	if _, err := os.Stat(filepath.Join(s.queueDir, id+".json")); err != nil {
+		return err
+	}
+
+	marker := filepath.Join(s.queueDir, id+".hold")
+	if !held {
+		if err := os.Remove(marker); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else if err := os.WriteFile(marker, nil, 0640); err != nil {
+		return err
+	}
+
+	// The marker decides, the status is for the history. A message being
+	// delivered keeps its status, delivery writes the entry when done.
+	claimed, err := s.Claim(id)
+	if err != nil || !claimed {
+		return err
+	}
+	defer s.Release(id)
+	email, err := s.loadQueuedEmail(filepath.Join(s.queueDir, id+".json"))
+	if err != nil {
+		return err
+	}
+	switch {
+	case held && email.Status != StatusDelivering:
+		email.SetStatus(StatusHeld)
+	case !held && email.Status == StatusHeld:
+		email.SetStatus(StatusDeferred)
+	default:
+		return nil
+	}
+	return s.UpdateQueuedEmail(email)
+}
+
+func (s *Storage) isMessageHeld(id string) bool {
+	_, err := os.Stat(filepath.Join(s.queueDir, id+".hold"))
+	return err == nil
+}
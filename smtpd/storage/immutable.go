@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Message files ({unix}_{uid}.eml) are immutable: they are written once under
+// a temporary name, made read-only and linked into place. Everything that
+// changes later lives next to them, flags in {file}.flags and the UID counter
+// in .uidnext, and imapd hard links a message on COPY. Backups (rsync, btrfs
+// snapshots) can rely on a message file never changing once it exists, see
+// "mymail verify-immutability".
+
+// WriteMessage stores r as the message file path with perm minus the write
+// bits. It fails instead of replacing an existing message.
+func WriteMessage(path string, r io.Reader, perm os.FileMode) error {
+	tmp, err := WriteTemp(filepath.Dir(path), r, perm&^0222)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	if err := os.Link(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// WriteTemp writes r to a new temporary file in dir with perm and syncs it
+// to disk. The caller links or renames it into place and removes the
+// temporary name.
+func WriteTemp(dir string, r io.Reader, perm os.FileMode) (string, error) {
+	// Dot prefix and no .eml suffix so imapd doesn't list half written files
+	tmp, err := os.CreateTemp(dir, ".tmp-")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(tmp, r)
+	if err == nil {
+		err = tmp.Chmod(perm)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// syncDir makes a new name in dir survive a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
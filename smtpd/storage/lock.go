@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// MailboxLock is the advisory lock of one mailbox directory. smtpd, imapd
+// and mymail take it on the mailbox's .lock file before they change the
+// .uidnext counter or a .flags sidecar, readers don't need it.
+type MailboxLock struct {
+	dir string
+	f   *os.File
+}
+
+// LockMailbox blocks until it holds the lock of the mailbox in dir. flock
+// is per open file, so a second LockMailbox on the same dir blocks as well,
+// also within one process.
+func LockMailbox(dir string) (*MailboxLock, error) {
+	f, err := os.OpenFile(filepath.Join(dir, ".lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &MailboxLock{dir: dir, f: f}, nil
+}
+
+// Unlock releases the lock
+func (l *MailboxLock) Unlock() error {
+	return l.f.Close()
+}
+
+// NextUID hands out the next UID of the locked mailbox, the counter is
+// renamed into place so a crash never leaves it half written. A lost or
+// damaged counter continues after the highest UID in the mailbox, with a
+// new UIDVALIDITY as UIDs of expunged messages may be handed out again.
+func (l *MailboxLock) NextUID() (int64, error) {
+	uidFile := filepath.Join(l.dir, ".uidnext")
+	uid := int64(0)
+	if data, err := os.ReadFile(uidFile); err == nil {
+		if n, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64); err == nil && n > 0 {
+			uid = n
+		}
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+	if uid == 0 {
+		highest, err := highestUID(l.dir)
+		if err != nil {
+			return 0, err
+		}
+		if highest > 0 {
+			if err := l.BumpUIDValidity(); err != nil {
+				return 0, err
+			}
+		}
+		uid = highest + 1
+	}
+	return uid, ReplaceFile(uidFile, []byte(strconv.FormatInt(uid+1, 10)), 0600)
+}
+
+// highestUID returns the highest UID of the {unix}_{uid}.eml files in dir
+func highestUID(dir string) (int64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	var highest int64
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".eml")
+		if !ok {
+			continue
+		}
+		if _, uid, ok := strings.Cut(name, "_"); ok {
+			if n, err := strconv.ParseInt(uid, 10, 64); err == nil && n > highest {
+				highest = n
+			}
+		}
+	}
+	return highest, nil
+}
+
+// BumpUIDValidity gives the locked mailbox a new .uidvalidity, imapd's
+// format, above the old one even within the same second
+func (l *MailboxLock) BumpUIDValidity() error {
+	file := filepath.Join(l.dir, ".uidvalidity")
+	v := time.Now().Unix()
+	if data, err := os.ReadFile(file); err == nil {
+		if n, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64); err == nil && n >= v {
+			v = n + 1
+		}
+	}
+	return ReplaceFile(file, []byte(strconv.FormatInt(v, 10)), 0400)
+}
+
+// WriteFlags replaces the .flags sidecar of the message file in the locked
+// mailbox, the format of imapd's SaveFlags
+func (l *MailboxLock) WriteFlags(file string, flags []string) error {
+	return ReplaceFile(filepath.Join(l.dir, file+".flags"), []byte(strings.Join(flags, "\n")), 0640)
+}
+
+// ReplaceFile atomically swaps the contents of path, a crash leaves the old
+// or the new version but never half of one
+func ReplaceFile(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// NextUID locks the mailbox in dir just to allocate a UID
+func NextUID(dir string) (int64, error) {
+	l, err := LockMailbox(dir)
+	if err != nil {
+		return 0, err
+	}
+	defer l.Unlock()
+	return l.NextUID()
+}
@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// TestNextUID allocates from several goroutines at once, no UID may be
+// handed out twice
+func TestNextUID(t *testing.T) {
+	dir := t.TempDir()
+	var (
+		mu   sync.Mutex
+		seen = make(map[int64]bool)
+		wg   sync.WaitGroup
+	)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				uid, err := NextUID(dir)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				if seen[uid] {
+					t.Errorf("uid %d handed out twice", uid)
+				}
+				seen[uid] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(seen) != 400 {
+		t.Errorf("got %d uids, want 400", len(seen))
+	}
+}
+
+// TestNextUIDRecover loses .uidnext of a mailbox with messages, UIDs go on
+// after the highest one under a new UIDVALIDITY
+func TestNextUIDRecover(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "1700000000_7.eml"), []byte("Subject: hi\r\n\r\n"), 0400)
+	os.WriteFile(filepath.Join(dir, ".uidvalidity"), []byte("1"), 0400)
+
+	uid, err := NextUID(dir)
+	if err != nil || uid != 8 {
+		t.Fatalf("uid=%d e=%v, expect 8", uid, err)
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, ".uidvalidity"))
+	if v, _ := strconv.ParseInt(string(data), 10, 64); v <= 1 {
+		t.Errorf("uidvalidity=%s not bumped", data)
+	}
+	if uid, _ := NextUID(dir); uid != 9 {
+		t.Errorf("uid=%d, expect 9", uid)
+	}
+}
@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mpdroog/mymail/smtpd/logging"
+)
+
+// staleTemp is the age after which a temporary file can't belong to a write
+// in progress, imapd shares the mail dir and may be writing at startup
+const staleTemp = time.Hour
+
+// Recover undoes what a crash left behind, call it at startup before the
+// queue processor runs. Recipients still in-flight were being delivered when
+// smtpd stopped, they are deferred and tried again right away: the remote
+// side may have the message already but a duplicate beats losing it. Entries
+// another instance sharing queue_dir holds a claim on are its business.
+func (s *Storage) Recover() error {
+	entries, err := os.ReadDir(s.queueDir)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		email, err := s.loadQueuedEmail(filepath.Join(s.queueDir, entry.Name()))
+		if err != nil {
+			// ListQueue skips it, so make it visible here at least
+			log.Printf(logging.Err+"Recover unreadable queue file %s e=%v", entry.Name(), err)
+			continue
+		}
+
+		inFlight := email.Status == StatusDelivering
+		for _, rcpt := range email.Recipients {
+			inFlight = inFlight || rcpt.Status == RcptInFlight
+		}
+		if !inFlight {
+			continue
+		}
+		claimed, err := s.Claim(email.ID)
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			continue
+		}
+		if err := s.recoverEmail(email.ID, now); err != nil {
+			s.Release(email.ID)
+			return err
+		}
+		if err := s.Release(email.ID); err != nil {
+			return err
+		}
+	}
+
+	for _, dir := range []string{s.queueDir, s.mailDir} {
+		if err := sweepTemp(dir, now.Add(-staleTemp)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recoverEmail defers the in-flight recipients of claimed queue entry id,
+// read again as its previous holder may have finished meanwhile
+func (s *Storage) recoverEmail(id string, now time.Time) error {
+	email, err := s.GetQueuedEmail(id)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for i := range email.Recipients {
+		rcpt := &email.Recipients[i]
+		if rcpt.Status != RcptInFlight {
+			continue
+		}
+		rcpt.Status = RcptDeferred
+		rcpt.LastError = "Interrupted by a restart"
+		rcpt.NextRetry = now
+		log.Printf("Recover email %s to %s was in-flight, redelivering", email.ID, rcpt.Address)
+	}
+	email.SetStatus(StatusDeferred)
+	email.UpdateNextRetry()
+	return s.UpdateQueuedEmail(email)
+}
+
+// sweepTemp removes the .tmp- files of WriteMessage and writeQueueFile
+// below dir older than before
+func sweepTemp(dir string, before time.Time) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || !strings.HasPrefix(d.Name(), ".tmp-") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || info.ModTime().After(before) {
+			return nil
+		}
+		log.Printf("Recover removing stale %s", path)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf(logging.Err+"sweepTemp e=%v", err)
+		}
+		return nil
+	})
+}
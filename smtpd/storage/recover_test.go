@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecover(t *testing.T) {
+	s := &Storage{mailDir: t.TempDir(), queueDir: t.TempDir()}
+	email := &QueuedEmail{ID: "1-1", Status: StatusDelivering, Recipients: []Recipient{
+		{Address: "a@example.com", Status: RcptInFlight, NextRetry: time.Now().Add(time.Hour)},
+		{Address: "b@example.com", Status: RcptDelivered},
+	}}
+	if err := s.UpdateQueuedEmail(email); err != nil {
+		t.Fatal(err)
+	}
+	inbox := filepath.Join(s.mailDir, "example.com", "a", "INBOX")
+	os.MkdirAll(inbox, 0750)
+	stale, fresh := filepath.Join(inbox, ".tmp-1"), filepath.Join(inbox, ".tmp-2")
+	os.WriteFile(stale, nil, 0640)
+	os.WriteFile(fresh, nil, 0640)
+	old := time.Now().Add(-2 * staleTemp)
+	os.Chtimes(stale, old, old)
+
+	if err := s.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.loadQueuedEmail(filepath.Join(s.queueDir, "1-1.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := got.Recipients[0]; r.Status != RcptDeferred || r.NextRetry.After(time.Now()) {
+		t.Errorf("in-flight recipient not reset: %+v", r)
+	}
+	if got.Status != StatusDeferred || len(got.History) != 1 {
+		t.Errorf("status=%s history=%v", got.Status, got.History)
+	}
+	if r := got.Recipients[1]; r.Status != RcptDelivered {
+		t.Errorf("delivered recipient changed: %+v", r)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("stale temp file kept e=%v", err)
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Errorf("fresh temp file removed e=%v", err)
+	}
+}
@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"time"
+)
+
+// Status of a queued message as a whole, Recipient.Status has the details
+//
+//	queued -> delivering -> deferred -> delivering -> ... -> delivered/bounced
+//
+// held can be entered from queued and deferred and returns to deferred
+const (
+	StatusQueued     = "queued"     // Not attempted yet
+	StatusDelivering = "delivering" // Handed to the queue processor
+	StatusDeferred   = "deferred"   // Some recipients wait for a retry
+	StatusHeld       = "held"       // On hold, see SetMessageHold
+	StatusDelivered  = "delivered"  // Done, at least one recipient accepted it
+	StatusBounced    = "bounced"    // Done, all recipients failed
+)
+
+// Transition is a status change of a queued message
+type Transition struct {
+	Status string    `json:"status"`
+	Time   time.Time `json:"time"`
+}
+
+// SetStatus moves e to status and records when, setting the current status
+// again is a no-op
+func (e *QueuedEmail) SetStatus(status string) {
+	if e.Status == status {
+		return
+	}
+	e.Status = status
+	e.History = append(e.History, Transition{Status: status, Time: time.Now()})
+}
+
+// FinalStatus is the status of a message with all recipients done
+func (e *QueuedEmail) FinalStatus() string {
+	for _, r := range e.Recipients {
+		if r.Status == RcptDelivered {
+			return StatusDelivered
+		}
+	}
+	return StatusBounced
+}
+
+// deriveStatus fills in Status for entries queued before it existed
+func (e *QueuedEmail) deriveStatus() {
+	if e.Status != "" {
+		return
+	}
+	e.Status = StatusQueued
+	for _, r := range e.Recipients {
+		if r.Attempts > 0 || r.Status != RcptQueued {
+			e.Status = StatusDeferred
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -8,29 +9,112 @@ import (
 	"strings"
 	"time"
 
+	"github.com/mpdroog/mymail/smtpd/calendar"
 	"github.com/mpdroog/mymail/smtpd/config"
+	"github.com/mpdroog/mymail/smtpd/dkim"
 )
 
 type Storage struct {
-	mailDir  string
-	queueDir string
+	mailDir       string
+	queueDir      string
+	attachmentDir string
+	instance      string        // Written into claims, see claim.go
+	claimTTL      time.Duration // Age after which a claim is taken over
 }
 
-type QueuedEmail struct {
-	ID        string    `json:"id"`
-	From      string    `json:"from"`
-	To        string    `json:"to"`
-	Data      []byte    `json:"data"`
-	CreatedAt time.Time `json:"created_at"`
+// Queue priority lanes, each drained by its own worker pool
+const (
+	PriorityInteractive = "interactive" // User submissions
+	PriorityBulk        = "bulk"        // Bounces and bulk/list mail
+)
+
+// Per-recipient delivery status
+const (
+	RcptQueued    = "queued"    // Not attempted yet
+	RcptDeferred  = "deferred"  // Temporary failure, will retry
+	RcptInFlight  = "in-flight" // Being delivered, reset by Recover after a crash
+	RcptDelivered = "delivered" // Accepted by the remote side
+	RcptBounced   = "bounced"   // Permanent failure, sender notified
+)
+
+type Recipient struct {
+	Address   string    `json:"address"`
+	Status    string    `json:"status"`
 	Attempts  int       `json:"attempts"`
 	LastError string    `json:"last_error"`
 	NextRetry time.Time `json:"next_retry"`
+	History   []Attempt `json:"history,omitempty"` // Oldest first
+
+	// Category of the last rejection when it was about our reputation,
+	// see reputation.Classify
+	Reputation string `json:"reputation,omitempty"`
+}
+
+// Attempt is one delivery try for a recipient
+type Attempt struct {
+	Time     time.Time `json:"time"`
+	Host     string    `json:"host,omitempty"` // MX or relay that answered, empty if none did
+	Duration string    `json:"duration"`
+	Code     int       `json:"code,omitempty"` // SMTP reply, 0 when there was none
+	Text     string    `json:"text"`
+}
+
+// Done returns true if no more delivery attempts are needed
+func (r *Recipient) Done() bool {
+	return r.Status == RcptDelivered || r.Status == RcptBounced
+}
+
+// QueuedEmail is one message with its recipients, the body is stored once
+type QueuedEmail struct {
+	ID         string       `json:"id"`
+	Priority   string       `json:"priority"`
+	From       string       `json:"from"`
+	Recipients []Recipient  `json:"recipients"`
+	Data       []byte       `json:"data"`
+	CreatedAt  time.Time    `json:"created_at"`
+	NextRetry  time.Time    `json:"next_retry"`         // Earliest NextRetry of pending recipients
+	Held       bool         `json:"-"`                  // On hold, see SetMessageHold
+	Warned     bool         `json:"warned,omitempty"`   // Delay warning sent
+	Status     string       `json:"status"`             // StatusQueued and friends, see status.go
+	History    []Transition `json:"history"`            // Status changes, oldest first
+	Instance   string       `json:"instance,omitempty"` // instance_id of the last delivery attempt, see claim.go
+
+	// Single-recipient format from before per-recipient state
+	To        string `json:"to,omitempty"`
+	Attempts  int    `json:"attempts,omitempty"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// UpdateNextRetry recalculates NextRetry from the pending recipients
+func (e *QueuedEmail) UpdateNextRetry() {
+	e.NextRetry = time.Time{}
+	for _, r := range e.Recipients {
+		if r.Done() {
+			continue
+		}
+		if e.NextRetry.IsZero() || r.NextRetry.Before(e.NextRetry) {
+			e.NextRetry = r.NextRetry
+		}
+	}
+}
+
+// Done returns true if all recipients are delivered or bounced
+func (e *QueuedEmail) Done() bool {
+	for _, r := range e.Recipients {
+		if !r.Done() {
+			return false
+		}
+	}
+	return true
 }
 
 func New() *Storage {
 	return &Storage{
-		mailDir:  config.C.MailDir,
-		queueDir: config.C.QueueDir,
+		mailDir:       config.C.MailDir,
+		queueDir:      config.C.QueueDir,
+		attachmentDir: config.C.AttachmentDir,
+		instance:      config.C.InstanceID,
+		claimTTL:      config.C.QueueClaimTTL,
 	}
 }
 
@@ -45,69 +129,197 @@ func (s *Storage) Init() error {
 		return fmt.Errorf("failed to create queue dir: %v", err)
 	}
 
+	// Create attachment directory
+	if s.attachmentDir != "" {
+		if err := os.MkdirAll(s.attachmentDir, 0750); err != nil {
+			return fmt.Errorf("failed to create attachment dir: %v", err)
+		}
+	}
+
 	return nil
 }
 
 // StoreLocal stores an email for local delivery in IMAP-compatible format
-// Emails are stored as {mail_dir}/{domain}/INBOX/{timestamp}_{uid}.eml
+// Emails are stored as {mail_dir}/{domain}/{user}/INBOX/{timestamp}_{uid}.eml
+// Calendar invites get the $Invite keyword and are copied to
+// config.C.CalendarMailbox when set.
 func (s *Storage) StoreLocal(recipient, from string, data []byte) error {
-	domain := getDomain(recipient)
+	var flags []string
+	_, invite := calendar.Find(data)
+	if invite {
+		flags = append(flags, "$Invite")
+	}
 
 	// Store in domain's INBOX folder (compatible with imapd)
-	inboxDir := filepath.Join(s.mailDir, domain, "INBOX")
-	if err := os.MkdirAll(inboxDir, 0750); err != nil {
+	if _, err := s.storeIn(recipient, "INBOX", data, flags); err != nil {
 		return err
 	}
+	if invite && config.C.CalendarMailbox != "" {
+		if _, err := s.storeIn(recipient, config.C.CalendarMailbox, data, flags); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storeIn writes data to a mailbox of recipient with the initial flags and
+// returns the filename
+func (s *Storage) storeIn(recipient, mailbox string, data []byte, flags []string) (string, error) {
+	mailboxDir := s.mailboxDir(recipient, mailbox)
+	if mailboxDir == "" {
+		return "", fmt.Errorf("invalid recipient %q", recipient)
+	}
+	if err := os.MkdirAll(mailboxDir, 0750); err != nil {
+		return "", err
+	}
+
+	lock, err := LockMailbox(mailboxDir)
+	if err != nil {
+		return "", err
+	}
+	defer lock.Unlock()
 
 	// Generate unique filename with .eml extension for imapd compatibility
-	uid := s.nextUID(inboxDir)
+	uid, err := lock.NextUID()
+	if err != nil {
+		return "", err
+	}
 	filename := fmt.Sprintf("%d_%d.eml", time.Now().Unix(), uid)
-	filePath := filepath.Join(inboxDir, filename)
 
-	return os.WriteFile(filePath, data, 0640)
+	if len(flags) > 0 {
+		if err := lock.WriteFlags(filename, flags); err != nil {
+			return "", err
+		}
+	}
+	return filename, WriteMessage(filepath.Join(mailboxDir, filename), bytes.NewReader(data), 0640)
+}
+
+// LoadLocal reads a stored email of recipient, file is the name in the mailbox
+func (s *Storage) LoadLocal(recipient, mailbox, file string) ([]byte, error) {
+	dir := s.mailboxDir(recipient, mailbox)
+	if dir == "" || file != filepath.Base(file) || file[0] == '.' || mailbox != filepath.Base(mailbox) || !strings.HasSuffix(file, ".eml") {
+		return nil, os.ErrNotExist
+	}
+	return os.ReadFile(filepath.Join(dir, file))
+}
+
+// Inbox is the directory StoreLocal writes the copy for recipient to,
+// recipients with the same Inbox share one physical mailbox
+func (s *Storage) Inbox(recipient string) string {
+	return s.mailboxDir(recipient, "INBOX")
+}
+
+// UserDir is the directory of the account name, {mail_dir}/{domain}/{user},
+// the one layout smtpd, imapd and mymail share. A name with @ lives in its
+// own domain, a bare name in domain. Both parts are lowercased, as smtpd
+// delivers to the lowercased recipient.
+func UserDir(mailDir, domain, name string) string {
+	if at := strings.LastIndexByte(name, '@'); at >= 0 {
+		name, domain = name[:at], name[at+1:]
+	}
+	return filepath.Join(mailDir, strings.ToLower(domain), strings.ToLower(name))
 }
 
-// nextUID returns the next available UID for a mailbox
-func (s *Storage) nextUID(mailboxPath string) int64 {
-	uidFile := filepath.Join(mailboxPath, ".uidnext")
-	data, err := os.ReadFile(uidFile)
-	uid := int64(1)
-	if err == nil {
-		if n, parseErr := fmt.Sscanf(strings.TrimSpace(string(data)), "%d", &uid); n != 1 || parseErr != nil {
-			uid = 1
+// mailboxDir is where imapd finds mailbox of the account of recipient, see
+// UserDir. Empty for a local part that isn't a directory name or a mailbox
+// name imapd would refuse.
+func (s *Storage) mailboxDir(recipient, mailbox string) string {
+	at := strings.LastIndexByte(recipient, '@')
+	if at < 0 {
+		return ""
+	}
+	user, domain := recipient[:at], recipient[at+1:]
+	if user == "" || domain == "" || strings.ContainsAny(recipient, `/\`) || user[0] == '.' || domain[0] == '.' || !validMailbox(mailbox) {
+		return ""
+	}
+	return filepath.Join(UserDir(s.mailDir, "", recipient), mailbox)
+}
+
+// validMailbox rejects absolute mailbox names and names with an empty, . or
+// .. component or one starting with a dot, which leave the user's directory
+// or reach its sidecars
+func validMailbox(mailbox string) bool {
+	if !filepath.IsLocal(mailbox) {
+		return false
+	}
+	for _, part := range strings.Split(mailbox, "/") {
+		if part == "" || part[0] == '.' {
+			return false
 		}
 	}
-	os.WriteFile(uidFile, []byte(fmt.Sprintf("%d", uid+1)), 0600)
-	return uid
+	return true
 }
 
-// QueueForRelay adds an email to the outgoing queue
-func (s *Storage) QueueForRelay(from, to string, data []byte) error {
+// QueueForRelay adds an email for one or more recipients to the outgoing queue
+func (s *Storage) QueueForRelay(from string, to []string, data []byte) error {
+	now := time.Now()
+	if config.C.DKIMDir != "" {
+		// Once, retries send the same signed message
+		data = dkim.SignMessage(config.C.DKIMDir, data, now)
+	}
 	email := QueuedEmail{
 		ID:        generateQueueID(),
+		Priority:  classifyPriority(from, data),
 		From:      from,
-		To:        to,
 		Data:      data,
-		CreatedAt: time.Now(),
-		Attempts:  0,
-		NextRetry: time.Now(),
+		CreatedAt: now,
+		NextRetry: now,
+	}
+	email.SetStatus(StatusQueued)
+	for _, rcpt := range to {
+		email.Recipients = append(email.Recipients, Recipient{
+			Address:   rcpt,
+			Status:    RcptQueued,
+			NextRetry: now,
+		})
 	}
 
-	filename := filepath.Join(s.queueDir, email.ID+".json")
+	return s.writeQueueFile(&email)
+}
 
-	f, err := os.Create(filename)
+// classifyPriority puts bounces and mail marked as bulk in the bulk lane
+func classifyPriority(from string, data []byte) string {
+	if from == "" {
+		return PriorityBulk
+	}
+
+	header, _, ok := splitMessage(data)
+	if !ok {
+		return PriorityInteractive
+	}
+	switch strings.ToLower(strings.TrimSpace(header.Get("Precedence"))) {
+	case "bulk", "list", "junk":
+		return PriorityBulk
+	}
+	if header.Get("List-Unsubscribe") != "" || header.Get("List-Id") != "" {
+		return PriorityBulk
+	}
+	return PriorityInteractive
+}
+
+// GetQueuedEmails returns all emails of the given priority lane ready for delivery
+func (s *Storage) GetQueuedEmails(priority string) ([]QueuedEmail, error) {
+	all, err := s.ListQueue()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer f.Close()
 
-	encoder := json.NewEncoder(f)
-	encoder.SetIndent("", "  ")
-	return encoder.Encode(&email)
+	var emails []QueuedEmail
+	now := time.Now()
+	for _, email := range all {
+		if email.Priority != priority || email.Held {
+			continue
+		}
+		if email.NextRetry.Before(now) || email.NextRetry.Equal(now) {
+			emails = append(emails, email)
+		}
+	}
+
+	return emails, nil
 }
 
-// GetQueuedEmails returns all emails ready for delivery
-func (s *Storage) GetQueuedEmails() ([]QueuedEmail, error) {
+// ListQueue returns all queued emails
+func (s *Storage) ListQueue() ([]QueuedEmail, error) {
 	var emails []QueuedEmail
 
 	entries, err := os.ReadDir(s.queueDir)
@@ -115,7 +327,6 @@ func (s *Storage) GetQueuedEmails() ([]QueuedEmail, error) {
 		return nil, err
 	}
 
-	now := time.Now()
 	for _, entry := range entries {
 		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
 			continue
@@ -126,15 +337,26 @@ func (s *Storage) GetQueuedEmails() ([]QueuedEmail, error) {
 		if err != nil {
 			continue
 		}
-
-		if email.NextRetry.Before(now) || email.NextRetry.Equal(now) {
-			emails = append(emails, *email)
-		}
+		email.Held = s.isMessageHeld(email.ID)
+		emails = append(emails, *email)
 	}
 
 	return emails, nil
 }
 
+// GetQueuedEmail reads queue entry id as it is on disk now
+func (s *Storage) GetQueuedEmail(id string) (*QueuedEmail, error) {
+	if id == "" || strings.ContainsAny(id, `/\`) {
+		return nil, os.ErrNotExist
+	}
+	email, err := s.loadQueuedEmail(filepath.Join(s.queueDir, id+".json"))
+	if err != nil {
+		return nil, err
+	}
+	email.Held = s.isMessageHeld(id)
+	return email, nil
+}
+
 func (s *Storage) loadQueuedEmail(path string) (*QueuedEmail, error) {
 	f, err := os.Open(path)
 	if err != nil {
@@ -146,27 +368,59 @@ func (s *Storage) loadQueuedEmail(path string) (*QueuedEmail, error) {
 	if err := json.NewDecoder(f).Decode(&email); err != nil {
 		return nil, err
 	}
+	if email.Priority == "" {
+		// Queued before priority lanes existed
+		email.Priority = PriorityInteractive
+	}
+	if email.To != "" && len(email.Recipients) == 0 {
+		// Queued before per-recipient state existed
+		email.Recipients = []Recipient{{
+			Address:   email.To,
+			Status:    RcptDeferred,
+			Attempts:  email.Attempts,
+			LastError: email.LastError,
+			NextRetry: email.NextRetry,
+		}}
+		email.To, email.Attempts, email.LastError = "", 0, ""
+	}
+	email.deriveStatus()
 
 	return &email, nil
 }
 
 // UpdateQueuedEmail updates a queued email after a delivery attempt
 func (s *Storage) UpdateQueuedEmail(email *QueuedEmail) error {
-	filename := filepath.Join(s.queueDir, email.ID+".json")
+	return s.writeQueueFile(email)
+}
 
-	f, err := os.Create(filename)
+// writeQueueFile replaces the queue file of email in one rename, a crash
+// halfway leaves the previous version instead of a truncated file
+func (s *Storage) writeQueueFile(email *QueuedEmail) error {
+	tmp, err := os.CreateTemp(s.queueDir, ".tmp-")
 	if err != nil {
 		return err
 	}
-	defer f.Close()
+	defer os.Remove(tmp.Name())
 
-	encoder := json.NewEncoder(f)
+	encoder := json.NewEncoder(tmp)
 	encoder.SetIndent("", "  ")
-	return encoder.Encode(email)
+	if err := encoder.Encode(email); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(s.queueDir, email.ID+".json"))
 }
 
 // RemoveFromQueue removes an email from the queue
 func (s *Storage) RemoveFromQueue(id string) error {
+	os.Remove(filepath.Join(s.queueDir, id+".hold"))
 	filename := filepath.Join(s.queueDir, id+".json")
 	return os.Remove(filename)
 }
@@ -174,11 +428,3 @@ func (s *Storage) RemoveFromQueue(id string) error {
 func generateQueueID() string {
 	return fmt.Sprintf("%d-%d", time.Now().UnixNano(), os.Getpid())
 }
-
-func getDomain(email string) string {
-	parts := strings.Split(email, "@")
-	if len(parts) == 2 {
-		return parts[1]
-	}
-	return ""
-}
@@ -0,0 +1,47 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// TestMailboxDir checks smtpd delivers where imapd reads
+func TestMailboxDir(t *testing.T) {
+	s := &Storage{mailDir: "/mail"}
+	patterns := map[string]string{
+		"mark@example.com":    filepath.Join("/mail", "example.com", "mark", "INBOX"),
+		"Mark@Example.COM":    filepath.Join("/mail", "example.com", "mark", "INBOX"),
+		`"a@b"@example.com`:   filepath.Join("/mail", "example.com", `"a@b"`, "INBOX"),
+		"../x@example.com":    "",
+		".hidden@example.com": "",
+		"mark@../etc":         "",
+		"mark":                "",
+		"@example.com":        "",
+		`"a\b"@example.com`:   "",
+	}
+	for rcpt, expect := range patterns {
+		if dir := s.mailboxDir(rcpt, "INBOX"); dir != expect {
+			t.Errorf("mailboxDir(%s)=%q expect=%q", rcpt, dir, expect)
+		}
+	}
+
+	mailboxes := map[string]bool{
+		"INBOX":        true,
+		"Archive/2024": true,
+		"":             false,
+		".":            false,
+		"..":           false,
+		"../../etc":    false,
+		"/etc":         false,
+		".trash":       false,
+		"Archive/..":   false,
+	}
+	for mailbox, ok := range mailboxes {
+		if dir := s.mailboxDir("mark@example.com", mailbox); (dir != "") != ok {
+			t.Errorf("mailboxDir(mark@example.com, %q)=%q", mailbox, dir)
+		}
+	}
+	if _, err := s.LoadLocal("mark@example.com", "..", "x.eml"); err == nil {
+		t.Errorf("LoadLocal read outside the user's directory")
+	}
+}
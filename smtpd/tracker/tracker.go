@@ -0,0 +1,175 @@
+// Package tracker keeps the live sessions of smtpd and imapd for the admin
+// API, and the temporary IP bans an operator sets there.
+package tracker
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Info is a snapshot of a live session for the admin API
+type Info struct {
+	ID         uint64    `json:"id"`
+	Protocol   string    `json:"protocol"`
+	RemoteAddr string    `json:"remote_addr"`
+	User       string    `json:"user"`
+	State      string    `json:"state"`
+	Started    time.Time `json:"started"`
+	Duration   string    `json:"duration"`
+	BytesIn    int64     `json:"bytes_in"`
+	BytesOut   int64     `json:"bytes_out"`
+	Memory     int64     `json:"memory"` // Message data held by the session
+}
+
+// Session is implemented by the sessions of both daemons, Info is called
+// from the admin API so it must lock what the session goroutine changes
+type Session interface {
+	Info() Info
+}
+
+// Conn counts the raw bytes (before TLS) of a connection
+type Conn struct {
+	net.Conn
+	in  atomic.Int64
+	out atomic.Int64
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.in.Add(int64(n))
+	return n, err
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.out.Add(int64(n))
+	return n, err
+}
+
+type entry struct {
+	sess Session
+	conn *Conn
+}
+
+// Tracker lists sessions and bans, the zero value is not usable, see New
+type Tracker struct {
+	mu       sync.Mutex
+	sessions map[uint64]entry
+	nextID   uint64
+	bans     map[string]time.Time
+}
+
+func New() *Tracker {
+	return &Tracker{
+		sessions: make(map[uint64]entry),
+		bans:     make(map[string]time.Time),
+	}
+}
+
+// Add tracks sess, which reads and writes conn, until Remove
+func (t *Tracker) Add(sess Session, conn *Conn) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.nextID++
+	t.sessions[t.nextID] = entry{sess: sess, conn: conn}
+	return t.nextID
+}
+
+func (t *Tracker) Remove(id uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.sessions, id)
+}
+
+// Sessions returns all live sessions ordered by ID
+func (t *Tracker) Sessions() []Info {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	out := make([]Info, 0, len(t.sessions))
+	for id, e := range t.sessions {
+		info := e.sess.Info()
+		info.ID = id
+		info.Duration = time.Since(info.Started).Round(time.Second).String()
+		info.BytesIn = e.conn.in.Load()
+		info.BytesOut = e.conn.out.Load()
+		out = append(out, info)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+// Each calls fn for every live session, with the tracker locked
+func (t *Tracker) Each(fn func(Session)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, e := range t.sessions {
+		fn(e.sess)
+	}
+}
+
+// Kick terminates a live session, returns false if it doesn't exist. It
+// closes the connection instead of saying goodbye, the session goroutine
+// owns the protocol state and ends on its next read or write.
+func (t *Tracker) Kick(id uint64) bool {
+	t.mu.Lock()
+	e, ok := t.sessions[id]
+	t.mu.Unlock()
+
+	if !ok {
+		return false
+	}
+	e.conn.Close()
+	return true
+}
+
+// Ban refuses new connections from ip until d has passed
+func (t *Tracker) Ban(ip string, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.bans[ip] = time.Now().Add(d)
+}
+
+// Unban lifts a ban, returns false if ip wasn't banned
+func (t *Tracker) Unban(ip string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.bans[ip]
+	delete(t.bans, ip)
+	return ok
+}
+
+// Bans returns active bans with their expiry
+func (t *Tracker) Bans() map[string]time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	out := make(map[string]time.Time, len(t.bans))
+	for ip, until := range t.bans {
+		if now.After(until) {
+			delete(t.bans, ip)
+			continue
+		}
+		out[ip] = until
+	}
+	return out
+}
+
+// Banned reports whether connections from addr are refused
+func (t *Tracker) Banned(addr net.Addr) bool {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	until, ok := t.bans[host]
+	return ok && time.Now().Before(until)
+}
@@ -0,0 +1,59 @@
+package tracker
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+type session struct{ user string }
+
+func (s *session) Info() Info {
+	return Info{Protocol: "test", User: s.user, Started: time.Now()}
+}
+
+func TestKick(t *testing.T) {
+	tr := New()
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := &Conn{Conn: server}
+	id := tr.Add(&session{user: "bob"}, conn)
+
+	go client.Write([]byte("EHLO"))
+	buf := make([]byte, 4)
+	if _, err := conn.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	list := tr.Sessions()
+	if len(list) != 1 || list[0].ID != id || list[0].User != "bob" || list[0].BytesIn != 4 {
+		t.Fatalf("Sessions=%+v", list)
+	}
+
+	if !tr.Kick(id) {
+		t.Fatalf("Kick(%d)=false", id)
+	}
+	// The session goroutine sees the closed connection
+	if _, err := conn.Read(buf); err == nil {
+		t.Errorf("Read after Kick succeeded")
+	}
+	tr.Remove(id)
+	if tr.Kick(id) {
+		t.Errorf("Kick of a removed session=true")
+	}
+}
+
+func TestBan(t *testing.T) {
+	tr := New()
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25}
+	tr.Ban("192.0.2.1", time.Hour)
+	tr.Ban("192.0.2.2", -time.Second)
+	if !tr.Banned(addr) {
+		t.Errorf("Banned(%s)=false", addr)
+	}
+	if bans := tr.Bans(); len(bans) != 1 {
+		t.Errorf("Bans=%v, expect the expired ban dropped", bans)
+	}
+	if !tr.Unban("192.0.2.1") || tr.Banned(addr) {
+		t.Errorf("Unban didn't lift the ban")
+	}
+}
@@ -0,0 +1,114 @@
+package users
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mpdroog/mymail/smtpd/messages"
+	"github.com/mpdroog/mymail/smtpd/storage"
+	"github.com/mpdroog/mymail/smtpd/whitelist"
+)
+
+// Folder is one of the standard folders of an account
+type Folder struct {
+	Name string
+	Use  string // SPECIAL-USE attribute (RFC 6154) imapd marks it with, e.g. \Sent
+}
+
+// Folders every account gets, Bootstrap creates them for a new one and
+// imapd at login for accounts that predate it
+var Folders = []Folder{
+	{"INBOX", ""},
+	{"Sent", `\Sent`},
+	{"Drafts", `\Drafts`},
+	{"Junk", `\Junk`},
+	{"Trash", `\Trash`},
+	{"Archive", `\Archive`},
+}
+
+// welcomeTemplate is used when no welcome_template file is configured
+const welcomeTemplate = `From: Postmaster <postmaster@{{.Domain}}>
+To: {{.Address}}
+Date: {{.Date}}
+Subject: Welcome to {{.Domain}}
+Content-Type: text/plain; charset=utf-8
+
+Hi {{.User}},
+
+Your mailbox {{.Address}} is ready.
+{{if .Quota}}
+It can hold up to {{.Quota}} of mail.
+{{end}}
+Use your username and password for both IMAP and SMTP.
+`
+
+// Welcome holds the fields available to the welcome template
+type Welcome struct {
+	User    string
+	Address string
+	Domain  string
+	Quota   string
+	Date    string
+}
+
+// Bootstrap creates the folders of a new account in its storage.UserDir,
+// its personal whitelist in whitelistDir (empty=disabled) and drops the
+// welcome message in the INBOX. tmpl is a text/template file, empty for
+// welcome.tmpl of the account's locale (see smtpd/messages) and "-" for no
+// message.
+func Bootstrap(mailDir, whitelistDir, domain, name string, acct *Account, tmpl string) error {
+	base := storage.UserDir(mailDir, domain, name)
+	for _, f := range Folders {
+		if err := os.MkdirAll(filepath.Join(base, f.Name), 0700); err != nil {
+			return err
+		}
+	}
+
+	addr := name
+	if !strings.Contains(addr, "@") {
+		addr += "@" + domain
+	}
+	if err := whitelist.Create(whitelistDir, addr); err != nil {
+		return err
+	}
+	if tmpl == "-" {
+		return nil
+	}
+	w := Welcome{
+		User:    name,
+		Address: addr,
+		Domain:  domain,
+		Quota:   acct.Quota,
+		Date:    time.Now().Format(time.RFC1123Z),
+	}
+
+	var msg []byte
+	if tmpl != "" {
+		// welcome_template predates template_dir, one text for all locales
+		data, err := os.ReadFile(tmpl)
+		if err != nil {
+			return err
+		}
+		msg, err = messages.Execute("welcome", string(data), w)
+		if err != nil {
+			return err
+		}
+	} else {
+		var err error
+		if msg, err = messages.Render("welcome", welcomeTemplate, messages.Locale(acct.Locale, addr), w); err != nil {
+			return err
+		}
+	}
+
+	inbox := filepath.Join(base, "INBOX")
+	uid, err := storage.NextUID(inbox)
+	if err != nil {
+		return err
+	}
+	filename := fmt.Sprintf("%d_%d.eml", time.Now().Unix(), uid)
+	return storage.WriteMessage(filepath.Join(inbox, filename), bytes.NewReader(msg), 0600)
+}
@@ -0,0 +1,319 @@
+package users
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/mpdroog/mymail/smtpd/config"
+)
+
+// Roles of an account, an account without roles is a RoleUser
+const (
+	RoleAdmin       = "admin"        // May use the admin API and log in as another user over IMAP
+	RoleUser        = "user"         // Sends and receives mail
+	RoleSendOnly    = "send-only"    // May relay but not use IMAP
+	RoleReceiveOnly = "receive-only" // May use IMAP but not relay
+)
+
+// Password hashes look like $pbkdf2-sha256$iterations$salt$key (base64)
+const (
+	hashPrefix     = "$pbkdf2-sha256$"
+	hashIterations = 600000
+	hashKeyLen     = 32
+)
+
+// Account is an entry of the user file, which maps usernames to either a
+// plain password or {"password": "...", "roles": ["admin"], "quota": "1GB"}.
+// smtpd, imapd and the mymail CLI share the file.
+type Account struct {
+	Password string   `json:"password"` // Plain text or a hash from HashPassword
+	Roles    []string `json:"roles,omitempty"`
+	Quota    string   `json:"quota,omitempty"`  // Human-readable mailbox limit (e.g. "1GB", empty=unlimited)
+	Locale   string   `json:"locale,omitempty"` // Language of generated messages (e.g. "nl", empty=domain or default)
+
+	// From addresses next to the account's own, "@example.com" allows a
+	// whole domain, see config from_policy
+	Identities []string `json:"identities,omitempty"`
+}
+
+func (a *Account) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		// Old format, just the password
+		a.Roles = nil
+		return json.Unmarshal(b, &a.Password)
+	}
+
+	type account Account // without UnmarshalJSON
+	if err := json.Unmarshal(b, (*account)(a)); err != nil {
+		return err
+	}
+	for _, role := range a.Roles {
+		if !ValidRole(role) {
+			return fmt.Errorf("unknown role %q", role)
+		}
+	}
+	return nil
+}
+
+// ValidRole reports whether role is one of the Role constants
+func ValidRole(role string) bool {
+	switch role {
+	case RoleAdmin, RoleUser, RoleSendOnly, RoleReceiveOnly:
+		return true
+	}
+	return false
+}
+
+// Has reports whether the account has role, no roles means RoleUser
+func (a *Account) Has(role string) bool {
+	if len(a.Roles) == 0 {
+		return role == RoleUser
+	}
+	for _, r := range a.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// CanIMAP reports whether the account may log in over IMAP
+func (a *Account) CanIMAP() bool {
+	return a.Has(RoleAdmin) || a.Has(RoleUser) || a.Has(RoleReceiveOnly)
+}
+
+// CanSend reports whether the account may relay mail after AUTH
+func (a *Account) CanSend() bool {
+	return a.Has(RoleAdmin) || a.Has(RoleUser) || a.Has(RoleSendOnly)
+}
+
+// Address is the mail address of username, without domain it is in the
+// first local domain
+func Address(username string) string {
+	if !strings.Contains(username, "@") && len(config.C.LocalDomains) > 0 {
+		return username + "@" + config.C.LocalDomains[0]
+	}
+	return username
+}
+
+// CanSendAs reports whether the account username may use addr as From,
+// its own address or one of its identities
+func (a *Account) CanSendAs(username, addr string) bool {
+	if strings.EqualFold(addr, Address(username)) {
+		return true
+	}
+	at := strings.LastIndex(addr, "@")
+	for _, id := range a.Identities {
+		if strings.EqualFold(id, addr) || (strings.HasPrefix(id, "@") && at != -1 && strings.EqualFold(id, addr[at:])) {
+			return true
+		}
+	}
+	return false
+}
+
+// Verify checks password against the hashed or plain stored password
+func (a *Account) Verify(password string) bool {
+	if !strings.HasPrefix(a.Password, hashPrefix) {
+		return subtle.ConstantTimeCompare([]byte(a.Password), []byte(password)) == 1
+	}
+
+	parts := strings.Split(strings.TrimPrefix(a.Password, hashPrefix), "$")
+	if len(parts) != 3 {
+		return false
+	}
+	iter, err := strconv.Atoi(parts[0])
+	if err != nil || iter <= 0 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	derivations <- struct{}{}
+	derived, err := pbkdf2.Key(sha256.New, password, salt, iter, len(key))
+	<-derivations
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(derived, key) == 1
+}
+
+// HashPassword returns the stored form of password
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, hashIterations, hashKeyLen)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s%d$%s$%s", hashPrefix, hashIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// derivations limits the hashes computed at once. A hash takes tens of
+// milliseconds of CPU, without a limit a flood of logins would starve
+// delivery; with it the flood waits in line.
+var derivations = make(chan struct{}, max(1, runtime.NumCPU()/2))
+
+// dummy is verified for unknown users so they take as long as a wrong password
+var dummy = sync.OnceValue(func() *Account {
+	hash, _ := HashPassword("")
+	return &Account{Password: hash}
+})
+
+// Check verifies username and password against accounts, unknown users
+// cost the same time as known ones
+func Check(accounts map[string]*Account, username, password string) (*Account, bool) {
+	acct, ok := accounts[username]
+	if !ok {
+		dummy().Verify(password)
+		return nil, false
+	}
+	return acct, acct.Verify(password)
+}
+
+// ErrExists is returned by Add for a taken username
+var ErrExists = errors.New("user already exists")
+
+// NewAccount validates roles and quota and hashes password
+func NewAccount(password string, roles []string, quota string) (*Account, error) {
+	if password == "" {
+		return nil, errors.New("empty password")
+	}
+	for _, role := range roles {
+		if !ValidRole(role) {
+			return nil, fmt.Errorf("unknown role %q", role)
+		}
+	}
+	if quota != "" {
+		if _, err := config.ParseSize(quota); err != nil {
+			return nil, fmt.Errorf("invalid quota %q: %v", quota, err)
+		}
+	}
+	hash, err := HashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	return &Account{Password: hash, Roles: roles, Quota: quota}, nil
+}
+
+// ValidName reports whether name can be a username and directory name.
+// "*" is reserved for IMAP master logins. A full address is stored in the
+// directory of its domain (see storage.UserDir), both parts must be set.
+func ValidName(name string) bool {
+	if name == "" || strings.ContainsAny(name, "/\\*: ") || strings.HasPrefix(name, ".") {
+		return false
+	}
+	local, domain, ok := strings.Cut(name, "@")
+	return !ok || (local != "" && domain != "" && !strings.HasPrefix(domain, ".") && !strings.Contains(domain, "@"))
+}
+
+// Add stores a new account in the user file
+func Add(path, name string, acct *Account) error {
+	if !ValidName(name) {
+		return fmt.Errorf("invalid username %q", name)
+	}
+	return Update(path, func(accounts map[string]*Account) error {
+		if accounts[name] != nil {
+			return ErrExists
+		}
+		accounts[name] = acct
+		return nil
+	})
+}
+
+// Lookup returns the account of addr, stored under the full address or,
+// in the first local domain, the bare username
+func Lookup(accounts map[string]*Account, addr string) *Account {
+	if acct := accounts[addr]; acct != nil {
+		return acct
+	}
+	name, domain, ok := strings.Cut(addr, "@")
+	if ok && len(config.C.LocalDomains) > 0 && strings.EqualFold(domain, config.C.LocalDomains[0]) {
+		return accounts[name]
+	}
+	return nil
+}
+
+// Load reads the user file, a missing file has no users
+func Load(path string) (map[string]*Account, error) {
+	accounts := make(map[string]*Account)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return accounts, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &accounts); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for name, acct := range accounts {
+		if acct == nil {
+			return nil, fmt.Errorf("%s: user %s has no password", path, name)
+		}
+	}
+	return accounts, nil
+}
+
+// Update applies fn to the user file and atomically replaces it, a lock
+// file keeps concurrent updates from losing changes
+func Update(path string, fn func(accounts map[string]*Account) error) error {
+	lock, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+
+	accounts, err := Load(path)
+	if err != nil {
+		return err
+	}
+	if err := fn(accounts); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(accounts, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,97 @@
+package users
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/mpdroog/mymail/smtpd/config"
+)
+
+func TestAccount(t *testing.T) {
+	type result struct {
+		password string
+		admin    bool
+		send     bool
+		valid    bool
+	}
+	patterns := map[string]result{
+		`"secret"`:               {"secret", false, true, true},
+		`{"password": "secret"}`: {"secret", false, true, true},
+		`{"password": "secret", "roles": ["admin"]}`:        {"secret", true, true, true},
+		`{"password": "secret", "roles": ["send-only"]}`:    {"secret", false, true, true},
+		`{"password": "secret", "roles": ["receive-only"]}`: {"secret", false, false, true},
+		`{"password": "secret", "roles": ["root"]}`:         {"", false, false, false},
+		`42`: {"", false, false, false},
+	}
+	for pattern, expect := range patterns {
+		var a Account
+		err := json.Unmarshal([]byte(pattern), &a)
+		if !expect.valid {
+			if err == nil {
+				t.Errorf("Invalid but pattern accepted: %s", pattern)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Valid but pattern invalid: %s e=%v", pattern, err)
+			continue
+		}
+		if a.Password != expect.password || a.Has(RoleAdmin) != expect.admin || a.CanSend() != expect.send {
+			t.Errorf("Account(%s)=%+v", pattern, a)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	hash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range []Account{{Password: "secret"}, {Password: hash}} {
+		if !a.Verify("secret") || a.Verify("guess") || a.Verify("") {
+			t.Errorf("Verify(%s) failed", a.Password)
+		}
+	}
+}
+
+func TestCanSendAs(t *testing.T) {
+	config.C.LocalDomains = []string{"example.com"}
+	defer func() { config.C.LocalDomains = nil }()
+	a := Account{Identities: []string{"info@example.com", "@example.org"}}
+
+	patterns := map[string]bool{
+		"mark@example.com":      true,
+		"Mark@Example.com":      true,
+		"info@example.com":      true,
+		"sales@example.org":     true,
+		"sales@example.com":     false,
+		"mark@example.net":      false,
+		"sales@sub.example.org": false,
+		"":                      false,
+	}
+	for addr, expect := range patterns {
+		if a.CanSendAs("mark", addr) != expect {
+			t.Errorf("CanSendAs(%q) expect=%t", addr, expect)
+		}
+	}
+}
+
+func TestValidName(t *testing.T) {
+	patterns := map[string]bool{
+		"mark":            true,
+		"bob@other.tld":   true,
+		"":                false,
+		".hidden":         false,
+		"a/b":             false,
+		"mark*admin":      false,
+		"@other.tld":      false,
+		"bob@":            false,
+		"bob@.tld":        false,
+		"bob@a@other.tld": false,
+	}
+	for name, expect := range patterns {
+		if ok := ValidName(name); ok != expect {
+			t.Errorf("ValidName(%q)=%v expect=%v", name, ok, expect)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package watchdog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mpdroog/mymail/smtpd/config"
+	"github.com/mpdroog/mymail/smtpd/logging"
+	"github.com/mpdroog/mymail/smtpd/stats"
+	"github.com/mpdroog/mymail/smtpd/storage"
+)
+
+// baselineDays is the history used to compute a user's normal hourly rate
+const baselineDays = 14
+
+// Alert is sent to the webhook as JSON and mailed to the operator
+type Alert struct {
+	User           string    `json:"user"`
+	Hourly         int       `json:"hourly"`
+	Baseline       float64   `json:"baseline"`
+	SuspendedUntil time.Time `json:"suspended_until,omitempty"`
+}
+
+// window counts the recipients of a user in the current hour
+type window struct {
+	start   time.Time
+	count   int
+	alerted bool
+}
+
+var (
+	mu        sync.Mutex
+	st        *storage.Storage
+	windows   = make(map[string]*window)
+	suspended = make(map[string]time.Time)
+
+	// Per-hour average per user, refreshed hourly from stats_dir
+	baseline     map[string]float64
+	baselineDate time.Time
+)
+
+// Init enables alert mails through the queue of s
+func Init(s *storage.Storage) {
+	mu.Lock()
+	defer mu.Unlock()
+	st = s
+}
+
+// Suspended returns true with its end while relay is blocked for user
+func Suspended(user string) (time.Time, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	until, ok := suspended[user]
+	if ok && time.Now().After(until) {
+		delete(suspended, user)
+		return time.Time{}, false
+	}
+	return until, ok
+}
+
+// Remaining returns how many more recipients user may relay this hour
+// before the watchdog acts and when the hour ends, false when disabled
+func Remaining(user string) (int, time.Time, bool) {
+	if config.C.WatchdogFactor <= 0 || user == "" {
+		return 0, time.Time{}, false
+	}
+	mu.Lock()
+	defer mu.Unlock()
+
+	now := time.Now()
+	limit := int(limitFor(user, now))
+	w := windows[user]
+	if w == nil || now.Sub(w.start) >= time.Hour {
+		return limit, now.Add(time.Hour), true
+	}
+	return max(limit-w.count, 0), w.start.Add(time.Hour), true
+}
+
+// Release lifts a suspension, returns false if user wasn't suspended
+func Release(user string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	_, ok := suspended[user]
+	delete(suspended, user)
+	return ok
+}
+
+// List returns active suspensions with their expiry
+func List() map[string]time.Time {
+	mu.Lock()
+	defer mu.Unlock()
+
+	now := time.Now()
+	out := make(map[string]time.Time, len(suspended))
+	for user, until := range suspended {
+		if now.After(until) {
+			delete(suspended, user)
+			continue
+		}
+		out[user] = until
+	}
+	return out
+}
+
+// Record counts n relayed recipients for user and alerts once per hour
+// when the rate exceeds the user's baseline
+func Record(user string, n int) {
+	if config.C.WatchdogFactor <= 0 || user == "" || n <= 0 {
+		return
+	}
+
+	mu.Lock()
+	now := time.Now()
+	w := windows[user]
+	if w == nil || now.Sub(w.start) >= time.Hour {
+		w = &window{start: now}
+		windows[user] = w
+	}
+	w.count += n
+
+	base := baselineFor(user, now)
+	limit := limitFor(user, now)
+	if w.alerted || float64(w.count) <= limit {
+		mu.Unlock()
+		return
+	}
+	w.alerted = true
+
+	a := Alert{User: user, Hourly: w.count, Baseline: base}
+	if config.C.WatchdogSuspend > 0 {
+		a.SuspendedUntil = now.Add(config.C.WatchdogSuspend)
+		suspended[user] = a.SuspendedUntil
+	}
+	mu.Unlock()
+
+	log.Printf("Watchdog user=%s hourly=%d baseline=%.1f suspended_until=%v", a.User, a.Hourly, a.Baseline, a.SuspendedUntil)
+	go notify(a)
+}
+
+// limitFor returns the hourly recipients of user above which the watchdog
+// acts, mu must be held
+func limitFor(user string, now time.Time) float64 {
+	limit := config.C.WatchdogFactor * baselineFor(user, now)
+	if limit < float64(config.C.WatchdogMinHourly) {
+		limit = float64(config.C.WatchdogMinHourly)
+	}
+	return limit
+}
+
+// baselineFor returns the average recipients per hour of user, mu must be held
+func baselineFor(user string, now time.Time) float64 {
+	if baseline == nil || now.Sub(baselineDate) >= time.Hour {
+		baseline = make(map[string]float64)
+		baselineDate = now
+
+		if config.C.StatsDir != "" {
+			// Exclude today, it is incomplete and contains the spike
+			to := now.AddDate(0, 0, -1)
+			days, err := stats.LoadRange(config.C.StatsDir, to.AddDate(0, 0, -baselineDays+1), to)
+			if err != nil {
+				log.Printf(logging.Err+"watchdog.baseline e=%v", err)
+			}
+			for _, d := range days {
+				for u, c := range d.Users {
+					baseline[u] += float64(c.Sent) / (baselineDays * 24)
+				}
+			}
+		}
+	}
+	return baseline[user]
+}
+
+func notify(a Alert) {
+	text := fmt.Sprintf("User %s sent to %d recipients in the last hour, usually %.1f per hour.\r\n", a.User, a.Hourly, a.Baseline)
+	if !a.SuspendedUntil.IsZero() {
+		text += fmt.Sprintf("Relay is suspended until %s.\r\n", a.SuspendedUntil.Format(time.RFC1123Z))
+	}
+	Notify("Outbound volume alert for "+a.User, text, a)
+}
+
+// Notify posts v as JSON to watchdog_webhook and mails text to
+// watchdog_email, for alerts of other parts of smtpd as well
+func Notify(subject, text string, v any) {
+	if config.C.WatchdogWebhook != "" {
+		body, err := json.Marshal(v)
+		if err == nil {
+			var res *http.Response
+			res, err = (&http.Client{Timeout: 10 * time.Second}).Post(config.C.WatchdogWebhook, "application/json", bytes.NewReader(body))
+			if err == nil {
+				res.Body.Close()
+				if res.StatusCode >= 300 {
+					err = fmt.Errorf("status %s", res.Status)
+				}
+			}
+		}
+		if err != nil {
+			log.Printf(logging.Err+"watchdog.webhook e=%v", err)
+		}
+	}
+
+	mu.Lock()
+	s := st
+	mu.Unlock()
+	if config.C.WatchdogEmail != "" && s != nil {
+		msg := "From: MAILER-DAEMON@" + config.C.Hostname + "\r\n"
+		msg += "To: " + config.C.WatchdogEmail + "\r\n"
+		msg += "Subject: " + subject + "\r\n"
+		msg += "Content-Type: text/plain; charset=utf-8\r\n"
+		msg += "\r\n"
+		msg += text
+		var err error
+		if isLocal(config.C.WatchdogEmail) {
+			err = s.StoreLocal(config.C.WatchdogEmail, "", []byte(msg))
+		} else {
+			err = s.QueueForRelay("", []string{config.C.WatchdogEmail}, []byte(msg))
+		}
+		if err != nil {
+			log.Printf(logging.Err+"watchdog.email e=%v", err)
+		}
+	}
+}
+
+func isLocal(email string) bool {
+	at := strings.LastIndex(email, "@")
+	for _, d := range config.C.LocalDomains {
+		if strings.EqualFold(d, email[at+1:]) {
+			return true
+		}
+	}
+	return false
+}
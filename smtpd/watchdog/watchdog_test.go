@@ -0,0 +1,35 @@
+package watchdog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mpdroog/mymail/smtpd/config"
+)
+
+func TestRemaining(t *testing.T) {
+	config.C.WatchdogFactor, config.C.WatchdogMinHourly, config.C.WatchdogSuspend = 3, 5, time.Hour
+	defer func() { config.C.WatchdogFactor, config.C.WatchdogMinHourly, config.C.WatchdogSuspend = 0, 0, 0 }()
+
+	patterns := []struct {
+		sent   int
+		expect int
+	}{
+		{0, 5},
+		{3, 2},
+		{2, 0},
+		{1, 0},
+	}
+	for _, p := range patterns {
+		Record("mark", p.sent)
+		left, reset, ok := Remaining("mark")
+		if !ok || left != p.expect || time.Until(reset) > time.Hour {
+			t.Errorf("after %d: left=%d reset=%v ok=%t expect=%d", p.sent, left, reset, ok, p.expect)
+		}
+	}
+	// Past the limit
+	if until, ok := Suspended("mark"); !ok || time.Until(until) <= 0 {
+		t.Errorf("Suspended=%v,%t", until, ok)
+	}
+	Release("mark")
+}
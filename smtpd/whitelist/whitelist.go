@@ -0,0 +1,144 @@
+package whitelist
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Prefix of the local part that adds to the sender's own whitelist, e.g.
+// whitelist+example.com@ adds "@example.com" and whitelist+john=example.com@
+// adds "john@example.com"
+const Prefix = "whitelist+"
+
+var mu sync.Mutex
+
+// path is {whitelist_dir}/{address}.txt with one entry per line
+func path(dir, addr string) (string, error) {
+	addr = strings.ToLower(addr)
+	if addr == "" || strings.ContainsAny(addr, "/\\") || strings.HasPrefix(addr, ".") {
+		return "", fmt.Errorf("invalid address %q", addr)
+	}
+	return filepath.Join(dir, addr+".txt"), nil
+}
+
+// Parse returns the entry encoded in the local part of a magic address, ok
+// is false when local isn't one
+func Parse(local string) (entry string, ok bool, err error) {
+	if len(local) < len(Prefix) || !strings.EqualFold(local[:len(Prefix)], Prefix) {
+		return "", false, nil
+	}
+	v := strings.ToLower(local[len(Prefix):])
+	user, domain, hasUser := strings.Cut(v, "=")
+	if !hasUser {
+		user, domain = "", v
+	}
+	if domain == "" || !strings.Contains(domain, ".") || strings.ContainsAny(domain, "=@/\\ ") {
+		return "", true, fmt.Errorf("invalid whitelist entry %q", v)
+	}
+	if hasUser && user == "" {
+		return "", true, fmt.Errorf("invalid whitelist entry %q", v)
+	}
+	return user + "@" + domain, true, nil
+}
+
+// Add appends entry to the whitelist of addr unless it's already there
+func Add(dir, addr, entry string) error {
+	p, err := path(dir, addr)
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	entries, err := load(p)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e == entry {
+			return nil
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(entry + "\n")
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Create gives addr an empty whitelist unless it has one, does nothing when
+// dir is empty
+func Create(dir, addr string) error {
+	if dir == "" {
+		return nil
+	}
+	p, err := path(dir, addr)
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// Allowed reports whether sender matches an entry of addr's whitelist, an
+// entry starting with @ matches the whole domain
+func Allowed(dir, addr, sender string) bool {
+	p, err := path(dir, addr)
+	if err != nil {
+		return false
+	}
+	entries, err := load(p)
+	if err != nil {
+		return false
+	}
+	sender = strings.ToLower(sender)
+	for _, e := range entries {
+		if sender == e || (strings.HasPrefix(e, "@") && strings.HasSuffix(sender, e)) {
+			return true
+		}
+	}
+	return false
+}
+
+func load(p string) ([]string, error) {
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			entries = append(entries, strings.ToLower(line))
+		}
+	}
+	return entries, scanner.Err()
+}
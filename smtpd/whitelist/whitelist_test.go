@@ -0,0 +1,57 @@
+package whitelist
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	patterns := map[string]string{
+		"whitelist+example.com":      "@example.com",
+		"Whitelist+John=Example.com": "john@example.com",
+		"whitelist+example":          "error",
+		"whitelist+=example.com":     "error",
+		"whitelist+a=b=example.com":  "error",
+		"mark":                       "",
+	}
+	for local, expect := range patterns {
+		entry, ok, err := Parse(local)
+		switch {
+		case expect == "" && ok:
+			t.Errorf("Parse(%s) is magic", local)
+		case expect == "error" && err == nil:
+			t.Errorf("Parse(%s)=%s, expect error", local, entry)
+		case expect != "" && expect != "error" && entry != expect:
+			t.Errorf("Parse(%s)=%s e=%v, expect %s", local, entry, err, expect)
+		}
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	dir := t.TempDir()
+	for _, entry := range []string{"@example.com", "john@example.org", "@example.com"} {
+		if err := Add(dir, "mark@example.nl", entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	patterns := map[string]bool{
+		"anyone@example.com": true,
+		"ANYONE@EXAMPLE.COM": true,
+		"john@example.org":   true,
+		"jane@example.org":   false,
+		"x@notexample.com":   false,
+		"x@example.com.evil": false,
+	}
+	for sender, expect := range patterns {
+		if Allowed(dir, "Mark@example.nl", sender) != expect {
+			t.Errorf("Allowed(%s) expect %t", sender, expect)
+		}
+	}
+	// A new account's empty whitelist doesn't replace an existing one
+	if err := Create(dir, "mark@example.nl"); err != nil {
+		t.Fatal(err)
+	}
+	if !Allowed(dir, "mark@example.nl", "john@example.org") {
+		t.Errorf("Create emptied the whitelist")
+	}
+	if Allowed(dir, "anna@example.nl", "anyone@example.com") {
+		t.Errorf("whitelist leaks to other users")
+	}
+}